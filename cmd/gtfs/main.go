@@ -0,0 +1,77 @@
+// gtfs exports the schedule database maintained by syncd as a GTFS static feed, for tools such as OpenTripPlanner
+// that don't read the CIF.
+//
+//	gtfs -o gtfs.zip -from 2023-05-21 -days 30 -coordinates stops.csv
+package main
+
+import (
+	"flag"
+	"log/slog"
+	"os"
+	"time"
+	"uk-rail-schedule-api/internal/calendar"
+	"uk-rail-schedule-api/internal/config"
+	"uk-rail-schedule-api/internal/db"
+	"uk-rail-schedule-api/internal/gtfs"
+
+	"github.com/joho/godotenv"
+)
+
+func main() {
+	_ = godotenv.Load()
+
+	output := flag.String("o", "gtfs.zip", "file to write the GTFS feed to")
+	from := flag.String("from", time.Now().Format("2006-01-02"), "first date of the feed, as YYYY-MM-DD")
+	days := flag.Int("days", 90, "number of days the feed covers")
+	coordinates := flag.String("coordinates", config.GetStopCoordinatesFilename(), "CSV file of stop positions, with code, lat and lon columns")
+	flag.Parse()
+
+	start, err := time.Parse("2006-01-02", *from)
+	if err != nil || *days < 1 {
+		slog.Error("-from must be a date as YYYY-MM-DD and -days at least 1", "from", *from, "days", *days)
+		os.Exit(2)
+	}
+
+	opts := gtfs.Options{Calendar: calendar.Default()}
+	if filename := config.GetBankHolidaysFilename(); filename != "" {
+		opts.Calendar, err = calendar.Load(filename)
+		if err != nil {
+			slog.Error("Failed to load bank holidays", "error", err)
+			os.Exit(1)
+		}
+	}
+	opts.Calendar.BankHolidayDivision = config.GetBankHolidayDivision()
+	if !opts.Calendar.HasDivision(opts.Calendar.BankHolidayDivision) {
+		slog.Error("Unknown bank holiday division", "division", opts.Calendar.BankHolidayDivision)
+		os.Exit(1)
+	}
+	if *coordinates != "" {
+		opts.Coordinates, err = gtfs.LoadCoordinates(*coordinates)
+		if err != nil {
+			slog.Error("Failed to load stop coordinates", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	database, err := db.Open(config.GetDatabaseFilename())
+	if err != nil {
+		slog.Error("Failed to open database", "error", err)
+		os.Exit(1)
+	}
+
+	f, err := os.Create(*output)
+	if err != nil {
+		slog.Error("Failed to create output file", "error", err)
+		os.Exit(1)
+	}
+	if err := gtfs.Export(database, f, start, start.AddDate(0, 0, *days-1), opts); err != nil {
+		f.Close()
+		os.Remove(*output)
+		slog.Error("Failed to export GTFS feed", "error", err)
+		os.Exit(1)
+	}
+	if err := f.Close(); err != nil {
+		slog.Error("Failed to write output file", "error", err)
+		os.Exit(1)
+	}
+}
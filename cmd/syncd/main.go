@@ -1,6 +1,7 @@
 // syncd is a long-running daemon that keeps the schedule database up-to-date.
-// It loads the initial schedule feed file into SQLite and listens for real-time
-// VSTP updates via the Network Rail STOMP feed.
+// It loads the initial schedule feed file into SQLite, downloads and loads the
+// feed again every day, and listens for real-time VSTP updates via the Network
+// Rail STOMP feed.
 package main
 
 import (
@@ -8,7 +9,9 @@ import (
 	"log/slog"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
+	"time"
 	"uk-rail-schedule-api/internal/config"
 	"uk-rail-schedule-api/internal/db"
 	internalsync "uk-rail-schedule-api/internal/sync"
@@ -26,10 +29,13 @@ func main() {
 	logger := setupLogger()
 	slog.SetDefault(logger)
 
-	ctx := context.Background()
-	shutdownTelemetry := telemetry.Setup(ctx, "uk-rail-schedule-api-syncd", version)
+	// ctx is cancelled by SIGINT or SIGTERM, which tells the workers to finish what they're doing and stop
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	shutdownTelemetry := telemetry.Setup(context.Background(), "uk-rail-schedule-api-syncd", version)
 	defer func() {
-		if err := shutdownTelemetry(ctx); err != nil {
+		if err := shutdownTelemetry(context.Background()); err != nil {
 			slog.Error("Failed to shut down telemetry", "error", err)
 		}
 	}()
@@ -44,26 +50,81 @@ func main() {
 
 	slog.Info("Starting schedule sync daemon", "version", version)
 
-	// Initial load of schedule feed
-	go internalsync.RefreshSchedules(
-		config.GetScheduleFeedFilename(),
-		database,
-		config.GetDataDir(),
-		config.ShouldDeleteExpiredSchedulesAfterRefresh(),
-	)
+	var workers sync.WaitGroup
+
+	downloadErr, feedURL, username, feedPassword := config.GetScheduleFeedDownloadDetails()
+	downloadOpts := internalsync.FeedDownloadOptions{
+		URL:        feedURL,
+		Username:   username,
+		Password:   feedPassword,
+		Filename:   config.GetScheduleFeedFilename(),
+		At:         config.GetScheduleFeedDownloadTime(),
+		Attempts:   config.GetScheduleFeedDownloadAttempts(),
+		RetryDelay: config.GetScheduleFeedRetryDelay(),
+		MinSize:    config.GetScheduleFeedMinSize(),
+	}
+	if downloadErr != nil {
+		slog.Warn("Open data credentials not configured - the schedule feed will not be downloaded", "error", downloadErr)
+	}
+
+	// Initial load of schedule feed, then a daily download of it
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		if _, err := os.Stat(downloadOpts.Filename); downloadErr == nil && os.IsNotExist(err) {
+			slog.Info("No schedule feed file - downloading it now", "filename", downloadOpts.Filename)
+			internalsync.DownloadScheduleFeed(ctx, downloadOpts)
+		}
+		internalsync.RefreshSchedules(
+			ctx,
+			config.GetScheduleFeedFilename(),
+			database,
+			config.GetDataDir(),
+			config.ShouldDeleteExpiredSchedulesAfterRefresh(),
+		)
+		if downloadErr == nil {
+			internalsync.DownloadSchedulesDaily(ctx, database, downloadOpts, config.GetDataDir(), config.ShouldDeleteExpiredSchedulesAfterRefresh())
+		}
+	}()
 
 	connErr, stompURL, login, password := config.GetStompConnectionDetails()
 	if connErr != nil {
 		slog.Warn("STOMP credentials not configured - VSTP feed will not be consumed", "error", connErr)
 	} else {
-		go internalsync.ListenForVSTP(database, stompURL, login, password, config.GetDataDir())
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			internalsync.ListenForVSTP(ctx, database, internalsync.StompOptions{
+				URL:          stompURL,
+				Login:        login,
+				Password:     password,
+				Destinations: config.GetVSTPDestinations(),
+				ClientID:     config.GetStompClientID(),
+			}, config.GetDataDir())
+		}()
 	}
 
 	// Block until a termination signal is received
-	quit := make(chan os.Signal, 1)
-	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
-	<-quit
-	slog.Info("Shutting down syncd")
+	<-ctx.Done()
+	timeout := config.GetShutdownTimeout()
+	slog.Info("Shutting down syncd", "timeout", timeout)
+
+	stopped := make(chan struct{})
+	go func() {
+		workers.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		slog.Info("Workers stopped")
+	case <-time.After(timeout):
+		// Anything not yet committed is rolled back by SQLite, and picked up again on the next start
+		slog.Warn("Workers didn't stop before the shutdown timeout - exiting anyway")
+	}
+
+	if sqlDB, err := database.DB(); err == nil {
+		sqlDB.Close()
+	}
 }
 
 // setupLogger configures the logger to write to a file if LOG_FILENAME is set, or to stderr otherwise.
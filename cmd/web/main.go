@@ -12,8 +12,10 @@ import (
 	"strings"
 	"time"
 	"uk-rail-schedule-api/internal/api"
+	"uk-rail-schedule-api/internal/calendar"
 	"uk-rail-schedule-api/internal/config"
 	"uk-rail-schedule-api/internal/db"
+	"uk-rail-schedule-api/internal/gtfs"
 	"uk-rail-schedule-api/internal/store"
 	"uk-rail-schedule-api/internal/telemetry"
 
@@ -56,6 +58,18 @@ func main() {
 	}
 
 	s := store.New(database, version)
+	if filename := config.GetBankHolidaysFilename(); filename != "" {
+		s.Calendar, err = calendar.Load(filename)
+		if err != nil {
+			slog.Error("Failed to load bank holidays", "error", err)
+			os.Exit(1)
+		}
+	}
+	s.Calendar.BankHolidayDivision = config.GetBankHolidayDivision()
+	if !s.Calendar.HasDivision(s.Calendar.BankHolidayDivision) {
+		slog.Error("Unknown bank holiday division", "division", s.Calendar.BankHolidayDivision)
+		os.Exit(1)
+	}
 
 	tmpl, err := template.New("").Funcs(template.FuncMap{
 		"now":     func() string { return time.Now().Format("2006-01-02") },
@@ -73,6 +87,14 @@ func main() {
 		Store:            s,
 		ScheduleFeedFile: config.GetScheduleFeedFilename(),
 		DataDir:          config.GetDataDir(),
+		MinConnection:    config.GetMinConnectionTime(),
+	}
+	if filename := config.GetStopCoordinatesFilename(); filename != "" {
+		h.StopCoordinates, err = gtfs.LoadCoordinates(filename)
+		if err != nil {
+			slog.Error("Failed to load stop coordinates", "error", err)
+			os.Exit(1)
+		}
 	}
 	wh := &api.WebHandler{Handler: *h, Templates: tmpl}
 
@@ -99,12 +121,38 @@ func main() {
 			r.Use(h.SchedulesCtx)
 			r.Get("/", h.GetSchedules)
 		})
+		r.Route("/boards/{location}", func(r chi.Router) {
+			r.Use(h.BoardCtx)
+			r.Get("/", h.GetBoard)
+		})
+		r.Route("/journeys", func(r chi.Router) {
+			r.Use(h.JourneysCtx)
+			r.Get("/", h.GetJourneys)
+		})
+		r.Get("/gtfs", h.GetGTFS)
+		r.Route("/trains/{trainuid}/calendar", func(r chi.Router) {
+			r.Use(h.RunningCalendarCtx)
+			r.Get("/", h.GetRunningCalendar)
+		})
+		r.Route("/calendar", func(r chi.Router) {
+			r.Use(h.CalendarCtx)
+			r.Get("/", h.GetCalendar)
+		})
+		r.Route("/locations", func(r chi.Router) {
+			r.Use(h.LocationsCtx)
+			r.Get("/", h.GetLocations)
+		})
 		r.Route("/status", func(r chi.Router) {
 			r.Use(h.StatusCtx)
 			r.Get("/", h.GetStatus)
 		})
 		r.Route("/refresh", func(r chi.Router) {
 			r.Get("/", h.RunRefresh)
+			r.Route("/{id}", func(r chi.Router) {
+				r.Use(h.RefreshJobCtx)
+				r.Get("/", h.GetRefreshJob)
+				r.Get("/report", h.GetRefreshReport)
+			})
 		})
 	})
 
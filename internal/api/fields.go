@@ -0,0 +1,66 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"uk-rail-schedule-api/internal/schedule"
+)
+
+// scheduleFields is the set of JSON field names of a schedule, which the fields parameter may select from.
+var scheduleFields = jsonFieldNames(reflect.TypeOf(schedule.Schedule{}))
+
+func jsonFieldNames(t reflect.Type) map[string]bool {
+	names := make(map[string]bool)
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = t.Field(i).Name
+		}
+		names[name] = true
+	}
+	return names
+}
+
+// parseFields splits a comma separated fields parameter, rejecting names that aren't schedule fields.
+func parseFields(param string) ([]string, error) {
+	var fields []string
+	for _, field := range strings.Split(param, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		if !scheduleFields[field] {
+			return nil, fmt.Errorf("unknown field %s", field)
+		}
+		fields = append(fields, field)
+	}
+	return fields, nil
+}
+
+// projectSchedules returns the schedules as JSON objects holding only the given fields.
+func projectSchedules(schedules []schedule.Schedule, fields []string) ([]map[string]json.RawMessage, error) {
+	projected := make([]map[string]json.RawMessage, 0, len(schedules))
+	for _, sch := range schedules {
+		b, err := json.Marshal(sch)
+		if err != nil {
+			return nil, err
+		}
+		var all map[string]json.RawMessage
+		if err := json.Unmarshal(b, &all); err != nil {
+			return nil, err
+		}
+		selected := make(map[string]json.RawMessage, len(fields))
+		for _, field := range fields {
+			if value, ok := all[field]; ok {
+				selected[field] = value
+			}
+		}
+		projected = append(projected, selected)
+	}
+	return projected, nil
+}
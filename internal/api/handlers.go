@@ -1,14 +1,24 @@
 package api
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 	"time"
+	"uk-rail-schedule-api/internal/calendar"
+	"uk-rail-schedule-api/internal/gtfs"
 	"uk-rail-schedule-api/internal/schedule"
 	"uk-rail-schedule-api/internal/store"
 	"uk-rail-schedule-api/internal/telemetry"
 	internalsync "uk-rail-schedule-api/internal/sync"
 
+	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/render"
 )
 
@@ -16,9 +26,46 @@ import (
 type ScheduleAPIResponse struct {
 	Headcode  string              `json:"headcode,omitempty"`
 	Tiploc    string              `json:"tiploc,omitempty"`
+	CRS       string              `json:"crs,omitempty"`
 	TrainUID  string              `json:"trainuid,omitempty"`
 	Date      string              `json:"date"`
+	// To is the last date of a range of dates starting at Date
+	To        string              `json:"to,omitempty"`
 	Schedules []schedule.Schedule `json:"schedules"`
+	// NextCursor is passed as the cursor parameter to fetch the next page. It is left out on the last page.
+	NextCursor string `json:"next_cursor,omitempty"`
+
+	// fields, if set, limits each schedule to the named JSON fields
+	fields []string
+}
+
+func (resp ScheduleAPIResponse) MarshalJSON() ([]byte, error) {
+	type envelope ScheduleAPIResponse
+	if len(resp.fields) == 0 {
+		return json.Marshal(envelope(resp))
+	}
+	projected, err := projectSchedules(resp.Schedules, resp.fields)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(struct {
+		envelope
+		Schedules []map[string]json.RawMessage `json:"schedules"`
+	}{envelope(resp), projected})
+}
+
+// LocationAPIResponse is the JSON envelope returned by the locations endpoint.
+type LocationAPIResponse struct {
+	Locations []schedule.Tiploc `json:"locations"`
+}
+
+// CalendarAPIResponse is the JSON envelope returned by the calendar endpoint.
+type CalendarAPIResponse struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	// BankHolidayDivision is the division whose bank holidays trains marked X don't run on
+	BankHolidayDivision string              `json:"bank_holiday_division"`
+	Divisions           []calendar.Division `json:"divisions"`
 }
 
 // ErrResponse is a renderable error for chi/render.
@@ -43,47 +90,120 @@ type Handler struct {
 	Store            *store.Store
 	ScheduleFeedFile string
 	DataDir          string
+	// MinConnection is the default time allowed to change trains in journey searches
+	MinConnection time.Duration
+	// StopCoordinates are the positions of stops in GTFS feeds
+	StopCoordinates gtfs.Coordinates
 }
 
 func (h *Handler) SchedulesCtx(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		headcode := r.URL.Query().Get("headcode")
-		tiploc := r.URL.Query().Get("tiploc")
-		trainUID := r.URL.Query().Get("trainuid")
+		query := r.URL.Query()
+		q := newScheduleQuery(query)
+		if q.Tiploc != "" && q.CRS != "" {
+			http.Error(w, "give either tiploc or crs, not both", 400)
+			return
+		}
 
-		date := time.Now().Format("2006-01-02")
-		if r.URL.Query().Has("date") {
-			date = r.URL.Query().Get("date")
+		limit := defaultScheduleLimit
+		if query.Has("limit") {
+			var err error
+			limit, err = strconv.Atoi(query.Get("limit"))
+			if err != nil || limit < 1 || limit > maxScheduleLimit {
+				http.Error(w, fmt.Sprintf("limit must be between 1 and %d", maxScheduleLimit), 400)
+				return
+			}
 		}
 
-		toc := "any"
-		if r.URL.Query().Has("toc") {
-			toc = r.URL.Query().Get("toc")
+		fields, err := parseFields(query.Get("fields"))
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
 		}
 
-		schedules, err := h.Store.GetSchedules(headcode, date, toc, tiploc, r.URL.Query().Get("hide_passed") == "true")
+		page, err := h.Store.GetSchedulePage(q, query.Get("cursor"), limit)
+		if errors.Is(err, store.ErrInvalidCursor) || errors.Is(err, store.ErrInvalidDateRange) {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		if errors.Is(err, store.ErrUnknownLocation) {
+			http.Error(w, err.Error(), 404)
+			return
+		}
 		if err != nil {
 			telemetry.RecordError(r.Context(), "db")
 			http.Error(w, err.Error(), 500)
 			return
 		}
-		if len(schedules) == 0 {
+		// A page after the last one is empty rather than not found
+		if len(page.Schedules) == 0 && !query.Has("cursor") {
 			http.Error(w, http.StatusText(404), 404)
 			return
 		}
 
+		if query.Get("include_locations") == "false" {
+			for idx := range page.Schedules {
+				page.Schedules[idx].ScheduleLocation = nil
+				if page.Schedules[idx].Cancellation != nil {
+					page.Schedules[idx].Cancellation.ScheduleLocation = nil
+				}
+			}
+		}
+
 		resp := ScheduleAPIResponse{
-			Headcode:  headcode,
-			Tiploc:    tiploc,
-			TrainUID:  trainUID,
-			Date:      date,
-			Schedules: schedules,
+			Headcode:   q.Headcode,
+			Tiploc:     query.Get("tiploc"),
+			CRS:        q.CRS,
+			TrainUID:   q.TrainUID,
+			Date:       q.Date,
+			To:         q.To,
+			Schedules:  page.Schedules,
+			NextCursor: page.NextCursor,
+			fields:     fields,
 		}
 		ctx := context.WithValue(r.Context(), "schedules", resp)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
+// defaultScheduleLimit and maxScheduleLimit bound the number of schedules returned in one page.
+const (
+	defaultScheduleLimit = 100
+	maxScheduleLimit     = 1000
+)
+
+// newScheduleQuery builds a schedule query from the query parameters of a request. The date defaults to today, and
+// "any" is accepted for toc and tiploc to mean no filter. from and to query a range of dates, from defaulting to the
+// date.
+func newScheduleQuery(values url.Values) store.ScheduleQuery {
+	q := store.ScheduleQuery{
+		Headcode:         values.Get("headcode"),
+		TrainUID:         values.Get("trainuid"),
+		TOC:              values.Get("toc"),
+		Tiploc:           values.Get("tiploc"),
+		CRS:              values.Get("crs"),
+		Category:         values.Get("category"),
+		PowerType:        values.Get("power_type"),
+		Date:             time.Now().Format("2006-01-02"),
+		HidePassed:       values.Get("hide_passed") == "true",
+		IncludeCancelled: values.Get("include_cancelled") == "true",
+	}
+	if values.Has("date") {
+		q.Date = values.Get("date")
+	}
+	if values.Has("from") {
+		q.Date = values.Get("from")
+	}
+	q.To = values.Get("to")
+	if q.TOC == "any" {
+		q.TOC = ""
+	}
+	if q.Tiploc == "any" {
+		q.Tiploc = ""
+	}
+	return q
+}
+
 // resolveIdentifier maps the named identifier query parameters to the internal
 // identifierType/identifier pair used by the store. Precedence: headcode →
 // tiploc → trainuid. Returns ("headcode", "") if none are set.
@@ -100,6 +220,291 @@ func resolveIdentifier(headcode, tiploc, trainuid string) (identifierType, ident
 	}
 }
 
+// defaultBoardWindow and maxBoardWindow bound the period covered by a board, in minutes.
+const (
+	defaultBoardWindow = 120
+	maxBoardWindow     = 1440
+)
+
+// BoardCtx builds the board for the {location} URL parameter. The board starts at the given date and time (HHMM),
+// defaulting to now, and covers the following window minutes.
+func (h *Handler) BoardCtx(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		location := chi.URLParam(r, "location")
+		query := r.URL.Query()
+
+		from, err := parseStartTime(query)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		window, err := parseWindow(query, defaultBoardWindow, maxBoardWindow)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+
+		boardType := store.BoardAll
+		if query.Has("type") {
+			boardType = query.Get("type")
+		}
+		if boardType != store.BoardAll && boardType != store.BoardDepartures && boardType != store.BoardArrivals {
+			http.Error(w, "type must be one of all, departures or arrivals", 400)
+			return
+		}
+
+		board, err := h.Store.GetBoard(location, from, window, boardType, query.Get("include_passes") == "true")
+		if errors.Is(err, store.ErrAmbiguousLocation) {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		if err != nil {
+			telemetry.RecordError(r.Context(), "db")
+			http.Error(w, err.Error(), 500)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), "board", board)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// parseStartTime returns the start of the period given by the date (YYYY-MM-DD) and time (HHMM) query parameters, in
+// UK local time, defaulting to now.
+func parseStartTime(query url.Values) (time.Time, error) {
+	start := time.Now()
+	if !query.Has("date") && !query.Has("time") {
+		return start, nil
+	}
+	date := query.Get("date")
+	if date == "" {
+		date = start.In(store.LondonLocation()).Format("2006-01-02")
+	}
+	hhmm := query.Get("time")
+	if hhmm == "" {
+		hhmm = "0000"
+	}
+	start, err := time.ParseInLocation("2006-01-02 1504", date+" "+hhmm, store.LondonLocation())
+	if err != nil {
+		return start, errors.New("date must be YYYY-MM-DD and time HHMM")
+	}
+	return start, nil
+}
+
+// parseWindow returns the length of the period given by the window query parameter, in minutes.
+func parseWindow(query url.Values, defaultWindow, maxWindow int) (time.Duration, error) {
+	window := defaultWindow
+	if query.Has("window") {
+		var err error
+		window, err = strconv.Atoi(query.Get("window"))
+		if err != nil || window < 1 || window > maxWindow {
+			return 0, fmt.Errorf("window must be between 1 and %d minutes", maxWindow)
+		}
+	}
+	return time.Duration(window) * time.Minute, nil
+}
+
+// defaultJourneyWindow and maxJourneyWindow bound the period in which journeys may start, and maxMinConnection the
+// time allowed for a change, in minutes.
+const (
+	defaultJourneyWindow = 120
+	maxJourneyWindow     = 1440
+	maxMinConnection     = 60
+)
+
+// JourneysCtx searches for journeys between the from and to locations, each a TIPLOC or CRS code, starting in the
+// window minutes after the given date and time (HHMM), defaulting to now. Journeys with a change are only included
+// if changes=true, leaving at least min_connection minutes, or the handler's MinConnection, to change.
+func (h *Handler) JourneysCtx(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if query.Get("from") == "" || query.Get("to") == "" {
+			http.Error(w, "from and to are required", 400)
+			return
+		}
+
+		from, err := parseStartTime(query)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		window, err := parseWindow(query, defaultJourneyWindow, maxJourneyWindow)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+
+		minConnection := h.MinConnection
+		if query.Has("min_connection") {
+			minutes, err := strconv.Atoi(query.Get("min_connection"))
+			if err != nil || minutes < 0 || minutes > maxMinConnection {
+				http.Error(w, fmt.Sprintf("min_connection must be between 0 and %d minutes", maxMinConnection), 400)
+				return
+			}
+			minConnection = time.Duration(minutes) * time.Minute
+		}
+
+		plan, err := h.Store.GetJourneys(store.JourneySearch{
+			From:          query.Get("from"),
+			To:            query.Get("to"),
+			DepartAfter:   from,
+			Window:        window,
+			Changes:       query.Get("changes") == "true",
+			MinConnection: minConnection,
+		})
+		if errors.Is(err, store.ErrAmbiguousLocation) {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		if err != nil {
+			telemetry.RecordError(r.Context(), "db")
+			http.Error(w, err.Error(), 500)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), "journeys", plan)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// defaultLocationLimit and maxLocationLimit bound the number of locations returned by a search.
+const (
+	defaultLocationLimit = 20
+	maxLocationLimit     = 100
+)
+
+// LocationsCtx searches for locations by code (TIPLOC, CRS or STANOX) and by name.
+func (h *Handler) LocationsCtx(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		search := store.LocationSearch{
+			Code:  query.Get("code"),
+			Name:  query.Get("name"),
+			Limit: defaultLocationLimit,
+		}
+		// q searches both codes and names, for type-ahead boxes
+		if q := query.Get("q"); q != "" {
+			search.Code, search.Name = q, q
+		}
+		if search.Code == "" && search.Name == "" {
+			http.Error(w, "one of q, code or name is required", 400)
+			return
+		}
+		if query.Has("limit") {
+			var err error
+			search.Limit, err = strconv.Atoi(query.Get("limit"))
+			if err != nil || search.Limit < 1 || search.Limit > maxLocationLimit {
+				http.Error(w, fmt.Sprintf("limit must be between 1 and %d", maxLocationLimit), 400)
+				return
+			}
+		}
+
+		locations, err := h.Store.SearchLocations(search)
+		if err != nil {
+			telemetry.RecordError(r.Context(), "db")
+			http.Error(w, err.Error(), 500)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), "locations", LocationAPIResponse{Locations: locations})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// defaultRunningDays is the number of days a running calendar covers if no end date is given.
+const defaultRunningDays = 28
+
+// RunningCalendarCtx builds the running calendar of the train with the {trainuid} URL parameter, from the from date,
+// defaulting to today, to the to date, defaulting to four weeks on.
+func (h *Handler) RunningCalendarCtx(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		from := time.Now().In(store.LondonLocation()).Format("2006-01-02")
+		if query.Has("from") {
+			from = query.Get("from")
+		}
+		to := query.Get("to")
+		if to == "" {
+			start, err := time.Parse("2006-01-02", from)
+			if err != nil {
+				http.Error(w, "from must be a date as YYYY-MM-DD", 400)
+				return
+			}
+			to = start.AddDate(0, 0, defaultRunningDays-1).Format("2006-01-02")
+		}
+
+		cal, err := h.Store.GetRunningCalendar(chi.URLParam(r, "trainuid"), from, to)
+		if errors.Is(err, store.ErrInvalidDateRange) {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		if err != nil {
+			telemetry.RecordError(r.Context(), "db")
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		if len(cal.Records) == 0 {
+			http.Error(w, http.StatusText(404), 404)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), "running", cal)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// CalendarCtx lists the bank holidays from one date to another, defaulting to the current year, in one division or
+// in all of them.
+func (h *Handler) CalendarCtx(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		year := time.Now().In(store.LondonLocation()).Year()
+		from := time.Date(year, 1, 1, 0, 0, 0, 0, time.UTC)
+		to := time.Date(year, 12, 31, 0, 0, 0, 0, time.UTC)
+		for _, param := range []struct {
+			name string
+			date *time.Time
+		}{{"from", &from}, {"to", &to}} {
+			if !query.Has(param.name) {
+				continue
+			}
+			date, err := time.Parse("2006-01-02", query.Get(param.name))
+			if err != nil {
+				http.Error(w, param.name+" must be a date as YYYY-MM-DD", 400)
+				return
+			}
+			*param.date = date
+		}
+		if to.Before(from) {
+			http.Error(w, "to must not be before from", 400)
+			return
+		}
+
+		cal := h.Store.Calendar
+		divisions := cal.Divisions()
+		if query.Has("division") {
+			division := query.Get("division")
+			if !cal.HasDivision(division) {
+				http.Error(w, "division must be one of "+strings.Join(divisions, ", "), 400)
+				return
+			}
+			divisions = []string{division}
+		}
+
+		resp := CalendarAPIResponse{
+			From:                from.Format("2006-01-02"),
+			To:                  to.Format("2006-01-02"),
+			BankHolidayDivision: cal.BankHolidayDivision,
+			Divisions:           []calendar.Division{},
+		}
+		for _, division := range divisions {
+			resp.Divisions = append(resp.Divisions, calendar.Division{Division: division, Events: cal.Holidays(division, from, to)})
+		}
+		ctx := context.WithValue(r.Context(), "calendar", resp)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
 func (h *Handler) StatusCtx(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		status, err := h.Store.GetStatus()
@@ -122,6 +527,51 @@ func (h *Handler) GetSchedules(w http.ResponseWriter, r *http.Request) {
 	render.JSON(w, r, schedules)
 }
 
+func (h *Handler) GetBoard(w http.ResponseWriter, r *http.Request) {
+	board, ok := r.Context().Value("board").(store.Board)
+	if !ok {
+		render.Render(w, r, ErrUnprocessable)
+		return
+	}
+	render.JSON(w, r, board)
+}
+
+func (h *Handler) GetJourneys(w http.ResponseWriter, r *http.Request) {
+	plan, ok := r.Context().Value("journeys").(store.JourneyPlan)
+	if !ok {
+		render.Render(w, r, ErrUnprocessable)
+		return
+	}
+	render.JSON(w, r, plan)
+}
+
+func (h *Handler) GetLocations(w http.ResponseWriter, r *http.Request) {
+	locations, ok := r.Context().Value("locations").(LocationAPIResponse)
+	if !ok {
+		render.Render(w, r, ErrUnprocessable)
+		return
+	}
+	render.JSON(w, r, locations)
+}
+
+func (h *Handler) GetRunningCalendar(w http.ResponseWriter, r *http.Request) {
+	cal, ok := r.Context().Value("running").(store.RunningCalendar)
+	if !ok {
+		render.Render(w, r, ErrUnprocessable)
+		return
+	}
+	render.JSON(w, r, cal)
+}
+
+func (h *Handler) GetCalendar(w http.ResponseWriter, r *http.Request) {
+	cal, ok := r.Context().Value("calendar").(CalendarAPIResponse)
+	if !ok {
+		render.Render(w, r, ErrUnprocessable)
+		return
+	}
+	render.JSON(w, r, cal)
+}
+
 func (h *Handler) GetStatus(w http.ResponseWriter, r *http.Request) {
 	status, ok := r.Context().Value("status").(store.APIStatus)
 	if !ok {
@@ -131,13 +581,117 @@ func (h *Handler) GetStatus(w http.ResponseWriter, r *http.Request) {
 	render.JSON(w, r, status)
 }
 
+// defaultGTFSDays and maxGTFSDays bound the number of days covered by a GTFS feed downloaded from the API. Longer
+// feeds can be exported with the gtfs command.
+const (
+	defaultGTFSDays = 7
+	maxGTFSDays     = 31
+)
+
+// GetGTFS exports the schedules as a zipped GTFS feed covering the given number of days from the from date, which
+// defaults to today.
+func (h *Handler) GetGTFS(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	from := time.Now().In(store.LondonLocation()).Format("2006-01-02")
+	if query.Has("from") {
+		from = query.Get("from")
+	}
+	start, err := time.Parse("2006-01-02", from)
+	if err != nil {
+		http.Error(w, "from must be YYYY-MM-DD", 400)
+		return
+	}
+
+	days := defaultGTFSDays
+	if query.Has("days") {
+		days, err = strconv.Atoi(query.Get("days"))
+		if err != nil || days < 1 || days > maxGTFSDays {
+			http.Error(w, fmt.Sprintf("days must be between 1 and %d", maxGTFSDays), 400)
+			return
+		}
+	}
+
+	// The feed is built in full before any of it is sent, so a failure can still be reported as an error
+	var buf bytes.Buffer
+	opts := gtfs.Options{Coordinates: h.StopCoordinates, Calendar: h.Store.Calendar}
+	if err := gtfs.Export(h.Store.DB, &buf, start, start.AddDate(0, 0, days-1), opts); err != nil {
+		telemetry.RecordError(r.Context(), "db")
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="gtfs-%s.zip"`, from))
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	buf.WriteTo(w)
+}
+
+// RunRefresh begins a refresh job to load the schedule feed file, and responds with the job, which can be polled at
+// /refresh/{id} until it has finished.
 func (h *Handler) RunRefresh(w http.ResponseWriter, r *http.Request) {
-	if internalsync.IsRefreshingDatabase() {
+	job, err := internalsync.BeginRefresh(h.Store.DB, h.ScheduleFeedFile)
+	if errors.Is(err, internalsync.ErrAlreadyRefreshing) {
 		w.WriteHeader(409)
 		render.JSON(w, r, "Database already being refreshed. Please try again later")
 		return
 	}
-	go internalsync.RefreshSchedules(h.ScheduleFeedFile, h.Store.DB, h.DataDir, false)
-	w.WriteHeader(201)
-	render.JSON(w, r, "Refreshing")
+	if err != nil {
+		telemetry.RecordError(r.Context(), "db")
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	// The refresh carries on after the response has been sent, so it isn't tied to the request's context
+	go internalsync.RunRefreshJob(context.Background(), job, h.Store.DB, h.DataDir, false)
+	w.Header().Set("Location", fmt.Sprintf("%s/%d", strings.TrimSuffix(r.URL.Path, "/"), job.ID))
+	render.Status(r, 201)
+	render.JSON(w, r, job)
+}
+
+// RefreshJobCtx looks up the refresh job with the {id} URL parameter.
+func (h *Handler) RefreshJobCtx(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseUint(chi.URLParam(r, "id"), 10, 64)
+		if err != nil {
+			http.Error(w, "id must be a refresh job id", 400)
+			return
+		}
+
+		job, err := h.Store.GetRefreshJob(id)
+		if errors.Is(err, store.ErrRefreshJobNotFound) {
+			render.Render(w, r, ErrNotFound)
+			return
+		}
+		if err != nil {
+			telemetry.RecordError(r.Context(), "db")
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		ctx := context.WithValue(r.Context(), "refresh_job", job)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func (h *Handler) GetRefreshJob(w http.ResponseWriter, r *http.Request) {
+	job, ok := r.Context().Value("refresh_job").(schedule.RefreshJob)
+	if !ok {
+		render.Render(w, r, ErrUnprocessable)
+		return
+	}
+	render.JSON(w, r, job)
+}
+
+// GetRefreshReport responds with the validation report of the refresh job looked up by RefreshJobCtx.
+func (h *Handler) GetRefreshReport(w http.ResponseWriter, r *http.Request) {
+	job, ok := r.Context().Value("refresh_job").(schedule.RefreshJob)
+	if !ok {
+		render.Render(w, r, ErrUnprocessable)
+		return
+	}
+	report, err := h.Store.GetRefreshReport(job)
+	if err != nil {
+		telemetry.RecordError(r.Context(), "db")
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	render.JSON(w, r, report)
 }
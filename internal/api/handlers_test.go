@@ -1,9 +1,15 @@
 package api_test
 
 import (
+	"archive/zip"
+	"bytes"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
 	"testing"
 	"time"
 
@@ -26,19 +32,21 @@ func setupTestDB(t *testing.T) *gorm.DB {
 	if err != nil {
 		t.Fatal("failed to open test database:", err)
 	}
-	if err := db.AutoMigrate(
-		&schedule.ScheduleLocation{},
-		&schedule.Schedule{},
-		&schedule.Tiploc{},
-		&schedule.Timetable{},
-	); err != nil {
+	if err := db.AutoMigrate(schedule.Models()...); err != nil {
 		t.Fatal("failed to migrate test database:", err)
 	}
+	// Each connection to an in-memory database is a separate database, so background refreshes must share the one
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal("failed to get test database connection pool:", err)
+	}
+	sqlDB.SetMaxOpenConns(1)
 	return db
 }
 
-// seedSchedule inserts a minimal schedule running on Sundays into the given DB.
-func seedSchedule(t *testing.T, db *gorm.DB, signallingID, trainUID string) {
+// seedRecord inserts a schedule record into the given DB: a permanent feed record running on Sundays from 2023, changed
+// by each of opts before it's augmented and inserted.
+func seedRecord(t *testing.T, db *gorm.DB, signallingID, trainUID string, opts ...func(*schedule.Schedule)) schedule.Schedule {
 	t.Helper()
 	sch := schedule.Schedule{
 		CIFStpIndicator:   "P",
@@ -50,10 +58,20 @@ func seedSchedule(t *testing.T, db *gorm.DB, signallingID, trainUID string) {
 		ScheduleEndDate:   "2099-12-31",
 		AtocCode:          "GW",
 	}
+	for _, opt := range opts {
+		opt(&sch)
+	}
 	sch.AugmentSchedule()
 	if err := db.Create(&sch).Error; err != nil {
 		t.Fatal("failed to seed schedule:", err)
 	}
+	return sch
+}
+
+// seedSchedule inserts a minimal schedule running on Sundays into the given DB.
+func seedSchedule(t *testing.T, db *gorm.DB, signallingID, trainUID string) {
+	t.Helper()
+	seedRecord(t, db, signallingID, trainUID)
 }
 
 // buildRouter wires a chi router with the JSON API routes under /api using the given handler.
@@ -64,11 +82,37 @@ func buildRouter(h *api.Handler) http.Handler {
 			r.Use(h.SchedulesCtx)
 			r.Get("/", h.GetSchedules)
 		})
+		r.Route("/boards/{location}", func(r chi.Router) {
+			r.Use(h.BoardCtx)
+			r.Get("/", h.GetBoard)
+		})
+		r.Route("/journeys", func(r chi.Router) {
+			r.Use(h.JourneysCtx)
+			r.Get("/", h.GetJourneys)
+		})
+		r.Get("/gtfs", h.GetGTFS)
+		r.Route("/trains/{trainuid}/calendar", func(r chi.Router) {
+			r.Use(h.RunningCalendarCtx)
+			r.Get("/", h.GetRunningCalendar)
+		})
+		r.Route("/calendar", func(r chi.Router) {
+			r.Use(h.CalendarCtx)
+			r.Get("/", h.GetCalendar)
+		})
+		r.Route("/locations", func(r chi.Router) {
+			r.Use(h.LocationsCtx)
+			r.Get("/", h.GetLocations)
+		})
 		r.Route("/status", func(r chi.Router) {
 			r.Use(h.StatusCtx)
 			r.Get("/", h.GetStatus)
 		})
 		r.Post("/refresh", h.RunRefresh)
+		r.Route("/refresh/{id}", func(r chi.Router) {
+			r.Use(h.RefreshJobCtx)
+			r.Get("/", h.GetRefreshJob)
+			r.Get("/report", h.GetRefreshReport)
+		})
 	})
 	return r
 }
@@ -197,7 +241,7 @@ func TestGetStatus_ReturnsCounts(t *testing.T) {
 
 func TestRunRefresh_WhenIdle(t *testing.T) {
 	db := setupTestDB(t)
-	// Use a non-existent feed file so the goroutine exits immediately
+	// Use a non-existent feed file so the job fails straight away
 	h := &api.Handler{
 		Store:            store.New(db, "test"),
 		ScheduleFeedFile: "/nonexistent/feed.json",
@@ -209,14 +253,110 @@ func TestRunRefresh_WhenIdle(t *testing.T) {
 	rec := httptest.NewRecorder()
 	router.ServeHTTP(rec, req)
 
-	// Wait for the background refresh goroutine to finish so it doesn't
-	// reset the flag and race with subsequent tests.
-	for internalsync.IsRefreshingDatabase() {
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d; body: %s", rec.Code, rec.Body.String())
+	}
+	var job schedule.RefreshJob
+	if err := json.NewDecoder(rec.Body).Decode(&job); err != nil {
+		t.Fatalf("failed to decode refresh job: %v", err)
+	}
+	if job.ID == 0 || job.State != schedule.RefreshJobRunning {
+		t.Errorf("expected a running job, got %+v", job)
+	}
+	if location := rec.Header().Get("Location"); location != fmt.Sprintf("/api/refresh/%d", job.ID) {
+		t.Errorf("expected Location /api/refresh/%d, got %q", job.ID, location)
+	}
+
+	// Poll the job, as a client would, until the background refresh has finished
+	deadline := time.Now().Add(5 * time.Second)
+	for job.State == schedule.RefreshJobRunning && time.Now().Before(deadline) {
 		time.Sleep(time.Millisecond)
+		req = httptest.NewRequest(http.MethodGet, fmt.Sprintf("/api/refresh/%d", job.ID), nil)
+		rec = httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d; body: %s", rec.Code, rec.Body.String())
+		}
+		if err := json.NewDecoder(rec.Body).Decode(&job); err != nil {
+			t.Fatalf("failed to decode refresh job: %v", err)
+		}
+	}
+	if job.State != schedule.RefreshJobFailed || job.Error == "" || job.FinishedAt == nil {
+		t.Errorf("expected the job to have failed to open the feed file, got %+v", job)
+	}
+}
+
+func TestGetRefreshJob_NotFound(t *testing.T) {
+	db := setupTestDB(t)
+	h := &api.Handler{Store: store.New(db, "test")}
+	router := buildRouter(h)
+
+	for path, want := range map[string]int{
+		"/api/refresh/99":    http.StatusNotFound,
+		"/api/refresh/first": http.StatusBadRequest,
+	} {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		if rec.Code != want {
+			t.Errorf("%s: expected %d, got %d", path, want, rec.Code)
+		}
 	}
+}
 
-	if rec.Code != http.StatusCreated {
-		t.Errorf("expected 201, got %d", rec.Code)
+func TestGetStatus_ReturnsLatestRefresh(t *testing.T) {
+	db := setupTestDB(t)
+	db.Create(&schedule.RefreshJob{Filename: "schedule.json", State: schedule.RefreshJobSucceeded})
+	db.Create(&schedule.RefreshJob{Filename: "schedule.json", State: schedule.RefreshJobRunning, BytesRead: 250, BytesTotal: 1000, Lines: 40})
+	router := buildRouter(&api.Handler{Store: store.New(db, "test")})
+
+	req := httptest.NewRequest(http.MethodGet, "/api/status", nil)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	var status store.APIStatus
+	if err := json.NewDecoder(rec.Body).Decode(&status); err != nil {
+		t.Fatalf("failed to decode status response: %v", err)
+	}
+	if status.LatestRefresh == nil || status.LatestRefresh.ID != 2 || status.LatestRefresh.PercentRead() != 25 || status.LatestRefresh.Lines != 40 {
+		t.Errorf("expected the progress of the running job, got %+v", status.LatestRefresh)
+	}
+}
+
+func TestGetRefreshReport(t *testing.T) {
+	db := setupTestDB(t)
+	db.Create(&schedule.RefreshJob{State: schedule.RefreshJobSucceeded, IssueCounts: map[string]int64{schedule.IssueUnparseableLine: 1, schedule.IssueUnknownTiploc: 1200}})
+	db.Create(&schedule.RefreshJob{State: schedule.RefreshJobSucceeded})
+	db.Create(&[]schedule.RefreshIssue{
+		{JobID: 1, Kind: schedule.IssueUnparseableLine, Line: 12, Detail: "unexpected end of JSON input"},
+		{JobID: 1, Kind: schedule.IssueUnknownTiploc, Key: "C002062023-01-01P", Detail: "calls at tiploc NOWHERE, which isn't in the feed"},
+		{JobID: 2, Kind: schedule.IssueDuplicateKey, Line: 3, Key: "C002062023-01-01P"},
+	})
+	router := buildRouter(&api.Handler{Store: store.New(db, "test")})
+
+	req := httptest.NewRequest(http.MethodGet, "/api/refresh/1/report", nil)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d; body: %s", rec.Code, rec.Body.String())
+	}
+
+	var report store.RefreshReport
+	if err := json.NewDecoder(rec.Body).Decode(&report); err != nil {
+		t.Fatalf("failed to decode refresh report: %v", err)
+	}
+	if report.JobID != 1 || report.Counts[schedule.IssueUnknownTiploc] != 1200 {
+		t.Errorf("expected the issue counts of job 1, got %+v", report)
+	}
+	if len(report.Issues) != 2 || report.Issues[0].Line != 12 || report.Issues[1].Key != "C002062023-01-01P" {
+		t.Errorf("expected the 2 issues of job 1 in the order they were found, got %+v", report.Issues)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/api/refresh/99/report", nil)
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for the report of an unknown job, got %d", rec.Code)
 	}
 }
 
@@ -279,29 +419,9 @@ func TestStatusCtx_NilDB(t *testing.T) {
 // location with the given TIPLOC code.
 func seedScheduleWithLocation(t *testing.T, db *gorm.DB, signallingID, trainUID, tiplocCode string) {
 	t.Helper()
-	sch := schedule.Schedule{
-		CIFStpIndicator:   "P",
-		SignallingID:      signallingID,
-		CIFTrainUID:       trainUID,
-		Source:            "Feed",
-		ScheduleDaysRuns:  "0000001", // Sunday
-		ScheduleStartDate: "2023-01-01",
-		ScheduleEndDate:   "2099-12-31",
-		AtocCode:          "GW",
-	}
-	sch.AugmentSchedule()
-	if err := db.Create(&sch).Error; err != nil {
-		t.Fatal("failed to seed schedule with location:", err)
-	}
-	loc := schedule.ScheduleLocation{
-		ScheduleID:     sch.ID,
-		RecordIdentity: "LO",
-		TiplocCode:     tiplocCode,
-		Departure:      "0930",
-	}
-	if err := db.Create(&loc).Error; err != nil {
-		t.Fatal("failed to seed schedule location:", err)
-	}
+	seedRecord(t, db, signallingID, trainUID, func(sch *schedule.Schedule) {
+		sch.ScheduleLocation = []schedule.ScheduleLocation{{RecordIdentity: "LO", TiplocCode: tiplocCode, Departure: "0930"}}
+	})
 }
 
 func TestGetSchedules_ByTiploc_Matches(t *testing.T) {
@@ -361,14 +481,11 @@ func TestGetSchedules_InvalidDate(t *testing.T) {
 }
 
 func TestRunRefresh_WhenBusy(t *testing.T) {
-	// Allow any goroutine spawned by a prior test to finish so it doesn't
-	// race with our manual flag-set below.
-	time.Sleep(50 * time.Millisecond)
-
-	internalsync.SetRefreshingDatabase(true)
-	t.Cleanup(func() { internalsync.SetRefreshingDatabase(false) })
-
 	db := setupTestDB(t)
+	// Another process, such as syncd, is loading the feed
+	if _, err := internalsync.BeginRefresh(db, "schedule.json"); err != nil {
+		t.Fatalf("BeginRefresh: %v", err)
+	}
 	h := &api.Handler{Store: store.New(db, "test")}
 	router := buildRouter(h)
 
@@ -380,3 +497,1157 @@ func TestRunRefresh_WhenBusy(t *testing.T) {
 		t.Errorf("expected 409, got %d", rec.Code)
 	}
 }
+
+// seedSTPRecord inserts a Sunday-running feed record for trainUID with the given STP indicator. Cancellations,
+// like those in the CIF feed, carry no headcode or operator.
+func seedSTPRecord(t *testing.T, db *gorm.DB, stp, signallingID, trainUID string) {
+	t.Helper()
+	seedRecord(t, db, signallingID, trainUID, func(sch *schedule.Schedule) {
+		sch.CIFStpIndicator = stp
+		sch.ScheduleStartDate, sch.ScheduleEndDate = "2023-05-21", "2023-05-21"
+		if stp == "C" {
+			sch.AtocCode = ""
+		}
+	})
+}
+
+func TestGetSchedules_FeedCancellationRemovesSchedule(t *testing.T) {
+	db := setupTestDB(t)
+	seedSchedule(t, db, "2A20", "C00206")
+	seedSTPRecord(t, db, "C", "", "C00206")
+	h := &api.Handler{Store: store.New(db, "test")}
+	router := buildRouter(h)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/schedules?headcode=2A20&date=2023-05-21", nil)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for a cancelled schedule, got %d", rec.Code)
+	}
+
+	// The cancellation only covers 2023-05-21; the following Sunday runs as normal.
+	req = httptest.NewRequest(http.MethodGet, "/api/schedules?headcode=2A20&date=2023-05-28", nil)
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected 200 outside the cancellation's date range, got %d", rec.Code)
+	}
+}
+
+func TestGetSchedules_FeedCancellationIncluded(t *testing.T) {
+	db := setupTestDB(t)
+	seedSchedule(t, db, "2A20", "C00206")
+	seedSTPRecord(t, db, "C", "", "C00206")
+	h := &api.Handler{Store: store.New(db, "test")}
+	router := buildRouter(h)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/schedules?headcode=2A20&date=2023-05-21&include_cancelled=true", nil)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d; body: %s", rec.Code, rec.Body.String())
+	}
+
+	var resp api.ScheduleAPIResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if len(resp.Schedules) != 1 {
+		t.Fatalf("expected 1 schedule, got %d", len(resp.Schedules))
+	}
+	if !resp.Schedules[0].Cancelled {
+		t.Error("expected schedule to be flagged as cancelled")
+	}
+	if resp.Schedules[0].Cancellation == nil || resp.Schedules[0].Cancellation.CIFStpIndicator != "C" {
+		t.Errorf("expected the cancellation record to be attached, got %+v", resp.Schedules[0].Cancellation)
+	}
+}
+
+func TestGetSchedules_FeedOverlayApplied(t *testing.T) {
+	db := setupTestDB(t)
+	seedSchedule(t, db, "2A20", "C00206")
+	seedSTPRecord(t, db, "O", "2A20", "C00206")
+	h := &api.Handler{Store: store.New(db, "test")}
+	router := buildRouter(h)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/schedules?headcode=2A20&date=2023-05-21", nil)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d; body: %s", rec.Code, rec.Body.String())
+	}
+
+	var resp api.ScheduleAPIResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if len(resp.Schedules) != 1 {
+		t.Fatalf("expected the overlay to be merged into a single schedule, got %d", len(resp.Schedules))
+	}
+	if resp.Schedules[0].CIFStpIndicator != "O" {
+		t.Errorf("expected the overlay to govern the schedule, got STP indicator %q", resp.Schedules[0].CIFStpIndicator)
+	}
+}
+
+func TestGetSchedules_IncludesAssociations(t *testing.T) {
+	db := setupTestDB(t)
+	seedSchedule(t, db, "2A20", "C00206")
+	seedSchedule(t, db, "2A21", "C00299")
+	assoc := schedule.Association{
+		Source:          "Feed",
+		MainTrainUID:    "C00206",
+		AssocTrainUID:   "C00299",
+		AssocStartDate:  "2023-01-01",
+		AssocEndDate:    "2099-12-31",
+		AssocDays:       "0000001",
+		Category:        "VV",
+		DateIndicator:   "S",
+		Location:        "HYWRDSH",
+		CIFStpIndicator: "P",
+	}
+	assoc.AugmentAssociation()
+	if err := db.Create(&assoc).Error; err != nil {
+		t.Fatal("failed to seed association:", err)
+	}
+	h := &api.Handler{Store: store.New(db, "test")}
+	router := buildRouter(h)
+
+	// Both the main and the associated train should carry the association
+	for _, headcode := range []string{"2A20", "2A21"} {
+		req := httptest.NewRequest(http.MethodGet, "/api/schedules?headcode="+headcode+"&date=2023-05-21", nil)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d; body: %s", rec.Code, rec.Body.String())
+		}
+
+		var resp api.ScheduleAPIResponse
+		if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+		if len(resp.Schedules) != 1 || len(resp.Schedules[0].Associations) != 1 {
+			t.Fatalf("expected 1 schedule with 1 association for %s, got %+v", headcode, resp.Schedules)
+		}
+		got := resp.Schedules[0].Associations[0]
+		if got.AssocTrainUID != "C00299" || got.Category != "VV" || got.Location != "HYWRDSH" {
+			t.Errorf("unexpected association for %s: %+v", headcode, got)
+		}
+	}
+}
+
+// seedJourney seeds a Sunday schedule from Derby to Sheffield, passing Belper, along with the TIPLOCs it calls at.
+func seedJourney(t *testing.T, db *gorm.DB, signallingID, trainUID string, departure, pass, arrival schedule.WTTTime) {
+	t.Helper()
+	seedRecord(t, db, signallingID, trainUID, func(sch *schedule.Schedule) {
+		sch.AtocCode = "EM"
+		sch.ScheduleLocation = []schedule.ScheduleLocation{
+			{RecordIdentity: "LO", TiplocCode: "DRBY", Departure: departure, PublicDeparture: departure, Platform: "5B"},
+			{RecordIdentity: "LI", TiplocCode: "BELPER", Pass: pass},
+			{RecordIdentity: "LT", TiplocCode: "SHEFFLD", Arrival: arrival, PublicArrival: arrival, Platform: "2"},
+		}
+	})
+	for _, tiploc := range []schedule.Tiploc{
+		{TiplocCode: "DRBY", CrsCode: "DBY", TpsDescription: "DERBY"},
+		{TiplocCode: "BELPER", CrsCode: "BLP", TpsDescription: "BELPER"},
+		{TiplocCode: "SHEFFLD", CrsCode: "SHF", TpsDescription: "SHEFFIELD"},
+	} {
+		db.Where("tiploc_code = ?", tiploc.TiplocCode).FirstOrCreate(&tiploc)
+	}
+}
+
+func getBoard(t *testing.T, router http.Handler, url string) store.Board {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, url, nil)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d; body: %s", rec.Code, rec.Body.String())
+	}
+	var board store.Board
+	if err := json.NewDecoder(rec.Body).Decode(&board); err != nil {
+		t.Fatalf("failed to decode board: %v", err)
+	}
+	return board
+}
+
+func TestGetBoard_WindowedDepartures(t *testing.T) {
+	db := setupTestDB(t)
+	seedJourney(t, db, "1F20", "C10001", "0930", "0940", "1010")
+	seedJourney(t, db, "1F22", "C10002", "1130", "1140", "1210")
+	router := buildRouter(&api.Handler{Store: store.New(db, "test")})
+
+	board := getBoard(t, router, "/api/boards/DRBY?date=2023-05-21&time=0900&window=60")
+	if len(board.Entries) != 1 {
+		t.Fatalf("expected 1 call within the window, got %d", len(board.Entries))
+	}
+	entry := board.Entries[0]
+	if entry.SignallingID != "1F20" || entry.Departure != "09:30" || entry.Platform != "5B" {
+		t.Errorf("unexpected board entry: %+v", entry)
+	}
+	if entry.Origin != "DERBY" || entry.Destination != "SHEFFIELD" {
+		t.Errorf("expected origin DERBY and destination SHEFFIELD, got %q and %q", entry.Origin, entry.Destination)
+	}
+	if entry.IsPass {
+		t.Error("expected a departure not to be flagged as a pass")
+	}
+
+	board = getBoard(t, router, "/api/boards/DRBY?date=2023-05-21&time=0900&window=180")
+	if len(board.Entries) != 2 || board.Entries[0].SignallingID != "1F20" || board.Entries[1].SignallingID != "1F22" {
+		t.Errorf("expected both calls in time order, got %+v", board.Entries)
+	}
+}
+
+func TestGetBoard_ByCRS(t *testing.T) {
+	db := setupTestDB(t)
+	seedJourney(t, db, "1F20", "C10001", "0930", "0940", "1010")
+	router := buildRouter(&api.Handler{Store: store.New(db, "test")})
+
+	board := getBoard(t, router, "/api/boards/SHF?date=2023-05-21&time=1000")
+	if len(board.Tiplocs) != 1 || board.Tiplocs[0] != "SHEFFLD" {
+		t.Errorf("expected CRS SHF to resolve to SHEFFLD, got %v", board.Tiplocs)
+	}
+	if len(board.Entries) != 1 || board.Entries[0].Arrival != "10:10" {
+		t.Errorf("expected the arrival at Sheffield, got %+v", board.Entries)
+	}
+
+	board = getBoard(t, router, "/api/boards/SHF?date=2023-05-21&time=1000&type=departures")
+	if len(board.Entries) != 0 {
+		t.Errorf("expected a terminating train not to appear on a departure board, got %+v", board.Entries)
+	}
+}
+
+func TestGetBoard_Passes(t *testing.T) {
+	db := setupTestDB(t)
+	seedJourney(t, db, "1F20", "C10001", "0930", "0940", "1010")
+	router := buildRouter(&api.Handler{Store: store.New(db, "test")})
+
+	board := getBoard(t, router, "/api/boards/BELPER?date=2023-05-21&time=0900")
+	if len(board.Entries) != 0 {
+		t.Errorf("expected passing trains to be left out by default, got %+v", board.Entries)
+	}
+
+	board = getBoard(t, router, "/api/boards/BELPER?date=2023-05-21&time=0900&include_passes=true")
+	if len(board.Entries) != 1 || !board.Entries[0].IsPass || board.Entries[0].Pass != "09:40" {
+		t.Errorf("expected the pass at Belper, got %+v", board.Entries)
+	}
+}
+
+// seedVSTPStops seeds a Sunday VSTP schedule from Derby to Sheffield that stops at Belper only to reverse, and sets
+// down only at Sheffield.
+func seedVSTPStops(t *testing.T, db *gorm.DB) {
+	t.Helper()
+	seedJourney(t, db, "1F20", "C10001", "0930", "0940", "1010")
+	seedRecord(t, db, "1F30", "V10001", func(sch *schedule.Schedule) {
+		sch.CIFStpIndicator, sch.Source, sch.AtocCode = "N", "VSTP", ""
+		sch.ScheduleLocation = []schedule.ScheduleLocation{
+			{RecordIdentity: "LO", TiplocCode: "DRBY", Departure: "1030", PublicDeparture: "1030", Activity: "TB"},
+			{RecordIdentity: "LI", TiplocCode: "BELPER", Arrival: "1040", Departure: "1045", Activity: "OPRM"},
+			{RecordIdentity: "LT", TiplocCode: "SHEFFLD", Arrival: "1110", PublicArrival: "1110", Activity: "TFD "},
+		}
+	})
+}
+
+func TestGetBoard_OperationalStops(t *testing.T) {
+	db := setupTestDB(t)
+	seedVSTPStops(t, db)
+	router := buildRouter(&api.Handler{Store: store.New(db, "test")})
+
+	board := getBoard(t, router, "/api/boards/BELPER?date=2023-05-21&time=1000")
+	if len(board.Entries) != 0 {
+		t.Errorf("expected a stop that isn't for passengers to be left out by default, got %+v", board.Entries)
+	}
+
+	board = getBoard(t, router, "/api/boards/BELPER?date=2023-05-21&time=1000&include_passes=true")
+	if len(board.Entries) != 1 || !board.Entries[0].OperationalStop || board.Entries[0].IsPass {
+		t.Errorf("expected the operational stop at Belper, got %+v", board.Entries)
+	}
+
+	board = getBoard(t, router, "/api/boards/SHEFFLD?date=2023-05-21&time=1100")
+	if len(board.Entries) != 1 || !board.Entries[0].SetsDown || board.Entries[0].TakesUp {
+		t.Errorf("expected the set down only arrival at Sheffield, got %+v", board.Entries)
+	}
+}
+
+func TestGetSchedules_DecodesActivities(t *testing.T) {
+	db := setupTestDB(t)
+	seedVSTPStops(t, db)
+	router := buildRouter(&api.Handler{Store: store.New(db, "test")})
+
+	resp := getSchedulePage(t, router, "/api/schedules?headcode=1F30&date=2023-05-21")
+	if len(resp.Schedules) != 1 || len(resp.Schedules[0].ScheduleLocation) != 3 {
+		t.Fatalf("expected the VSTP schedule with its 3 locations, got %+v", resp.Schedules)
+	}
+	locations := resp.Schedules[0].ScheduleLocation
+	if !locations[0].TakesUp || locations[0].SetsDown {
+		t.Errorf("expected the origin to take up only, got %+v", locations[0])
+	}
+	belper := locations[1]
+	if !belper.OperationalStop || len(belper.Activities) != 2 || belper.Activities[1].Code != "RM" ||
+		belper.Activities[1].Description != "Reversing movement, or driver changes ends" {
+		t.Errorf("expected the reversal at Belper, got %+v", belper)
+	}
+	if !locations[2].SetsDown || locations[2].TakesUp {
+		t.Errorf("expected the terminus to set down only, got %+v", locations[2])
+	}
+
+	// Trains that don't stop for passengers are left out when passed trains are hidden
+	resp = getSchedulePage(t, router, "/api/schedules?tiploc=BELPER&date=2099-01-04")
+	if len(resp.Schedules) != 2 {
+		t.Errorf("expected both trains at Belper, got %d", len(resp.Schedules))
+	}
+	req := httptest.NewRequest(http.MethodGet, "/api/schedules?tiploc=DRBY&date=2099-01-04&hide_passed=true", nil)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	req = httptest.NewRequest(http.MethodGet, "/api/schedules?tiploc=BELPER&date=2099-01-04&hide_passed=true", nil)
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected no trains stopping for passengers at Belper, got %d; body: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestGetBoard_AfterMidnight(t *testing.T) {
+	db := setupTestDB(t)
+	// Departs late on Sunday and arrives early on Monday
+	seedJourney(t, db, "1F99", "C10099", "2330", "2340", "0015")
+	router := buildRouter(&api.Handler{Store: store.New(db, "test")})
+
+	board := getBoard(t, router, "/api/boards/SHEFFLD?date=2023-05-22&time=0000&window=60")
+	if len(board.Entries) != 1 {
+		t.Fatalf("expected Sunday's train to arrive early on Monday, got %+v", board.Entries)
+	}
+	if board.Entries[0].ScheduleDate != "2023-05-21" {
+		t.Errorf("expected the schedule date to be the day the train started, got %q", board.Entries[0].ScheduleDate)
+	}
+
+	board = getBoard(t, router, "/api/boards/SHEFFLD?date=2023-05-21&time=0000&window=60")
+	if len(board.Entries) != 0 {
+		t.Errorf("expected no arrival in the early hours of Sunday, got %+v", board.Entries)
+	}
+}
+
+func TestGetSchedules_CallTimesAfterMidnight(t *testing.T) {
+	db := setupTestDB(t)
+	// Passes Belper half a minute after midnight, between calls on Sunday and Monday
+	seedJourney(t, db, "1F98", "C10098", "2350", "0000H", "0015")
+	router := buildRouter(&api.Handler{Store: store.New(db, "test")})
+
+	resp := getSchedulePage(t, router, "/api/schedules?headcode=1F98&date=2023-05-21")
+	if len(resp.Schedules) != 1 || len(resp.Schedules[0].ScheduleLocation) != 3 {
+		t.Fatalf("expected one schedule with three locations, got %+v", resp.Schedules)
+	}
+	london := schedule.LondonLocation()
+	locs := resp.Schedules[0].ScheduleLocation
+	for _, tt := range []struct {
+		name string
+		got  int64
+		want time.Time
+	}{
+		{"departure from Derby", locs[0].DepartureTS, time.Date(2023, 5, 21, 23, 50, 0, 0, london)},
+		{"pass at Belper", locs[1].PassTS, time.Date(2023, 5, 22, 0, 0, 30, 0, london)},
+		{"arrival at Sheffield", locs[2].ArrivalTS, time.Date(2023, 5, 22, 0, 15, 0, 0, london)},
+	} {
+		if tt.got != tt.want.Unix() {
+			t.Errorf("expected the %s at %s, got %s", tt.name, tt.want, time.Unix(tt.got, 0).In(london))
+		}
+	}
+	if locs[1].DayOffset != 1 || locs[2].DayOffset != 1 {
+		t.Errorf("expected the calls after midnight to be a day on, got %d and %d", locs[1].DayOffset, locs[2].DayOffset)
+	}
+
+	board := getBoard(t, router, "/api/boards/BELPER?date=2023-05-22&time=0000&window=30&include_passes=true")
+	if len(board.Entries) != 1 || board.Entries[0].Pass != "00:00:30" {
+		t.Errorf("expected Sunday's train to pass Belper early on Monday, got %+v", board.Entries)
+	}
+}
+
+func TestGetBoard_InvalidParameters(t *testing.T) {
+	db := setupTestDB(t)
+	router := buildRouter(&api.Handler{Store: store.New(db, "test")})
+
+	for _, url := range []string{
+		"/api/boards/DRBY?window=0",
+		"/api/boards/DRBY?window=100000",
+		"/api/boards/DRBY?date=2023-05-21&time=25:00",
+		"/api/boards/DRBY?type=sideways",
+	} {
+		req := httptest.NewRequest(http.MethodGet, url, nil)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("expected 400 for %s, got %d", url, rec.Code)
+		}
+	}
+}
+
+func TestGetSchedules_HostileInputIsHarmless(t *testing.T) {
+	db := setupTestDB(t)
+	seedScheduleWithLocation(t, db, "2A20", "C00206", "DRBY")
+	h := &api.Handler{Store: store.New(db, "test")}
+	router := buildRouter(h)
+
+	for _, query := range []string{
+		"headcode=" + url.QueryEscape(`2A20' OR '1'='1`),
+		"headcode=" + url.QueryEscape(`2A20" OR "1"="1`),
+		"toc=" + url.QueryEscape(`GW' OR 1=1 --`),
+		"tiploc=" + url.QueryEscape(`DRBY') OR ('1'='1`),
+		"trainuid=" + url.QueryEscape(`C00206'; DROP TABLE schedules; --`),
+		"category=" + url.QueryEscape(`' OR ''='`),
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/api/schedules?date=2023-05-21&"+query, nil)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("%s: expected 404, got %d; body: %s", query, rec.Code, rec.Body.String())
+		}
+	}
+
+	var count int64
+	if err := db.Model(&schedule.Schedule{}).Count(&count).Error; err != nil || count != 1 {
+		t.Errorf("expected the schedules table to be untouched, got count %d, err %v", count, err)
+	}
+}
+
+func TestGetSchedules_ValueContainingQuote(t *testing.T) {
+	db := setupTestDB(t)
+	seedScheduleWithLocation(t, db, "2A20", "C00206", "ST'PANC")
+	h := &api.Handler{Store: store.New(db, "test")}
+	router := buildRouter(h)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/schedules?date=2023-05-21&tiploc="+url.QueryEscape("ST'PANC"), nil)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected 200 for a TIPLOC containing a quote, got %d; body: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestGetSchedules_CategoryAndPowerTypeFilters(t *testing.T) {
+	db := setupTestDB(t)
+	seedSchedule(t, db, "2A20", "C00206")
+	db.Model(&schedule.Schedule{}).Where("cif_train_uid = ?", "C00206").
+		Updates(map[string]interface{}{"cif_train_category": "OO", "cif_power_type": "DMU"})
+	h := &api.Handler{Store: store.New(db, "test")}
+	router := buildRouter(h)
+
+	cases := []struct {
+		query    string
+		expected int
+	}{
+		{"category=OO", http.StatusOK},
+		{"category=XX", http.StatusNotFound},
+		{"power_type=DMU", http.StatusOK},
+		{"power_type=EMU", http.StatusNotFound},
+		{"category=OO&power_type=DMU&trainuid=C00206", http.StatusOK},
+		{"trainuid=C00207", http.StatusNotFound},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest(http.MethodGet, "/api/schedules?date=2023-05-21&"+c.query, nil)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+
+		if rec.Code != c.expected {
+			t.Errorf("%s: expected %d, got %d", c.query, c.expected, rec.Code)
+		}
+	}
+}
+
+// getSchedulePage requests a page of schedules and decodes the response.
+func getSchedulePage(t *testing.T, router http.Handler, url string) api.ScheduleAPIResponse {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, url, nil)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200 for %s, got %d; body: %s", url, rec.Code, rec.Body.String())
+	}
+	var resp api.ScheduleAPIResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	return resp
+}
+
+func TestGetSchedules_CursorPagination(t *testing.T) {
+	db := setupTestDB(t)
+	for _, uid := range []string{"C00205", "C00201", "C00204", "C00203", "C00202"} {
+		seedScheduleWithLocation(t, db, "2A20", uid, "DRBY")
+	}
+	h := &api.Handler{Store: store.New(db, "test")}
+	router := buildRouter(h)
+
+	var uids []string
+	cursor := ""
+	for pages := 0; ; pages++ {
+		if pages > 3 {
+			t.Fatal("expected pagination to finish within 3 pages")
+		}
+		resp := getSchedulePage(t, router, "/api/schedules?tiploc=DRBY&date=2023-05-21&limit=2&cursor="+cursor)
+		if len(resp.Schedules) > 2 {
+			t.Fatalf("expected at most 2 schedules per page, got %d", len(resp.Schedules))
+		}
+		for _, sch := range resp.Schedules {
+			uids = append(uids, sch.CIFTrainUID)
+		}
+		if resp.NextCursor == "" {
+			break
+		}
+		cursor = resp.NextCursor
+
+		// Removing a schedule already returned mustn't disturb the following pages
+		if pages == 0 {
+			db.Where("cif_train_uid = ?", "C00201").Delete(&schedule.Schedule{})
+		}
+	}
+
+	expected := []string{"C00201", "C00202", "C00203", "C00204", "C00205"}
+	if len(uids) != len(expected) {
+		t.Fatalf("expected %v across all pages, got %v", expected, uids)
+	}
+	for i := range expected {
+		if uids[i] != expected[i] {
+			t.Errorf("expected %v across all pages, got %v", expected, uids)
+			break
+		}
+	}
+}
+
+func TestGetSchedules_DefaultLimit(t *testing.T) {
+	db := setupTestDB(t)
+	for i := 0; i < 150; i++ {
+		seedSchedule(t, db, "2A20", fmt.Sprintf("C%05d", i))
+	}
+	h := &api.Handler{Store: store.New(db, "test")}
+	router := buildRouter(h)
+
+	// Without a limit only the first page is returned, with a cursor for the rest
+	resp := getSchedulePage(t, router, "/api/schedules?headcode=2A20&date=2023-05-21")
+	if len(resp.Schedules) != 100 || resp.NextCursor == "" {
+		t.Fatalf("expected a page of 100 schedules with a next cursor, got %d", len(resp.Schedules))
+	}
+	resp = getSchedulePage(t, router, "/api/schedules?headcode=2A20&date=2023-05-21&cursor="+resp.NextCursor)
+	if len(resp.Schedules) != 50 || resp.NextCursor != "" {
+		t.Errorf("expected the last 50 schedules after the cursor, got %d with next cursor %q", len(resp.Schedules), resp.NextCursor)
+	}
+
+	resp = getSchedulePage(t, router, "/api/schedules?headcode=2A20&date=2023-05-21&limit=1000")
+	if len(resp.Schedules) != 150 || resp.NextCursor != "" {
+		t.Errorf("expected all 150 schedules on one page, got %d with next cursor %q", len(resp.Schedules), resp.NextCursor)
+	}
+}
+
+func TestGetSchedules_InvalidPaginationParameters(t *testing.T) {
+	db := setupTestDB(t)
+	seedSchedule(t, db, "2A20", "C00206")
+	h := &api.Handler{Store: store.New(db, "test")}
+	router := buildRouter(h)
+
+	// The last cursor has no run date
+	for _, query := range []string{"limit=0", "limit=abc", "limit=100000", "cursor=not-a-cursor!", "cursor=MTY4NDY1MjQwMDpDMDAyMDY", "fields=no_such_field"} {
+		req := httptest.NewRequest(http.MethodGet, "/api/schedules?headcode=2A20&date=2023-05-21&"+query, nil)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", query, rec.Code)
+		}
+	}
+}
+
+func TestGetSchedules_WithoutLocations(t *testing.T) {
+	db := setupTestDB(t)
+	seedScheduleWithLocation(t, db, "2A20", "C00206", "DRBY")
+	h := &api.Handler{Store: store.New(db, "test")}
+	router := buildRouter(h)
+
+	resp := getSchedulePage(t, router, "/api/schedules?headcode=2A20&date=2023-05-21&include_locations=false")
+	if len(resp.Schedules) != 1 {
+		t.Fatalf("expected 1 schedule, got %d", len(resp.Schedules))
+	}
+	if len(resp.Schedules[0].ScheduleLocation) != 0 {
+		t.Errorf("expected locations to be left out, got %d", len(resp.Schedules[0].ScheduleLocation))
+	}
+	if resp.Schedules[0].TimeOfDepartureFromOrigin != "09:30" {
+		t.Errorf("expected derived fields to still be returned, got departure %q", resp.Schedules[0].TimeOfDepartureFromOrigin)
+	}
+}
+
+func TestGetSchedules_SelectedFields(t *testing.T) {
+	db := setupTestDB(t)
+	seedScheduleWithLocation(t, db, "2A20", "C00206", "DRBY")
+	h := &api.Handler{Store: store.New(db, "test")}
+	router := buildRouter(h)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/schedules?headcode=2A20&date=2023-05-21&fields=CIF_train_uid,signalling_id", nil)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d; body: %s", rec.Code, rec.Body.String())
+	}
+	var resp struct {
+		Headcode  string                   `json:"headcode"`
+		Schedules []map[string]interface{} `json:"schedules"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if resp.Headcode != "2A20" {
+		t.Errorf("expected the envelope to be unchanged, got headcode %q", resp.Headcode)
+	}
+	if len(resp.Schedules) != 1 {
+		t.Fatalf("expected 1 schedule, got %d", len(resp.Schedules))
+	}
+	if len(resp.Schedules[0]) != 2 || resp.Schedules[0]["CIF_train_uid"] != "C00206" || resp.Schedules[0]["signalling_id"] != "2A20" {
+		t.Errorf("expected only CIF_train_uid and signalling_id, got %v", resp.Schedules[0])
+	}
+}
+
+// seedClaphamJunction inserts the TIPLOCs of Clapham Junction, which share CRS code CLJ, and of Clapham High Street.
+func seedClaphamJunction(t *testing.T, db *gorm.DB) {
+	t.Helper()
+	for _, tiploc := range []schedule.Tiploc{
+		{TiplocCode: "CLPHMJN", CrsCode: "CLJ", Stanox: "87219", Description: "CLAPHAM JUNCTION", TpsDescription: "CLAPHAM JUNCTION"},
+		{TiplocCode: "CLPHMJC", CrsCode: "CLJ", Stanox: "87221", Description: "CLAPHAM JN (CENTRAL LINES)", TpsDescription: "CLAPHAM JUNCTION CENTRAL SIDE"},
+		{TiplocCode: "CLPHMHS", CrsCode: "CLP", Stanox: "87730", Description: "CLAPHAM HIGH STREET", TpsDescription: "CLAPHAM HIGH STREET"},
+		{TiplocCode: "BATRSPK", CrsCode: "BAK", Stanox: "87217", Description: "BATTERSEA PARK", TpsDescription: "BATTERSEA PARK"},
+	} {
+		if err := db.Create(&tiploc).Error; err != nil {
+			t.Fatal("failed to seed tiploc:", err)
+		}
+	}
+}
+
+// searchLocations requests a location search and returns the TIPLOCs found, in order.
+func searchLocations(t *testing.T, router http.Handler, query string) []string {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "/api/locations?"+query, nil)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200 for %s, got %d; body: %s", query, rec.Code, rec.Body.String())
+	}
+	var resp api.LocationAPIResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	var tiplocs []string
+	for _, loc := range resp.Locations {
+		tiplocs = append(tiplocs, loc.TiplocCode)
+	}
+	return tiplocs
+}
+
+func TestGetLocations_Search(t *testing.T) {
+	db := setupTestDB(t)
+	seedClaphamJunction(t, db)
+	router := buildRouter(&api.Handler{Store: store.New(db, "test")})
+
+	cases := []struct {
+		query    string
+		expected []string
+	}{
+		{"code=CLJ", []string{"CLPHMJC", "CLPHMJN"}},
+		{"code=87219", []string{"CLPHMJN"}},
+		{"code=clphmhs", []string{"CLPHMHS"}},
+		{"name=clapham%20j", []string{"CLPHMJN", "CLPHMJC"}},
+		{"name=clapham", []string{"CLPHMHS", "CLPHMJN", "CLPHMJC"}},
+		{"name=park", []string{"BATRSPK"}},
+		{"name=high%20clapham", []string{"CLPHMHS"}},
+		{"name=clapam%20junction", []string{"CLPHMJN", "CLPHMJC"}},
+		{"name=batersea", []string{"BATRSPK"}},
+		{"name=vlapham%20junction", []string{"CLPHMJN", "CLPHMJC"}},
+		{"name=ba", []string{"BATRSPK"}},
+		{"name=xy", nil},
+		{"name=%25", nil},
+		{"q=BAK", []string{"BATRSPK"}},
+		{"q=clapham&limit=1", []string{"CLPHMHS"}},
+	}
+	for _, c := range cases {
+		tiplocs := searchLocations(t, router, c.query)
+		if fmt.Sprint(tiplocs) != fmt.Sprint(c.expected) {
+			t.Errorf("%s: expected %v, got %v", c.query, c.expected, tiplocs)
+		}
+	}
+}
+
+func TestGetLocations_InvalidParameters(t *testing.T) {
+	db := setupTestDB(t)
+	router := buildRouter(&api.Handler{Store: store.New(db, "test")})
+
+	for _, query := range []string{"", "name=", "q=CLJ&limit=0", "q=CLJ&limit=1000"} {
+		req := httptest.NewRequest(http.MethodGet, "/api/locations?"+query, nil)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%q: expected 400, got %d", query, rec.Code)
+		}
+	}
+}
+
+func TestGetSchedules_ByCRS(t *testing.T) {
+	db := setupTestDB(t)
+	seedClaphamJunction(t, db)
+	seedScheduleWithLocation(t, db, "2A20", "C00206", "CLPHMJC")
+	seedScheduleWithLocation(t, db, "2A21", "C00207", "CLPHMJN")
+	seedScheduleWithLocation(t, db, "2A22", "C00208", "CLPHMHS")
+	router := buildRouter(&api.Handler{Store: store.New(db, "test")})
+
+	resp := getSchedulePage(t, router, "/api/schedules?tiploc=CLJ&date=2023-05-21")
+	if len(resp.Schedules) != 2 {
+		t.Fatalf("expected CLJ to cover both Clapham Junction TIPLOCs, got %d schedules", len(resp.Schedules))
+	}
+	for _, sch := range resp.Schedules {
+		if sch.CIFTrainUID == "C00208" {
+			t.Error("expected a train at Clapham High Street not to be returned for CLJ")
+		}
+	}
+}
+
+func TestGetSchedules_CodeThatIsBothTiplocAndCRS(t *testing.T) {
+	db := setupTestDB(t)
+	seedClaphamJunction(t, db)
+	if err := db.Create(&schedule.Tiploc{TiplocCode: "CLJ", TpsDescription: "CLJ SIDINGS"}).Error; err != nil {
+		t.Fatal("failed to seed tiploc:", err)
+	}
+	seedScheduleWithLocation(t, db, "2A20", "C00206", "CLPHMJC")
+	seedScheduleWithLocation(t, db, "2A21", "C00207", "CLPHMJN")
+	seedScheduleWithLocation(t, db, "5Z99", "C00209", "CLJ")
+	router := buildRouter(&api.Handler{Store: store.New(db, "test")})
+
+	resp := getSchedulePage(t, router, "/api/schedules?tiploc=CLJ&date=2023-05-21")
+	if len(resp.Schedules) != 1 || resp.Schedules[0].CIFTrainUID != "C00209" {
+		t.Errorf("expected tiploc=CLJ to be the TIPLOC, got %d schedules", len(resp.Schedules))
+	}
+	resp = getSchedulePage(t, router, "/api/schedules?crs=CLJ&date=2023-05-21")
+	if len(resp.Schedules) != 2 || resp.CRS != "CLJ" {
+		t.Errorf("expected crs=CLJ to cover both Clapham Junction TIPLOCs, got %d schedules", len(resp.Schedules))
+	}
+
+	for url, want := range map[string]int{
+		"/api/schedules?tiploc=CLJ&crs=CLJ&date=2023-05-21": http.StatusBadRequest,
+		"/api/schedules?crs=XYZ&date=2023-05-21":            http.StatusNotFound,
+		"/api/boards/CLJ?date=2023-05-21&time=0900":         http.StatusBadRequest,
+		"/api/journeys?from=CLJ&to=CLPHMHS&date=2023-05-21": http.StatusBadRequest,
+		"/api/boards/CLPHMJN?date=2023-05-21&time=0900":     http.StatusOK,
+	} {
+		req := httptest.NewRequest(http.MethodGet, url, nil)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+
+		if rec.Code != want {
+			t.Errorf("%s: expected %d, got %d", url, want, rec.Code)
+		}
+	}
+}
+
+// seedService inserts a train running on Sundays making the given stops, each "TIPLOC arrival departure" with "-" for
+// no public time, along with TIPLOCs for the stops.
+func seedService(t *testing.T, db *gorm.DB, signallingID, trainUID string, stops ...string) {
+	t.Helper()
+	var locations []schedule.ScheduleLocation
+	crs := map[string]string{"DRBY": "DBY", "BELPER": "BLP", "SHEFFLD": "SHF", "LEEDS": "LDS", "CHFD": "CHD", "CHFDBAY": "CHD"}
+	for idx, stop := range stops {
+		var tiploc string
+		var arrival, departure schedule.WTTTime
+		fmt.Sscan(stop, &tiploc, &arrival, &departure)
+		loc := schedule.ScheduleLocation{RecordIdentity: "LI", TiplocCode: tiploc}
+		if arrival != "-" {
+			loc.Arrival, loc.PublicArrival = arrival, arrival
+		}
+		if departure != "-" {
+			loc.Departure, loc.PublicDeparture = departure, departure
+		}
+		if idx == 0 {
+			loc.RecordIdentity = "LO"
+		} else if idx == len(stops)-1 {
+			loc.RecordIdentity = "LT"
+		}
+		locations = append(locations, loc)
+
+		db.Where("tiploc_code = ?", tiploc).FirstOrCreate(&schedule.Tiploc{TiplocCode: tiploc, CrsCode: crs[tiploc], TpsDescription: tiploc})
+	}
+	seedRecord(t, db, signallingID, trainUID, func(sch *schedule.Schedule) {
+		sch.AtocCode, sch.ScheduleLocation = "EM", locations
+	})
+}
+
+// getJourneys requests a journey search and decodes the response.
+func getJourneys(t *testing.T, router http.Handler, url string) store.JourneyPlan {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, url, nil)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200 for %s, got %d; body: %s", url, rec.Code, rec.Body.String())
+	}
+	var plan store.JourneyPlan
+	if err := json.NewDecoder(rec.Body).Decode(&plan); err != nil {
+		t.Fatalf("failed to decode journeys: %v", err)
+	}
+	return plan
+}
+
+func TestGetJourneys_Direct(t *testing.T) {
+	db := setupTestDB(t)
+	seedService(t, db, "1F20", "C10001", "DRBY - 0930", "BELPER 0940 0941", "SHEFFLD 1010 -")
+	// Sets down only at Derby, so can't be joined there
+	seedService(t, db, "1F21", "C10002", "LEEDS - 0800", "DRBY 0935 -", "SHEFFLD 1015 -")
+	router := buildRouter(&api.Handler{Store: store.New(db, "test")})
+
+	plan := getJourneys(t, router, "/api/journeys?from=DRBY&to=SHF&date=2023-05-21&time=0900&window=60")
+	if len(plan.Journeys) != 1 {
+		t.Fatalf("expected 1 journey, got %+v", plan.Journeys)
+	}
+	journey := plan.Journeys[0]
+	if journey.Changes != 0 || len(journey.Legs) != 1 || journey.Legs[0].CIFTrainUID != "C10001" {
+		t.Fatalf("expected a direct journey on C10001, got %+v", journey)
+	}
+	leg := journey.Legs[0]
+	if leg.From != "DRBY" || leg.Departure != "09:30" || leg.To != "SHEFFLD" || leg.Arrival != "10:10" {
+		t.Errorf("unexpected leg %+v", leg)
+	}
+	if journey.ArrivalTS-journey.DepartureTS != 40*60 {
+		t.Errorf("expected a 40 minute journey, got %d seconds", journey.ArrivalTS-journey.DepartureTS)
+	}
+
+	// Trains only run one way
+	plan = getJourneys(t, router, "/api/journeys?from=SHF&to=DRBY&date=2023-05-21&time=0900&window=180")
+	if len(plan.Journeys) != 0 {
+		t.Errorf("expected no journeys in the opposite direction, got %+v", plan.Journeys)
+	}
+
+	// Outside the window
+	plan = getJourneys(t, router, "/api/journeys?from=DRBY&to=SHF&date=2023-05-21&time=0931&window=60")
+	if len(plan.Journeys) != 0 {
+		t.Errorf("expected no journeys leaving after 09:31, got %+v", plan.Journeys)
+	}
+}
+
+func TestGetJourneys_WithChange(t *testing.T) {
+	db := setupTestDB(t)
+	seedService(t, db, "1F20", "C10001", "DRBY - 1000", "CHFD 1020 -")
+	// Leaves from the bay platform TIPLOC of the same station
+	seedService(t, db, "1L30", "C10002", "CHFDBAY - 1030", "SHEFFLD 1042 1044", "LEEDS 1130 -")
+	router := buildRouter(&api.Handler{Store: store.New(db, "test")})
+
+	plan := getJourneys(t, router, "/api/journeys?from=DRBY&to=LEEDS&date=2023-05-21&time=0930&changes=true&min_connection=5")
+	if len(plan.Journeys) != 1 {
+		t.Fatalf("expected 1 journey, got %+v", plan.Journeys)
+	}
+	journey := plan.Journeys[0]
+	if journey.Changes != 1 || len(journey.Legs) != 2 {
+		t.Fatalf("expected a journey with one change, got %+v", journey)
+	}
+	if journey.Legs[0].To != "CHFD" || journey.Legs[1].From != "CHFDBAY" || journey.Legs[1].Arrival != "11:30" {
+		t.Errorf("expected a change at Chesterfield, got %+v", journey.Legs)
+	}
+
+	plan = getJourneys(t, router, "/api/journeys?from=DRBY&to=LEEDS&date=2023-05-21&time=0930&changes=true&min_connection=15")
+	if len(plan.Journeys) != 0 {
+		t.Errorf("expected no journeys when the connection is too short, got %+v", plan.Journeys)
+	}
+
+	plan = getJourneys(t, router, "/api/journeys?from=DRBY&to=LEEDS&date=2023-05-21&time=0930")
+	if len(plan.Journeys) != 0 {
+		t.Errorf("expected no journeys with a change unless changes=true, got %+v", plan.Journeys)
+	}
+
+	// A direct train leaving later and arriving sooner is better than changing
+	seedService(t, db, "1L31", "C10003", "DRBY - 1005", "LEEDS 1120 -")
+	plan = getJourneys(t, router, "/api/journeys?from=DRBY&to=LEEDS&date=2023-05-21&time=0930&changes=true&min_connection=5")
+	if len(plan.Journeys) != 1 || plan.Journeys[0].Changes != 0 {
+		t.Errorf("expected only the direct journey, got %+v", plan.Journeys)
+	}
+}
+
+func TestGetJourneys_AfterMidnight(t *testing.T) {
+	db := setupTestDB(t)
+	// Runs on Sundays, reaching Derby early on Monday
+	seedService(t, db, "1F99", "C10009", "LEEDS - 2340", "DRBY 0008 0010", "SHEFFLD 0050 -")
+	router := buildRouter(&api.Handler{Store: store.New(db, "test")})
+
+	plan := getJourneys(t, router, "/api/journeys?from=DRBY&to=SHF&date=2023-05-22&time=0000&window=60")
+	if len(plan.Journeys) != 1 {
+		t.Fatalf("expected the Sunday night train, got %+v", plan.Journeys)
+	}
+	leg := plan.Journeys[0].Legs[0]
+	if leg.ScheduleDate != "2023-05-21" {
+		t.Errorf("expected schedule date 2023-05-21, got %s", leg.ScheduleDate)
+	}
+	departure := time.Unix(leg.DepartureTS, 0).In(store.LondonLocation()).Format("2006-01-02 15:04")
+	if departure != "2023-05-22 00:10" {
+		t.Errorf("expected departure at 2023-05-22 00:10, got %s", departure)
+	}
+}
+
+func TestGetJourneys_InvalidParameters(t *testing.T) {
+	db := setupTestDB(t)
+	router := buildRouter(&api.Handler{Store: store.New(db, "test")})
+
+	for _, query := range []string{"from=DRBY", "to=SHF", "from=DRBY&to=SHF&time=9am", "from=DRBY&to=SHF&window=0",
+		"from=DRBY&to=SHF&min_connection=-1", "from=DRBY&to=SHF&min_connection=abc"} {
+		req := httptest.NewRequest(http.MethodGet, "/api/journeys?"+query, nil)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", query, rec.Code)
+		}
+	}
+}
+
+func TestGetGTFS(t *testing.T) {
+	db := setupTestDB(t)
+	seedService(t, db, "1F20", "C10001", "DRBY - 0930", "SHEFFLD 1010 -")
+	router := buildRouter(&api.Handler{Store: store.New(db, "test")})
+
+	req := httptest.NewRequest(http.MethodGet, "/api/gtfs?from=2023-05-21&days=7", nil)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d; body: %s", rec.Code, rec.Body.String())
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/zip" {
+		t.Errorf("expected a zip, got content type %q", ct)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(rec.Body.Bytes()), int64(rec.Body.Len()))
+	if err != nil {
+		t.Fatalf("expected a valid zip, got %v", err)
+	}
+	if len(zr.File) != 7 {
+		t.Errorf("expected the 7 GTFS files, got %d", len(zr.File))
+	}
+
+	for _, query := range []string{"from=21-05-2023", "days=0", "days=365"} {
+		req := httptest.NewRequest(http.MethodGet, "/api/gtfs?"+query, nil)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", query, rec.Code)
+		}
+	}
+
+	// A failed export is reported as an error rather than as a broken download
+	if err := db.Migrator().DropTable(&schedule.ScheduleLocation{}); err != nil {
+		t.Fatal(err)
+	}
+	req = httptest.NewRequest(http.MethodGet, "/api/gtfs?from=2023-05-21&days=7", nil)
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("expected 500 when the export fails, got %d", rec.Code)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct == "application/zip" || rec.Header().Get("Content-Disposition") != "" {
+		t.Errorf("expected no zip headers on a failed export, got %v", rec.Header())
+	}
+}
+
+func TestGetSchedules_BankHolidayRunning(t *testing.T) {
+	db := setupTestDB(t)
+	for _, train := range []struct{ signallingID, trainUID, bankHolidayRunning string }{
+		{"2B10", "C20010", "X"},
+		{"2B11", "C20011", "G"},
+		{"2B12", "C20012", ""},
+	} {
+		seedRecord(t, db, train.signallingID, train.trainUID, func(sch *schedule.Schedule) {
+			sch.ScheduleDaysRuns, sch.CIFBankHolidayRunning = "1111111", train.bankHolidayRunning
+		})
+	}
+	router := buildRouter(&api.Handler{Store: store.New(db, "test")})
+
+	runs := func(date string) []string {
+		var headcodes []string
+		for _, sch := range getSchedulePage(t, router, "/api/schedules?date="+date).Schedules {
+			headcodes = append(headcodes, sch.SignallingID)
+		}
+		sort.Strings(headcodes)
+		return headcodes
+	}
+	for date, want := range map[string][]string{
+		// The spring bank holiday, the Glasgow Fair Monday, and an ordinary Monday
+		"2023-05-29": {"2B11", "2B12"},
+		"2023-07-17": {"2B10", "2B12"},
+		"2023-07-24": {"2B10", "2B11", "2B12"},
+	} {
+		if got := runs(date); strings.Join(got, ",") != strings.Join(want, ",") {
+			t.Errorf("expected %v to run on %s, got %v", want, date, got)
+		}
+	}
+}
+
+func TestGetCalendar(t *testing.T) {
+	router := buildRouter(&api.Handler{Store: store.New(setupTestDB(t), "test")})
+
+	req := httptest.NewRequest(http.MethodGet, "/api/calendar?division=scotland&from=2023-11-01&to=2023-12-31", nil)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d; body: %s", rec.Code, rec.Body.String())
+	}
+	var resp api.CalendarAPIResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if len(resp.Divisions) != 1 || resp.Divisions[0].Division != "scotland" || len(resp.Divisions[0].Events) != 3 {
+		t.Fatalf("expected St Andrew's Day, Christmas and Boxing Day in Scotland, got %+v", resp.Divisions)
+	}
+	if resp.Divisions[0].Events[0].Title != "St Andrew’s Day" || resp.BankHolidayDivision != "england-and-wales" {
+		t.Errorf("unexpected calendar %+v", resp)
+	}
+
+	for _, query := range []string{"division=wales", "from=2023-13-01", "from=2023-12-01&to=2023-11-01"} {
+		req := httptest.NewRequest(http.MethodGet, "/api/calendar?"+query, nil)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", query, rec.Code)
+		}
+	}
+}
+
+// seedSundayOverlay inserts an overlay changing the operator of trainUID on Sunday 2023-06-04.
+func seedSundayOverlay(t *testing.T, db *gorm.DB, signallingID, trainUID string) {
+	t.Helper()
+	seedRecord(t, db, signallingID, trainUID, func(sch *schedule.Schedule) {
+		sch.CIFStpIndicator, sch.AtocCode = "O", "XC"
+		sch.ScheduleStartDate, sch.ScheduleEndDate = "2023-06-04", "2023-06-04"
+	})
+}
+
+func TestGetSchedules_DateRange(t *testing.T) {
+	db := setupTestDB(t)
+	seedSchedule(t, db, "2A20", "C00206")
+	seedSTPRecord(t, db, "C", "", "C00206")
+	seedSundayOverlay(t, db, "2A20", "C00206")
+	router := buildRouter(&api.Handler{Store: store.New(db, "test")})
+
+	resp := getSchedulePage(t, router, "/api/schedules?headcode=2A20&from=2023-05-21&to=2023-06-10&include_cancelled=true")
+	if resp.Date != "2023-05-21" || resp.To != "2023-06-10" {
+		t.Errorf("expected the range in the response, got %q to %q", resp.Date, resp.To)
+	}
+	if len(resp.Schedules) != 3 {
+		t.Fatalf("expected the train on each of the three Sundays, got %d", len(resp.Schedules))
+	}
+	for i, want := range []struct {
+		runDate   string
+		cancelled bool
+		toc       string
+	}{
+		{"2023-05-21", true, "GW"},
+		{"2023-05-28", false, "GW"},
+		{"2023-06-04", false, "XC"},
+	} {
+		sch := resp.Schedules[i]
+		if sch.RunDate != want.runDate || sch.Cancelled != want.cancelled || sch.AtocCode != want.toc {
+			t.Errorf("expected %+v, got run date %s, cancelled %v and operator %s", want, sch.RunDate, sch.Cancelled, sch.AtocCode)
+		}
+	}
+
+	// Every day is on its own page
+	var runDates []string
+	url := "/api/schedules?headcode=2A20&from=2023-05-21&to=2023-06-10&include_cancelled=true&limit=1"
+	for page := getSchedulePage(t, router, url); ; page = getSchedulePage(t, router, url+"&cursor="+page.NextCursor) {
+		for _, sch := range page.Schedules {
+			runDates = append(runDates, sch.RunDate)
+		}
+		if page.NextCursor == "" || len(runDates) > 3 {
+			break
+		}
+	}
+	if strings.Join(runDates, ",") != "2023-05-21,2023-05-28,2023-06-04" {
+		t.Errorf("expected a page for each date, got %v", runDates)
+	}
+
+	for _, query := range []string{"from=2023-05-21&to=2023-05-20", "from=2023-05-01&to=2023-06-01", "from=2023-05-21&to=tomorrow"} {
+		req := httptest.NewRequest(http.MethodGet, "/api/schedules?headcode=2A20&"+query, nil)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", query, rec.Code)
+		}
+	}
+}
+
+func getRunningCalendar(t *testing.T, router http.Handler, url string) store.RunningCalendar {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, url, nil)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200 for %s, got %d; body: %s", url, rec.Code, rec.Body.String())
+	}
+	var cal store.RunningCalendar
+	if err := json.NewDecoder(rec.Body).Decode(&cal); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	return cal
+}
+
+func TestGetRunningCalendar(t *testing.T) {
+	db := setupTestDB(t)
+	seedSchedule(t, db, "2A20", "C00206")
+	seedSTPRecord(t, db, "C", "", "C00206")
+	seedSundayOverlay(t, db, "2A20", "C00206")
+	router := buildRouter(&api.Handler{Store: store.New(db, "test")})
+
+	cal := getRunningCalendar(t, router, "/api/trains/C00206/calendar?from=2023-05-21&to=2023-06-04")
+	if cal.Summary != "C------R------R" {
+		t.Errorf("expected the train to be cancelled, then run on the following Sundays, got %q", cal.Summary)
+	}
+	if len(cal.Days) != 15 || len(cal.Records) != 3 {
+		t.Fatalf("expected 15 days governed by 3 records, got %d and %d", len(cal.Days), len(cal.Records))
+	}
+	for i, want := range []string{"C", "P", "O"} {
+		if cal.Records[i].CIFStpIndicator != want {
+			t.Errorf("expected record %d to be %s, got %+v", i, want, cal.Records[i])
+		}
+	}
+	if cal.Days[0].Record != cal.Records[0].ID || cal.Days[7].Record != cal.Records[1].ID || cal.Days[14].Record != cal.Records[2].ID {
+		t.Errorf("expected each Sunday to refer to the record governing it, got %+v", cal.Days)
+	}
+	if cal.Days[1].Record != 0 || cal.Days[1].Runs {
+		t.Errorf("expected no record on the Monday, got %+v", cal.Days[1])
+	}
+
+	seedRecord(t, db, "2B10", "C20010", func(sch *schedule.Schedule) {
+		sch.ScheduleDaysRuns, sch.CIFBankHolidayRunning = "1111111", "X"
+	})
+	cal = getRunningCalendar(t, router, "/api/trains/C20010/calendar?from=2023-05-28&to=2023-05-30")
+	if cal.Summary != "RBR" || cal.Days[1].BankHoliday != "Spring bank holiday" {
+		t.Errorf("expected the train not to run on the spring bank holiday, got %+v", cal)
+	}
+
+	for query, want := range map[string]int{
+		"C99999/calendar?from=2023-05-21":               http.StatusNotFound,
+		"C00206/calendar?from=2023-05-21&to=2024-06-01": http.StatusBadRequest,
+		"C00206/calendar?from=21-05-2023":               http.StatusBadRequest,
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/api/trains/"+query, nil)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		if rec.Code != want {
+			t.Errorf("%s: expected %d, got %d", query, want, rec.Code)
+		}
+	}
+}
@@ -106,17 +106,16 @@ func (h *WebHandler) Search(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	tocFilter := toc
-	if tocFilter == "" {
-		tocFilter = "any"
-	}
-	/// THIS NEEDS TO BE TIPLOC FILTER!!!!
-	tiplocFilter := tiploc
-	if tiplocFilter == "" {
-		tiplocFilter = "any"
-	}
-
-	schedules, err := h.Store.GetSchedules(headcode, date, tocFilter, tiplocFilter, hidePassedTrains)
+	// The web UI always shows cancelled trains, flagged as such, so users aren't left wondering where they went
+	schedules, err := h.Store.GetSchedules(store.ScheduleQuery{
+		Headcode:         headcode,
+		TrainUID:         trainUID,
+		TOC:              toc,
+		Tiploc:           tiploc,
+		Date:             date,
+		HidePassed:       hidePassedTrains,
+		IncludeCancelled: true,
+	})
 
 	if isHtmx {
 		data := map[string]interface{}{
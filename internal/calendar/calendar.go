@@ -0,0 +1,173 @@
+// Package calendar holds the bank holidays that decide whether trains marked not to run on bank holidays run on a
+// date. The holidays are bundled in the format of https://www.gov.uk/bank-holidays.json, with Glasgow's local
+// holidays as a division of their own, and can be corrected by a file of overrides in the same format.
+package calendar
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+// The divisions of the calendar. CIF_bank_holiday_running X is for bank holiday Mondays, in the division set by
+// Calendar.BankHolidayDivision, and G is for Glasgow bank holidays.
+const (
+	EnglandAndWales = "england-and-wales"
+	Scotland        = "scotland"
+	Glasgow         = "glasgow"
+)
+
+//go:embed bank-holidays.json
+var bundled []byte
+
+// Holiday is one bank holiday in a division.
+type Holiday struct {
+	Title string `json:"title"`
+	Date  string `json:"date"`
+	Notes string `json:"notes,omitempty"`
+	// Removed, in a file of overrides, takes a bundled holiday out of the calendar, such as one that's been moved
+	Removed bool `json:"removed,omitempty"`
+}
+
+// Division is the bank holidays of one part of the country.
+type Division struct {
+	Division string    `json:"division"`
+	Events   []Holiday `json:"events"`
+}
+
+// Calendar is the bank holidays of each division, by date.
+type Calendar struct {
+	// BankHolidayDivision is the division whose bank holiday Mondays trains with CIF_bank_holiday_running X don't run on
+	BankHolidayDivision string
+
+	holidays map[string]map[string]Holiday
+}
+
+// Default returns the bundled calendar.
+func Default() *Calendar {
+	c := &Calendar{BankHolidayDivision: EnglandAndWales, holidays: make(map[string]map[string]Holiday)}
+	if err := c.merge(bundled); err != nil {
+		panic(fmt.Sprintf("failed to read the bundled bank holidays: %v", err))
+	}
+	return c
+}
+
+// Load returns the bundled calendar with the overrides in filename applied. A holiday in the overrides replaces the
+// bundled one on the same date, or removes it if it's marked as removed, and a division that isn't bundled is added.
+func Load(filename string) (*Calendar, error) {
+	c := Default()
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read bank holidays from %s: %w", filename, err)
+	}
+	if err := c.merge(data); err != nil {
+		return nil, fmt.Errorf("failed to read bank holidays from %s: %w", filename, err)
+	}
+	return c, nil
+}
+
+func (c *Calendar) merge(data []byte) error {
+	var divisions map[string]Division
+	if err := json.Unmarshal(data, &divisions); err != nil {
+		return err
+	}
+	for name, division := range divisions {
+		if division.Division != "" {
+			name = division.Division
+		}
+		if c.holidays[name] == nil {
+			c.holidays[name] = make(map[string]Holiday)
+		}
+		for _, holiday := range division.Events {
+			if _, err := time.Parse("2006-01-02", holiday.Date); err != nil {
+				return fmt.Errorf("invalid date %q for %s in %s", holiday.Date, holiday.Title, name)
+			}
+			if holiday.Removed {
+				delete(c.holidays[name], holiday.Date)
+				continue
+			}
+			c.holidays[name][holiday.Date] = holiday
+		}
+	}
+	return nil
+}
+
+// Divisions returns the names of the divisions in the calendar, in alphabetical order.
+func (c *Calendar) Divisions() []string {
+	if c == nil {
+		return nil
+	}
+	var names []string
+	for name := range c.holidays {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// HasDivision reports whether the calendar has a division.
+func (c *Calendar) HasDivision(division string) bool {
+	if c == nil {
+		return false
+	}
+	_, ok := c.holidays[division]
+	return ok
+}
+
+// Holiday returns the bank holiday in a division on date, or false if it isn't one.
+func (c *Calendar) Holiday(division string, date time.Time) (Holiday, bool) {
+	if c == nil {
+		return Holiday{}, false
+	}
+	holiday, ok := c.holidays[division][date.Format("2006-01-02")]
+	return holiday, ok
+}
+
+// Holidays returns the bank holidays in a division from one date to another, inclusive, in date order.
+func (c *Calendar) Holidays(division string, from, to time.Time) []Holiday {
+	holidays := []Holiday{}
+	if c == nil {
+		return holidays
+	}
+	first, last := from.Format("2006-01-02"), to.Format("2006-01-02")
+	for date, holiday := range c.holidays[division] {
+		if date >= first && date <= last {
+			holidays = append(holidays, holiday)
+		}
+	}
+	sort.Slice(holidays, func(i, j int) bool { return holidays[i].Date < holidays[j].Date })
+	return holidays
+}
+
+// Runs reports whether a train with the given CIF_bank_holiday_running runs on date, as far as bank holidays go: X
+// doesn't run on bank holiday Mondays and G doesn't run on Glasgow bank holidays. A nil calendar has no bank holidays.
+func (c *Calendar) Runs(bankHolidayRunning string, date time.Time) bool {
+	_, excluded := c.Excludes(bankHolidayRunning, date)
+	return !excluded
+}
+
+// Excludes returns the bank holiday on date that a train with the given CIF_bank_holiday_running doesn't run on, or
+// false if it runs. The CIF defines X as not running on bank holiday Mondays, so trains marked X still run on Good
+// Friday, Christmas Day and the other bank holidays that can fall on another day of the week.
+func (c *Calendar) Excludes(bankHolidayRunning string, date time.Time) (Holiday, bool) {
+	switch bankHolidayRunning {
+	case "X":
+		if date.Weekday() != time.Monday {
+			return Holiday{}, false
+		}
+		return c.Holiday(c.bankHolidayDivision(), date)
+	case "G":
+		return c.Holiday(Glasgow, date)
+	}
+	return Holiday{}, false
+}
+
+func (c *Calendar) bankHolidayDivision() string {
+	if c == nil || c.BankHolidayDivision == "" {
+		return EnglandAndWales
+	}
+	return c.BankHolidayDivision
+}
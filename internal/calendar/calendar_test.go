@@ -0,0 +1,135 @@
+package calendar
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func date(t *testing.T, value string) time.Time {
+	t.Helper()
+	d, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestRuns(t *testing.T) {
+	c := Default()
+	tests := []struct {
+		bankHolidayRunning string
+		date               string
+		want               bool
+	}{
+		{"", "2023-05-29", true},
+		{"X", "2023-05-29", false},
+		{"X", "2023-05-30", true},
+		// Easter Monday isn't a bank holiday in Scotland, and the summer bank holiday is earlier there
+		{"X", "2023-04-10", false},
+		{"X", "2023-08-07", true},
+		// X is only for bank holiday Mondays, so not Good Friday, or Christmas Day on a Monday or otherwise
+		{"X", "2023-04-07", true},
+		{"X", "2023-12-25", false},
+		{"X", "2024-12-25", true},
+		{"X", "2024-12-26", true},
+		{"G", "2023-05-29", true},
+		{"G", "2023-07-17", false},
+	}
+	for _, tt := range tests {
+		if got := c.Runs(tt.bankHolidayRunning, date(t, tt.date)); got != tt.want {
+			t.Errorf("Runs(%q, %s) = %v, want %v", tt.bankHolidayRunning, tt.date, got, tt.want)
+		}
+	}
+
+	c.BankHolidayDivision = Scotland
+	if !c.Runs("X", date(t, "2023-04-10")) {
+		t.Error("expected trains to run on Easter Monday in Scotland")
+	}
+	if c.Runs("X", date(t, "2023-08-07")) {
+		t.Error("expected trains not to run on the Scottish summer bank holiday")
+	}
+
+	var none *Calendar
+	if !none.Runs("X", date(t, "2023-05-29")) {
+		t.Error("expected trains to run when there's no calendar")
+	}
+}
+
+func TestHolidays(t *testing.T) {
+	c := Default()
+	holidays := c.Holidays(Scotland, date(t, "2023-11-01"), date(t, "2024-01-02"))
+	var got []string
+	for _, holiday := range holidays {
+		got = append(got, holiday.Date)
+	}
+	want := []string{"2023-11-30", "2023-12-25", "2023-12-26", "2024-01-01", "2024-01-02"}
+	if len(got) != len(want) {
+		t.Fatalf("got holidays %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("got holidays %v, want %v", got, want)
+		}
+	}
+	if divisions := c.Divisions(); len(divisions) != 3 || divisions[0] != EnglandAndWales {
+		t.Errorf("expected the bundled divisions, got %v", divisions)
+	}
+}
+
+func TestNilCalendar(t *testing.T) {
+	var c *Calendar
+	if divisions := c.Divisions(); len(divisions) != 0 {
+		t.Errorf("expected no divisions, got %v", divisions)
+	}
+	if c.HasDivision(EnglandAndWales) {
+		t.Error("expected a nil calendar to have no divisions")
+	}
+	if holidays := c.Holidays(EnglandAndWales, date(t, "2023-01-01"), date(t, "2023-12-31")); len(holidays) != 0 {
+		t.Errorf("expected no holidays, got %v", holidays)
+	}
+	if !c.Runs("X", date(t, "2023-05-29")) {
+		t.Error("expected a nil calendar to have no bank holidays for trains marked X")
+	}
+}
+
+func TestLoad_Overrides(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "bank-holidays.json")
+	overrides := `{
+		"england-and-wales": {"division": "england-and-wales", "events": [
+			{"title": "Spring bank holiday", "date": "2023-05-29", "removed": true},
+			{"title": "Spring bank holiday", "date": "2023-06-05", "notes": "Moved"}
+		]},
+		"northern-ireland": {"division": "northern-ireland", "events": [
+			{"title": "Battle of the Boyne (Orangemen’s Day)", "date": "2023-07-12"}
+		]}
+	}`
+	if err := os.WriteFile(filename, []byte(overrides), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := Load(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.Holiday(EnglandAndWales, date(t, "2023-05-29")); ok {
+		t.Error("expected the removed holiday to be taken out")
+	}
+	if holiday, ok := c.Holiday(EnglandAndWales, date(t, "2023-06-05")); !ok || holiday.Notes != "Moved" {
+		t.Errorf("expected the added holiday, got %+v", holiday)
+	}
+	if _, ok := c.Holiday(EnglandAndWales, date(t, "2023-12-25")); !ok {
+		t.Error("expected the bundled holidays to be kept")
+	}
+	if !c.HasDivision("northern-ireland") {
+		t.Error("expected the new division to be added")
+	}
+
+	if err := os.WriteFile(filename, []byte(`{"scotland": {"events": [{"date": "30/11/2023"}]}}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(filename); err == nil {
+		t.Error("expected an invalid date to be an error")
+	}
+}
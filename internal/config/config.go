@@ -5,6 +5,9 @@ import (
 	"log/slog"
 	"os"
 	"path"
+	"strconv"
+	"strings"
+	"time"
 )
 
 func GetScheduleFeedFilename() string {
@@ -45,6 +48,27 @@ func GetStompConnectionDetails() (err error, url string, login string, password
 	return nil, url, login, password
 }
 
+// GetVSTPDestinations returns the STOMP topics and queues that VSTP messages are received from.
+func GetVSTPDestinations() []string {
+	var destinations []string
+	for _, destination := range strings.Split(os.Getenv("VSTP_DESTINATIONS"), ",") {
+		if destination = strings.TrimSpace(destination); destination != "" {
+			destinations = append(destinations, destination)
+		}
+	}
+	if len(destinations) == 0 {
+		slog.Debug("No VSTP_DESTINATIONS environment variable set - defaulting to /topic/VSTP_ALL")
+		destinations = []string{"/topic/VSTP_ALL"}
+	}
+	return destinations
+}
+
+// GetStompClientID returns the client id used to make durable subscriptions to the STOMP server, or an empty string
+// if subscriptions shouldn't be durable.
+func GetStompClientID() string {
+	return os.Getenv("NR_STOMP_CLIENT_ID")
+}
+
 func GetHTTPListenAddress() string {
 	addr := os.Getenv("LISTEN_ON")
 	if addr == "" {
@@ -57,3 +81,117 @@ func GetHTTPListenAddress() string {
 func ShouldDeleteExpiredSchedulesAfterRefresh() bool {
 	return os.Getenv("DELETE_EXPIRED_SCHEDULES_ON_REFRESH") == "yes"
 }
+
+// GetShutdownTimeout returns how long syncd waits for its workers to stop when it's asked to shut down.
+func GetShutdownTimeout() time.Duration {
+	seconds, err := strconv.Atoi(os.Getenv("SHUTDOWN_TIMEOUT_SECONDS"))
+	if err != nil || seconds <= 0 {
+		slog.Debug("No valid SHUTDOWN_TIMEOUT_SECONDS environment variable set - defaulting to 20")
+		seconds = 20
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// GetMinConnectionTime returns the default time allowed to change trains in journey searches.
+func GetMinConnectionTime() time.Duration {
+	minutes, err := strconv.Atoi(os.Getenv("MIN_CONNECTION_MINUTES"))
+	if err != nil || minutes < 0 {
+		slog.Debug("No valid MIN_CONNECTION_MINUTES environment variable set - defaulting to 5")
+		minutes = 5
+	}
+	return time.Duration(minutes) * time.Minute
+}
+
+// The Network Rail open data URLs of the full extract of the schedule feed and of the daily updates to it.
+const (
+	fullScheduleFeedURL   = "https://publicdatafeeds.networkrail.co.uk/ntrod/CifFileAuthenticate?type=CIF_ALL_FULL_DAILY&day=toc-full"
+	updateScheduleFeedURL = "https://publicdatafeeds.networkrail.co.uk/ntrod/CifFileAuthenticate?type=CIF_ALL_UPDATE_DAILY&day=toc-update-{day}"
+)
+
+// GetScheduleFeedDownloadDetails returns the URL the schedule feed is downloaded from and the credentials for the
+// Network Rail open data portal. Without SCHEDULE_FEED_URL it's the full extract, or today's update if
+// SCHEDULE_FEED_TYPE is "update"; "{day}" in the URL stands for the day of the week.
+func GetScheduleFeedDownloadDetails() (err error, url string, username string, password string) {
+	url = os.Getenv("SCHEDULE_FEED_URL")
+	if url == "" {
+		if os.Getenv("SCHEDULE_FEED_TYPE") == "update" {
+			slog.Debug("No SCHEDULE_FEED_URL environment variable set - defaulting to the daily update")
+			url = updateScheduleFeedURL
+		} else {
+			slog.Debug("No SCHEDULE_FEED_URL environment variable set - defaulting to the full extract")
+			url = fullScheduleFeedURL
+		}
+	}
+	username = os.Getenv("UKRA_USERNAME")
+	password = os.Getenv("UKRA_PASSWORD")
+	if username == "" || password == "" {
+		err = errors.New("UKRA_USERNAME and UKRA_PASSWORD environment variables must be set to download the schedule feed")
+		slog.Error(err.Error())
+		return err, url, username, password
+	}
+	return nil, url, username, password
+}
+
+// GetScheduleFeedDownloadTime returns the time of day, in UTC, the schedule feed is downloaded, as the time since
+// midnight.
+func GetScheduleFeedDownloadTime() time.Duration {
+	at, err := time.Parse("15:04", os.Getenv("SCHEDULE_FEED_DOWNLOAD_TIME"))
+	if err != nil {
+		slog.Debug("No valid SCHEDULE_FEED_DOWNLOAD_TIME environment variable set - defaulting to 06:00")
+		return 6 * time.Hour
+	}
+	return time.Duration(at.Hour())*time.Hour + time.Duration(at.Minute())*time.Minute
+}
+
+// GetScheduleFeedDownloadAttempts returns the number of times a schedule feed download is tried before giving up.
+func GetScheduleFeedDownloadAttempts() int {
+	attempts, err := strconv.Atoi(os.Getenv("SCHEDULE_FEED_DOWNLOAD_ATTEMPTS"))
+	if err != nil || attempts <= 0 {
+		slog.Debug("No valid SCHEDULE_FEED_DOWNLOAD_ATTEMPTS environment variable set - defaulting to 5")
+		attempts = 5
+	}
+	return attempts
+}
+
+// GetScheduleFeedRetryDelay returns how long to wait before retrying a failed schedule feed download the first time.
+func GetScheduleFeedRetryDelay() time.Duration {
+	seconds, err := strconv.Atoi(os.Getenv("SCHEDULE_FEED_RETRY_SECONDS"))
+	if err != nil || seconds <= 0 {
+		slog.Debug("No valid SCHEDULE_FEED_RETRY_SECONDS environment variable set - defaulting to 60")
+		seconds = 60
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// GetScheduleFeedMinSize returns the smallest size, in bytes, a downloaded schedule feed file can be.
+func GetScheduleFeedMinSize() int64 {
+	size, err := strconv.ParseInt(os.Getenv("SCHEDULE_FEED_MIN_BYTES"), 10, 64)
+	if err != nil || size < 0 {
+		slog.Debug("No valid SCHEDULE_FEED_MIN_BYTES environment variable set - defaulting to 1024")
+		size = 1024
+	}
+	return size
+}
+
+// GetBankHolidaysFilename returns the file of overrides to the bundled bank holidays, or an empty string if there
+// isn't one. It's in the format of https://www.gov.uk/bank-holidays.json.
+func GetBankHolidaysFilename() string {
+	return os.Getenv("BANK_HOLIDAYS_FILENAME")
+}
+
+// GetStopCoordinatesFilename returns the CSV file of stop positions used in GTFS feeds, or an empty string if there
+// isn't one.
+func GetStopCoordinatesFilename() string {
+	return os.Getenv("STOP_COORDINATES_FILENAME")
+}
+
+// GetBankHolidayDivision returns the division of the bank holiday calendar whose bank holidays trains marked not to
+// run on bank holidays don't run on.
+func GetBankHolidayDivision() string {
+	division := os.Getenv("BANK_HOLIDAY_DIVISION")
+	if division == "" {
+		slog.Debug("No BANK_HOLIDAY_DIVISION environment variable set - defaulting to england-and-wales")
+		division = "england-and-wales"
+	}
+	return division
+}
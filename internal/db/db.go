@@ -1,33 +1,52 @@
 package db
 
 import (
+	"database/sql"
+	"errors"
+	"fmt"
 	"log/slog"
 	"os"
+	"time"
 	"uk-rail-schedule-api/internal/schedule"
 
+	"github.com/mattn/go-sqlite3"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 )
 
+// BusyTimeout is how long a connection waits for another to release the write lock before failing with SQLITE_BUSY.
+// A daily update holds the lock for as long as it takes to apply, far longer than the driver's default 5 seconds.
+const BusyTimeout = 10 * time.Minute
+
 // Open opens (or creates) the SQLite database at the given path and returns a GORM handle.
 func Open(databaseFilename string) (*gorm.DB, error) {
 	if _, err := os.Stat(databaseFilename); os.IsNotExist(err) {
 		slog.Info("Database doesn't exist - creating", "databaseFilename", databaseFilename)
+		// An empty file is an empty database, and connections need a file to keep track of
+		if err := os.WriteFile(databaseFilename, nil, 0o644); err != nil {
+			return nil, err
+		}
 	}
 
-	database, err := gorm.Open(sqlite.Open(databaseFilename), &gorm.Config{})
+	// Transactions take the write lock as they begin, so a transaction waiting for Swap can tell it's been swapped
+	dsn := fmt.Sprintf("%s?_txlock=immediate&_busy_timeout=%d", databaseFilename, BusyTimeout.Milliseconds())
+	conn := sql.OpenDB(&fileConnector{filename: databaseFilename, dsn: dsn})
+	database, err := gorm.Open(&sqlite.Dialector{DSN: databaseFilename, Conn: conn}, &gorm.Config{})
 	if err != nil {
+		conn.Close()
 		return nil, err
 	}
 
-	if err := database.AutoMigrate(
-		&schedule.ScheduleLocation{},
-		&schedule.Schedule{},
-		&schedule.Tiploc{},
-		&schedule.Timetable{},
-	); err != nil {
+	if err := database.AutoMigrate(schedule.Models()...); err != nil {
+		conn.Close()
 		return nil, err
 	}
 
 	return database, nil
 }
+
+// IsBusy reports whether err is from SQLite giving up waiting for another connection to release the database.
+func IsBusy(err error) bool {
+	var sqliteErr sqlite3.Error
+	return errors.As(err, &sqliteErr) && (sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked)
+}
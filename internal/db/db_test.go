@@ -1,11 +1,16 @@
 package db_test
 
 import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
 	"path/filepath"
 	"testing"
 	"uk-rail-schedule-api/internal/db"
 	"uk-rail-schedule-api/internal/schedule"
 
+	_ "github.com/mattn/go-sqlite3"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 	"gorm.io/gorm/logger"
@@ -70,3 +75,50 @@ func TestOpen_ExistingDatabase_MigratesNewColumns(t *testing.T) {
 		t.Fatalf("expected insert to succeed after migration, got: %v", err)
 	}
 }
+
+func TestOpen_WaitsForTheWriteLock(t *testing.T) {
+	database, err := db.Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var timeout int64
+	if err := database.Raw("PRAGMA busy_timeout").Scan(&timeout).Error; err != nil {
+		t.Fatal(err)
+	}
+	if timeout != db.BusyTimeout.Milliseconds() {
+		t.Errorf("expected a busy timeout of %d ms, got %d", db.BusyTimeout.Milliseconds(), timeout)
+	}
+}
+
+func TestIsBusy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	holder, err := sql.Open("sqlite3", path+"?_busy_timeout=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer holder.Close()
+	waiter, err := sql.Open("sqlite3", path+"?_busy_timeout=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer waiter.Close()
+	if _, err := holder.Exec("CREATE TABLE t (id INTEGER)"); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := holder.Conn(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(context.Background(), "BEGIN IMMEDIATE"); err != nil {
+		t.Fatal(err)
+	}
+	_, err = waiter.Exec("INSERT INTO t (id) VALUES (1)")
+	if !db.IsBusy(err) {
+		t.Errorf("expected writing while another connection holds the lock to be busy, got: %v", err)
+	}
+	if db.IsBusy(fmt.Errorf("failed to apply: %w", errors.New("invalid"))) {
+		t.Error("expected another error not to be busy")
+	}
+}
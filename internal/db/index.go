@@ -0,0 +1,55 @@
+package db
+
+import (
+	"maps"
+	"slices"
+
+	"gorm.io/gorm"
+)
+
+// DropIndexes drops the indexes on the tables of models, apart from those named in keep, so that rows can be loaded
+// into them quickly. CreateIndexes puts them back.
+func DropIndexes(database *gorm.DB, keep []string, models ...any) error {
+	for _, model := range models {
+		names, err := indexNames(database, model)
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			if slices.Contains(keep, name) || !database.Migrator().HasIndex(model, name) {
+				continue
+			}
+			if err := database.Migrator().DropIndex(model, name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// CreateIndexes creates any of the indexes on the tables of models that are missing.
+func CreateIndexes(database *gorm.DB, models ...any) error {
+	for _, model := range models {
+		names, err := indexNames(database, model)
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			if database.Migrator().HasIndex(model, name) {
+				continue
+			}
+			if err := database.Migrator().CreateIndex(model, name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func indexNames(database *gorm.DB, model any) ([]string, error) {
+	stmt := &gorm.Statement{DB: database}
+	if err := stmt.Parse(model); err != nil {
+		return nil, err
+	}
+	return slices.Sorted(maps.Keys(stmt.Schema.ParseIndexes())), nil
+}
@@ -0,0 +1,33 @@
+package db_test
+
+import (
+	"path/filepath"
+	"testing"
+	"uk-rail-schedule-api/internal/db"
+	"uk-rail-schedule-api/internal/schedule"
+)
+
+func TestDropIndexes_KeepsNamedIndexesAndCreateIndexesRestoresThem(t *testing.T) {
+	database := openFile(t, filepath.Join(t.TempDir(), "ukra.db"))
+	if err := database.AutoMigrate(&schedule.Schedule{}); err != nil {
+		t.Fatalf("AutoMigrate: %v", err)
+	}
+	migrator := database.Migrator()
+
+	if err := db.DropIndexes(database, []string{"idx_schedules_combined_id"}, &schedule.Schedule{}); err != nil {
+		t.Fatalf("DropIndexes: %v", err)
+	}
+	if !migrator.HasIndex(&schedule.Schedule{}, "idx_schedules_combined_id") {
+		t.Error("expected the kept index to remain")
+	}
+	if migrator.HasIndex(&schedule.Schedule{}, "idx_schedules_cif_train_uid") {
+		t.Error("expected the other indexes to be dropped")
+	}
+
+	if err := db.CreateIndexes(database, &schedule.Schedule{}); err != nil {
+		t.Fatalf("CreateIndexes: %v", err)
+	}
+	if !migrator.HasIndex(&schedule.Schedule{}, "idx_schedules_cif_train_uid") {
+		t.Error("expected the dropped indexes to be created again")
+	}
+}
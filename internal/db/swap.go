@@ -0,0 +1,144 @@
+package db
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"io/fs"
+	"os"
+
+	"github.com/mattn/go-sqlite3"
+	"gorm.io/gorm"
+)
+
+// NextFilename is where a database is rebuilt before it's swapped in with Swap, and PreviousFilename is where the
+// database it replaced is kept, so it can be rolled back.
+func NextFilename(filename string) string     { return filename + ".next" }
+func PreviousFilename(filename string) string { return filename + ".prev" }
+
+// Filename returns the path of a database's file, or "" for an in-memory database.
+func Filename(database *gorm.DB) (string, error) {
+	var databases []struct {
+		Name string
+		File string
+	}
+	if err := database.Raw("PRAGMA database_list").Scan(&databases).Error; err != nil {
+		return "", err
+	}
+	for _, d := range databases {
+		if d.Name == "main" {
+			return d.File, nil
+		}
+	}
+	return "", nil
+}
+
+// Swap replaces the file of the live database with the file of next, which is closed, keeping the file replaced as
+// its PreviousFilename. carryOver is called first, to copy any rows that must survive the swap from live to next.
+// Both are done holding live's write lock, so nothing can be written to the old file in the meantime. Connections
+// made by Open, in this process or any other, move to the new file as soon as they're next used.
+func Swap(live, next *gorm.DB, carryOver func(live, next *gorm.DB) error) error {
+	filename, err := Filename(live)
+	if err != nil {
+		return err
+	}
+	nextFilename, err := Filename(next)
+	if err != nil {
+		return err
+	}
+	if filename == "" || nextFilename == "" {
+		return errors.New("an in-memory database can't be swapped")
+	}
+
+	// Transactions begin immediately, so this takes the write lock straight away
+	return live.Transaction(func(tx *gorm.DB) error {
+		if err := carryOver(tx, next); err != nil {
+			return err
+		}
+		sqlDB, err := next.DB()
+		if err != nil {
+			return err
+		}
+		if err := sqlDB.Close(); err != nil {
+			return err
+		}
+
+		previous := PreviousFilename(filename)
+		if err := os.Remove(previous); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		if err := os.Link(filename, previous); err != nil {
+			return err
+		}
+		return os.Rename(nextFilename, filename)
+	})
+}
+
+// fileConnector makes connections to the database file at filename which are dropped once the file has been
+// replaced by Swap, so database/sql makes new ones to the new file.
+type fileConnector struct {
+	filename string
+	dsn      string
+	driver   sqlite3.SQLiteDriver
+}
+
+func (c *fileConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	before, err := os.Stat(c.filename)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := c.driver.Open(c.dsn)
+	if err != nil {
+		return nil, err
+	}
+	after, err := os.Stat(c.filename)
+	if err != nil || !os.SameFile(before, after) {
+		// Swapped while connecting, so database/sql tries again
+		conn.Close()
+		return nil, driver.ErrBadConn
+	}
+	return &fileConn{SQLiteConn: conn.(*sqlite3.SQLiteConn), filename: c.filename, file: after}, nil
+}
+
+func (c *fileConnector) Driver() driver.Driver {
+	return &c.driver
+}
+
+// fileConn is a connection to the file that was at filename when it was made.
+type fileConn struct {
+	*sqlite3.SQLiteConn
+	filename string
+	file     os.FileInfo
+}
+
+func (c *fileConn) swapped() bool {
+	file, err := os.Stat(c.filename)
+	return err != nil || !os.SameFile(file, c.file)
+}
+
+// IsValid stops a connection to a file that's been swapped out going back into the pool.
+func (c *fileConn) IsValid() bool {
+	return !c.swapped()
+}
+
+// ResetSession stops a connection to a file that's been swapped out being reused.
+func (c *fileConn) ResetSession(ctx context.Context) error {
+	if c.swapped() {
+		return driver.ErrBadConn
+	}
+	return nil
+}
+
+// BeginTx checks the file hasn't been swapped out once the transaction holds the write lock, so a transaction that
+// was waiting for Swap to finish is begun again on the new file rather than writing to the old one.
+func (c *fileConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	tx, err := c.SQLiteConn.BeginTx(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	if c.swapped() {
+		tx.Rollback()
+		return nil, driver.ErrBadConn
+	}
+	return tx, nil
+}
@@ -0,0 +1,104 @@
+package db_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"uk-rail-schedule-api/internal/db"
+	"uk-rail-schedule-api/internal/schedule"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// openFile opens a database file with db.Open, closing it when the test ends.
+func openFile(t *testing.T, filename string) *gorm.DB {
+	t.Helper()
+	database, err := db.Open(filename)
+	if err != nil {
+		t.Fatalf("failed to open %s: %v", filename, err)
+	}
+	database.Logger = logger.Discard
+	t.Cleanup(func() {
+		if sqlDB, err := database.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+	return database
+}
+
+func trainUIDs(t *testing.T, database *gorm.DB) []string {
+	t.Helper()
+	var uids []string
+	if err := database.Model(&schedule.Schedule{}).Order("cif_train_uid").Pluck("cif_train_uid", &uids).Error; err != nil {
+		t.Fatalf("failed to query schedules: %v", err)
+	}
+	return uids
+}
+
+func TestSwap_MovesConnectionsToNewFile(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "ukra.db")
+	live := openFile(t, filename)
+	// The same database opened by another process, such as the web service
+	other := openFile(t, filename)
+	live.Create(&schedule.Schedule{CIFTrainUID: "OLD001"})
+	if got := trainUIDs(t, other); len(got) != 1 {
+		t.Fatalf("expected the other handle to see the live schedule, got %v", got)
+	}
+
+	next := openFile(t, db.NextFilename(filename))
+	next.Create(&schedule.Schedule{CIFTrainUID: "NEW001"})
+
+	carried := false
+	if err := db.Swap(live, next, func(live, next *gorm.DB) error {
+		carried = true
+		return nil
+	}); err != nil {
+		t.Fatalf("Swap: %v", err)
+	}
+	if !carried {
+		t.Error("expected carryOver to be called")
+	}
+
+	for name, database := range map[string]*gorm.DB{"live": live, "other": other} {
+		if got := trainUIDs(t, database); len(got) != 1 || got[0] != "NEW001" {
+			t.Errorf("%s: expected the reloaded schedule, got %v", name, got)
+		}
+	}
+	if _, err := os.Stat(db.NextFilename(filename)); !os.IsNotExist(err) {
+		t.Errorf("expected the next file to have been moved into place, got %v", err)
+	}
+	if got := trainUIDs(t, openFile(t, db.PreviousFilename(filename))); len(got) != 1 || got[0] != "OLD001" {
+		t.Errorf("expected the previous file to keep the old schedule, got %v", got)
+	}
+}
+
+func TestSwap_WriteWaitingForSwapGoesToNewFile(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "ukra.db")
+	live := openFile(t, filename)
+	other := openFile(t, filename)
+	// Make sure other has a connection to the old file to reuse
+	trainUIDs(t, other)
+	next := openFile(t, db.NextFilename(filename))
+
+	written := make(chan error, 1)
+	if err := db.Swap(live, next, func(live, next *gorm.DB) error {
+		// Written by another process while the swap holds the write lock
+		go func() { written <- other.Create(&schedule.Schedule{CIFTrainUID: "VSTP01"}).Error }()
+		time.Sleep(100 * time.Millisecond)
+		return nil
+	}); err != nil {
+		t.Fatalf("Swap: %v", err)
+	}
+	if err := <-written; err != nil {
+		t.Fatalf("expected the write to succeed once the swap finished, got %v", err)
+	}
+
+	if got := trainUIDs(t, live); len(got) != 1 || got[0] != "VSTP01" {
+		t.Errorf("expected the write to go to the new file, got %v", got)
+	}
+	if got := trainUIDs(t, openFile(t, db.PreviousFilename(filename))); len(got) != 0 {
+		t.Errorf("expected nothing to be written to the old file, got %v", got)
+	}
+}
@@ -0,0 +1,87 @@
+package gtfs
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"uk-rail-schedule-api/internal/schedule"
+)
+
+// Coordinate is the position of a stop, in WGS84 degrees.
+type Coordinate struct {
+	Lat, Lon float64
+}
+
+// Coordinates are the positions of stops by TIPLOC or CRS code.
+type Coordinates map[string]Coordinate
+
+// LoadCoordinates reads the positions of stops from a CSV file with code, lat and lon columns, named in its header
+// row, in which code is a TIPLOC or CRS code.
+func LoadCoordinates(filename string) (Coordinates, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read stop coordinates from %s: %w", filename, err)
+	}
+	defer f.Close()
+
+	coordinates, err := readCoordinates(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read stop coordinates from %s: %w", filename, err)
+	}
+	return coordinates, nil
+}
+
+func readCoordinates(r io.Reader) (Coordinates, error) {
+	cr := csv.NewReader(r)
+	header, err := cr.Read()
+	if err != nil {
+		return nil, err
+	}
+	columns := map[string]int{}
+	for idx, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = idx
+	}
+	code, hasCode := columns["code"]
+	lat, hasLat := columns["lat"]
+	lon, hasLon := columns["lon"]
+	if !hasCode || !hasLat || !hasLon {
+		return nil, errors.New("the header must name code, lat and lon columns")
+	}
+
+	coordinates := Coordinates{}
+	for {
+		row, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			return coordinates, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		var c Coordinate
+		c.Lat, err = strconv.ParseFloat(strings.TrimSpace(row[lat]), 64)
+		if err != nil || c.Lat < -90 || c.Lat > 90 {
+			return nil, fmt.Errorf("invalid lat %q for %s", row[lat], row[code])
+		}
+		c.Lon, err = strconv.ParseFloat(strings.TrimSpace(row[lon]), 64)
+		if err != nil || c.Lon < -180 || c.Lon > 180 {
+			return nil, fmt.Errorf("invalid lon %q for %s", row[lon], row[code])
+		}
+		coordinates[strings.TrimSpace(row[code])] = c
+	}
+}
+
+// find returns the position of a TIPLOC, given by its own code or failing that its CRS code.
+func (c Coordinates) find(tiploc schedule.Tiploc) (Coordinate, bool) {
+	if coordinate, ok := c[tiploc.TiplocCode]; ok {
+		return coordinate, true
+	}
+	if tiploc.CrsCode == "" {
+		return Coordinate{}, false
+	}
+	coordinate, ok := c[tiploc.CrsCode]
+	return coordinate, ok
+}
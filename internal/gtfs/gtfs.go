@@ -0,0 +1,411 @@
+// Package gtfs exports the schedules in the database as a GTFS static feed (https://gtfs.org/schedule/reference/).
+package gtfs
+
+import (
+	"archive/zip"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"uk-rail-schedule-api/internal/calendar"
+	"uk-rail-schedule-api/internal/schedule"
+	"uk-rail-schedule-api/internal/store"
+
+	"gorm.io/gorm"
+)
+
+// AgencyURL is given for every agency, as GTFS requires one and the CIF doesn't include them.
+const AgencyURL = "https://www.nationalrail.co.uk/"
+
+// Timezone is the timezone of every agency and of the times in stop_times.txt.
+const Timezone = "Europe/London"
+
+// uidChunkSize is the number of trains whose schedules are loaded and written at a time.
+const uidChunkSize = 500
+
+// GTFS route types
+const (
+	routeTypeRail  = 2
+	routeTypeBus   = 3
+	routeTypeFerry = 4
+)
+
+// files are the files of the feed, in the order they're written to the zip, with their columns.
+var files = []struct {
+	name    string
+	columns []string
+}{
+	{"agency.txt", []string{"agency_id", "agency_name", "agency_url", "agency_timezone"}},
+	{"stops.txt", []string{"stop_id", "stop_code", "stop_name", "stop_lat", "stop_lon"}},
+	{"routes.txt", []string{"route_id", "agency_id", "route_long_name", "route_type"}},
+	{"trips.txt", []string{"route_id", "service_id", "trip_id", "trip_headsign", "trip_short_name"}},
+	{"stop_times.txt", []string{"trip_id", "arrival_time", "departure_time", "stop_id", "stop_sequence", "platform_code", "pickup_type", "drop_off_type"}},
+	{"calendar.txt", []string{"service_id", "monday", "tuesday", "wednesday", "thursday", "friday", "saturday", "sunday", "start_date", "end_date"}},
+	{"calendar_dates.txt", []string{"service_id", "date", "exception_type"}},
+}
+
+// Options are the optional inputs to an export.
+type Options struct {
+	// Coordinates are the positions of stops. Without them stop_lat and stop_lon are left empty
+	Coordinates Coordinates
+	// Calendar is the bank holidays that trains marked not to run on them are removed from. Without it they run
+	Calendar *calendar.Calendar
+}
+
+// exporter holds the state of an export in progress. Each file is written to a temporary file, as a zip can only
+// be written one file at a time, and they're built up together as the schedules are read.
+type exporter struct {
+	db       *gorm.DB
+	from, to time.Time
+	opts     Options
+
+	writers map[string]*csv.Writer
+	tiplocs map[string]schedule.Tiploc
+
+	agencies map[string]bool
+	stops    map[string]bool
+	routes   map[string]bool
+	tripIDs  map[string]bool
+	trips    int
+}
+
+/*
+Export writes the schedules running between the dates from and to, inclusive, to w as a zipped GTFS feed.
+
+Every schedule record other than a cancellation becomes a trip, with its own service. The service runs on the days
+the record does within its dates, and calendar_dates.txt removes the days on which STP precedence gives the train to
+another record: an overlay, STP schedule or cancellation, or which are bank holidays the train doesn't run on in
+opts.Calendar. Overlays are complete schedules in the CIF, so become trips
+in their own right. Only calls with public times are included, and trips with fewer than two are left out.
+
+TIPLOCs carry no coordinates, so they're taken from opts.Coordinates, by TIPLOC or failing that by CRS code, and
+calls at stops without them are left out as GTFS requires. Without coordinates at all every stop is included with
+empty stop_lat and stop_lon columns, which isn't a valid feed until they're filled in by joining on stop_id or
+stop_code (the CRS code).
+*/
+func Export(db *gorm.DB, w io.Writer, from, to time.Time, opts Options) error {
+	if db == nil {
+		return errors.New("db is nil")
+	}
+
+	dir, err := os.MkdirTemp("", "gtfs-")
+	if err != nil {
+		return fmt.Errorf("error creating temporary directory: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	e := &exporter{
+		db:       db,
+		from:     from,
+		to:       to,
+		opts:     opts,
+		writers:  make(map[string]*csv.Writer),
+		tiplocs:  make(map[string]schedule.Tiploc),
+		agencies: make(map[string]bool),
+		stops:    make(map[string]bool),
+		routes:   make(map[string]bool),
+		tripIDs:  make(map[string]bool),
+	}
+
+	for _, file := range files {
+		f, err := os.Create(filepath.Join(dir, file.name))
+		if err != nil {
+			return fmt.Errorf("error creating %s: %w", file.name, err)
+		}
+		defer f.Close()
+		e.writers[file.name] = csv.NewWriter(f)
+		e.writers[file.name].Write(file.columns)
+	}
+
+	if err := e.export(); err != nil {
+		return err
+	}
+
+	zw := zip.NewWriter(w)
+	for _, file := range files {
+		e.writers[file.name].Flush()
+		if err := e.writers[file.name].Error(); err != nil {
+			return fmt.Errorf("error writing %s: %w", file.name, err)
+		}
+		if err := addToZip(zw, filepath.Join(dir, file.name), file.name); err != nil {
+			return err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return fmt.Errorf("error writing GTFS zip: %w", err)
+	}
+
+	slog.Info("Exported GTFS feed", "from", from.Format("2006-01-02"), "to", to.Format("2006-01-02"), "trips", e.trips, "stops", len(e.stops), "agencies", len(e.agencies))
+	return nil
+}
+
+func addToZip(zw *zip.Writer, path, name string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("error opening %s: %w", name, err)
+	}
+	defer f.Close()
+
+	out, err := zw.Create(name)
+	if err != nil {
+		return fmt.Errorf("error adding %s to zip: %w", name, err)
+	}
+	if _, err := io.Copy(out, f); err != nil {
+		return fmt.Errorf("error adding %s to zip: %w", name, err)
+	}
+	return nil
+}
+
+func (e *exporter) export() error {
+	var tiplocs []schedule.Tiploc
+	if err := e.db.Find(&tiplocs).Error; err != nil {
+		return fmt.Errorf("error loading tiplocs: %w", err)
+	}
+	for _, tiploc := range tiplocs {
+		e.tiplocs[tiploc.TiplocCode] = tiploc
+	}
+
+	validSQL, validArgs := store.Filter{}.ValidBetween(e.from, e.to).SQL()
+	var uids []string
+	if err := e.db.Model(&schedule.Schedule{}).Where(validSQL, validArgs...).
+		Distinct().Order("cif_train_uid").Pluck("cif_train_uid", &uids).Error; err != nil {
+		return fmt.Errorf("error finding trains: %w", err)
+	}
+
+	for start := 0; start < len(uids); start += uidChunkSize {
+		chunk := uids[start:min(start+uidChunkSize, len(uids))]
+
+		var records []schedule.Schedule
+		if err := e.db.Where(validSQL, validArgs...).Where("cif_train_uid IN ?", chunk).
+			Order("cif_train_uid, id").Find(&records).Error; err != nil {
+			return fmt.Errorf("error loading schedules: %w", err)
+		}
+		if err := e.loadLocations(records); err != nil {
+			return err
+		}
+
+		byUID := make(map[string][]schedule.Schedule)
+		for _, rec := range records {
+			byUID[rec.CIFTrainUID] = append(byUID[rec.CIFTrainUID], rec)
+		}
+		for _, uid := range chunk {
+			e.writeTrain(byUID[uid])
+		}
+	}
+
+	e.writeStops()
+	e.writeAgencies()
+	return nil
+}
+
+func (e *exporter) loadLocations(records []schedule.Schedule) error {
+	ids := make([]uint64, 0, len(records))
+	for _, rec := range records {
+		ids = append(ids, rec.ID)
+	}
+	var locations []schedule.ScheduleLocation
+	if err := e.db.Where("schedule_id IN ?", ids).Order("schedule_id, id").Find(&locations).Error; err != nil {
+		return fmt.Errorf("error loading schedule locations: %w", err)
+	}
+	byScheduleID := make(map[uint64][]schedule.ScheduleLocation)
+	for _, loc := range locations {
+		byScheduleID[loc.ScheduleID] = append(byScheduleID[loc.ScheduleID], loc)
+	}
+	for idx := range records {
+		records[idx].ScheduleLocation = byScheduleID[records[idx].ID]
+	}
+	return nil
+}
+
+// writeTrain writes a trip for each of a train's records that governs it on at least one day of the export.
+func (e *exporter) writeTrain(records []schedule.Schedule) {
+	wins := make(map[uint64][]time.Time)
+	for day := e.from; !day.After(e.to); day = day.AddDate(0, 0, 1) {
+		var running []schedule.Schedule
+		for _, rec := range records {
+			if rec.RunsOn(day) {
+				running = append(running, rec)
+			}
+		}
+		winner, ok := schedule.STPWinner(running)
+		if !ok || winner.CIFStpIndicator == "C" {
+			continue
+		}
+		// Trains marked not to run on bank holidays don't, as for the schedules endpoint
+		if resolved, _ := schedule.ResolveSTP(running, day.Unix()); !e.opts.Calendar.Runs(resolved.CIFBankHolidayRunning, day) {
+			continue
+		}
+		wins[winner.ID] = append(wins[winner.ID], day)
+	}
+
+	for _, rec := range records {
+		if len(wins[rec.ID]) > 0 {
+			e.writeTrip(rec, wins[rec.ID])
+		}
+	}
+}
+
+// writeTrip writes a record's trip, stop times and service, which runs on the given days.
+func (e *exporter) writeTrip(sch schedule.Schedule, days []time.Time) {
+	type stopTime struct {
+		loc                schedule.ScheduleLocation
+		arrival, departure string
+		pickup, dropOff    string
+	}
+
+	// The call times are worked out on the first day the trip runs, so that times after midnight, which may only be
+	// apparent from the working times, are on the right day
+	sch.ScheduleLocation = slices.Clone(sch.ScheduleLocation)
+	sch.SetCallTimes(days[0])
+	london := schedule.LondonLocation()
+	// Times after midnight are given as 24:00 or later, as GTFS requires
+	gtfsTime := func(ts int64) string {
+		if ts == 0 {
+			return ""
+		}
+		t := time.Unix(ts, 0).In(london)
+		dayOffset := int(time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC).Sub(days[0]).Hours() / 24)
+		total := dayOffset*24*3600 + t.Hour()*3600 + t.Minute()*60 + t.Second()
+		return fmt.Sprintf("%02d:%02d:%02d", total/3600, total/60%60, total%60)
+	}
+
+	var stopTimes []stopTime
+	for _, loc := range sch.ScheduleLocation {
+		if loc.PublicArrival.IsZero() && loc.PublicDeparture.IsZero() {
+			continue
+		}
+		if _, ok := e.coordinate(loc.TiplocCode); !ok && e.opts.Coordinates != nil {
+			continue
+		}
+		st := stopTime{loc: loc, arrival: gtfsTime(loc.PublicArrivalTS), departure: gtfsTime(loc.PublicDepartureTS)}
+		// A call with only one public time is set down or pick up only
+		if st.arrival == "" {
+			st.arrival, st.dropOff = st.departure, "1"
+		}
+		if st.departure == "" {
+			st.departure, st.pickup = st.arrival, "1"
+		}
+		stopTimes = append(stopTimes, st)
+	}
+	if len(stopTimes) < 2 {
+		return
+	}
+
+	tripID := sch.CombinedID
+	if e.tripIDs[tripID] {
+		// The same schedule from both the feed and VSTP
+		tripID = fmt.Sprintf("%s_%d", sch.CombinedID, sch.ID)
+	}
+	e.tripIDs[tripID] = true
+	e.trips++
+
+	origin, destination := stopTimes[0].loc.TiplocCode, stopTimes[len(stopTimes)-1].loc.TiplocCode
+	routeID := sch.AtocCode + "_" + origin + "_" + destination
+	if !e.routes[routeID] {
+		e.routes[routeID] = true
+		e.writers["routes.txt"].Write([]string{routeID, sch.AtocCode,
+			e.stopName(origin) + " to " + e.stopName(destination), fmt.Sprint(routeType(sch.CIFTrainCategory))})
+	}
+	e.agencies[sch.AtocCode] = true
+
+	e.writers["trips.txt"].Write([]string{routeID, tripID, tripID, e.stopName(destination), sch.SignallingID})
+	for idx, st := range stopTimes {
+		e.stops[st.loc.TiplocCode] = true
+		e.writers["stop_times.txt"].Write([]string{tripID, st.arrival, st.departure, st.loc.TiplocCode,
+			fmt.Sprint(idx + 1), st.loc.Platform, st.pickup, st.dropOff})
+	}
+
+	e.writeService(tripID, sch, days)
+}
+
+// writeService writes a service running on the given days, as the record's days run between its dates, less the
+// days on which it doesn't run.
+func (e *exporter) writeService(serviceID string, sch schedule.Schedule, days []time.Time) {
+	start, end := days[0], days[len(days)-1]
+	row := []string{serviceID}
+	for _, runs := range padDaysRuns(sch.ScheduleDaysRuns) {
+		row = append(row, string(runs))
+	}
+	row = append(row, start.Format("20060102"), end.Format("20060102"))
+	e.writers["calendar.txt"].Write(row)
+
+	running := make(map[time.Time]bool, len(days))
+	for _, day := range days {
+		running[day] = true
+	}
+	for day := start; !day.After(end); day = day.AddDate(0, 0, 1) {
+		if schedule.RunsOnDay(sch.ScheduleDaysRuns, day) && !running[day] {
+			e.writers["calendar_dates.txt"].Write([]string{serviceID, day.Format("20060102"), "2"})
+		}
+	}
+}
+
+func (e *exporter) writeStops() {
+	codes := make([]string, 0, len(e.stops))
+	for code := range e.stops {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	for _, code := range codes {
+		var lat, lon string
+		if coordinate, ok := e.coordinate(code); ok {
+			lat, lon = strconv.FormatFloat(coordinate.Lat, 'f', -1, 64), strconv.FormatFloat(coordinate.Lon, 'f', -1, 64)
+		}
+		e.writers["stops.txt"].Write([]string{code, e.tiplocs[code].CrsCode, e.stopName(code), lat, lon})
+	}
+}
+
+// coordinate returns the position of a TIPLOC, or false if it has none.
+func (e *exporter) coordinate(code string) (Coordinate, bool) {
+	tiploc, ok := e.tiplocs[code]
+	if !ok {
+		tiploc.TiplocCode = code
+	}
+	return e.opts.Coordinates.find(tiploc)
+}
+
+func (e *exporter) writeAgencies() {
+	codes := make([]string, 0, len(e.agencies))
+	for code := range e.agencies {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	for _, code := range codes {
+		e.writers["agency.txt"].Write([]string{code, schedule.GetCompanyNameByATOC(code), AgencyURL, Timezone})
+	}
+}
+
+// stopName returns the name of a TIPLOC, or the TIPLOC itself if it has none.
+func (e *exporter) stopName(code string) string {
+	tiploc := e.tiplocs[code]
+	if name := strings.TrimSpace(tiploc.TpsDescription); name != "" {
+		return name
+	}
+	if name := strings.TrimSpace(tiploc.Description); name != "" {
+		return name
+	}
+	return code
+}
+
+func padDaysRuns(daysRuns string) string {
+	return (daysRuns + "0000000")[:7]
+}
+
+// routeType returns the GTFS route type for a CIF train category.
+func routeType(category string) int {
+	switch category {
+	case "BR", "BS":
+		return routeTypeBus
+	case "SS":
+		return routeTypeFerry
+	}
+	return routeTypeRail
+}
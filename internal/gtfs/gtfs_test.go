@@ -0,0 +1,292 @@
+package gtfs_test
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"uk-rail-schedule-api/internal/calendar"
+	"uk-rail-schedule-api/internal/gtfs"
+	"uk-rail-schedule-api/internal/schedule"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+func setupTestDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{
+		Logger: logger.Discard,
+	})
+	if err != nil {
+		t.Fatal("failed to open test database:", err)
+	}
+	if err := db.AutoMigrate(schedule.Models()...); err != nil {
+		t.Fatal("failed to migrate test database:", err)
+	}
+	return db
+}
+
+// seedRecord inserts a schedule record for train C10001 from Derby to Sheffield, or with no locations for a
+// cancellation.
+func seedRecord(t *testing.T, db *gorm.DB, stp, daysRuns, start, end string, departure, arrival schedule.WTTTime) {
+	t.Helper()
+	sch := schedule.Schedule{
+		CIFStpIndicator:   stp,
+		SignallingID:      "1F20",
+		CIFTrainUID:       "C10001",
+		Source:            "Feed",
+		ScheduleDaysRuns:  daysRuns,
+		ScheduleStartDate: start,
+		ScheduleEndDate:   end,
+		CIFTrainCategory:  "XX",
+	}
+	if stp != "C" {
+		sch.AtocCode = "EM"
+		sch.ScheduleLocation = []schedule.ScheduleLocation{
+			{RecordIdentity: "LO", TiplocCode: "DRBY", Departure: departure, PublicDeparture: departure, Platform: "1"},
+			{RecordIdentity: "LI", TiplocCode: "BELPER", Pass: departure},
+			{RecordIdentity: "LI", TiplocCode: "CHFD", Arrival: "2355", Departure: "0005", PublicArrival: "2355", PublicDeparture: "0005"},
+			{RecordIdentity: "LT", TiplocCode: "SHEFFLD", Arrival: arrival, PublicArrival: arrival},
+		}
+	}
+	sch.AugmentSchedule()
+	if err := db.Create(&sch).Error; err != nil {
+		t.Fatal("failed to seed schedule:", err)
+	}
+}
+
+// export runs an export and returns the rows of each file, without the header.
+func export(t *testing.T, db *gorm.DB, from, to time.Time, opts gtfs.Options) map[string][][]string {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := gtfs.Export(db, &buf, from, to, opts); err != nil {
+		t.Fatalf("expected export to succeed, got %v", err)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("expected a zip, got %v", err)
+	}
+	files := make(map[string][][]string)
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatalf("failed to open %s: %v", f.Name, err)
+		}
+		rows, err := csv.NewReader(rc).ReadAll()
+		rc.Close()
+		if err != nil {
+			t.Fatalf("failed to read %s: %v", f.Name, err)
+		}
+		files[f.Name] = rows[1:]
+	}
+	return files
+}
+
+func TestExport(t *testing.T) {
+	db := setupTestDB(t)
+	db.Create(&schedule.Tiploc{TiplocCode: "DRBY", CrsCode: "DBY", TpsDescription: "DERBY"})
+	db.Create(&schedule.Tiploc{TiplocCode: "SHEFFLD", CrsCode: "SHF", TpsDescription: "SHEFFIELD"})
+	// Runs every day, overlaid on Tuesday 23rd and cancelled on Thursday 25th May 2023
+	seedRecord(t, db, "P", "1111111", "2023-01-01", "2023-12-31", "2330", "0020")
+	seedRecord(t, db, "O", "0100000", "2023-05-23", "2023-05-23", "2335", "0025")
+	seedRecord(t, db, "C", "0001000", "2023-05-25", "2023-05-25", "", "")
+
+	files := export(t, db, time.Date(2023, 5, 22, 0, 0, 0, 0, time.UTC), time.Date(2023, 5, 28, 0, 0, 0, 0, time.UTC), gtfs.Options{})
+
+	for _, name := range []string{"agency.txt", "stops.txt", "routes.txt", "trips.txt", "stop_times.txt", "calendar.txt", "calendar_dates.txt"} {
+		if _, ok := files[name]; !ok {
+			t.Errorf("expected %s in the feed", name)
+		}
+	}
+
+	if len(files["agency.txt"]) != 1 || files["agency.txt"][0][1] != "East Midlands Railway" {
+		t.Errorf("expected East Midlands Railway as the only agency, got %v", files["agency.txt"])
+	}
+
+	trips := files["trips.txt"]
+	if len(trips) != 2 || trips[0][2] != "C100012023-01-01P" || trips[1][2] != "C100012023-05-23O" {
+		t.Fatalf("expected trips for the permanent schedule and overlay, got %v", trips)
+	}
+	if trips[0][3] != "SHEFFIELD" || trips[0][4] != "1F20" {
+		t.Errorf("expected headsign SHEFFIELD and short name 1F20, got %v", trips[0])
+	}
+
+	calendars := map[string][]string{}
+	for _, row := range files["calendar.txt"] {
+		calendars[row[0]] = row
+	}
+	if got := strings.Join(calendars["C100012023-01-01P"][1:], ","); got != "1,1,1,1,1,1,1,20230522,20230528" {
+		t.Errorf("expected the permanent schedule to run daily through the export, got %s", got)
+	}
+	if got := strings.Join(calendars["C100012023-05-23O"][1:], ","); got != "0,1,0,0,0,0,0,20230523,20230523" {
+		t.Errorf("expected the overlay to run on the 23rd only, got %s", got)
+	}
+
+	var removed []string
+	for _, row := range files["calendar_dates.txt"] {
+		if row[0] == "C100012023-01-01P" && row[2] == "2" {
+			removed = append(removed, row[1])
+		}
+	}
+	if strings.Join(removed, ",") != "20230523,20230525" {
+		t.Errorf("expected the overlaid and cancelled days to be removed from the permanent schedule, got %v", removed)
+	}
+
+	var stopTimes [][]string
+	for _, row := range files["stop_times.txt"] {
+		if row[0] == "C100012023-01-01P" {
+			stopTimes = append(stopTimes, row)
+		}
+	}
+	if len(stopTimes) != 3 {
+		t.Fatalf("expected the pass at Belper to be left out, got %v", stopTimes)
+	}
+	if stopTimes[0][2] != "23:30:00" || stopTimes[0][6] != "" || stopTimes[0][7] != "1" {
+		t.Errorf("expected a pick up only departure at 23:30:00, got %v", stopTimes[0])
+	}
+	if stopTimes[1][1] != "23:55:00" || stopTimes[1][2] != "24:05:00" {
+		t.Errorf("expected times after midnight to continue past 24:00, got %v", stopTimes[1])
+	}
+	if stopTimes[2][1] != "24:20:00" || stopTimes[2][6] != "1" {
+		t.Errorf("expected a set down only arrival at 24:20:00, got %v", stopTimes[2])
+	}
+
+	stops := map[string][]string{}
+	for _, row := range files["stops.txt"] {
+		stops[row[0]] = row
+	}
+	if len(stops) != 3 || stops["DRBY"][1] != "DBY" || stops["DRBY"][2] != "DERBY" || stops["CHFD"][2] != "CHFD" {
+		t.Errorf("expected stops for the calls made, named from the TIPLOC table, got %v", stops)
+	}
+}
+
+func TestExport_OutsideDates(t *testing.T) {
+	db := setupTestDB(t)
+	seedRecord(t, db, "P", "1111111", "2023-01-01", "2023-01-31", "0930", "1010")
+
+	files := export(t, db, time.Date(2023, 5, 22, 0, 0, 0, 0, time.UTC), time.Date(2023, 5, 28, 0, 0, 0, 0, time.UTC), gtfs.Options{})
+	if len(files["trips.txt"]) != 0 || len(files["calendar.txt"]) != 0 {
+		t.Errorf("expected no trips for a schedule ending before the export, got %v", files["trips.txt"])
+	}
+}
+
+func TestExport_Coordinates(t *testing.T) {
+	db := setupTestDB(t)
+	db.Create(&schedule.Tiploc{TiplocCode: "DRBY", CrsCode: "DBY", TpsDescription: "DERBY"})
+	db.Create(&schedule.Tiploc{TiplocCode: "SHEFFLD", CrsCode: "SHF", TpsDescription: "SHEFFIELD"})
+	seedRecord(t, db, "P", "1111111", "2023-01-01", "2023-12-31", "2330", "0020")
+
+	filename := filepath.Join(t.TempDir(), "stops.csv")
+	if err := os.WriteFile(filename, []byte("code,lat,lon\nDRBY,52.9166,-1.4633\nSHF,53.3783,-1.4620\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	coordinates, err := gtfs.LoadCoordinates(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := export(t, db, time.Date(2023, 5, 22, 0, 0, 0, 0, time.UTC), time.Date(2023, 5, 28, 0, 0, 0, 0, time.UTC), gtfs.Options{Coordinates: coordinates})
+
+	stops := map[string][]string{}
+	for _, row := range files["stops.txt"] {
+		stops[row[0]] = row
+	}
+	if len(stops) != 2 {
+		t.Fatalf("expected Chesterfield, which has no coordinates, to be left out, got %v", stops)
+	}
+	if got := strings.Join(stops["DRBY"][3:], ","); got != "52.9166,-1.4633" {
+		t.Errorf("expected Derby's coordinates by TIPLOC, got %s", got)
+	}
+	if got := strings.Join(stops["SHEFFLD"][3:], ","); got != "53.3783,-1.462" {
+		t.Errorf("expected Sheffield's coordinates by CRS code, got %s", got)
+	}
+	if len(files["stop_times.txt"]) != 2 {
+		t.Errorf("expected only the calls at stops with coordinates, got %v", files["stop_times.txt"])
+	}
+
+	if err := os.WriteFile(filename, []byte("code,lat,lon\nDRBY,north,-1.4633\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := gtfs.LoadCoordinates(filename); err == nil {
+		t.Error("expected an invalid latitude to be an error")
+	}
+	if err := os.WriteFile(filename, []byte("tiploc,latitude,longitude\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := gtfs.LoadCoordinates(filename); err == nil {
+		t.Error("expected a header without code, lat and lon to be an error")
+	}
+}
+
+func TestExport_BankHolidays(t *testing.T) {
+	db := setupTestDB(t)
+	seedRecord(t, db, "P", "1111111", "2023-01-01", "2024-12-31", "0930", "1010")
+	if err := db.Model(&schedule.Schedule{}).Where("cif_train_uid = ?", "C10001").
+		Update("cif_bank_holiday_running", "X").Error; err != nil {
+		t.Fatal(err)
+	}
+	opts := gtfs.Options{Calendar: calendar.Default()}
+
+	// The spring bank holiday on Monday 29th May 2023
+	from, to := time.Date(2023, 5, 26, 0, 0, 0, 0, time.UTC), time.Date(2023, 5, 31, 0, 0, 0, 0, time.UTC)
+	files := export(t, db, from, to, opts)
+	if len(files["calendar_dates.txt"]) != 1 || strings.Join(files["calendar_dates.txt"][0], ",") != "C100012023-01-01P,20230529,2" {
+		t.Errorf("expected the bank holiday to be removed from the service, got %v", files["calendar_dates.txt"])
+	}
+	files = export(t, db, from, to, gtfs.Options{})
+	if len(files["calendar_dates.txt"]) != 0 {
+		t.Errorf("expected no bank holidays without a calendar, got %v", files["calendar_dates.txt"])
+	}
+
+	// Christmas Day on a Wednesday isn't a bank holiday Monday
+	files = export(t, db, time.Date(2024, 12, 23, 0, 0, 0, 0, time.UTC), time.Date(2024, 12, 27, 0, 0, 0, 0, time.UTC), opts)
+	if len(files["trips.txt"]) != 1 || len(files["calendar_dates.txt"]) != 0 {
+		t.Errorf("expected the train to run on Christmas Day, got %v", files["calendar_dates.txt"])
+	}
+}
+
+func TestExport_FirstPublicCallAfterMidnight(t *testing.T) {
+	db := setupTestDB(t)
+	// An empty stock move out of Derby before midnight that picks up passengers at Chesterfield after it
+	sch := schedule.Schedule{
+		CIFStpIndicator:   "P",
+		SignallingID:      "2F90",
+		CIFTrainUID:       "C10002",
+		Source:            "Feed",
+		ScheduleDaysRuns:  "1111111",
+		ScheduleStartDate: "2023-01-01",
+		ScheduleEndDate:   "2023-12-31",
+		CIFTrainCategory:  "OO",
+		AtocCode:          "EM",
+		ScheduleLocation: []schedule.ScheduleLocation{
+			{RecordIdentity: "LO", TiplocCode: "DRBY", Departure: "2350"},
+			{RecordIdentity: "LI", TiplocCode: "CHFD", Arrival: "0004H", Departure: "0005", PublicArrival: "0004", PublicDeparture: "0005"},
+			{RecordIdentity: "LT", TiplocCode: "SHEFFLD", Arrival: "0020", PublicArrival: "0020"},
+		},
+	}
+	sch.AugmentSchedule()
+	if err := db.Create(&sch).Error; err != nil {
+		t.Fatal("failed to seed schedule:", err)
+	}
+
+	files := export(t, db, time.Date(2023, 5, 22, 0, 0, 0, 0, time.UTC), time.Date(2023, 5, 28, 0, 0, 0, 0, time.UTC), gtfs.Options{})
+
+	stopTimes := files["stop_times.txt"]
+	if len(stopTimes) != 2 {
+		t.Fatalf("expected the calls at Chesterfield and Sheffield, got %v", stopTimes)
+	}
+	if stopTimes[0][1] != "24:04:00" || stopTimes[0][2] != "24:05:00" {
+		t.Errorf("expected the first public call to be after midnight, at 24:04:00 and 24:05:00, got %v", stopTimes[0])
+	}
+	if stopTimes[1][1] != "24:20:00" {
+		t.Errorf("expected the arrival at Sheffield at 24:20:00, got %v", stopTimes[1])
+	}
+}
@@ -0,0 +1,109 @@
+package schedule
+
+import "strings"
+
+// Activity is one of the activities at a location in a schedule, such as T, stops to take up and set down
+// passengers.
+type Activity struct {
+	Code        string `json:"code"`
+	Description string `json:"description"`
+}
+
+type ActivityDescription struct {
+	Code        string
+	Description string
+}
+
+var activityDescriptions = []ActivityDescription{
+	{"A", "Stops or shunts for other trains to pass"},
+	{"AE", "Attach/detach assisting locomotive"},
+	{"AX", "Shows as 'X' on arrival"},
+	{"BL", "Stops for banking locomotive"},
+	{"C", "Stops to change trainmen"},
+	{"D", "Stops to set down passengers"},
+	{"-D", "Stops to detach vehicles"},
+	{"E", "Stops for examination"},
+	{"G", "National Rail Timetable data to add"},
+	{"H", "Notional activity to prevent WTT timing columns merge"},
+	{"HH", "Notional activity to prevent WTT timing columns merge, where a third column is involved"},
+	{"K", "Passenger count point"},
+	{"KC", "Ticket collection and examination point"},
+	{"KE", "Ticket examination point"},
+	{"KF", "Ticket examination point, 1st class only"},
+	{"KS", "Selective ticket examination point"},
+	{"L", "Stops to change locomotives"},
+	{"N", "Stop not advertised"},
+	{"OP", "Stops for other operating reasons"},
+	{"OR", "Train locomotive on rear"},
+	{"PR", "Propelling between points shown"},
+	{"R", "Stops when required"},
+	{"RM", "Reversing movement, or driver changes ends"},
+	{"RR", "Stops for locomotive to run round train"},
+	{"S", "Stops for railway personnel only"},
+	{"T", "Stops to take up and set down passengers"},
+	{"-T", "Stops to attach and detach vehicles"},
+	{"TB", "Train begins"},
+	{"TF", "Train finishes"},
+	{"TS", "Detail consist for TOPS Direct requested by EWS"},
+	{"TW", "Stops (or at pick-up only) for tablet, staff or token"},
+	{"U", "Stops to take up passengers"},
+	{"-U", "Stops to attach vehicles"},
+	{"W", "Stops for watering of coaches"},
+	{"X", "Passes another train at crossing point on single line"},
+}
+
+func GetActivityDescription(code string) string {
+	for _, ad := range activityDescriptions {
+		if ad.Code == code {
+			return ad.Description
+		}
+	}
+	return "Description not found"
+}
+
+// ParseActivities splits a CIF activity field, up to six two-character codes run together, into its codes. Single
+// character codes are padded with a space, which is removed.
+func ParseActivities(field string) []string {
+	var codes []string
+	for i := 0; i < len(field); i += 2 {
+		if code := strings.TrimSpace(field[i:min(i+2, len(field))]); code != "" {
+			codes = append(codes, code)
+		}
+	}
+	return codes
+}
+
+// DecodeActivity fills in the activities at the location, with their descriptions, and the calling flags derived
+// from them. Schedules from the feed don't have activities, so whether passengers are taken up or set down is
+// decided from the public times instead, as it is for the origin (TB) and terminus (TF) of VSTP schedules and for
+// request stops (R) without any other passenger activity.
+func (l *ScheduleLocation) DecodeActivity() {
+	l.Activities = nil
+	codes := make(map[string]bool)
+	for _, code := range ParseActivities(l.Activity) {
+		l.Activities = append(l.Activities, Activity{Code: code, Description: GetActivityDescription(code)})
+		codes[code] = true
+	}
+
+	stops := !l.Arrival.IsZero() || !l.Departure.IsZero()
+	l.Passes = !stops && !l.Pass.IsZero()
+	l.TakesUp, l.SetsDown = false, false
+	switch {
+	case !stops:
+	case codes["T"] || codes["U"] || codes["D"]:
+		l.TakesUp = codes["T"] || codes["U"]
+		l.SetsDown = codes["T"] || codes["D"]
+	default:
+		l.TakesUp = !l.PublicDeparture.IsZero()
+		l.SetsDown = !l.PublicArrival.IsZero()
+	}
+	l.RequestStop = codes["R"]
+	l.Unadvertised = codes["N"]
+	l.OperationalStop = stops && !l.TakesUp && !l.SetsDown
+}
+
+// IsPublicStop reports whether passengers can join or leave the train at the location, which is only known once
+// DecodeActivity has been called.
+func (l *ScheduleLocation) IsPublicStop() bool {
+	return (l.TakesUp || l.SetsDown) && !l.Unadvertised
+}
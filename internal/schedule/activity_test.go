@@ -0,0 +1,104 @@
+package schedule
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseActivities(t *testing.T) {
+	tests := map[string][]string{
+		"":             nil,
+		"            ": nil,
+		"T ":           {"T"},
+		"TB":           {"TB"},
+		"T RMOP":       {"T", "RM", "OP"},
+		"-DN ":         {"-D", "N"},
+		"TBA":          {"TB", "A"},
+	}
+	for field, want := range tests {
+		if got := ParseActivities(field); !reflect.DeepEqual(got, want) {
+			t.Errorf("ParseActivities(%q) = %q, want %q", field, got, want)
+		}
+	}
+}
+
+func TestDecodeActivity(t *testing.T) {
+	type flags struct {
+		takesUp, setsDown, requestStop, unadvertised, operationalStop, passes bool
+	}
+	tests := map[string]struct {
+		loc  ScheduleLocation
+		want flags
+	}{
+		"public stop": {
+			loc:  ScheduleLocation{Activity: "T ", Arrival: "1000", Departure: "1001", PublicArrival: "1000", PublicDeparture: "1001"},
+			want: flags{takesUp: true, setsDown: true},
+		},
+		"set down only": {
+			loc:  ScheduleLocation{Activity: "D ", Arrival: "1000", Departure: "1001", PublicArrival: "1000", PublicDeparture: "1001"},
+			want: flags{setsDown: true},
+		},
+		"take up only": {
+			loc:  ScheduleLocation{Activity: "U ", Arrival: "1000", Departure: "1001", PublicDeparture: "1001"},
+			want: flags{takesUp: true},
+		},
+		"request stop": {
+			loc:  ScheduleLocation{Activity: "R ", Arrival: "1000", Departure: "1001", PublicArrival: "1000", PublicDeparture: "1001"},
+			want: flags{takesUp: true, setsDown: true, requestStop: true},
+		},
+		"unadvertised stop": {
+			loc:  ScheduleLocation{Activity: "N T ", Arrival: "1000", Departure: "1001"},
+			want: flags{takesUp: true, setsDown: true, unadvertised: true},
+		},
+		"operational stop": {
+			loc:  ScheduleLocation{Activity: "OPRM", Arrival: "1000", Departure: "1005"},
+			want: flags{operationalStop: true},
+		},
+		"pass": {
+			loc:  ScheduleLocation{Pass: "1000H"},
+			want: flags{passes: true},
+		},
+		"VSTP origin": {
+			loc:  ScheduleLocation{Activity: "TB", Departure: "1000", PublicDeparture: "1000"},
+			want: flags{takesUp: true},
+		},
+		"empty stock terminus": {
+			loc:  ScheduleLocation{Activity: "TF", Arrival: "1000"},
+			want: flags{operationalStop: true},
+		},
+		"feed stop without public times": {
+			loc:  ScheduleLocation{Arrival: "1000", Departure: "1001"},
+			want: flags{operationalStop: true},
+		},
+		"feed set down only": {
+			loc:  ScheduleLocation{Arrival: "1000", Departure: "1001", PublicArrival: "1000"},
+			want: flags{setsDown: true},
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			loc := tt.loc
+			loc.DecodeActivity()
+			got := flags{loc.TakesUp, loc.SetsDown, loc.RequestStop, loc.Unadvertised, loc.OperationalStop, loc.Passes}
+			if got != tt.want {
+				t.Errorf("got flags %+v, want %+v", got, tt.want)
+			}
+			if want := (got.takesUp || got.setsDown) && !got.unadvertised; loc.IsPublicStop() != want {
+				t.Errorf("expected IsPublicStop to be %v", want)
+			}
+		})
+	}
+}
+
+func TestDecodeActivityDescriptions(t *testing.T) {
+	loc := ScheduleLocation{Activity: "T RMXX", Arrival: "1000", Departure: "1001"}
+	loc.DecodeActivity()
+	want := []Activity{
+		{Code: "T", Description: "Stops to take up and set down passengers"},
+		{Code: "RM", Description: "Reversing movement, or driver changes ends"},
+		{Code: "XX", Description: "Description not found"},
+	}
+	if !reflect.DeepEqual(loc.Activities, want) {
+		t.Errorf("got activities %+v, want %+v", loc.Activities, want)
+	}
+}
@@ -0,0 +1,191 @@
+package schedule
+
+import (
+	"log/slog"
+	"sort"
+	"strings"
+	"time"
+)
+
+// JSONAssociationV1 is an association record from the schedule feed, linking two trains at a location where one
+// joins or divides from the other, or where one forms the next working of the other.
+type JSONAssociationV1 struct {
+	TransactionType     string `json:"transaction_type"`
+	MainTrainUID        string `json:"main_train_uid"`
+	AssocTrainUID       string `json:"assoc_train_uid"`
+	AssocStartDate      string `json:"assoc_start_date"`
+	AssocEndDate        string `json:"assoc_end_date"`
+	AssocDays           string `json:"assoc_days"`
+	Category            string `json:"category"`
+	DateIndicator       string `json:"date_indicator"`
+	Location            string `json:"location"`
+	BaseLocationSuffix  string `json:"base_location_suffix"`
+	AssocLocationSuffix string `json:"assoc_location_suffix"`
+	DiagramType         string `json:"diagram_type"`
+	CIFStpIndicator     string `json:"CIF_stp_indicator"`
+}
+
+// Association represents an association between two train schedules.
+type Association struct {
+	ID uint64 `gorm:"primaryKey" json:"-"`
+	// An association is uniquely identified by its main and associated train UIDs, start date, location and STP indicator
+	CombinedID string `gorm:"index" json:"-"`
+	// This is 'Feed' for the schedule feed file
+	Source string `json:"source,omitempty"`
+
+	CreatedAt   time.Time `json:"-"`
+	PublishedAt time.Time `json:"published_at,omitempty"`
+
+	TransactionType          string `json:"transaction_type,omitempty"`
+	MainTrainUID             string `gorm:"index" json:"main_train_uid"`
+	AssocTrainUID            string `gorm:"index" json:"assoc_train_uid"`
+	AssocStartDate           string `json:"assoc_start_date"`
+	AssocEndDate             string `json:"assoc_end_date"`
+	AssocDays                string `json:"assoc_days"`
+	Category                 string `json:"category"`
+	CategoryDescription      string `json:"category_description,omitempty"`
+	DateIndicator            string `json:"date_indicator,omitempty"`
+	DateIndicatorDescription string `json:"date_indicator_description,omitempty"`
+	Location                 string `json:"location"`
+	BaseLocationSuffix       string `json:"base_location_suffix,omitempty"`
+	AssocLocationSuffix      string `json:"assoc_location_suffix,omitempty"`
+	DiagramType              string `json:"diagram_type,omitempty"`
+	CIFStpIndicator          string `gorm:"index" json:"CIF_stp_indicator"`
+
+	// Derived fields
+	AssocStartDateTS int64 `json:"-"`
+	AssocEndDateTS   int64 `json:"-"`
+}
+
+type AssociationCategoryDescription struct {
+	Code        string
+	Description string
+}
+
+var associationCategoryDescriptions = []AssociationCategoryDescription{
+	{"JJ", "Join"},
+	{"VV", "Divide"},
+	{"NP", "Next"},
+}
+
+func GetAssociationCategoryDescription(code string) string {
+	for _, cd := range associationCategoryDescriptions {
+		if cd.Code == code {
+			return cd.Description
+		}
+	}
+	return "Description not found"
+}
+
+type AssociationDateIndicatorDescription struct {
+	Code        string
+	Description string
+}
+
+var associationDateIndicatorDescriptions = []AssociationDateIndicatorDescription{
+	{"S", "Standard (same day)"},
+	{"N", "Over next-midnight"},
+	{"P", "Over previous-midnight"},
+}
+
+func GetAssociationDateIndicatorDescription(code string) string {
+	for _, dd := range associationDateIndicatorDescriptions {
+		if dd.Code == code {
+			return dd.Description
+		}
+	}
+	return ""
+}
+
+func (s *ScheduleFeedRecord) IsAssociation() bool {
+	return s.Association.MainTrainUID != ""
+}
+
+func (a *JSONAssociationV1) ToAssociation(publishedAt time.Time) (assoc Association) {
+	assoc.Source = "Feed"
+	assoc.PublishedAt = publishedAt
+
+	assoc.TransactionType = a.TransactionType
+	assoc.MainTrainUID = a.MainTrainUID
+	assoc.AssocTrainUID = a.AssocTrainUID
+	assoc.AssocStartDate = a.AssocStartDate
+	assoc.AssocEndDate = a.AssocEndDate
+	assoc.AssocDays = a.AssocDays
+	assoc.Category = a.Category
+	assoc.DateIndicator = a.DateIndicator
+	assoc.Location = a.Location
+	assoc.BaseLocationSuffix = a.BaseLocationSuffix
+	assoc.AssocLocationSuffix = a.AssocLocationSuffix
+	assoc.DiagramType = a.DiagramType
+	assoc.CIFStpIndicator = a.CIFStpIndicator
+
+	return assoc
+}
+
+// AugmentAssociation enriches the association with human-readable descriptions and computed fields.
+func (assoc *Association) AugmentAssociation() error {
+	assoc.MainTrainUID = strings.TrimSpace(assoc.MainTrainUID)
+	assoc.AssocTrainUID = strings.TrimSpace(assoc.AssocTrainUID)
+	assoc.CategoryDescription = GetAssociationCategoryDescription(assoc.Category)
+	assoc.DateIndicatorDescription = GetAssociationDateIndicatorDescription(assoc.DateIndicator)
+
+	// The feed gives association dates as timestamps (e.g. 2023-05-21T00:00:00Z), but only the date is significant
+	if len(assoc.AssocStartDate) > 10 {
+		assoc.AssocStartDate = assoc.AssocStartDate[:10]
+	}
+	if len(assoc.AssocEndDate) > 10 {
+		assoc.AssocEndDate = assoc.AssocEndDate[:10]
+	}
+
+	layout := "2006-01-02 15:04:05"
+
+	ts, err := time.Parse(layout, assoc.AssocStartDate+" 00:00:00")
+	if err != nil {
+		slog.Warn("Failed to parse start date for association", "error", err)
+	} else {
+		assoc.AssocStartDateTS = ts.Unix()
+	}
+
+	ts, err = time.Parse(layout, assoc.AssocEndDate+" 23:59:59")
+	if err != nil {
+		slog.Warn("Failed to parse end date for association", "error", err)
+	} else {
+		assoc.AssocEndDateTS = ts.Unix()
+	}
+
+	assoc.CombinedID = assoc.MainTrainUID + assoc.AssocTrainUID + assoc.AssocStartDate + assoc.Location + assoc.BaseLocationSuffix + assoc.CIFStpIndicator
+
+	return nil
+}
+
+// ResolveAssociations applies the STP precedence rules to associations valid on a single date. Associations between
+// the same two trains at the same location are ranked C, N, O, P (most recently published first within an
+// indicator) and only the winner is kept; associations cancelled on the date are dropped.
+func ResolveAssociations(associations []Association) []Association {
+	var keys []string
+	byKey := make(map[string][]Association)
+	for _, assoc := range associations {
+		key := assoc.MainTrainUID + assoc.AssocTrainUID + assoc.Location + assoc.BaseLocationSuffix
+		if _, ok := byKey[key]; !ok {
+			keys = append(keys, key)
+		}
+		byKey[key] = append(byKey[key], assoc)
+	}
+
+	var resolved []Association
+	for _, key := range keys {
+		candidates := byKey[key]
+		sort.SliceStable(candidates, func(i, j int) bool {
+			ri, rj := stpRank(candidates[i].CIFStpIndicator), stpRank(candidates[j].CIFStpIndicator)
+			if ri != rj {
+				return ri < rj
+			}
+			return candidates[i].PublishedAt.After(candidates[j].PublishedAt)
+		})
+		if candidates[0].CIFStpIndicator == "C" {
+			continue
+		}
+		resolved = append(resolved, candidates[0])
+	}
+	return resolved
+}
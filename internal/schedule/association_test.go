@@ -0,0 +1,54 @@
+package schedule
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+const associationLine = `{"JsonAssociationV1":{"transaction_type":"Create","main_train_uid":"W12345","assoc_train_uid":"W12399","assoc_start_date":"2023-05-21T00:00:00Z","assoc_end_date":"2023-12-03T00:00:00Z","assoc_days":"0000001","category":"VV","date_indicator":"S","location":"HYWRDSH","base_location_suffix":null,"assoc_location_suffix":null,"diagram_type":"T","CIF_stp_indicator":"P"}}`
+
+func TestUnmarshalJSONAndAugmentAssociation(t *testing.T) {
+	var record ScheduleFeedRecord
+	if err := json.Unmarshal([]byte(associationLine), &record); err != nil {
+		t.Fatal("Failed to unmarshal JSON:", err)
+	}
+
+	if !record.IsAssociation() {
+		t.Fatal("expected record to be recognised as an association")
+	}
+	if record.IsSchedule() || record.IsTiploc() || record.IsMetadata() {
+		t.Error("expected association not to be recognised as any other record type")
+	}
+
+	assoc := record.Association.ToAssociation(time.Time{})
+	assoc.AugmentAssociation()
+
+	expect(assoc.MainTrainUID, "MainTrainUID", "W12345", t)
+	expect(assoc.AssocTrainUID, "AssocTrainUID", "W12399", t)
+	expect(assoc.Location, "Location", "HYWRDSH", t)
+	expect(assoc.CategoryDescription, "CategoryDescription", "Divide", t)
+	expect(assoc.AssocStartDate, "AssocStartDate", "2023-05-21", t)
+	expect(assoc.AssocEndDate, "AssocEndDate", "2023-12-03", t)
+	expect(assoc.CombinedID, "CombinedID", "W12345W123992023-05-21HYWRDSHP", t)
+	if assoc.AssocStartDateTS == 0 || assoc.AssocEndDateTS == 0 {
+		t.Error("expected association dates to be converted to timestamps")
+	}
+}
+
+func TestResolveAssociations(t *testing.T) {
+	permanent := Association{MainTrainUID: "W12345", AssocTrainUID: "W12399", Location: "HYWRDSH", Category: "VV", CIFStpIndicator: "P"}
+	overlay := permanent
+	overlay.Category = "JJ"
+	overlay.CIFStpIndicator = "O"
+	elsewhere := Association{MainTrainUID: "W12345", AssocTrainUID: "W12377", Location: "BRGHTN", Category: "NP", CIFStpIndicator: "P"}
+	cancellation := elsewhere
+	cancellation.CIFStpIndicator = "C"
+
+	resolved := ResolveAssociations([]Association{permanent, elsewhere, overlay, cancellation})
+	if len(resolved) != 1 {
+		t.Fatalf("expected 1 association after resolution, got %d", len(resolved))
+	}
+	expect(resolved[0].CIFStpIndicator, "CIFStpIndicator", "O", t)
+	expect(resolved[0].Category, "Category", "JJ", t)
+}
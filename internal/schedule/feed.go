@@ -1,21 +1,25 @@
 package schedule
 
-import "time"
+import (
+	"strings"
+	"time"
+)
 
-// All lines in the schedule record contain one of three types:
-// JsonTimetableV1 (metadata), JsonScheduleV1 (a schedule), or TiplocV1 (a location).
+// All lines in the schedule record contain one of four types:
+// JsonTimetableV1 (metadata), JsonScheduleV1 (a schedule), JsonAssociationV1 (an association) or TiplocV1 (a location).
 type ScheduleFeedRecord struct {
-	Timetable      Timetable      `json:"JsonTimetableV1,omitempty"`
-	JSONScheduleV1 JSONScheduleV1 `json:"JsonScheduleV1,omitempty"`
-	Tiploc         Tiploc         `json:"TiplocV1,omitempty"`
+	Timetable      Timetable         `json:"JsonTimetableV1,omitempty"`
+	JSONScheduleV1 JSONScheduleV1    `json:"JsonScheduleV1,omitempty"`
+	Association    JSONAssociationV1 `json:"JsonAssociationV1,omitempty"`
+	Tiploc         Tiploc            `json:"TiplocV1,omitempty"`
 }
 
 type Tiploc struct {
 	TransactionType string `json:"transaction_type"`
 	TiplocCode      string `gorm:"index" json:"tiploc_code"`
 	Nalco           string `json:"nalco"`
-	Stanox          string `json:"stanox"`
-	CrsCode         string `json:"crs_code"`
+	Stanox          string `gorm:"index" json:"stanox"`
+	CrsCode         string `gorm:"index" json:"crs_code"`
 	Description     string `json:"description"`
 	TpsDescription  string `json:"tps_description"`
 }
@@ -25,7 +29,12 @@ type Timetable struct {
 	Timestamp      int               `json:"timestamp"`
 	Owner          string            `json:"owner"`
 	Sender         TimetableSender   `json:"Sender" gorm:"-:all"`
-	Metadata       TimetableMetadata `json:"Metadata" gorm:"-:all"`
+	Metadata       TimetableMetadata `json:"Metadata" gorm:"embedded;embeddedPrefix:metadata_"`
+}
+
+// IsUpdate reports whether the timetable heads a daily update file (CIF_ALL_UPDATE_DAILY) rather than a full extract.
+func (t *Timetable) IsUpdate() bool {
+	return strings.EqualFold(t.Metadata.Type, "update")
 }
 
 type TimetableSender struct {
@@ -39,6 +48,14 @@ type TimetableMetadata struct {
 	Sequence int    `json:"sequence"`
 }
 
+// FeedLoadProgress records how many lines of a full extract, after its metadata, have been loaded, so that a load
+// that's interrupted can carry on from where it stopped. It's removed once the load is complete.
+type FeedLoadProgress struct {
+	TimetableTimestamp int `gorm:"primaryKey;autoIncrement:false"`
+	Lines              int64
+	UpdatedAt          time.Time
+}
+
 type JSONScheduleV1 struct {
 	CIFBankHolidayRunning string `json:"CIF_bank_holiday_running"`
 	CIFStpIndicator       string `json:"CIF_stp_indicator"`
@@ -34,5 +34,5 @@ func TestUnmarshalJSONAndAugmentJSONSchedule(t *testing.T) {
 	expect(schedule.ScheduleEndDate, "ScheduleEndDate", "2023-12-03", t)
 	expect(schedule.ScheduleLocation[0].TiplocCode, "Location 0 TiplocCode", "DRBY", t)
 	expect(schedule.ScheduleLocation[0].RecordIdentity, "Location 0 LocationType", "LO", t)
-	expect(schedule.ScheduleLocation[0].Departure, "Location 0 Departure", "0756", t)
+	expect(schedule.ScheduleLocation[0].Departure, "Location 0 Departure", WTTTime("0756"), t)
 }
@@ -0,0 +1,84 @@
+package schedule
+
+import "time"
+
+// The states of a RefreshJob.
+const (
+	RefreshJobRunning   = "running"
+	RefreshJobSucceeded = "succeeded"
+	RefreshJobFailed    = "failed"
+)
+
+// RefreshJob records a load of the schedule feed file, whichever process ran it, so its progress and outcome can be
+// looked up while and after it runs.
+type RefreshJob struct {
+	ID         uint64     `gorm:"primaryKey" json:"id"`
+	Filename   string     `json:"filename"`
+	State      string     `gorm:"index" json:"state"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	// The number of each kind of record loaded from the file
+	Schedules    int64  `json:"schedules"`
+	Tiplocs      int64  `json:"tiplocs"`
+	Associations int64  `json:"associations"`
+	Error        string `json:"error,omitempty"`
+
+	// The progress of the load, updated while it runs. BytesRead and BytesTotal are of the file as it's stored, so
+	// of the compressed data if it's gzipped.
+	BytesRead  int64 `json:"bytes_read"`
+	BytesTotal int64 `json:"bytes_total"`
+	Lines      int64 `json:"lines"`
+	// EstimatedFinishAt is when the file is expected to have been read, going by how quickly it's being read
+	EstimatedFinishAt *time.Time `json:"estimated_finish_at,omitempty"`
+	// IssueCounts are the number of each kind of RefreshIssue found in the file, once the job has finished
+	IssueCounts map[string]int64 `gorm:"serializer:json" json:"issue_counts,omitempty"`
+}
+
+// PercentRead is how much of the file has been read, as a percentage.
+func (j RefreshJob) PercentRead() int64 {
+	if j.BytesTotal == 0 {
+		return 0
+	}
+	return min(100, j.BytesRead*100/j.BytesTotal)
+}
+
+// IssueTotal is the number of issues of any kind found in the file.
+func (j RefreshJob) IssueTotal() int64 {
+	var total int64
+	for _, count := range j.IssueCounts {
+		total += count
+	}
+	return total
+}
+
+// The kinds of RefreshIssue.
+const (
+	IssueUnparseableLine = "unparseable_line"
+	IssueUnknownTiploc   = "unknown_tiploc"
+	IssueInvalidDaysRun  = "invalid_days_run"
+	IssueInvalidDate     = "invalid_date"
+	IssueDuplicateKey    = "duplicate_key"
+)
+
+// RefreshIssue is a problem found in the feed file loaded by a refresh job. Records with issues are still loaded,
+// apart from unparseable lines, which are skipped.
+type RefreshIssue struct {
+	ID    uint64 `gorm:"primaryKey" json:"-"`
+	JobID uint64 `gorm:"index" json:"-"`
+	Kind  string `json:"kind"`
+	// Line is the line of the file the issue is on, counting from 1, or 0 for issues found once the file was loaded
+	Line int64 `json:"line,omitempty"`
+	// Key identifies the record: the CombinedID of a schedule or association, or the code of a tiploc
+	Key    string `json:"key,omitempty"`
+	Detail string `json:"detail"`
+}
+
+// RefreshLease is held by the job loading the schedule feed, so that the web service and syncd, which share the
+// database, never load it at the same time. The job renews the lease while it runs; one that's expired was left
+// by a process that stopped without releasing it, and can be taken over.
+type RefreshLease struct {
+	Name  string `gorm:"primaryKey"`
+	JobID uint64
+	// ExpiresAt is a Unix timestamp, in seconds
+	ExpiresAt int64
+}
@@ -71,28 +71,57 @@ type Schedule struct {
 	TimeOfDepartureFromOrigin    string `json:"time_of_departure_from_origin,omitempty"`
 	TimeOfArrivalAtDestinationTS int64  `json:"time_of_arrival_at_destination_ts"`
 	TimeOfArrivalAtDestination   string `json:"time_of_arrival_at_destination,omitempty"`
+
+	// Set when an STP cancellation governs the schedule on the requested date. Cancellation is the 'C' record.
+	Cancelled    bool      `gorm:"-" json:"cancelled,omitempty"`
+	Cancellation *Schedule `gorm:"-" json:"cancellation,omitempty"`
+
+	// Associations with other trains (joins, divides and next workings) valid on the requested date
+	Associations []Association `gorm:"-" json:"associations,omitempty"`
+
+	// The date the schedule runs on, as YYYY-MM-DD, when it's resolved for a date
+	RunDate string `gorm:"-" json:"run_date,omitempty"`
 }
 
 // ScheduleLocation represents a location associated with a schedule, including arrival/departure times and other details.
 type ScheduleLocation struct {
-	ID                   int    `gorm:"primaryKey"`
-	ScheduleID           uint64 `gorm:"index"`
-	LocationType         string `json:"location_type,omitempty"`
-	RecordIdentity       string `json:"record_identity,omitempty"`
-	TiplocCode           string `gorm:"index" json:"tiploc_code,omitempty"`
-	TiplocInstance       string `json:"tiploc_instance,omitempty"`
-	Departure            string `json:"departure,omitempty"`
-	PublicDeparture      string `json:"public_departure,omitempty"`
-	Platform             string `json:"platform,omitempty"`
-	Line                 string `json:"line,omitempty"`
-	EngineeringAllowance string `json:"engineering_allowance,omitempty"`
-	PathingAllowance     string `json:"pathing_allowance,omitempty"`
-	PerformanceAllowance string `json:"performance_allowance,omitempty"`
-	Arrival              string `json:"arrival,omitempty"`
-	PublicArrival        string `json:"public_arrival,omitempty"`
-	Pass                 string `json:"pass,omitempty"`
-	Path                 string `json:"path,omitempty"`
-	Tiploc               Tiploc `gorm:"foreignKey:TiplocCode;references:TiplocCode"`
+	ID                   int     `gorm:"primaryKey"`
+	ScheduleID           uint64  `gorm:"index"`
+	LocationType         string  `json:"location_type,omitempty"`
+	RecordIdentity       string  `json:"record_identity,omitempty"`
+	TiplocCode           string  `gorm:"index" json:"tiploc_code,omitempty"`
+	TiplocInstance       string  `json:"tiploc_instance,omitempty"`
+	Departure            WTTTime `json:"departure,omitempty"`
+	PublicDeparture      WTTTime `json:"public_departure,omitempty"`
+	Platform             string  `json:"platform,omitempty"`
+	Line                 string  `json:"line,omitempty"`
+	EngineeringAllowance string  `json:"engineering_allowance,omitempty"`
+	PathingAllowance     string  `json:"pathing_allowance,omitempty"`
+	PerformanceAllowance string  `json:"performance_allowance,omitempty"`
+	Arrival              WTTTime `json:"arrival,omitempty"`
+	PublicArrival        WTTTime `json:"public_arrival,omitempty"`
+	Pass                 WTTTime `json:"pass,omitempty"`
+	Path                 string  `json:"path,omitempty"`
+	Activity             string  `json:"activity,omitempty"`
+	Tiploc               Tiploc  `gorm:"foreignKey:TiplocCode;references:TiplocCode"`
+
+	// Derived from the activity and times by DecodeActivity. OperationalStop is a stop that isn't for passengers.
+	Activities      []Activity `gorm:"-" json:"activities,omitempty"`
+	TakesUp         bool       `gorm:"-" json:"takes_up,omitempty"`
+	SetsDown        bool       `gorm:"-" json:"sets_down,omitempty"`
+	RequestStop     bool       `gorm:"-" json:"request_stop,omitempty"`
+	Unadvertised    bool       `gorm:"-" json:"unadvertised,omitempty"`
+	OperationalStop bool       `gorm:"-" json:"operational_stop,omitempty"`
+	Passes          bool       `gorm:"-" json:"passes,omitempty"`
+
+	// Set by SetCallTimes for the date the schedule runs on. DayOffset is the number of days after the train starts its
+	// journey that it's at the location.
+	DayOffset         int   `gorm:"-" json:"day_offset,omitempty"`
+	ArrivalTS         int64 `gorm:"-" json:"arrival_ts,omitempty"`
+	DepartureTS       int64 `gorm:"-" json:"departure_ts,omitempty"`
+	PassTS            int64 `gorm:"-" json:"pass_ts,omitempty"`
+	PublicArrivalTS   int64 `gorm:"-" json:"public_arrival_ts,omitempty"`
+	PublicDepartureTS int64 `gorm:"-" json:"public_departure_ts,omitempty"`
 }
 
 type TrainCategoryDescription struct {
@@ -535,3 +564,20 @@ func (schedule *Schedule) AugmentSchedule() error {
 
 	return nil
 }
+
+// Models returns the models stored in the database, in the order they're migrated.
+func Models() []any {
+	return []any{
+		&ScheduleLocation{},
+		&Schedule{},
+		&Tiploc{},
+		&Timetable{},
+		&Association{},
+		&VSTPAuditEntry{},
+		&ProcessedVSTPMessage{},
+		&FeedLoadProgress{},
+		&RefreshJob{},
+		&RefreshLease{},
+		&RefreshIssue{},
+	}
+}
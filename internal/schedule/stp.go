@@ -0,0 +1,139 @@
+package schedule
+
+import (
+	"log/slog"
+	"sort"
+	"time"
+)
+
+// stpPrecedence orders STP indicators so that, for any date, the record that governs the train sorts first:
+// C (cancellation) beats N (STP new), which beats O (overlay), which beats P (permanent).
+var stpPrecedence = map[string]int{
+	"C": 0,
+	"N": 1,
+	"O": 2,
+	"P": 3,
+}
+
+func stpRank(indicator string) int {
+	if rank, ok := stpPrecedence[indicator]; ok {
+		return rank
+	}
+	return len(stpPrecedence)
+}
+
+/*
+ResolveSTP applies the STP precedence rules to all of the records for a single train UID that are valid on the given
+date, and returns the schedule that actually runs on that date.
+
+Records are ranked C, N, O, P. Where two records share an indicator (e.g. an overlay in the feed that has since been
+re-issued through VSTP) the most recently published wins. The winning record is then interpreted as follows:
+
+  - P or N: returned as-is.
+  - O: applied on top of the permanent schedule, if there is one, otherwise returned as-is.
+  - C: the schedule it cancels is returned flagged as Cancelled, with the cancellation record attached.
+
+The second return value is false if records is empty.
+*/
+func ResolveSTP(records []Schedule, datetime int64) (Schedule, bool) {
+	if len(records) == 0 {
+		return Schedule{}, false
+	}
+
+	sorted := sortByPrecedence(records)
+	winner := sorted[0]
+
+	var permanent *Schedule
+	for idx := range sorted {
+		if sorted[idx].CIFStpIndicator == "P" {
+			permanent = &sorted[idx]
+			break
+		}
+	}
+
+	switch winner.CIFStpIndicator {
+	case "C":
+		// Return the schedule being cancelled, so clients can still see which train isn't running. Prefer the
+		// permanent schedule, falling back to whichever non-cancellation record ranks next.
+		var cancelled *Schedule
+		if permanent != nil {
+			cancelled = permanent
+		} else {
+			for idx := range sorted {
+				if sorted[idx].CIFStpIndicator != "C" {
+					cancelled = &sorted[idx]
+					break
+				}
+			}
+		}
+		cancellation := winner
+		if cancelled == nil {
+			slog.Debug("Cancellation has no underlying schedule", "combinedid", winner.CombinedID)
+			winner.Cancelled = true
+			winner.Cancellation = &cancellation
+			return winner, true
+		}
+		resolved := *cancelled
+		resolved.Cancelled = true
+		resolved.Cancellation = &cancellation
+		return resolved, true
+
+	case "O":
+		if permanent == nil {
+			slog.Debug("Overlay has no underlying permanent schedule", "combinedid", winner.CombinedID)
+			return winner, true
+		}
+		resolved := *permanent
+		resolved.ApplyOverlays([]Schedule{winner}, datetime)
+		return resolved, true
+	}
+
+	return winner, true
+}
+
+// STPWinner returns the record that governs a train on a date, given all of its records valid on the date, without
+// interpreting it as ResolveSTP does: a cancellation or overlay is returned as the record itself. The second return
+// value is false if records is empty.
+func STPWinner(records []Schedule) (Schedule, bool) {
+	if len(records) == 0 {
+		return Schedule{}, false
+	}
+	return sortByPrecedence(records)[0], true
+}
+
+// RunsOn reports whether the record is valid on date, which is midnight UTC, and its days run include date's day of
+// the week, before STP precedence is applied.
+func (s *Schedule) RunsOn(date time.Time) bool {
+	return s.ScheduleStartDateTS <= date.Unix() && s.ScheduleEndDateTS >= date.Unix()+86399 &&
+		RunsOnDay(s.ScheduleDaysRuns, date)
+}
+
+// RunsOnDay reports whether a CIF days run string, which starts on Monday, includes date's day of the week.
+func RunsOnDay(daysRuns string, date time.Time) bool {
+	index := daysRunIndex(date)
+	return len(daysRuns) >= index && daysRuns[index-1] == '1'
+}
+
+// daysRunIndex returns the 1-based position of date's day of the week in a CIF days run string.
+func daysRunIndex(date time.Time) int {
+	dow := int(date.Weekday())
+	if dow == 0 {
+		dow = 7
+	}
+	return dow
+}
+
+// sortByPrecedence returns a copy of records in STP precedence order, the most recently published first where two
+// records share an indicator.
+func sortByPrecedence(records []Schedule) []Schedule {
+	sorted := make([]Schedule, len(records))
+	copy(sorted, records)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		ri, rj := stpRank(sorted[i].CIFStpIndicator), stpRank(sorted[j].CIFStpIndicator)
+		if ri != rj {
+			return ri < rj
+		}
+		return sorted[i].PublishedAt.After(sorted[j].PublishedAt)
+	})
+	return sorted
+}
@@ -0,0 +1,137 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+func stpRecord(stp, source, signallingID string) Schedule {
+	sch := Schedule{
+		CIFTrainUID:       "C00206",
+		CIFStpIndicator:   stp,
+		Source:            source,
+		SignallingID:      signallingID,
+		ScheduleDaysRuns:  "1111111",
+		ScheduleStartDate: "2023-01-01",
+		ScheduleEndDate:   "2023-12-31",
+	}
+	sch.AugmentSchedule()
+	return sch
+}
+
+func TestResolveSTP_Empty(t *testing.T) {
+	if _, ok := ResolveSTP(nil, 0); ok {
+		t.Error("expected no schedule to be resolved from no records")
+	}
+}
+
+func TestResolveSTP_PermanentOnly(t *testing.T) {
+	resolved, ok := ResolveSTP([]Schedule{stpRecord("P", "Feed", "2A20")}, 1684627200)
+	if !ok {
+		t.Fatal("expected a schedule to be resolved")
+	}
+	expect(resolved.CIFStpIndicator, "CIFStpIndicator", "P", t)
+	expect(resolved.Cancelled, "Cancelled", false, t)
+}
+
+func TestResolveSTP_FeedOverlayBeatsPermanent(t *testing.T) {
+	overlay := stpRecord("O", "Feed", "2A21")
+	overlay.ScheduleLocation = []ScheduleLocation{{TiplocCode: "DRBY"}}
+
+	resolved, ok := ResolveSTP([]Schedule{stpRecord("P", "Feed", "2A20"), overlay}, 1684627200)
+	if !ok {
+		t.Fatal("expected a schedule to be resolved")
+	}
+	expect(resolved.CIFStpIndicator, "CIFStpIndicator", "O", t)
+	expect(resolved.SignallingID, "SignallingID", "2A21", t)
+	expect(resolved.Source, "Source", "Feed,Feed", t)
+	if len(resolved.ScheduleLocation) != 1 {
+		t.Errorf("expected overlay locations to replace permanent locations, got %d", len(resolved.ScheduleLocation))
+	}
+}
+
+func TestResolveSTP_CancellationBeatsOverlay(t *testing.T) {
+	records := []Schedule{
+		stpRecord("O", "VSTP", "2A21"),
+		stpRecord("P", "Feed", "2A20"),
+		stpRecord("C", "Feed", ""),
+	}
+
+	resolved, ok := ResolveSTP(records, 1684627200)
+	if !ok {
+		t.Fatal("expected a schedule to be resolved")
+	}
+	expect(resolved.Cancelled, "Cancelled", true, t)
+	expect(resolved.CIFStpIndicator, "CIFStpIndicator", "P", t)
+	expect(resolved.SignallingID, "SignallingID", "2A20", t)
+	if resolved.Cancellation == nil {
+		t.Fatal("expected the cancellation record to be attached")
+	}
+	expect(resolved.Cancellation.CIFStpIndicator, "Cancellation.CIFStpIndicator", "C", t)
+}
+
+func TestResolveSTP_CancellationWithoutUnderlyingSchedule(t *testing.T) {
+	resolved, ok := ResolveSTP([]Schedule{stpRecord("C", "Feed", "")}, 1684627200)
+	if !ok {
+		t.Fatal("expected a schedule to be resolved")
+	}
+	expect(resolved.Cancelled, "Cancelled", true, t)
+	expect(resolved.CIFStpIndicator, "CIFStpIndicator", "C", t)
+}
+
+func TestResolveSTP_STPNewBeatsPermanent(t *testing.T) {
+	resolved, _ := ResolveSTP([]Schedule{stpRecord("P", "Feed", "2A20"), stpRecord("N", "Feed", "2A22")}, 1684627200)
+	expect(resolved.CIFStpIndicator, "CIFStpIndicator", "N", t)
+	expect(resolved.SignallingID, "SignallingID", "2A22", t)
+}
+
+func TestResolveSTP_LatestPublishedWinsTie(t *testing.T) {
+	older := stpRecord("O", "Feed", "2A21")
+	older.PublishedAt = time.Unix(1684000000, 0)
+	newer := stpRecord("O", "VSTP", "2A29")
+	newer.PublishedAt = time.Unix(1684500000, 0)
+
+	resolved, _ := ResolveSTP([]Schedule{stpRecord("P", "Feed", "2A20"), older, newer}, 1684627200)
+	expect(resolved.SignallingID, "SignallingID", "2A29", t)
+}
+
+func TestSTPWinner_ReturnsRecordUninterpreted(t *testing.T) {
+	records := []Schedule{stpRecord("P", "Feed", "2A20"), stpRecord("O", "Feed", "2A21"), stpRecord("C", "Feed", "")}
+
+	winner, ok := STPWinner(records)
+	if !ok {
+		t.Fatal("expected a winner")
+	}
+	expect(winner.CIFStpIndicator, "CIFStpIndicator", "C", t)
+	expect(winner.Cancelled, "Cancelled", false, t)
+
+	winner, _ = STPWinner(records[:2])
+	expect(winner.CIFStpIndicator, "CIFStpIndicator", "O", t)
+	expect(winner.SignallingID, "SignallingID", "2A21", t)
+
+	if _, ok := STPWinner(nil); ok {
+		t.Error("expected no winner from no records")
+	}
+}
+
+func TestRunsOn(t *testing.T) {
+	sch := stpRecord("P", "Feed", "2A20")
+	sch.ScheduleDaysRuns = "1111100"
+	tests := []struct {
+		date string
+		want bool
+	}{
+		{"2022-12-30", false},
+		{"2023-01-02", true},
+		{"2023-05-20", false},
+		{"2023-05-21", false},
+		{"2023-12-29", true},
+		{"2024-01-01", false},
+	}
+	for _, tt := range tests {
+		date, _ := time.Parse("2006-01-02", tt.date)
+		if got := sch.RunsOn(date); got != tt.want {
+			t.Errorf("RunsOn(%s) = %v, want %v", tt.date, got, tt.want)
+		}
+	}
+}
@@ -2,7 +2,9 @@ package schedule
 
 import (
 	"fmt"
+	"log/slog"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -24,39 +26,65 @@ type VSTPCIFMsgV1 struct {
 }
 
 type VSTPSchedule struct {
-	ScheduleSegment []struct {
-		ScheduleLocation []struct {
-			Location struct {
-				Tiploc struct {
-					TiplocID string `json:"tiploc_id"`
-				} `json:"tiploc"`
-			} `json:"location"`
-			ScheduledPassTime       string `json:"scheduled_pass_time"`
-			ScheduledDepartureTime  string `json:"scheduled_departure_time"`
-			ScheduledArrivalTime    string `json:"scheduled_arrival_time"`
-			PublicDepartureTime     string `json:"public_departure_time"`
-			PublicArrivalTime       string `json:"public_arrival_time"`
-			CIFPath                 string `json:"CIF_path,omitempty"`
-			CIFActivity             string `json:"CIF_activity,omitempty"`
-			CIFPathingAllowance     string `json:"CIF_pathing_allowance,omitempty"`
-			CIFEngineeringAllowance string `json:"CIF_engineering_allowance,omitempty"`
-			CIFPerformanceAllowance string `json:"CIF_performance_allowance,omitempty"`
-			CIFLine                 string `json:"CIF_line,omitempty"`
-		} `json:"schedule_location"`
-		SignallingID        string `json:"signalling_id"`
-		CIFTrainServiceCode string `json:"CIF_train_service_code"`
-		CIFTrainCategory    string `json:"CIF_train_category"`
-		CIFPowerType        string `json:"CIF_power_type"`
-	} `json:"schedule_segment"`
-	TransactionType     string `json:"transaction_type"`
-	TrainStatus         string `json:"train_status"`
-	ScheduleStartDate   string `json:"schedule_start_date"`
-	ScheduleEndDate     string `json:"schedule_end_date"`
-	ScheduleDaysRuns    string `json:"schedule_days_runs"`
-	ApplicableTimetable string `json:"applicable_timetable"`
-	CIFTrainUID         string `json:"CIF_train_uid"`
-	CIFStpIndicator     string `json:"CIF_stp_indicator"`
-	CIFSpeed            string `json:"CIF_speed,omitempty"`
+	ScheduleSegment       []VSTPScheduleSegment `json:"schedule_segment"`
+	TransactionType       string                `json:"transaction_type"`
+	TrainStatus           string                `json:"train_status"`
+	ScheduleStartDate     string                `json:"schedule_start_date"`
+	ScheduleEndDate       string                `json:"schedule_end_date"`
+	ScheduleDaysRuns      string                `json:"schedule_days_runs"`
+	ApplicableTimetable   string                `json:"applicable_timetable"`
+	CIFBankHolidayRunning string                `json:"CIF_bank_holiday_running,omitempty"`
+	CIFTrainUID           string                `json:"CIF_train_uid"`
+	CIFStpIndicator       string                `json:"CIF_stp_indicator"`
+	// The speed is given for each segment, but some messages have it here instead
+	CIFSpeed string `json:"CIF_speed,omitempty"`
+}
+
+// VSTPScheduleSegment is the part of a VSTP schedule run with the same train attributes. Messages almost always have a
+// single segment.
+type VSTPScheduleSegment struct {
+	ScheduleLocation            []VSTPScheduleLocation `json:"schedule_location"`
+	SignallingID                string                 `json:"signalling_id"`
+	UicCode                     string                 `json:"uic_code,omitempty"`
+	AtocCode                    string                 `json:"atoc_code,omitempty"`
+	CIFTrainCategory            string                 `json:"CIF_train_category"`
+	CIFHeadcode                 string                 `json:"CIF_headcode,omitempty"`
+	CIFCourseIndicator          string                 `json:"CIF_course_indicator,omitempty"`
+	CIFTrainServiceCode         string                 `json:"CIF_train_service_code"`
+	CIFBusinessSector           string                 `json:"CIF_business_sector,omitempty"`
+	CIFPowerType                string                 `json:"CIF_power_type"`
+	CIFTimingLoad               string                 `json:"CIF_timing_load,omitempty"`
+	CIFSpeed                    string                 `json:"CIF_speed,omitempty"`
+	CIFOperatingCharacteristics string                 `json:"CIF_operating_characteristics,omitempty"`
+	CIFTrainClass               string                 `json:"CIF_train_class,omitempty"`
+	CIFSleepers                 string                 `json:"CIF_sleepers,omitempty"`
+	CIFReservations             string                 `json:"CIF_reservations,omitempty"`
+	CIFConnectionIndicator      string                 `json:"CIF_connection_indicator,omitempty"`
+	CIFCateringCode             string                 `json:"CIF_catering_code,omitempty"`
+	CIFServiceBranding          string                 `json:"CIF_service_branding,omitempty"`
+	CIFTractionClass            string                 `json:"CIF_traction_class,omitempty"`
+}
+
+// VSTPScheduleLocation is a location in a VSTP schedule segment. Times are "HHMMSS", and blank fields are sent as
+// spaces.
+type VSTPScheduleLocation struct {
+	Location struct {
+		Tiploc struct {
+			TiplocID string `json:"tiploc_id"`
+		} `json:"tiploc"`
+	} `json:"location"`
+	ScheduledPassTime       string `json:"scheduled_pass_time"`
+	ScheduledDepartureTime  string `json:"scheduled_departure_time"`
+	ScheduledArrivalTime    string `json:"scheduled_arrival_time"`
+	PublicDepartureTime     string `json:"public_departure_time"`
+	PublicArrivalTime       string `json:"public_arrival_time"`
+	CIFPlatform             string `json:"CIF_platform,omitempty"`
+	CIFPath                 string `json:"CIF_path,omitempty"`
+	CIFActivity             string `json:"CIF_activity,omitempty"`
+	CIFPathingAllowance     string `json:"CIF_pathing_allowance,omitempty"`
+	CIFEngineeringAllowance string `json:"CIF_engineering_allowance,omitempty"`
+	CIFPerformanceAllowance string `json:"CIF_performance_allowance,omitempty"`
+	CIFLine                 string `json:"CIF_line,omitempty"`
 }
 
 type VSTPSender struct {
@@ -67,49 +95,127 @@ type VSTPSender struct {
 	SessionID    string `json:"sessionID"`
 }
 
+// The changes a VSTP message can make to the schedules, as recorded in the audit trail
+const (
+	VSTPActionCreated  = "created"
+	VSTPActionReplaced = "replaced"
+	VSTPActionDeleted  = "deleted"
+	VSTPActionNotFound = "not_found"
+	VSTPActionIgnored  = "ignored"
+)
+
+// VSTPAuditEntry records which VSTP message changed which schedule, and how. Schedules are identified by their
+// CombinedID (UID, start date and STP indicator), which is kept after the schedule itself has been deleted.
+type VSTPAuditEntry struct {
+	ID              uint64    `gorm:"primaryKey" json:"id"`
+	CreatedAt       time.Time `json:"created_at"`
+	OriginMsgID     string    `gorm:"index" json:"origin_msg_id"`
+	PublishedAt     time.Time `json:"published_at"`
+	TransactionType string    `json:"transaction_type"`
+	CombinedID      string    `gorm:"index" json:"combined_id"`
+	Action          string    `json:"action"`
+	// The schedule created by the message, if any, and the number of schedules it removed
+	ScheduleID   uint64 `json:"schedule_id,omitempty"`
+	RemovedCount int    `json:"removed_count"`
+}
+
+// ProcessedVSTPMessage records a VSTP message that has been applied, so that the same message isn't applied again
+// when it is redelivered or replayed. Messages are identified by their originMsgId or, failing that, by a SHA-256
+// hash of their content.
+type ProcessedVSTPMessage struct {
+	ID          uint64    `gorm:"primaryKey" json:"id"`
+	CreatedAt   time.Time `json:"created_at"`
+	OriginMsgID string    `gorm:"index" json:"origin_msg_id"`
+	ContentHash string    `gorm:"uniqueIndex" json:"content_hash"`
+	CombinedID  string    `json:"combined_id"`
+}
+
+// ToSchedule converts a VSTP schedule into a Schedule in the same form as those from the schedule feed: blank fields
+// are empty, times are WTT times ("HHMM", with an "H" for a half minute) and the locations are marked as the origin
+// (LO), intermediate (LI) or terminus (LT). The locations of every segment are included, and the train's attributes
+// are taken from the first.
 func (s *VSTPSchedule) ToSchedule(publishedAt time.Time) (sch Schedule) {
 	sch.Source = "VSTP"
 	sch.PublishedAt = publishedAt
 
-	sch.TransactionType = s.TransactionType
-	sch.CIFStpIndicator = s.CIFStpIndicator
-	sch.CIFTrainUID = s.CIFTrainUID
-	sch.ScheduleDaysRuns = s.ScheduleDaysRuns
-	sch.ScheduleStartDate = s.ScheduleStartDate
-	sch.ScheduleEndDate = s.ScheduleEndDate
+	sch.TransactionType = strings.TrimSpace(s.TransactionType)
+	sch.TrainStatus = strings.TrimSpace(s.TrainStatus)
+	sch.CIFBankHolidayRunning = strings.TrimSpace(s.CIFBankHolidayRunning)
+	sch.CIFStpIndicator = strings.TrimSpace(s.CIFStpIndicator)
+	sch.CIFTrainUID = strings.TrimSpace(s.CIFTrainUID)
+	sch.ApplicableTimetable = strings.TrimSpace(s.ApplicableTimetable)
+	sch.ScheduleDaysRuns = strings.TrimSpace(s.ScheduleDaysRuns)
+	sch.ScheduleStartDate = strings.TrimSpace(s.ScheduleStartDate)
+	sch.ScheduleEndDate = strings.TrimSpace(s.ScheduleEndDate)
 
-	speed, err := strconv.Atoi(s.CIFSpeed)
-	if err != nil {
-		sch.CIFSpeed = ""
+	speed := s.CIFSpeed
+	if len(s.ScheduleSegment) > 0 {
+		segment := s.ScheduleSegment[0]
+		sch.SignallingID = strings.TrimSpace(segment.SignallingID)
+		sch.UicCode = strings.TrimSpace(segment.UicCode)
+		sch.AtocCode = strings.TrimSpace(segment.AtocCode)
+		sch.CIFTrainCategory = strings.TrimSpace(segment.CIFTrainCategory)
+		sch.CIFHeadcode = strings.TrimSpace(segment.CIFHeadcode)
+		sch.CIFCourseIndicator, _ = strconv.Atoi(strings.TrimSpace(segment.CIFCourseIndicator))
+		sch.CIFTrainServiceCode = strings.TrimSpace(segment.CIFTrainServiceCode)
+		sch.CIFBusinessSector = strings.TrimSpace(segment.CIFBusinessSector)
+		sch.CIFPowerType = strings.TrimSpace(segment.CIFPowerType)
+		sch.CIFTimingLoad = strings.TrimSpace(segment.CIFTimingLoad)
+		sch.CIFOperatingCharacteristics = strings.TrimSpace(segment.CIFOperatingCharacteristics)
+		sch.CIFTrainClass = strings.TrimSpace(segment.CIFTrainClass)
+		sch.CIFSleepers = strings.TrimSpace(segment.CIFSleepers)
+		sch.CIFReservations = strings.TrimSpace(segment.CIFReservations)
+		sch.CIFConnectionIndicator = strings.TrimSpace(segment.CIFConnectionIndicator)
+		sch.CIFCateringCode = strings.TrimSpace(segment.CIFCateringCode)
+		sch.CIFServiceBranding = strings.TrimSpace(segment.CIFServiceBranding)
+		sch.TractionClass = strings.TrimSpace(segment.CIFTractionClass)
+		if strings.TrimSpace(segment.CIFSpeed) != "" {
+			speed = segment.CIFSpeed
+		}
 	}
-	if err == nil {
+
+	if speed, err := strconv.Atoi(strings.TrimSpace(speed)); err == nil {
 		sch.CIFSpeed = fmt.Sprintf("%.0f", float64(speed)/2.24)
 	}
 
-	if len(s.ScheduleSegment) > 0 {
-		sch.SignallingID = s.ScheduleSegment[0].SignallingID
-		sch.CIFTrainCategory = s.ScheduleSegment[0].CIFTrainCategory
-		sch.CIFTrainServiceCode = s.ScheduleSegment[0].CIFTrainServiceCode
-		sch.CIFPowerType = s.ScheduleSegment[0].CIFPowerType
-		sch.ScheduleLocation = make([]ScheduleLocation, len(s.ScheduleSegment[0].ScheduleLocation))
-		for i := 0; i < len(sch.ScheduleLocation); i++ {
-			sch.ScheduleLocation[i].PublicArrival = s.ScheduleSegment[0].ScheduleLocation[i].PublicArrivalTime
-			sch.ScheduleLocation[i].PublicDeparture = s.ScheduleSegment[0].ScheduleLocation[i].PublicDepartureTime
-			sch.ScheduleLocation[i].Arrival = s.ScheduleSegment[0].ScheduleLocation[i].ScheduledArrivalTime
-			sch.ScheduleLocation[i].Departure = s.ScheduleSegment[0].ScheduleLocation[i].ScheduledDepartureTime
-			sch.ScheduleLocation[i].Pass = s.ScheduleSegment[0].ScheduleLocation[i].CIFPath
-			sch.ScheduleLocation[i].RecordIdentity = s.ScheduleSegment[0].ScheduleLocation[i].CIFActivity
-			sch.ScheduleLocation[i].LocationType = s.ScheduleSegment[0].ScheduleLocation[i].CIFActivity
-			sch.ScheduleLocation[i].TiplocCode = s.ScheduleSegment[0].ScheduleLocation[i].Location.Tiploc.TiplocID
+	for _, segment := range s.ScheduleSegment {
+		for _, loc := range segment.ScheduleLocation {
+			sch.ScheduleLocation = append(sch.ScheduleLocation, ScheduleLocation{
+				TiplocCode:           strings.TrimSpace(loc.Location.Tiploc.TiplocID),
+				Arrival:              vstpWTTTime(loc.ScheduledArrivalTime),
+				Departure:            vstpWTTTime(loc.ScheduledDepartureTime),
+				Pass:                 vstpWTTTime(loc.ScheduledPassTime),
+				PublicArrival:        vstpPublicTime(loc.PublicArrivalTime),
+				PublicDeparture:      vstpPublicTime(loc.PublicDepartureTime),
+				Platform:             strings.TrimSpace(loc.CIFPlatform),
+				Line:                 strings.TrimSpace(loc.CIFLine),
+				Path:                 strings.TrimSpace(loc.CIFPath),
+				EngineeringAllowance: strings.TrimSpace(loc.CIFEngineeringAllowance),
+				PathingAllowance:     strings.TrimSpace(loc.CIFPathingAllowance),
+				PerformanceAllowance: strings.TrimSpace(loc.CIFPerformanceAllowance),
+				// Each activity is two characters, so only the padding at the end is removed
+				Activity: strings.TrimRight(loc.CIFActivity, " "),
+			})
 		}
 	}
+	for i := range sch.ScheduleLocation {
+		identity := "LI"
+		switch i {
+		case 0:
+			identity = "LO"
+		case len(sch.ScheduleLocation) - 1:
+			identity = "LT"
+		}
+		sch.ScheduleLocation[i].RecordIdentity = identity
+		sch.ScheduleLocation[i].LocationType = identity
+	}
 
 	// Parse schedule start/end dates to Unix timestamps
 	layout := "2006-01-02 15:04:05"
 
 	ts, err := time.Parse(layout, sch.ScheduleStartDate+" 00:00:00")
 	if err != nil {
-		fmt.Println("Failed to parse start date for schedule :", err)
+		slog.Warn("Failed to parse start date for VSTP schedule", "error", err, "uid", sch.CIFTrainUID)
 	}
 	if err == nil {
 		sch.ScheduleStartDateTS = ts.Unix()
@@ -117,7 +223,7 @@ func (s *VSTPSchedule) ToSchedule(publishedAt time.Time) (sch Schedule) {
 
 	ts, err = time.Parse(layout, sch.ScheduleEndDate+" 23:59:59")
 	if err != nil {
-		fmt.Println("Failed to parse end date for schedule :", err)
+		slog.Warn("Failed to parse end date for VSTP schedule", "error", err, "uid", sch.CIFTrainUID)
 	}
 	if err == nil {
 		sch.ScheduleEndDateTS = ts.Unix()
@@ -125,3 +231,25 @@ func (s *VSTPSchedule) ToSchedule(publishedAt time.Time) (sch Schedule) {
 
 	return sch
 }
+
+// vstpWTTTime converts a VSTP working timetable time, "HHMMSS", to the feed's "HHMM", with an "H" for a half minute.
+// Blank times are empty.
+func vstpWTTTime(t string) WTTTime {
+	t = strings.TrimSpace(t)
+	if len(t) < 4 {
+		return ""
+	}
+	if len(t) >= 6 && t[4:6] == "30" {
+		return WTTTime(t[:4] + "H")
+	}
+	return WTTTime(t[:4])
+}
+
+// vstpPublicTime converts a VSTP public time to the feed's "HHMM". Public times are always whole minutes.
+func vstpPublicTime(t string) WTTTime {
+	t = strings.TrimSpace(t)
+	if len(t) < 4 {
+		return ""
+	}
+	return WTTTime(t[:4])
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"os"
 	"path/filepath"
+	"reflect"
 	"testing"
 	"time"
 )
@@ -34,8 +35,66 @@ func TestUnmarshalJSONAndAugmentSchedule(t *testing.T) {
 	expect(schedule.ScheduleStartDate, "ScheduleStartDate", "2023-10-13", t)
 	expect(schedule.ScheduleEndDate, "ScheduleEndDate", "2023-10-13", t)
 	expect(schedule.ScheduleLocation[0].TiplocCode, "Location 0 TiplocCode", "ROCKFRY", t)
-	expect(schedule.ScheduleLocation[0].RecordIdentity, "Location 0 LocationType", "TB", t)
-	expect(schedule.ScheduleLocation[0].Departure, "Location 0 Departure", "235600", t)
+	expect(schedule.ScheduleLocation[0].RecordIdentity, "Location 0 RecordIdentity", "LO", t)
+	expect(schedule.ScheduleLocation[0].Activity, "Location 0 Activity", "TB", t)
+	expect(schedule.ScheduleLocation[0].Departure, "Location 0 Departure", WTTTime("2356"), t)
+	expect(schedule.ScheduleLocation[1].Pass, "Location 1 Pass", WTTTime("2358"), t)
+	expect(schedule.ScheduleLocation[2].Pass, "Location 2 Pass", WTTTime("2359H"), t)
+	last := schedule.ScheduleLocation[len(schedule.ScheduleLocation)-1]
+	expect(last.RecordIdentity, "Last location RecordIdentity", "LT", t)
+}
+
+// The fixture vstp_full.json is a VSTP message using every field, and vstp_full_feed.json the same schedule as a
+// schedule feed record. Both should convert to the same schedule.
+func TestVSTPToScheduleMatchesFeedSchedule(t *testing.T) {
+	var vstpMsg VSTPStompMsg
+	readFixture(t, "vstp_full.json", &vstpMsg)
+	var record ScheduleFeedRecord
+	readFixture(t, "vstp_full_feed.json", &record)
+
+	publishedAt := time.Date(2023, 10, 14, 7, 12, 41, 0, time.UTC)
+	got := vstpMsg.VSTPCIFMsgV1.VSTPSchedule.ToSchedule(publishedAt)
+	want := record.JSONScheduleV1.ToSchedule(publishedAt)
+	want.Source = "VSTP"
+	want.ScheduleStartDateTS = time.Date(2023, 10, 14, 0, 0, 0, 0, time.UTC).Unix()
+	want.ScheduleEndDateTS = time.Date(2023, 10, 14, 23, 59, 59, 0, time.UTC).Unix()
+
+	if !reflect.DeepEqual(got, want) {
+		gotJSON, _ := json.MarshalIndent(got, "", "  ")
+		wantJSON, _ := json.MarshalIndent(want, "", "  ")
+		t.Errorf("VSTP schedule doesn't match the feed schedule\ngot:  %s\nwant: %s", gotJSON, wantJSON)
+	}
+
+	// The converted schedule survives being sent as JSON by the API
+	data, err := json.Marshal(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var roundTripped Schedule
+	if err := json.Unmarshal(data, &roundTripped); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(roundTripped, got) {
+		t.Errorf("expected the schedule to round trip through JSON, got %+v", roundTripped)
+	}
+}
+
+func TestVSTPToScheduleSpeedOnSchedule(t *testing.T) {
+	s := VSTPSchedule{CIFSpeed: "112", ScheduleStartDate: "2023-10-14", ScheduleEndDate: "2023-10-14", ScheduleSegment: []VSTPScheduleSegment{{CIFSpeed: " "}}}
+	if sch := s.ToSchedule(time.Time{}); sch.CIFSpeed != "50" {
+		t.Errorf("expected the speed given for the schedule to be used, got %q", sch.CIFSpeed)
+	}
+}
+
+func readFixture(t *testing.T, name string, v any) {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("..", "..", "test-fixtures", name))
+	if err != nil {
+		t.Fatal("Failed to read fixture:", err)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		t.Fatal("Failed to unmarshal fixture:", err)
+	}
 }
 
 func expect(value any, name string, expected_value any, t *testing.T) bool {
@@ -0,0 +1,165 @@
+package schedule
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// londonLocation is the Europe/London timezone. WTT times are always UK local time (GMT/BST).
+var londonLocation *time.Location
+
+func init() {
+	loc, err := time.LoadLocation("Europe/London")
+	if err != nil {
+		panic(fmt.Sprintf("failed to load Europe/London timezone: %v", err))
+	}
+	londonLocation = loc
+}
+
+// LondonLocation returns the Europe/London timezone, in which WTT times are given.
+func LondonLocation() *time.Location {
+	return londonLocation
+}
+
+// WTTTime is a time in a schedule, as "HHMM" with an "H" for a half minute (e.g. "0940H") as in the schedule feed, or
+// as "HHMMSS" as sent by VSTP. It's the local time of day, with no date: a train running over midnight has times on
+// the following day. Blank is no time.
+type WTTTime string
+
+// Seconds returns the number of seconds after midnight of the time, or false if it isn't a time.
+func (t WTTTime) Seconds() (int, bool) {
+	s := strings.TrimSpace(string(t))
+	if len(s) < 4 {
+		return 0, false
+	}
+	hours, err := strconv.Atoi(s[:2])
+	if err != nil || hours > 23 {
+		return 0, false
+	}
+	minutes, err := strconv.Atoi(s[2:4])
+	if err != nil || minutes > 59 {
+		return 0, false
+	}
+	seconds := 0
+	switch rest := s[4:]; {
+	case rest == "H":
+		seconds = 30
+	case len(rest) == 2:
+		if seconds, err = strconv.Atoi(rest); err != nil || seconds > 59 {
+			return 0, false
+		}
+	}
+	return hours*3600 + minutes*60 + seconds, true
+}
+
+// IsZero reports whether there's no time.
+func (t WTTTime) IsZero() bool {
+	_, ok := t.Seconds()
+	return !ok
+}
+
+// Format returns the time as "HH:MM", or "HH:MM:SS" if it isn't on the minute, such as "09:40:30" for "0940H". It
+// returns "" if there's no time.
+func (t WTTTime) Format() string {
+	seconds, ok := t.Seconds()
+	if !ok {
+		return ""
+	}
+	if seconds%60 != 0 {
+		return fmt.Sprintf("%02d:%02d:%02d", seconds/3600, seconds/60%60, seconds%60)
+	}
+	return fmt.Sprintf("%02d:%02d", seconds/3600, seconds/60%60)
+}
+
+// localTimestamp returns the Unix timestamp of a UK local time of day, given in seconds, dayOffset days after date.
+// On the night the clocks go back the times between 01:00 and 02:00 happen twice, and the first that isn't before
+// notBefore is used, so that the times along a journey don't go backwards. Times skipped when the clocks go forward
+// are taken as GMT.
+func localTimestamp(date time.Time, dayOffset, seconds int, notBefore int64) int64 {
+	t := time.Date(date.Year(), date.Month(), date.Day()+dayOffset, 0, 0, seconds, 0, londonLocation)
+	// Go picks the later of a repeated time, so the earlier is an hour before if its clock time is the same
+	if earlier := t.Add(-time.Hour); earlier.Hour() == t.Hour() && earlier.Minute() == t.Minute() && earlier.Unix() >= notBefore {
+		return earlier.Unix()
+	}
+	return t.Unix()
+}
+
+// SetCallTimes works out the timestamps of the schedule's times when it runs on date, the day the train starts its
+// journey. The times are in order along the journey, so a time earlier than the one before it is on the following
+// day. Each location's DayOffset is the number of days after date of its first working time, and its public times
+// are taken to be on the day nearest the matching working time. The schedule's departure from its origin and arrival
+// at its destination are filled in too.
+func (s *Schedule) SetCallTimes(date time.Time) {
+	// A working time, in seconds after midnight, dayOffset days after date
+	type dayTime struct {
+		seconds, dayOffset int
+		ok                 bool
+	}
+	var previous dayTime
+	var previousTS int64
+	// wtt returns the timestamp of a working time, moving on to the next day if it's before the one before it
+	wtt := func(t WTTTime) (int64, dayTime) {
+		seconds, ok := t.Seconds()
+		if !ok {
+			return 0, dayTime{}
+		}
+		current := dayTime{seconds: seconds, dayOffset: previous.dayOffset, ok: true}
+		if previous.ok && seconds < previous.seconds {
+			current.dayOffset++
+		}
+		previous = current
+		previousTS = localTimestamp(date, current.dayOffset, seconds, previousTS)
+		return previousTS, current
+	}
+	// public returns the timestamp of a public time on the day nearest the working time it goes with
+	public := func(t WTTTime, working dayTime) int64 {
+		seconds, ok := t.Seconds()
+		if !ok {
+			return 0
+		}
+		if !working.ok {
+			return localTimestamp(date, previous.dayOffset, seconds, 0)
+		}
+		dayOffset := working.dayOffset
+		if seconds-working.seconds > 12*3600 {
+			dayOffset--
+		} else if working.seconds-seconds > 12*3600 {
+			dayOffset++
+		}
+		return localTimestamp(date, dayOffset, seconds, 0)
+	}
+
+	for i := range s.ScheduleLocation {
+		loc := &s.ScheduleLocation[i]
+		var arrival, pass, departure dayTime
+		loc.ArrivalTS, arrival = wtt(loc.Arrival)
+		loc.PassTS, pass = wtt(loc.Pass)
+		loc.DepartureTS, departure = wtt(loc.Departure)
+		for _, t := range []dayTime{arrival, pass, departure} {
+			if t.ok {
+				loc.DayOffset = t.dayOffset
+				break
+			}
+		}
+
+		// A public time without the matching working time goes with the other working time
+		if !arrival.ok {
+			arrival = departure
+		}
+		if !departure.ok {
+			departure = arrival
+		}
+		loc.PublicArrivalTS = public(loc.PublicArrival, arrival)
+		loc.PublicDepartureTS = public(loc.PublicDeparture, departure)
+	}
+
+	s.TimeOfDepartureFromOriginTS, s.TimeOfDepartureFromOrigin = 0, ""
+	s.TimeOfArrivalAtDestinationTS, s.TimeOfArrivalAtDestination = 0, ""
+	if n := len(s.ScheduleLocation); n > 0 {
+		origin, destination := s.ScheduleLocation[0], s.ScheduleLocation[n-1]
+		s.TimeOfDepartureFromOriginTS, s.TimeOfDepartureFromOrigin = origin.DepartureTS, origin.Departure.Format()
+		s.TimeOfArrivalAtDestinationTS, s.TimeOfArrivalAtDestination = destination.ArrivalTS, destination.Arrival.Format()
+	}
+}
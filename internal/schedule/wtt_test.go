@@ -0,0 +1,153 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWTTTime(t *testing.T) {
+	tests := []struct {
+		time    WTTTime
+		seconds int
+		ok      bool
+		format  string
+	}{
+		{"0940", 9*3600 + 40*60, true, "09:40"},
+		{"0940H", 9*3600 + 40*60 + 30, true, "09:40:30"},
+		{"094030", 9*3600 + 40*60 + 30, true, "09:40:30"},
+		{"094000", 9*3600 + 40*60, true, "09:40"},
+		{"2359H", 23*3600 + 59*60 + 30, true, "23:59:30"},
+		{"0000", 0, true, "00:00"},
+		{"", 0, false, ""},
+		{"      ", 0, false, ""},
+		{"2460", 0, false, ""},
+		{"9Z99", 0, false, ""},
+	}
+	for _, tt := range tests {
+		seconds, ok := tt.time.Seconds()
+		if seconds != tt.seconds || ok != tt.ok {
+			t.Errorf("WTTTime(%q).Seconds() = %d, %v, want %d, %v", tt.time, seconds, ok, tt.seconds, tt.ok)
+		}
+		if format := tt.time.Format(); format != tt.format {
+			t.Errorf("WTTTime(%q).Format() = %q, want %q", tt.time, format, tt.format)
+		}
+		if tt.time.IsZero() == tt.ok {
+			t.Errorf("WTTTime(%q).IsZero() = %v", tt.time, tt.time.IsZero())
+		}
+	}
+}
+
+// london returns the Unix timestamp of a UK local time.
+func london(t *testing.T, value string) int64 {
+	t.Helper()
+	ts, err := time.ParseInLocation("2006-01-02 15:04:05", value, LondonLocation())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ts.Unix()
+}
+
+func TestSetCallTimes_RunsOverMidnight(t *testing.T) {
+	sch := Schedule{ScheduleLocation: []ScheduleLocation{
+		{TiplocCode: "KNGX", Departure: "2330", PublicDeparture: "2330"},
+		{TiplocCode: "PBRO", Arrival: "2359", Departure: "0000H", PublicArrival: "2359", PublicDeparture: "0000"},
+		{TiplocCode: "GRTHM", Pass: "0015H"},
+		{TiplocCode: "DONC", Arrival: "0110", PublicArrival: "0110"},
+	}}
+	sch.SetCallTimes(time.Date(2023, 5, 21, 0, 0, 0, 0, time.UTC))
+
+	locs := sch.ScheduleLocation
+	for _, tt := range []struct {
+		name string
+		got  int64
+		want string
+	}{
+		{"KNGX departure", locs[0].DepartureTS, "2023-05-21 23:30:00"},
+		{"PBRO arrival", locs[1].ArrivalTS, "2023-05-21 23:59:00"},
+		{"PBRO public arrival", locs[1].PublicArrivalTS, "2023-05-21 23:59:00"},
+		{"PBRO departure", locs[1].DepartureTS, "2023-05-22 00:00:30"},
+		{"PBRO public departure", locs[1].PublicDepartureTS, "2023-05-22 00:00:00"},
+		{"GRTHM pass", locs[2].PassTS, "2023-05-22 00:15:30"},
+		{"DONC arrival", locs[3].ArrivalTS, "2023-05-22 01:10:00"},
+	} {
+		if tt.got != london(t, tt.want) {
+			t.Errorf("expected the %s at %s, got %s", tt.name, tt.want, time.Unix(tt.got, 0).In(LondonLocation()))
+		}
+	}
+	for i, want := range []int{0, 0, 1, 1} {
+		if locs[i].DayOffset != want {
+			t.Errorf("expected %s to have day offset %d, got %d", locs[i].TiplocCode, want, locs[i].DayOffset)
+		}
+	}
+
+	if sch.TimeOfDepartureFromOriginTS != locs[0].DepartureTS || sch.TimeOfArrivalAtDestinationTS != locs[3].ArrivalTS {
+		t.Errorf("expected the origin departure and destination arrival to be set, got %d and %d",
+			sch.TimeOfDepartureFromOriginTS, sch.TimeOfArrivalAtDestinationTS)
+	}
+	if sch.TimeOfArrivalAtDestination != "01:10" {
+		t.Errorf("expected the arrival at the destination to be formatted, got %q", sch.TimeOfArrivalAtDestination)
+	}
+}
+
+func TestSetCallTimes_PublicTimeOnOtherSideOfMidnight(t *testing.T) {
+	// The public arrival is rounded up into the next day
+	sch := Schedule{ScheduleLocation: []ScheduleLocation{
+		{TiplocCode: "KNGX", Departure: "2330", PublicDeparture: "2330"},
+		{TiplocCode: "PBRO", Arrival: "2359H", PublicArrival: "0000"},
+	}}
+	sch.SetCallTimes(time.Date(2023, 5, 21, 0, 0, 0, 0, time.UTC))
+	if want := london(t, "2023-05-22 00:00:00"); sch.ScheduleLocation[1].PublicArrivalTS != want {
+		t.Errorf("expected the public arrival just after midnight, got %s", time.Unix(sch.ScheduleLocation[1].PublicArrivalTS, 0))
+	}
+}
+
+func TestSetCallTimes_ClocksChange(t *testing.T) {
+	tests := map[string]struct {
+		date  time.Time
+		times []WTTTime
+		want  []time.Time
+	}{
+		// The clocks go forward from 01:00 GMT to 02:00 BST, so the run from 00:30 to 03:30 takes two hours
+		"spring": {
+			date:  time.Date(2023, 3, 25, 0, 0, 0, 0, time.UTC),
+			times: []WTTTime{"2330", "0030", "0050", "0330"},
+			want: []time.Time{
+				time.Date(2023, 3, 25, 23, 30, 0, 0, time.UTC),
+				time.Date(2023, 3, 26, 0, 30, 0, 0, time.UTC),
+				time.Date(2023, 3, 26, 0, 50, 0, 0, time.UTC),
+				time.Date(2023, 3, 26, 2, 30, 0, 0, time.UTC),
+			},
+		},
+		// The clocks go back from 02:00 BST to 01:00 GMT, so the times from 01:00 to 02:00 happen twice. The train
+		// is at 01:10 and 01:50 the first time round.
+		"autumn": {
+			date:  time.Date(2023, 10, 28, 0, 0, 0, 0, time.UTC),
+			times: []WTTTime{"2330", "0030", "0110", "0150", "0230"},
+			want: []time.Time{
+				time.Date(2023, 10, 28, 22, 30, 0, 0, time.UTC),
+				time.Date(2023, 10, 28, 23, 30, 0, 0, time.UTC),
+				time.Date(2023, 10, 29, 0, 10, 0, 0, time.UTC),
+				time.Date(2023, 10, 29, 0, 50, 0, 0, time.UTC),
+				time.Date(2023, 10, 29, 2, 30, 0, 0, time.UTC),
+			},
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			sch := Schedule{ScheduleLocation: []ScheduleLocation{{Departure: tt.times[0]}}}
+			for _, pass := range tt.times[1:] {
+				sch.ScheduleLocation = append(sch.ScheduleLocation, ScheduleLocation{Pass: pass})
+			}
+			sch.SetCallTimes(tt.date)
+			for i, loc := range sch.ScheduleLocation {
+				got := loc.PassTS
+				if i == 0 {
+					got = loc.DepartureTS
+				}
+				if got != tt.want[i].Unix() {
+					t.Errorf("expected %s at %s, got %s", tt.times[i], tt.want[i], time.Unix(got, 0).UTC())
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,170 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+	"uk-rail-schedule-api/internal/schedule"
+)
+
+// Board types accepted by GetBoard.
+const (
+	BoardAll        = "all"
+	BoardDepartures = "departures"
+	BoardArrivals   = "arrivals"
+)
+
+// Board is a time-windowed list of the calls trains make at a location.
+type Board struct {
+	Location string       `json:"location"`
+	Tiplocs  []string     `json:"tiplocs"`
+	Type     string       `json:"type"`
+	From     time.Time    `json:"from"`
+	To       time.Time    `json:"to"`
+	Entries  []BoardEntry `json:"entries"`
+}
+
+// BoardEntry is a single call at a location on a board. Times are WTT times formatted as HH:MM, or HH:MM:SS for a
+// half minute.
+type BoardEntry struct {
+	CIFTrainUID         string `json:"CIF_train_uid"`
+	SignallingID        string `json:"signalling_id,omitempty"`
+	AtocCode            string `json:"atoc_code,omitempty"`
+	AtocCodeDescription string `json:"atoc_code_description,omitempty"`
+	CIFStpIndicator     string `json:"CIF_stp_indicator,omitempty"`
+	Source              string `json:"source,omitempty"`
+	// The date the train started its journey, which is not the date of the call if it runs over midnight
+	ScheduleDate string `json:"schedule_date"`
+	TiplocCode   string `json:"tiploc_code"`
+	Origin       string `json:"origin,omitempty"`
+	Destination  string `json:"destination,omitempty"`
+
+	Arrival         string `json:"arrival,omitempty"`
+	Departure       string `json:"departure,omitempty"`
+	Pass            string `json:"pass,omitempty"`
+	PublicArrival   string `json:"public_arrival,omitempty"`
+	PublicDeparture string `json:"public_departure,omitempty"`
+	Platform        string `json:"platform,omitempty"`
+	Line            string `json:"line,omitempty"`
+
+	IsPass    bool `json:"is_pass"`
+	Cancelled bool `json:"cancelled,omitempty"`
+	// Whether passengers can join or leave the train, whether it only stops on request, and whether it stops for
+	// other reasons without any passenger activity
+	TakesUp         bool `json:"takes_up,omitempty"`
+	SetsDown        bool `json:"sets_down,omitempty"`
+	RequestStop     bool `json:"request_stop,omitempty"`
+	OperationalStop bool `json:"operational_stop,omitempty"`
+
+	// Unix timestamp of the call used to place it on the board: the pass time for passing trains, the departure on a
+	// departure board, the arrival on an arrival board, otherwise the arrival or, if the train starts here, departure
+	TimeTS int64 `json:"time_ts"`
+}
+
+// GetBoard returns the calls made at location (a TIPLOC or CRS code) between from and from+window, ordered by time.
+// boardType restricts the board to departures or arrivals; passing calls, and stops that aren't for passengers, are
+// left out unless includePasses is set.
+func (s *Store) GetBoard(location string, from time.Time, window time.Duration, boardType string, includePasses bool) (Board, error) {
+	board := Board{Location: location, Type: boardType, From: from, To: from.Add(window), Entries: []BoardEntry{}}
+
+	if s.DB == nil {
+		return board, errors.New("db is nil")
+	}
+	if boardType != BoardAll && boardType != BoardDepartures && boardType != BoardArrivals {
+		return board, fmt.Errorf("unknown board type %s", boardType)
+	}
+
+	tiplocs, atLocation, err := s.resolveTiplocs(location, s.ResolveLocation)
+	if err != nil {
+		return board, err
+	}
+	board.Tiplocs = tiplocs
+
+	// Trains that started the previous day may still be running within the window
+	firstDay := londonDate(from).AddDate(0, 0, -1)
+	lastDay := londonDate(board.To)
+
+	schedules, err := s.GetSchedules(ScheduleQuery{
+		Date:             firstDay.Format("2006-01-02"),
+		To:               lastDay.Format("2006-01-02"),
+		Tiploc:           location,
+		IncludeCancelled: true,
+	})
+	if err != nil {
+		return board, err
+	}
+	for _, sch := range schedules {
+		for _, loc := range sch.ScheduleLocation {
+			if !atLocation[loc.TiplocCode] {
+				continue
+			}
+			entry, ok := newBoardEntry(sch, loc, boardType)
+			if !ok || (!loc.IsPublicStop() && !includePasses) {
+				continue
+			}
+			if entry.TimeTS < board.From.Unix() || entry.TimeTS >= board.To.Unix() {
+				continue
+			}
+			entry.ScheduleDate = sch.RunDate
+			board.Entries = append(board.Entries, entry)
+		}
+	}
+
+	sort.SliceStable(board.Entries, func(i, j int) bool {
+		return board.Entries[i].TimeTS < board.Entries[j].TimeTS
+	})
+
+	return board, nil
+}
+
+// newBoardEntry builds the board entry for a schedule's call at loc. It returns false if the call doesn't belong on
+// a board of the given type, e.g. a train terminating at the location on a departure board.
+func newBoardEntry(sch schedule.Schedule, loc schedule.ScheduleLocation, boardType string) (BoardEntry, bool) {
+	entry := BoardEntry{
+		CIFTrainUID:         sch.CIFTrainUID,
+		SignallingID:        sch.SignallingID,
+		AtocCode:            sch.AtocCode,
+		AtocCodeDescription: sch.AtocCodeDescription,
+		CIFStpIndicator:     sch.CIFStpIndicator,
+		Source:              sch.Source,
+		TiplocCode:          loc.TiplocCode,
+		Origin:              sch.Origin,
+		Destination:         sch.Destination,
+		Arrival:             loc.Arrival.Format(),
+		Departure:           loc.Departure.Format(),
+		Pass:                loc.Pass.Format(),
+		PublicArrival:       loc.PublicArrival.Format(),
+		PublicDeparture:     loc.PublicDeparture.Format(),
+		Platform:            loc.Platform,
+		Line:                loc.Line,
+		Cancelled:           sch.Cancelled,
+		IsPass:              loc.Passes,
+		TakesUp:             loc.TakesUp,
+		SetsDown:            loc.SetsDown,
+		RequestStop:         loc.RequestStop,
+		OperationalStop:     loc.OperationalStop,
+	}
+
+	switch {
+	case entry.IsPass:
+		entry.TimeTS = loc.PassTS
+	case boardType == BoardDepartures:
+		entry.TimeTS = loc.DepartureTS
+	case boardType == BoardArrivals:
+		entry.TimeTS = loc.ArrivalTS
+	default:
+		entry.TimeTS = loc.ArrivalTS
+		if entry.TimeTS == 0 {
+			entry.TimeTS = loc.DepartureTS
+		}
+	}
+
+	return entry, entry.TimeTS != 0
+}
+
+// londonDate returns the UK calendar date of t as midnight UTC, the form in which schedule dates are stored.
+func londonDate(t time.Time) time.Time {
+	local := t.In(londonLocation)
+	return time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, time.UTC)
+}
@@ -0,0 +1,327 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+	"uk-rail-schedule-api/internal/schedule"
+)
+
+// maxConnectionWait is the longest wait at an interchange considered when looking for connections.
+const maxConnectionWait = 2 * time.Hour
+
+// JourneySearch describes a search for journeys between two locations, each a TIPLOC or CRS code.
+type JourneySearch struct {
+	From string
+	To   string
+	// Journeys leave From between DepartAfter and DepartAfter+Window
+	DepartAfter time.Time
+	Window      time.Duration
+	// Changes allows journeys with a single change of train, leaving at least MinConnection to make the change
+	Changes       bool
+	MinConnection time.Duration
+}
+
+// JourneyPlan is the list of journeys found by a search, ordered by departure and then arrival.
+type JourneyPlan struct {
+	From         string    `json:"from"`
+	To           string    `json:"to"`
+	FromTiplocs  []string  `json:"from_tiplocs"`
+	ToTiplocs    []string  `json:"to_tiplocs"`
+	DepartAfter  time.Time `json:"depart_after"`
+	DepartBefore time.Time `json:"depart_before"`
+	Journeys     []Journey `json:"journeys"`
+}
+
+// Journey is a way of travelling between the locations of a search, on one train or, with a change, two.
+type Journey struct {
+	DepartureTS int64        `json:"departure_ts"`
+	ArrivalTS   int64        `json:"arrival_ts"`
+	Changes     int          `json:"changes"`
+	Legs        []JourneyLeg `json:"legs"`
+}
+
+// JourneyLeg is the part of a journey made on one train. Times are public times formatted as HH:MM.
+type JourneyLeg struct {
+	CIFTrainUID         string `json:"CIF_train_uid"`
+	SignallingID        string `json:"signalling_id,omitempty"`
+	AtocCode            string `json:"atoc_code,omitempty"`
+	AtocCodeDescription string `json:"atoc_code_description,omitempty"`
+	CIFStpIndicator     string `json:"CIF_stp_indicator,omitempty"`
+	// The date the train started its journey, which is not the date of the leg if it runs over midnight
+	ScheduleDate string `json:"schedule_date"`
+	Origin       string `json:"origin,omitempty"`
+	Destination  string `json:"destination,omitempty"`
+
+	From              string `json:"from"`
+	FromDescription   string `json:"from_description,omitempty"`
+	Departure         string `json:"departure"`
+	DeparturePlatform string `json:"departure_platform,omitempty"`
+	DepartureTS       int64  `json:"departure_ts"`
+	To                string `json:"to"`
+	ToDescription     string `json:"to_description,omitempty"`
+	Arrival           string `json:"arrival"`
+	ArrivalPlatform   string `json:"arrival_platform,omitempty"`
+	ArrivalTS         int64  `json:"arrival_ts"`
+}
+
+// publicCall is a stop at which passengers may join or leave a train, at a time that allows for the train running
+// over midnight.
+type publicCall struct {
+	loc         schedule.ScheduleLocation
+	arrivalTS   int64
+	departureTS int64
+}
+
+// interchange is the part of a train's run between an interchange and the destination of a search.
+type interchange struct {
+	sch  schedule.Schedule
+	date time.Time
+	from publicCall
+	to   publicCall
+}
+
+// GetJourneys returns the journeys from search.From to search.To leaving within the search window. Only public
+// calls are used, so trains can't be joined where they only set down, or left where they only pick up. Changes must
+// be made at a single station, which may be on a different TIPLOC of the station, and no journey is returned with a
+// change if another gets there at least as early without leaving any earlier.
+func (s *Store) GetJourneys(search JourneySearch) (JourneyPlan, error) {
+	plan := JourneyPlan{
+		From:         search.From,
+		To:           search.To,
+		DepartAfter:  search.DepartAfter,
+		DepartBefore: search.DepartAfter.Add(search.Window),
+		Journeys:     []Journey{},
+	}
+
+	if s.DB == nil {
+		return plan, errors.New("db is nil")
+	}
+
+	var atFrom, atTo map[string]bool
+	var err error
+	if plan.FromTiplocs, atFrom, err = s.resolveTiplocs(search.From, s.ResolveLocation); err != nil {
+		return plan, err
+	}
+	if plan.ToTiplocs, atTo, err = s.resolveTiplocs(search.To, s.ResolveLocation); err != nil {
+		return plan, err
+	}
+
+	// Trains that started the previous day may still be running within the window
+	firstDay := londonDate(plan.DepartAfter).AddDate(0, 0, -1)
+	lastDay := londonDate(plan.DepartBefore)
+
+	type departure struct {
+		sch   schedule.Schedule
+		date  time.Time
+		calls []publicCall
+	}
+	var departures []departure
+	schedules, err := s.GetSchedules(ScheduleQuery{
+		Date:   firstDay.Format("2006-01-02"),
+		To:     lastDay.Format("2006-01-02"),
+		Tiploc: search.From,
+	})
+	if err != nil {
+		return plan, err
+	}
+	for _, sch := range schedules {
+		day, err := time.Parse("2006-01-02", sch.RunDate)
+		if err != nil {
+			return plan, fmt.Errorf("invalid run date %s: %w", sch.RunDate, err)
+		}
+		calls := publicCalls(sch)
+		for idx, call := range calls {
+			if !atFrom[call.loc.TiplocCode] || call.departureTS == 0 {
+				continue
+			}
+			if call.departureTS >= plan.DepartAfter.Unix() && call.departureTS < plan.DepartBefore.Unix() {
+				departures = append(departures, departure{sch: sch, date: day, calls: calls[idx:]})
+			}
+			break
+		}
+	}
+
+	var connections []Journey
+	var interchanges map[string][]interchange
+	for _, dep := range departures {
+		board := dep.calls[0]
+		direct := false
+		for _, call := range dep.calls[1:] {
+			if atTo[call.loc.TiplocCode] && call.arrivalTS != 0 {
+				plan.Journeys = append(plan.Journeys, newJourney(newJourneyLeg(dep.sch, dep.date, board, call)))
+				direct = true
+				break
+			}
+		}
+		if direct || !search.Changes {
+			continue
+		}
+
+		if interchanges == nil {
+			if interchanges, err = s.interchangesTo(search.To, atTo, firstDay, lastDay.AddDate(0, 0, 1)); err != nil {
+				return plan, err
+			}
+		}
+
+		var best *Journey
+		for _, call := range dep.calls[1:] {
+			if call.arrivalTS == 0 || atFrom[call.loc.TiplocCode] {
+				continue
+			}
+			for _, onward := range interchanges[stationKey(call.loc)] {
+				if onward.sch.CIFTrainUID == dep.sch.CIFTrainUID {
+					continue
+				}
+				wait := time.Duration(onward.from.departureTS-call.arrivalTS) * time.Second
+				if wait < search.MinConnection || wait > maxConnectionWait {
+					continue
+				}
+				if best == nil || onward.to.arrivalTS < best.ArrivalTS {
+					journey := newJourney(
+						newJourneyLeg(dep.sch, dep.date, board, call),
+						newJourneyLeg(onward.sch, onward.date, onward.from, onward.to),
+					)
+					best = &journey
+				}
+			}
+		}
+		if best != nil {
+			connections = append(connections, *best)
+		}
+	}
+
+	for _, connection := range connections {
+		if !dominated(connection, plan.Journeys, connections) {
+			plan.Journeys = append(plan.Journeys, connection)
+		}
+	}
+
+	sort.SliceStable(plan.Journeys, func(i, j int) bool {
+		if plan.Journeys[i].DepartureTS != plan.Journeys[j].DepartureTS {
+			return plan.Journeys[i].DepartureTS < plan.Journeys[j].DepartureTS
+		}
+		return plan.Journeys[i].ArrivalTS < plan.Journeys[j].ArrivalTS
+	})
+
+	return plan, nil
+}
+
+// interchangesTo returns, by station, the runs to the destination of the trains running between firstDay and
+// lastDay that reach it, from each station at which passengers can join them.
+func (s *Store) interchangesTo(to string, atTo map[string]bool, firstDay, lastDay time.Time) (map[string][]interchange, error) {
+	schedules, err := s.GetSchedules(ScheduleQuery{
+		Date:   firstDay.Format("2006-01-02"),
+		To:     lastDay.Format("2006-01-02"),
+		Tiploc: to,
+	})
+	if err != nil {
+		return nil, err
+	}
+	interchanges := make(map[string][]interchange)
+	for _, sch := range schedules {
+		day, err := time.Parse("2006-01-02", sch.RunDate)
+		if err != nil {
+			return nil, fmt.Errorf("invalid run date %s: %w", sch.RunDate, err)
+		}
+		calls := publicCalls(sch)
+		arrival := -1
+		for idx, call := range calls {
+			if atTo[call.loc.TiplocCode] && call.arrivalTS != 0 {
+				arrival = idx
+				break
+			}
+		}
+		for idx := 0; idx < arrival; idx++ {
+			if calls[idx].departureTS == 0 || atTo[calls[idx].loc.TiplocCode] {
+				continue
+			}
+			key := stationKey(calls[idx].loc)
+			interchanges[key] = append(interchanges[key], interchange{sch: sch, date: day, from: calls[idx], to: calls[arrival]})
+		}
+	}
+	return interchanges, nil
+}
+
+// publicCalls returns the calls of a schedule that have a public arrival or departure, in order. Passengers can only
+// leave at a call that sets down, and join at one that takes up.
+func publicCalls(sch schedule.Schedule) []publicCall {
+	var calls []publicCall
+	for _, loc := range sch.ScheduleLocation {
+		if !loc.IsPublicStop() {
+			continue
+		}
+		call := publicCall{loc: loc}
+		if loc.SetsDown {
+			call.arrivalTS = loc.PublicArrivalTS
+		}
+		if loc.TakesUp {
+			call.departureTS = loc.PublicDepartureTS
+		}
+		if call.arrivalTS != 0 || call.departureTS != 0 {
+			calls = append(calls, call)
+		}
+	}
+	return calls
+}
+
+// stationKey identifies the station a location belongs to, so that a change can be made between its TIPLOCs.
+func stationKey(loc schedule.ScheduleLocation) string {
+	if loc.Tiploc.CrsCode != "" {
+		return "CRS:" + loc.Tiploc.CrsCode
+	}
+	return loc.TiplocCode
+}
+
+func newJourneyLeg(sch schedule.Schedule, date time.Time, from, to publicCall) JourneyLeg {
+	return JourneyLeg{
+		CIFTrainUID:         sch.CIFTrainUID,
+		SignallingID:        sch.SignallingID,
+		AtocCode:            sch.AtocCode,
+		AtocCodeDescription: sch.AtocCodeDescription,
+		CIFStpIndicator:     sch.CIFStpIndicator,
+		ScheduleDate:        date.Format("2006-01-02"),
+		Origin:              sch.Origin,
+		Destination:         sch.Destination,
+		From:                from.loc.TiplocCode,
+		FromDescription:     from.loc.Tiploc.TpsDescription,
+		Departure:           from.loc.PublicDeparture.Format(),
+		DeparturePlatform:   from.loc.Platform,
+		DepartureTS:         from.departureTS,
+		To:                  to.loc.TiplocCode,
+		ToDescription:       to.loc.Tiploc.TpsDescription,
+		Arrival:             to.loc.PublicArrival.Format(),
+		ArrivalPlatform:     to.loc.Platform,
+		ArrivalTS:           to.arrivalTS,
+	}
+}
+
+func newJourney(legs ...JourneyLeg) Journey {
+	return Journey{
+		DepartureTS: legs[0].DepartureTS,
+		ArrivalTS:   legs[len(legs)-1].ArrivalTS,
+		Changes:     len(legs) - 1,
+		Legs:        legs,
+	}
+}
+
+// dominated reports whether another journey leaves no earlier than journey and gets there no later, with fewer
+// changes or, with the same number, a strictly shorter journey time.
+func dominated(journey Journey, others ...[]Journey) bool {
+	for _, list := range others {
+		for _, other := range list {
+			if other.DepartureTS < journey.DepartureTS || other.ArrivalTS > journey.ArrivalTS {
+				continue
+			}
+			if other.Changes < journey.Changes {
+				return true
+			}
+			if other.Changes == journey.Changes &&
+				(other.DepartureTS > journey.DepartureTS || other.ArrivalTS < journey.ArrivalTS) {
+				return true
+			}
+		}
+	}
+	return false
+}
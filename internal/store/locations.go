@@ -0,0 +1,259 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"uk-rail-schedule-api/internal/schedule"
+)
+
+// ErrAmbiguousLocation is returned for a location code that is both a TIPLOC and the CRS code of other TIPLOCs, and
+// ErrUnknownLocation for a CRS code that no TIPLOC has.
+var (
+	ErrAmbiguousLocation = errors.New("ambiguous location")
+	ErrUnknownLocation   = errors.New("unknown location")
+)
+
+// ResolveLocation returns the TIPLOCs for a location code, which may be either a TIPLOC or a CRS code. A CRS code
+// resolves to every TIPLOC belonging to the station. A code that is both a TIPLOC and the CRS code of a station with
+// other TIPLOCs is ambiguous, and ErrAmbiguousLocation is returned; ResolveTiploc and ResolveCRS choose between them.
+// Codes that match neither are returned unchanged, so that schedules can still be found for TIPLOCs missing from the
+// TIPLOC table.
+func (s *Store) ResolveLocation(code string) ([]string, error) {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	isTiploc, err := s.isTiploc(code)
+	if err != nil {
+		return nil, err
+	}
+	station, err := s.crsTiplocs(code)
+	if err != nil {
+		return nil, err
+	}
+	if isTiploc && slices.ContainsFunc(station, func(tiploc string) bool { return tiploc != code }) {
+		return nil, fmt.Errorf("%w: %s is both a TIPLOC and the CRS code of %s", ErrAmbiguousLocation, code, strings.Join(station, ", "))
+	}
+	if isTiploc || len(station) == 0 {
+		return []string{code}, nil
+	}
+	return station, nil
+}
+
+// ResolveTiploc returns the TIPLOCs for a location code as ResolveLocation does, except that a code that is both a
+// TIPLOC and a CRS code is taken to be the TIPLOC.
+func (s *Store) ResolveTiploc(code string) ([]string, error) {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	isTiploc, err := s.isTiploc(code)
+	if err != nil {
+		return nil, err
+	}
+	if isTiploc {
+		return []string{code}, nil
+	}
+	station, err := s.crsTiplocs(code)
+	if err != nil {
+		return nil, err
+	}
+	if len(station) > 0 {
+		return station, nil
+	}
+	return []string{code}, nil
+}
+
+// ResolveCRS returns the TIPLOCs belonging to the station with a CRS code, or ErrUnknownLocation if there are none.
+func (s *Store) ResolveCRS(code string) ([]string, error) {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	station, err := s.crsTiplocs(code)
+	if err != nil {
+		return nil, err
+	}
+	if len(station) == 0 {
+		return nil, fmt.Errorf("%w: no TIPLOC has CRS code %s", ErrUnknownLocation, code)
+	}
+	return station, nil
+}
+
+func (s *Store) isTiploc(code string) (bool, error) {
+	if s.DB == nil {
+		return false, errors.New("db is nil")
+	}
+	var count int64
+	if err := s.DB.Model(&schedule.Tiploc{}).Where("tiploc_code = ?", code).Count(&count).Error; err != nil {
+		return false, fmt.Errorf("error looking up tiploc: %w", err)
+	}
+	return count > 0, nil
+}
+
+func (s *Store) crsTiplocs(code string) ([]string, error) {
+	if s.DB == nil {
+		return nil, errors.New("db is nil")
+	}
+	var tiplocs []string
+	if err := s.DB.Model(&schedule.Tiploc{}).Where("crs_code = ?", code).Distinct().Order("tiploc_code").
+		Pluck("tiploc_code", &tiplocs).Error; err != nil {
+		return nil, fmt.Errorf("error looking up crs code: %w", err)
+	}
+	return tiplocs, nil
+}
+
+// resolveTiplocs resolves a location with resolve to its TIPLOCs, both as a list and as a set. Both are nil if no
+// location is given.
+func (s *Store) resolveTiplocs(location string, resolve func(string) ([]string, error)) ([]string, map[string]bool, error) {
+	if location == "" {
+		return nil, nil, nil
+	}
+	tiplocs, err := resolve(location)
+	if err != nil {
+		return nil, nil, err
+	}
+	atLocation := make(map[string]bool, len(tiplocs))
+	for _, tiploc := range tiplocs {
+		atLocation[tiploc] = true
+	}
+	return tiplocs, atLocation, nil
+}
+
+// queryTiplocs resolves the location of a schedule query: q.CRS as a CRS code, or q.Tiploc as a TIPLOC, or failing
+// that a CRS code.
+func (s *Store) queryTiplocs(q ScheduleQuery) ([]string, map[string]bool, error) {
+	if q.CRS != "" {
+		return s.resolveTiplocs(q.CRS, s.ResolveCRS)
+	}
+	return s.resolveTiplocs(q.Tiploc, s.ResolveTiploc)
+}
+
+// LocationSearch describes a search for locations. Code is matched exactly against TIPLOC, CRS and STANOX codes;
+// Name is matched against the location's descriptions by prefix, then by the words it contains, or failing those
+// allowing for typing errors. Matches are returned in that order.
+type LocationSearch struct {
+	Code  string
+	Name  string
+	Limit int
+}
+
+// maxNameDistance is the number of typing errors allowed when fuzzy matching a location name, and
+// maxFuzzyCandidates the number of locations compared with the name.
+const (
+	maxNameDistance    = 2
+	maxFuzzyCandidates = 1000
+)
+
+// SearchLocations returns the locations matching the search, best matches first.
+func (s *Store) SearchLocations(search LocationSearch) ([]schedule.Tiploc, error) {
+	locations := []schedule.Tiploc{}
+	if s.DB == nil {
+		return locations, errors.New("db is nil")
+	}
+
+	seen := make(map[string]bool)
+	add := func(found []schedule.Tiploc) {
+		for _, tiploc := range found {
+			if len(locations) >= search.Limit || seen[tiploc.TiplocCode] {
+				continue
+			}
+			seen[tiploc.TiplocCode] = true
+			locations = append(locations, tiploc)
+		}
+	}
+
+	if code := strings.ToUpper(strings.TrimSpace(search.Code)); code != "" {
+		var found []schedule.Tiploc
+		if err := s.DB.Where("tiploc_code = ? OR crs_code = ? OR stanox = ?", code, code, code).
+			Order("tiploc_code").Find(&found).Error; err != nil {
+			return nil, fmt.Errorf("error searching locations by code: %w", err)
+		}
+		add(found)
+	}
+
+	name := strings.ToUpper(strings.Join(strings.Fields(search.Name), " "))
+	if name == "" || len(locations) >= search.Limit {
+		return locations, nil
+	}
+
+	var found []schedule.Tiploc
+	prefix := escapeLike(name) + "%"
+	if err := s.DB.Where(`UPPER(tps_description) LIKE ? ESCAPE '\' OR UPPER(description) LIKE ? ESCAPE '\'`, prefix, prefix).
+		Order("tps_description").Limit(search.Limit).Find(&found).Error; err != nil {
+		return nil, fmt.Errorf("error searching locations by name: %w", err)
+	}
+	add(found)
+	if len(locations) >= search.Limit {
+		return locations, nil
+	}
+
+	words := Filter{}
+	for _, word := range strings.Fields(name) {
+		pattern := "%" + escapeLike(word) + "%"
+		words = words.where(`UPPER(tps_description) LIKE ? ESCAPE '\' OR UPPER(description) LIKE ? ESCAPE '\'`, pattern, pattern)
+	}
+	wordsSQL, wordsArgs := words.SQL()
+	found = nil
+	if err := s.DB.Where(wordsSQL, wordsArgs...).Order("tps_description").Limit(search.Limit * 2).Find(&found).Error; err != nil {
+		return nil, fmt.Errorf("error searching locations by name: %w", err)
+	}
+	nameMatches := len(found)
+	add(found)
+	if len(locations) >= search.Limit {
+		return locations, nil
+	}
+
+	// If nothing matches by name, look for names within a typing error or two of the search. Short searches allow
+	// fewer errors, as otherwise they would match almost everything.
+	distance := min(len(name)/4, maxNameDistance)
+	if distance == 0 || nameMatches > 0 {
+		return locations, nil
+	}
+	// A name within distance errors of the search contains at least one of distance+1 pieces of it unchanged, so
+	// only names containing one of them need to be compared
+	var pieces []string
+	var patterns []interface{}
+	runes := []rune(name)
+	for i := 0; i <= distance; i++ {
+		piece := string(runes[i*len(runes)/(distance+1) : (i+1)*len(runes)/(distance+1)])
+		pieces = append(pieces, `UPPER(tps_description) LIKE ? ESCAPE '\'`)
+		patterns = append(patterns, "%"+escapeLike(piece)+"%")
+	}
+	var candidates []schedule.Tiploc
+	if err := s.DB.Where("tps_description <> ''").Where("("+strings.Join(pieces, " OR ")+")", patterns...).
+		Order("tps_description").Limit(maxFuzzyCandidates).Find(&candidates).Error; err != nil {
+		return nil, fmt.Errorf("error searching locations by name: %w", err)
+	}
+	var fuzzy []schedule.Tiploc
+	for _, tiploc := range candidates {
+		if nameDistance(name, strings.ToUpper(tiploc.TpsDescription)) <= distance {
+			fuzzy = append(fuzzy, tiploc)
+		}
+	}
+	add(fuzzy)
+
+	return locations, nil
+}
+
+// escapeLike escapes the wildcards of a LIKE pattern so that s is matched literally.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// nameDistance returns the edit distance between search and the closest prefix of name, so that "CLAPAM J" is
+// close to "CLAPHAM JUNCTION".
+func nameDistance(search, name string) int {
+	a, b := []rune(search), []rune(name)
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	// Any prefix of name may be matched, so the rest of the name is free
+	return slices.Min(previous)
+}
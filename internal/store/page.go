@@ -0,0 +1,147 @@
+package store
+
+import (
+	"encoding/base64"
+	"errors"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"uk-rail-schedule-api/internal/schedule"
+)
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// SchedulePage is one page of the schedules matching a query. NextCursor is empty on the last page.
+type SchedulePage struct {
+	Schedules  []schedule.Schedule
+	NextCursor string
+}
+
+// GetSchedulePage returns the page of schedules matching q that follows cursor, in the order GetSchedules returns
+// them. An empty cursor starts from the first schedule, and a limit of 0 returns every remaining schedule.
+//
+// STP precedence is resolved in memory, so the page can't be cut in SQL; instead the cursor records the sort key,
+// train UID and run date of the last schedule returned, which stays valid as schedules are added or removed between
+// requests. Dates that can only hold schedules before the cursor are left out of the query, so later pages of a date
+// range don't fetch the dates earlier pages covered, but each page still resolves every schedule on the remaining
+// dates. Associations, which need queries of their own, are only looked up for the schedules on the page.
+func (s *Store) GetSchedulePage(q ScheduleQuery, cursor string, limit int) (SchedulePage, error) {
+	var page SchedulePage
+
+	var after cursorPosition
+	if cursor != "" {
+		var err error
+		after, err = decodeCursor(cursor)
+		if err != nil {
+			return page, err
+		}
+		var remaining bool
+		q, remaining = after.narrow(q)
+		if !remaining {
+			return page, nil
+		}
+	}
+
+	schedules, atLocation, err := s.findSchedules(q)
+	if err != nil {
+		return page, err
+	}
+
+	if cursor != "" {
+		// The schedules are in cursor order, so the page starts at the first one after the cursor
+		start := sort.Search(len(schedules), func(i int) bool {
+			return after.before(newCursorPosition(schedules[i], atLocation))
+		})
+		schedules = schedules[start:]
+	}
+
+	if limit > 0 && len(schedules) > limit {
+		schedules = schedules[:limit]
+		last := schedules[limit-1]
+		page.NextCursor = encodeCursor(newCursorPosition(last, atLocation))
+	}
+	if err := s.attachAssociations(schedules); err != nil {
+		return page, err
+	}
+	page.Schedules = schedules
+	return page, nil
+}
+
+// cursorPosition is the place of a schedule in the order sortSchedules puts them in.
+type cursorPosition struct {
+	key     int64
+	uid     string
+	runDate string
+}
+
+func newCursorPosition(sch schedule.Schedule, atLocation map[string]bool) cursorPosition {
+	return cursorPosition{key: scheduleSortKey(sch, atLocation), uid: sch.CIFTrainUID, runDate: sch.RunDate}
+}
+
+// before reports whether p comes before other.
+func (p cursorPosition) before(other cursorPosition) bool {
+	if p.key != other.key {
+		return p.key < other.key
+	}
+	if p.uid != other.uid {
+		return p.uid < other.uid
+	}
+	return p.runDate < other.runDate
+}
+
+// narrow returns q limited to the dates that can have schedules after p, or false if none of its dates can. A train
+// is taken to finish within a day of the date it starts, so no schedule running on a date more than a day before the
+// date of p's sort key can come after it. Schedules without a time sort last whatever date they run on, so a cursor
+// among them doesn't narrow the query. A query whose dates aren't valid is left for findSchedules to reject.
+func (p cursorPosition) narrow(q ScheduleQuery) (ScheduleQuery, bool) {
+	if p.key == math.MaxInt64 {
+		return q, true
+	}
+	from, err := time.Parse("2006-01-02", q.Date)
+	if err != nil {
+		return q, true
+	}
+	to := from
+	if q.To != "" {
+		if from, to, err = parseDateRange(q.Date, q.To, MaxScheduleRangeDays); err != nil {
+			return q, true
+		}
+	}
+
+	at := time.Unix(p.key, 0).In(londonLocation)
+	earliest := time.Date(at.Year(), at.Month(), at.Day()-1, 0, 0, 0, 0, time.UTC)
+	if earliest.After(to) {
+		return q, false
+	}
+	if earliest.After(from) {
+		q.Date = earliest.Format("2006-01-02")
+		q.To = to.Format("2006-01-02")
+	}
+	return q, true
+}
+
+func encodeCursor(p cursorPosition) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(p.key, 10) + ":" + p.uid + ":" + p.runDate))
+}
+
+func decodeCursor(cursor string) (cursorPosition, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return cursorPosition{}, ErrInvalidCursor
+	}
+	key, rest, ok := strings.Cut(string(decoded), ":")
+	if !ok {
+		return cursorPosition{}, ErrInvalidCursor
+	}
+	k, err := strconv.ParseInt(key, 10, 64)
+	if err != nil {
+		return cursorPosition{}, ErrInvalidCursor
+	}
+	uid, runDate, ok := strings.Cut(rest, ":")
+	if !ok || runDate == "" {
+		return cursorPosition{}, ErrInvalidCursor
+	}
+	return cursorPosition{key: k, uid: uid, runDate: runDate}, nil
+}
@@ -0,0 +1,104 @@
+package store
+
+import (
+	"strings"
+	"time"
+)
+
+// ScheduleQuery describes a search for the schedules running on a date. Empty fields don't filter.
+type ScheduleQuery struct {
+	Headcode string
+	TrainUID string
+	TOC      string
+	Tiploc   string
+	// CRS, if set instead of Tiploc, is the CRS code of a station whose TIPLOCs the schedules call at
+	CRS       string
+	Category  string
+	PowerType string
+	// Date the schedules run on, as YYYY-MM-DD
+	Date string
+	// To, if set, makes the query a range from Date to To, inclusive, returning the schedule resolved for each date
+	// a train runs on
+	To string
+
+	// HidePassed leaves out trains that have already passed the TIPLOC, or reached their destination, by now. Trains
+	// that don't stop for passengers at the TIPLOC are left out too.
+	HidePassed bool
+	// IncludeCancelled returns cancelled schedules, flagged as cancelled, rather than leaving them out
+	IncludeCancelled bool
+}
+
+// Filter is a composable set of conditions on the schedules table. Every value is passed to the database as a bound
+// parameter, never formatted into the SQL, so filters are safe to build from untrusted input. Methods given an empty
+// value return the filter unchanged.
+type Filter struct {
+	conditions []string
+	args       []interface{}
+}
+
+func (f Filter) where(condition string, args ...interface{}) Filter {
+	f.conditions = append(f.conditions[:len(f.conditions):len(f.conditions)], condition)
+	f.args = append(f.args[:len(f.args):len(f.args)], args...)
+	return f
+}
+
+// Headcode filters on the signalling ID.
+func (f Filter) Headcode(headcode string) Filter {
+	if headcode == "" {
+		return f
+	}
+	return f.where("signalling_id = ?", headcode)
+}
+
+// TrainUID filters on the CIF train UID.
+func (f Filter) TrainUID(uid string) Filter {
+	if uid == "" {
+		return f
+	}
+	return f.where("cif_train_uid = ?", uid)
+}
+
+// TOC filters on the ATOC code of the operator.
+func (f Filter) TOC(toc string) Filter {
+	if toc == "" {
+		return f
+	}
+	return f.where("atoc_code = ?", toc)
+}
+
+// Tiplocs filters on schedules calling at, or passing, any of the given TIPLOCs.
+func (f Filter) Tiplocs(tiplocs ...string) Filter {
+	if len(tiplocs) == 0 {
+		return f
+	}
+	return f.where("id IN (SELECT schedule_id FROM schedule_locations WHERE tiploc_code IN ?)", tiplocs)
+}
+
+// Category filters on the CIF train category, e.g. OO for ordinary passenger.
+func (f Filter) Category(category string) Filter {
+	if category == "" {
+		return f
+	}
+	return f.where("cif_train_category = ?", category)
+}
+
+// PowerType filters on the CIF power type, e.g. EMU.
+func (f Filter) PowerType(powerType string) Filter {
+	if powerType == "" {
+		return f
+	}
+	return f.where("cif_power_type = ?", powerType)
+}
+
+// ValidBetween filters on schedules whose date range overlaps the days from and to, inclusive.
+func (f Filter) ValidBetween(from, to time.Time) Filter {
+	return f.where("schedule_start_date_ts <= ? AND schedule_end_date_ts >= ?", to.Unix()+86399, from.Unix())
+}
+
+// SQL returns the filter as a condition for a WHERE clause, and its arguments.
+func (f Filter) SQL() (string, []interface{}) {
+	if len(f.conditions) == 0 {
+		return "1=1", nil
+	}
+	return "(" + strings.Join(f.conditions, ") AND (") + ")", f.args
+}
@@ -0,0 +1,58 @@
+package store_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"uk-rail-schedule-api/internal/store"
+)
+
+func TestFilter_ValuesAreBound(t *testing.T) {
+	hostile := `2A20' OR '1'='1`
+	date := time.Date(2023, 5, 21, 0, 0, 0, 0, time.UTC)
+
+	sql, args := store.Filter{}.
+		Headcode(hostile).
+		TrainUID(hostile).
+		TOC(hostile).
+		Tiplocs(hostile).
+		Category(hostile).
+		PowerType(hostile).
+		ValidBetween(date, date).
+		SQL()
+
+	if strings.Contains(sql, " OR ") || strings.Contains(sql, "2A20") {
+		t.Errorf("expected values to be bound rather than formatted into the SQL, got %q", sql)
+	}
+	if n := strings.Count(sql, "?"); n != len(args) {
+		t.Errorf("expected one argument per placeholder, got %d placeholders and %d args", n, len(args))
+	}
+}
+
+func TestFilter_EmptyValuesDontFilter(t *testing.T) {
+	sql, args := store.Filter{}.Headcode("").TOC("").Tiplocs().SQL()
+	if sql != "1=1" || len(args) != 0 {
+		t.Errorf("expected an empty filter, got %q with %d args", sql, len(args))
+	}
+}
+
+func TestFilter_IsImmutable(t *testing.T) {
+	base := store.Filter{}.Headcode("2A20")
+	withTOC := base.TOC("GW")
+	withUID := base.TrainUID("C00206")
+
+	baseSQL, baseArgs := base.SQL()
+	tocSQL, tocArgs := withTOC.SQL()
+	uidSQL, uidArgs := withUID.SQL()
+
+	if len(baseArgs) != 1 || strings.Contains(baseSQL, "atoc_code") {
+		t.Errorf("expected base filter to be unchanged, got %q %v", baseSQL, baseArgs)
+	}
+	if !strings.Contains(tocSQL, "atoc_code") || strings.Contains(tocSQL, "cif_train_uid") || tocArgs[1] != "GW" {
+		t.Errorf("unexpected TOC filter %q %v", tocSQL, tocArgs)
+	}
+	if !strings.Contains(uidSQL, "cif_train_uid") || strings.Contains(uidSQL, "atoc_code") || uidArgs[1] != "C00206" {
+		t.Errorf("unexpected UID filter %q %v", uidSQL, uidArgs)
+	}
+}
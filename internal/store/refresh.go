@@ -0,0 +1,53 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"uk-rail-schedule-api/internal/schedule"
+
+	"gorm.io/gorm"
+)
+
+var ErrRefreshJobNotFound = errors.New("refresh job not found")
+
+// GetRefreshJob returns the refresh job with the given ID, which may still be running.
+func (s *Store) GetRefreshJob(id uint64) (schedule.RefreshJob, error) {
+	var job schedule.RefreshJob
+	if s.DB == nil {
+		return job, errors.New("db is nil")
+	}
+
+	err := s.DB.First(&job, id).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return job, ErrRefreshJobNotFound
+	}
+	if err != nil {
+		return job, fmt.Errorf("error looking up refresh job: %w", err)
+	}
+	return job, nil
+}
+
+// RefreshReport is the validation report of a refresh job: the number of each kind of issue found in the feed file it
+// loaded, and the first of each kind. It's only complete once the job has finished.
+type RefreshReport struct {
+	JobID  uint64                  `json:"job_id"`
+	State  string                  `json:"state"`
+	Counts map[string]int64        `json:"counts"`
+	Issues []schedule.RefreshIssue `json:"issues"`
+}
+
+// GetRefreshReport returns the validation report of a refresh job, with its issues in the order they were found.
+func (s *Store) GetRefreshReport(job schedule.RefreshJob) (RefreshReport, error) {
+	report := RefreshReport{JobID: job.ID, State: job.State, Counts: job.IssueCounts, Issues: []schedule.RefreshIssue{}}
+	if report.Counts == nil {
+		report.Counts = map[string]int64{}
+	}
+	if s.DB == nil {
+		return report, errors.New("db is nil")
+	}
+
+	if err := s.DB.Where("job_id = ?", job.ID).Order("id").Find(&report.Issues).Error; err != nil {
+		return report, fmt.Errorf("error looking up refresh issues: %w", err)
+	}
+	return report, nil
+}
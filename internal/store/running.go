@@ -0,0 +1,141 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"time"
+	"uk-rail-schedule-api/internal/schedule"
+)
+
+// The longest ranges of dates, in days, that schedules and running calendars can be queried for.
+const (
+	MaxScheduleRangeDays = 31
+	MaxRunningRangeDays  = 366
+)
+
+var ErrInvalidDateRange = errors.New("invalid date range")
+
+// parseDateRange parses a range of dates given as YYYY-MM-DD, which must be in order and no longer than maxDays.
+func parseDateRange(from, to string, maxDays int) (time.Time, time.Time, error) {
+	first, err := time.Parse("2006-01-02", from)
+	if err != nil {
+		return first, first, fmt.Errorf("%w: from must be a date as YYYY-MM-DD", ErrInvalidDateRange)
+	}
+	last, err := time.Parse("2006-01-02", to)
+	if err != nil {
+		return first, last, fmt.Errorf("%w: to must be a date as YYYY-MM-DD", ErrInvalidDateRange)
+	}
+	if last.Before(first) {
+		return first, last, fmt.Errorf("%w: to must not be before from", ErrInvalidDateRange)
+	}
+	if last.After(first.AddDate(0, 0, maxDays-1)) {
+		return first, last, fmt.Errorf("%w: the range can't be longer than %d days", ErrInvalidDateRange, maxDays)
+	}
+	return first, last, nil
+}
+
+// RunningCalendar shows on which dates a train runs, and which of its records governs each date.
+type RunningCalendar struct {
+	TrainUID string `json:"trainuid"`
+	From     string `json:"from"`
+	To       string `json:"to"`
+	// Summary has a character for each date: R if the train runs, C if it's cancelled, B if it doesn't run on the
+	// date's bank holiday, and - if no record is valid on the date
+	Summary string `json:"summary"`
+	// Records are the records that govern the train on at least one of the dates, in the order they first do
+	Records []RunningRecord `json:"records"`
+	Days    []RunningDay    `json:"days"`
+}
+
+// RunningRecord is a record of a train, as referred to by the days of a running calendar.
+type RunningRecord struct {
+	ID                    uint64 `json:"id"`
+	CIFStpIndicator       string `json:"CIF_stp_indicator"`
+	Source                string `json:"source"`
+	SignallingID          string `json:"signalling_id,omitempty"`
+	ScheduleStartDate     string `json:"schedule_start_date"`
+	ScheduleEndDate       string `json:"schedule_end_date"`
+	ScheduleDaysRuns      string `json:"schedule_days_runs"`
+	CIFBankHolidayRunning string `json:"CIF_bank_holiday_running,omitempty"`
+}
+
+// RunningDay is whether a train runs on one date.
+type RunningDay struct {
+	Date      string `json:"date"`
+	Runs      bool   `json:"runs"`
+	Cancelled bool   `json:"cancelled,omitempty"`
+	// BankHoliday is the title of the bank holiday the train doesn't run on
+	BankHoliday string `json:"bank_holiday,omitempty"`
+	// Record is the ID of the record that governs the train on the date: the cancellation if it's cancelled, and
+	// the overlay rather than the permanent schedule it alters. It's left out if no record is valid on the date.
+	Record uint64 `json:"record,omitempty"`
+}
+
+// GetRunningCalendar returns the running calendar of the train with the given UID from one date to another, given as
+// YYYY-MM-DD, applying STP precedence and bank holidays to each date as GetSchedules does. The calendar has no
+// records if the train has none valid in the range.
+func (s *Store) GetRunningCalendar(uid, from, to string) (RunningCalendar, error) {
+	calendar := RunningCalendar{TrainUID: uid, From: from, To: to, Records: []RunningRecord{}, Days: []RunningDay{}}
+	if s.DB == nil {
+		return calendar, errors.New("db is nil")
+	}
+	first, last, err := parseDateRange(from, to, MaxRunningRangeDays)
+	if err != nil {
+		return calendar, err
+	}
+
+	filterSQL, filterArgs := Filter{}.TrainUID(uid).ValidBetween(first, last).SQL()
+	var records []schedule.Schedule
+	if err := s.DB.Raw("SELECT * FROM schedules WHERE "+filterSQL, filterArgs...).Scan(&records).Error; err != nil {
+		return calendar, fmt.Errorf("error querying schedules: %w", err)
+	}
+
+	summary := make([]byte, 0, int(last.Sub(first).Hours()/24)+1)
+	seen := make(map[uint64]bool)
+	for day := first; !day.After(last); day = day.AddDate(0, 0, 1) {
+		running := RunningDay{Date: day.Format("2006-01-02")}
+		valid := validOn(records, day)
+
+		winner, ok := schedule.STPWinner(valid)
+		if !ok {
+			calendar.Days = append(calendar.Days, running)
+			summary = append(summary, '-')
+			continue
+		}
+		running.Record = winner.ID
+		if !seen[winner.ID] {
+			seen[winner.ID] = true
+			calendar.Records = append(calendar.Records, newRunningRecord(winner))
+		}
+
+		resolved, _ := schedule.ResolveSTP(valid, day.Unix())
+		holiday, excluded := s.Calendar.Excludes(resolved.CIFBankHolidayRunning, day)
+		switch {
+		case resolved.Cancelled:
+			running.Cancelled = true
+			summary = append(summary, 'C')
+		case excluded:
+			running.BankHoliday = holiday.Title
+			summary = append(summary, 'B')
+		default:
+			running.Runs = true
+			summary = append(summary, 'R')
+		}
+		calendar.Days = append(calendar.Days, running)
+	}
+	calendar.Summary = string(summary)
+	return calendar, nil
+}
+
+func newRunningRecord(rec schedule.Schedule) RunningRecord {
+	return RunningRecord{
+		ID:                    rec.ID,
+		CIFStpIndicator:       rec.CIFStpIndicator,
+		Source:                rec.Source,
+		SignallingID:          rec.SignallingID,
+		ScheduleStartDate:     rec.ScheduleStartDate,
+		ScheduleEndDate:       rec.ScheduleEndDate,
+		ScheduleDaysRuns:      rec.ScheduleDaysRuns,
+		CIFBankHolidayRunning: rec.CIFBankHolidayRunning,
+	}
+}
@@ -4,24 +4,22 @@ import (
 	"errors"
 	"fmt"
 	"log/slog"
+	"math"
+	"slices"
 	"sort"
-	"strconv"
 	"time"
+	"uk-rail-schedule-api/internal/calendar"
 	"uk-rail-schedule-api/internal/schedule"
 
 	"gorm.io/gorm"
 )
 
-// londonLocation is the Europe/London timezone, used when interpreting WTT times.
-// WTT times in the CIF schedule feed are always UK local time (GMT/BST).
-var londonLocation *time.Location
+// londonLocation is the Europe/London timezone, used when interpreting dates and times.
+var londonLocation = schedule.LondonLocation()
 
-func init() {
-	loc, err := time.LoadLocation("Europe/London")
-	if err != nil {
-		panic(fmt.Sprintf("failed to load Europe/London timezone: %v", err))
-	}
-	londonLocation = loc
+// LondonLocation returns the Europe/London timezone, in which dates and times in the API are interpreted.
+func LondonLocation() *time.Location {
+	return londonLocation
 }
 
 // APIStatus holds summary counts returned by the /status endpoint.
@@ -35,16 +33,21 @@ type APIStatus struct {
 	VSTPCountLastHour            int64
 	VSTPCountLastSixHours        int64
 	VSTPCountLastTwentyFourHours int64
+	// LatestRefresh is the most recent load of the schedule feed, with its progress if it's still running
+	LatestRefresh *schedule.RefreshJob
 }
 
 // Store wraps a GORM database handle and provides schedule query methods.
 type Store struct {
 	DB      *gorm.DB
 	Version string
+	// Calendar is the bank holidays consulted for trains that don't run on them. It's the bundled calendar unless
+	// replaced with one that has overrides.
+	Calendar *calendar.Calendar
 }
 
 func New(db *gorm.DB, version string) *Store {
-	return &Store{DB: db, Version: version}
+	return &Store{DB: db, Version: version, Calendar: calendar.Default()}
 }
 
 func (s *Store) GetStatus() (APIStatus, error) {
@@ -80,147 +83,179 @@ func (s *Store) GetStatus() (APIStatus, error) {
 		}
 	}
 
+	var jobs []schedule.RefreshJob
+	if err := s.DB.Order("id desc").Limit(1).Find(&jobs).Error; err != nil {
+		return status, fmt.Errorf("error looking up latest refresh job: %w", err)
+	}
+	if len(jobs) > 0 {
+		status.LatestRefresh = &jobs[0]
+	}
+
 	return status, nil
 }
 
-func (s *Store) GetSchedules(headcode, date, toc, tiplocId string, hidePassedTrains bool) ([]schedule.Schedule, error) {
-	var schedules []schedule.Schedule
-	var tiploc schedule.Tiploc
+// GetSchedules returns the schedules running on q.Date that match the query, with STP overlays applied and trains
+// that don't run on the day's bank holiday left out.
+// Cancelled schedules are only returned, flagged as cancelled, if q.IncludeCancelled is set. If q.To is set the
+// schedules running on each date of the range are returned, a train running on several dates once for each.
+func (s *Store) GetSchedules(q ScheduleQuery) ([]schedule.Schedule, error) {
+	schedules, _, err := s.findSchedules(q)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.attachAssociations(schedules); err != nil {
+		return nil, err
+	}
 
-	if s.DB == nil {
-		return schedules, errors.New("db is nil")
+	if len(schedules) > 0 {
+		return schedules, nil
 	}
+	return nil, nil
+}
+
+// findSchedules returns the schedules matching q in the order GetSchedules returns them, without their associations,
+// and the TIPLOCs of the requested location, or nil if there isn't one.
+func (s *Store) findSchedules(q ScheduleQuery) ([]schedule.Schedule, map[string]bool, error) {
+	var schedules []schedule.Schedule
 
-	var headcodeFilter string
-	if headcode == "" {
-		headcodeFilter = "1=1"
-	} else {
-		headcodeFilter = fmt.Sprintf("signalling_id = \"%s\"", headcode)
+	if s.DB == nil {
+		return nil, nil, errors.New("db is nil")
 	}
 
-	ts, err := time.Parse("2006-01-02", date)
+	from, err := time.Parse("2006-01-02", q.Date)
 	if err != nil {
-		slog.Error("Failed to parse date", "date", date)
-		return schedules, fmt.Errorf("failed to parse date %s", date)
+		slog.Error("Failed to parse date", "date", q.Date)
+		return nil, nil, fmt.Errorf("failed to parse date %s", q.Date)
 	}
-
-	startDate := ts.Unix()
-	endDate := startDate + 86399
-	dow := int(ts.Weekday())
-	if dow == 0 {
-		dow = 7
+	to := from
+	if q.To != "" {
+		if from, to, err = parseDateRange(q.Date, q.To, MaxScheduleRangeDays); err != nil {
+			return nil, nil, err
+		}
 	}
-	dayFilter := fmt.Sprintf(" and substr(schedule_days_runs, %d, 1) = \"1\" ", dow)
 
-	var atocFilter string
-	if toc != "any" {
-		atocFilter = fmt.Sprintf(" and atoc_code = \"%s\" ", toc)
+	// The location may be a CRS code covering several TIPLOCs
+	tiplocs, atLocation, err := s.queryTiplocs(q)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	var tiplocFilter string
-	if tiplocId != "" && tiplocId != "any" {
-		tiplocFilter = fmt.Sprintf(" and id in (select schedule_id from schedule_locations where schedule_locations.tiploc_code = \"%s\")", tiplocId)
-	}
+	filter := Filter{}.
+		Headcode(q.Headcode).
+		TrainUID(q.TrainUID).
+		TOC(q.TOC).
+		Tiplocs(tiplocs...).
+		Category(q.Category).
+		PowerType(q.PowerType).
+		ValidBetween(from, to)
+	filterSQL, filterArgs := filter.SQL()
+	validSQL, validArgs := Filter{}.ValidBetween(from, to).SQL()
 
-	slog.Debug("filters",
-		"headcode_filter", headcodeFilter,
-		"start_date", startDate, "end_date", endDate,
-		"day_filter", dayFilter,
-		"atoc_filter", atocFilter,
-		"tiploc_filter", tiplocFilter,
-	)
+	slog.Debug("filters", "sql", filterSQL, "args", filterArgs)
 
 	/* Query applies STP indicator rules:
 C - Planned cancellation (train won't run)
 N - STP schedule (cannot be overlaid)
 O - Overlay schedule (alteration to permanent)
 P - Permanent schedule
-For any date, 'C' or 'O' beats 'P' (lowest alphabetical STP wins). */
-	sqlErr := s.DB.Debug().Raw(
-		"SELECT * FROM schedules WHERE (cif_stp_indicator = 'P' or cif_stp_indicator = 'N') AND "+
-		headcodeFilter+" AND schedule_start_date_ts <= ? AND schedule_end_date_ts >= ? "+
-		dayFilter+atocFilter+tiplocFilter,
-		startDate, endDate,
-		).Scan(&schedules).Error
-
-	if sqlErr != nil {
-		return nil, fmt.Errorf("error querying schedules: %w", sqlErr)
+For any date, 'C', 'N' or 'O' beats 'P' (lowest alphabetical STP wins), whether the record came from the feed or VSTP.
+
+Cancellations carry no headcode, operator or locations, so the filters are only used to find the train UIDs of
+interest; every record for those UIDs valid in the range is then fetched, once, and resolved for each date. A train
+is only of interest on a date if one of the records matching the filters runs on it. */
+	var matching []uint64
+	if err := s.DB.Raw("SELECT id FROM schedules WHERE "+filterSQL, filterArgs...).Scan(&matching).Error; err != nil {
+		return nil, nil, fmt.Errorf("error querying schedules: %w", err)
 	}
-
-	for idx := range schedules {
-		s.DB.Debug().Model(&schedule.ScheduleLocation{}).Preload("Tiploc").Find(&schedules[idx].ScheduleLocation, "schedule_id = ?", schedules[idx].ID)
-		slog.Debug("schedule", "idx", idx, "schedule_id", schedules[idx].ID, "locations", len(schedules[idx].ScheduleLocation))
+	matches := make(map[uint64]bool, len(matching))
+	for _, id := range matching {
+		matches[id] = true
 	}
 
-	var overlays []schedule.Schedule
-	sqlErr = s.DB.Raw(
-		"SELECT * FROM schedules WHERE source=\"VSTP\" AND (cif_stp_indicator = 'O' or cif_stp_indicator = 'C') AND "+
-		headcodeFilter+" AND schedule_start_date_ts <= ? AND schedule_end_date_ts >= ? "+
-		dayFilter+atocFilter+tiplocFilter,
-		startDate, endDate,
-		).Scan(&overlays).Error
+	var records []schedule.Schedule
+	if err := s.DB.Raw(
+		"SELECT * FROM schedules WHERE "+validSQL+
+			" AND cif_train_uid IN (SELECT cif_train_uid FROM schedules WHERE "+filterSQL+")",
+		append(validArgs, filterArgs...)...,
+	).Scan(&records).Error; err != nil {
+		return nil, nil, fmt.Errorf("error querying schedules: %w", err)
+	}
 
-	if sqlErr != nil {
-		return nil, fmt.Errorf("error querying overlays: %w", sqlErr)
+	if err := s.loadLocations(records); err != nil {
+		return nil, nil, err
 	}
 
-	for idx := range overlays {
-		s.DB.Find(&overlays[idx].ScheduleLocation, "schedule_id = ?", overlays[idx].ID)
+	var uids []string
+	recordsByUID := make(map[string][]schedule.Schedule)
+	for _, rec := range records {
+		if _, ok := recordsByUID[rec.CIFTrainUID]; !ok {
+			uids = append(uids, rec.CIFTrainUID)
+		}
+		recordsByUID[rec.CIFTrainUID] = append(recordsByUID[rec.CIFTrainUID], rec)
 	}
 
-	for idx := range schedules {
-		schedules[idx].ApplyOverlays(overlays, startDate)
-	}
-
-	// Enrich schedules with origin/destination station names and departure/arrival timestamps
-	for idx, sch := range schedules {
-		for _, l := range sch.ScheduleLocation {
-			// LO - Originating location; TB - Train Begins (VSTP)
-			if l.RecordIdentity == "LO" || l.RecordIdentity == "TB" {
-				s.DB.Where("tiploc_code = ?", l.TiplocCode).First(&tiploc)
-				schedules[idx].Origin = tiploc.TpsDescription
-				schedules[idx].TimeOfDepartureFromOriginTS, _ = combineDateAndTime(ts.Unix(), l.Departure)
-				schedules[idx].TimeOfDepartureFromOrigin = formatWTTTime(l.Departure)
+	for day := from; !day.After(to); day = day.AddDate(0, 0, 1) {
+		for _, uid := range uids {
+			valid := validOn(recordsByUID[uid], day)
+			if !anyMatch(valid, matches) {
+				continue
 			}
-			// LT - Termination location; TF - Train Finishes (VSTP)
-			if l.RecordIdentity == "LT" || l.RecordIdentity == "TF" {
-				s.DB.Where("tiploc_code = ?", l.TiplocCode).First(&tiploc)
-				schedules[idx].Destination = tiploc.TpsDescription
-				schedules[idx].TimeOfArrivalAtDestinationTS, _ = combineDateAndTime(ts.Unix(), l.Arrival)
-				schedules[idx].TimeOfArrivalAtDestination = formatWTTTime(l.Arrival)
+			resolved, ok := schedule.ResolveSTP(valid, day.Unix())
+			if !ok {
+				continue
+			}
+			if resolved.Cancelled && !q.IncludeCancelled {
+				continue
+			}
+			// Trains marked not to run on bank holidays don't run, rather than being cancelled, on one
+			if !s.Calendar.Runs(resolved.CIFBankHolidayRunning, day) {
+				continue
+			}
+			// An overlay may divert the train away from the requested TIPLOC
+			if !resolved.Cancelled && atLocation != nil && !callsAt(resolved, atLocation) {
+				continue
 			}
-		}
 
-		// If arrival is earlier than departure it's probably next-day; add 24 hours
-		if schedules[idx].TimeOfArrivalAtDestinationTS < schedules[idx].TimeOfDepartureFromOriginTS {
-			schedules[idx].TimeOfArrivalAtDestinationTS += 86400
+			// The records are shared between the dates, so each date's call times are set on its own locations
+			resolved.ScheduleLocation = slices.Clone(resolved.ScheduleLocation)
+			resolved.RunDate = day.Format("2006-01-02")
+			resolved.SetCallTimes(day)
+			// Enrich schedules with origin/destination station names
+			for _, l := range resolved.ScheduleLocation {
+				// LO - Originating location; TB - Train Begins (VSTP)
+				if l.RecordIdentity == "LO" || l.RecordIdentity == "TB" {
+					resolved.Origin = l.Tiploc.TpsDescription
+				}
+				// LT - Termination location; TF - Train Finishes (VSTP)
+				if l.RecordIdentity == "LT" || l.RecordIdentity == "TF" {
+					resolved.Destination = l.Tiploc.TpsDescription
+				}
+			}
+			schedules = append(schedules, resolved)
 		}
 	}
 
-	if hidePassedTrains {
+	if q.HidePassed {
 		now := time.Now().Unix()
 		filtered := schedules[:0]
 		for _, sch := range schedules {
-			if tiplocId != "" && tiplocId != "any" {
-				// Find the scheduled time at the requested TIPLOC; keep if not yet passed.
+			if atLocation != nil {
+				// Find the scheduled time the train stops for passengers at the requested TIPLOC; keep if not yet
+				// passed. Trains that only pass or stop for operational reasons are left out.
 				var tiplocTime int64
+				stops := false
 				for _, loc := range sch.ScheduleLocation {
-					if loc.TiplocCode != tiplocId {
+					if !atLocation[loc.TiplocCode] || !loc.IsPublicStop() {
 						continue
 					}
-					t := loc.Departure
-					if t == "" {
-						t = loc.Pass
-					}
-					if t == "" {
-						t = loc.Arrival
-					}
-					if t != "" {
-						tiplocTime, _ = combineDateAndTime(ts.Unix(), t)
+					stops = true
+					tiplocTime = loc.DepartureTS
+					if tiplocTime == 0 {
+						tiplocTime = loc.ArrivalTS
 					}
 					break
 				}
-				if tiplocTime == 0 || tiplocTime >= now {
+				if stops && (tiplocTime == 0 || tiplocTime >= now) {
 					filtered = append(filtered, sch)
 				}
 			} else {
@@ -233,93 +268,230 @@ For any date, 'C' or 'O' beats 'P' (lowest alphabetical STP wins). */
 		schedules = filtered
 	}
 
-	// Sort schedules in time order. When a TIPLOC is active, sort by the time
-	// the train is at that TIPLOC (Arrival → Pass → Departure). Otherwise sort
-	// by departure from origin.
-	sortTiploc := ""
-	if tiplocId != "" && tiplocId != "any" {
-		sortTiploc = tiplocId
+	sortSchedules(schedules, atLocation)
+	return schedules, atLocation, nil
+}
+
+// validOn returns the records valid on date, before STP precedence is applied.
+func validOn(records []schedule.Schedule, date time.Time) []schedule.Schedule {
+	var valid []schedule.Schedule
+	for _, rec := range records {
+		if rec.RunsOn(date) {
+			valid = append(valid, rec)
+		}
 	}
+	return valid
+}
 
-	// getSortKey returns the sort timestamp for a schedule. Because sort.Slice
-	// swaps elements of schedules in-place, the key must be computed from the
-	// schedule value at the current index rather than from a pre-built array
-	// (which would go out of sync with the slice as elements are moved).
-	getSortKey := func(sch schedule.Schedule) int64 {
-		if sortTiploc != "" {
-			for _, loc := range sch.ScheduleLocation {
-				if loc.TiplocCode != sortTiploc {
-					continue
-				}
-				t := loc.Arrival
-				if t == "" {
-					t = loc.Pass
-				}
-				if t == "" {
-					t = loc.Departure
-				}
-				if t != "" {
-					key, _ := combineDateAndTime(ts.Unix(), t)
-					return key
-				}
-				break
-			}
-			return 0
+// anyMatch reports whether any of records has its ID in ids.
+func anyMatch(records []schedule.Schedule, ids map[uint64]bool) bool {
+	for _, rec := range records {
+		if ids[rec.ID] {
+			return true
 		}
-		return sch.TimeOfDepartureFromOriginTS
 	}
+	return false
+}
 
-	sort.Slice(schedules, func(i, j int) bool {
-		ki := getSortKey(schedules[i])
-		kj := getSortKey(schedules[j])
-		if ki == 0 {
-			return false
+// sortSchedules sorts schedules in time order. When a TIPLOC is active, sort by the time the train is at that TIPLOC,
+// otherwise by departure from origin. Ties are broken on the train UID, then the date it runs on, so the order is
+// stable between requests, which pagination depends on.
+func sortSchedules(schedules []schedule.Schedule, atLocation map[string]bool) {
+	sort.SliceStable(schedules, func(i, j int) bool {
+		ki := scheduleSortKey(schedules[i], atLocation)
+		kj := scheduleSortKey(schedules[j], atLocation)
+		if ki != kj {
+			return ki < kj
 		}
-		if kj == 0 {
-			return true
+		if schedules[i].CIFTrainUID != schedules[j].CIFTrainUID {
+			return schedules[i].CIFTrainUID < schedules[j].CIFTrainUID
 		}
-		return ki < kj
+		return schedules[i].RunDate < schedules[j].RunDate
 	})
+}
 
-	if len(schedules) > 0 {
-		return schedules, nil
+// scheduleSortKey returns the timestamp a schedule is ordered by: the time the train is first at one of the TIPLOCs in
+// atLocation (Arrival → Pass → Departure) if any are given, otherwise its departure from origin. Schedules without a
+// time sort last.
+func scheduleSortKey(sch schedule.Schedule, atLocation map[string]bool) int64 {
+	key := sch.TimeOfDepartureFromOriginTS
+	if atLocation != nil {
+		key = 0
+		for _, loc := range sch.ScheduleLocation {
+			if !atLocation[loc.TiplocCode] {
+				continue
+			}
+			for _, ts := range []int64{loc.ArrivalTS, loc.PassTS, loc.DepartureTS} {
+				if ts != 0 {
+					key = ts
+					break
+				}
+			}
+			break
+		}
 	}
-	return nil, nil
+	if key == 0 {
+		return math.MaxInt64
+	}
+	return key
 }
 
-// combineDateAndTime combines a Unix date timestamp with a WTT time string "HHMM" or "HHMMSS".
-// WTT times are always UK local time (GMT/BST), so Europe/London is used when constructing
-// the combined timestamp to correctly account for daylight saving time.
-func combineDateAndTime(date int64, wttTime string) (int64, error) {
-	if len(wttTime) < 4 {
-		return 0, fmt.Errorf("wtt time too short: %q", wttTime)
+// queryChunkSize limits the number of values bound into a single IN clause, keeping queries within SQLite's limit
+// on the number of parameters.
+const queryChunkSize = 500
+
+// loadLocations fills in the locations of each record, with their activities decoded, and the TIPLOC of each
+// location, using one query per chunk of records and one per chunk of TIPLOCs rather than a query per record.
+func (s *Store) loadLocations(records []schedule.Schedule) error {
+	ids := make([]uint64, 0, len(records))
+	for _, rec := range records {
+		ids = append(ids, rec.ID)
 	}
 
-	var currentTime time.Time
-	if date != 0 {
-		currentTime = time.Unix(date, 0).In(londonLocation)
-	} else {
-		currentTime = time.Now().In(londonLocation)
+	byScheduleID := make(map[uint64][]schedule.ScheduleLocation)
+	tiplocCodes := make(map[string]bool)
+	for start := 0; start < len(ids); start += queryChunkSize {
+		chunk := ids[start:min(start+queryChunkSize, len(ids))]
+
+		var locations []schedule.ScheduleLocation
+		if err := s.DB.Where("schedule_id IN ?", chunk).Order("schedule_id, id").Find(&locations).Error; err != nil {
+			return fmt.Errorf("error querying schedule locations: %w", err)
+		}
+		for _, loc := range locations {
+			byScheduleID[loc.ScheduleID] = append(byScheduleID[loc.ScheduleID], loc)
+			tiplocCodes[loc.TiplocCode] = true
+		}
 	}
 
-	hours, err := strconv.Atoi(wttTime[:2])
-	if err != nil {
-		return 0, fmt.Errorf("error parsing hours: %w", err)
+	codes := make([]string, 0, len(tiplocCodes))
+	for code := range tiplocCodes {
+		codes = append(codes, code)
 	}
+	tiplocs := make(map[string]schedule.Tiploc)
+	for start := 0; start < len(codes); start += queryChunkSize {
+		chunk := codes[start:min(start+queryChunkSize, len(codes))]
 
-	minutes, err := strconv.Atoi(wttTime[2:4])
+		var found []schedule.Tiploc
+		if err := s.DB.Where("tiploc_code IN ?", chunk).Find(&found).Error; err != nil {
+			return fmt.Errorf("error querying tiplocs: %w", err)
+		}
+		for _, tiploc := range found {
+			tiplocs[tiploc.TiplocCode] = tiploc
+		}
+	}
+
+	for idx := range records {
+		locations := byScheduleID[records[idx].ID]
+		for l := range locations {
+			locations[l].Tiploc = tiplocs[locations[l].TiplocCode]
+			locations[l].DecodeActivity()
+		}
+		records[idx].ScheduleLocation = locations
+		slog.Debug("schedule", "idx", idx, "schedule_id", records[idx].ID, "locations", len(locations))
+	}
+	return nil
+}
+
+// attachAssociations adds the associations valid on each schedule's run date to the schedule, whether it's the main
+// or the associated train. An association's dates are those of the main train, so for the associated train the date
+// indicator is used to work out which day's association applies.
+func (s *Store) attachAssociations(schedules []schedule.Schedule) error {
+	if len(schedules) == 0 {
+		return nil
+	}
+
+	var uids []string
+	seen := make(map[string]bool)
+	firstRunDate, lastRunDate := schedules[0].RunDate, schedules[0].RunDate
+	for _, sch := range schedules {
+		if !seen[sch.CIFTrainUID] {
+			seen[sch.CIFTrainUID] = true
+			uids = append(uids, sch.CIFTrainUID)
+		}
+		firstRunDate = min(firstRunDate, sch.RunDate)
+		lastRunDate = max(lastRunDate, sch.RunDate)
+	}
+	from, err := time.Parse("2006-01-02", firstRunDate)
 	if err != nil {
-		return 0, fmt.Errorf("error parsing minutes: %w", err)
+		return fmt.Errorf("invalid run date %q: %w", firstRunDate, err)
 	}
+	to, err := time.Parse("2006-01-02", lastRunDate)
+	if err != nil {
+		return fmt.Errorf("invalid run date %q: %w", lastRunDate, err)
+	}
+
+	// An associated train's association may be valid on the day either side of the schedule's date
+	validSQL := "assoc_start_date_ts <= ? AND assoc_end_date_ts >= ?"
+	validArgs := []interface{}{to.AddDate(0, 0, 1).Unix() + 86399, from.AddDate(0, 0, -1).Unix()}
+
+	byMainUID := make(map[string][]schedule.Association)
+	byAssocUID := make(map[string][]schedule.Association)
 
-	newTime := time.Date(currentTime.Year(), currentTime.Month(), currentTime.Day(), hours, minutes, 0, 0, londonLocation)
-	return newTime.Unix(), nil
+	for start := 0; start < len(uids); start += queryChunkSize {
+		chunk := uids[start:min(start+queryChunkSize, len(uids))]
+
+		var mains []schedule.Association
+		args := append([]interface{}{chunk}, validArgs...)
+		if err := s.DB.Raw("SELECT * FROM associations WHERE main_train_uid IN ? AND "+validSQL, args...).Scan(&mains).Error; err != nil {
+			return fmt.Errorf("error querying associations: %w", err)
+		}
+		for _, assoc := range mains {
+			byMainUID[assoc.MainTrainUID] = append(byMainUID[assoc.MainTrainUID], assoc)
+		}
+
+		var assocs []schedule.Association
+		if err := s.DB.Raw("SELECT * FROM associations WHERE assoc_train_uid IN ? AND "+validSQL, args...).Scan(&assocs).Error; err != nil {
+			return fmt.Errorf("error querying associations: %w", err)
+		}
+		for _, assoc := range assocs {
+			byAssocUID[assoc.AssocTrainUID] = append(byAssocUID[assoc.AssocTrainUID], assoc)
+		}
+	}
+
+	for idx := range schedules {
+		uid := schedules[idx].CIFTrainUID
+		date, err := time.Parse("2006-01-02", schedules[idx].RunDate)
+		if err != nil {
+			return fmt.Errorf("invalid run date %q for %s: %w", schedules[idx].RunDate, uid, err)
+		}
+		var candidates []schedule.Association
+		for _, assoc := range byMainUID[uid] {
+			if associationValidOn(assoc, date) {
+				candidates = append(candidates, assoc)
+			}
+		}
+		// An associated train that runs over next-midnight ('N') is associated on the day after the main train's
+		// date, and one that runs over previous-midnight ('P') on the day before.
+		for _, assoc := range byAssocUID[uid] {
+			mainDate := date
+			switch assoc.DateIndicator {
+			case "N":
+				mainDate = date.AddDate(0, 0, -1)
+			case "P":
+				mainDate = date.AddDate(0, 0, 1)
+			}
+			if associationValidOn(assoc, mainDate) {
+				candidates = append(candidates, assoc)
+			}
+		}
+		schedules[idx].Associations = schedule.ResolveAssociations(candidates)
+	}
+	return nil
+}
+
+// associationValidOn reports whether an association is valid on date.
+func associationValidOn(assoc schedule.Association, date time.Time) bool {
+	return assoc.AssocStartDateTS <= date.Unix() && assoc.AssocEndDateTS >= date.Unix()+86399 &&
+		schedule.RunsOnDay(assoc.AssocDays, date)
 }
 
-// formatWTTTime formats a WTT time string "HHMM" or "HHMMSS" as "HH:MM".
-func formatWTTTime(wttTime string) string {
-	if len(wttTime) < 4 {
-		return ""
+// callsAt reports whether the schedule has a location at any of the TIPLOCs in atLocation.
+func callsAt(sch schedule.Schedule, atLocation map[string]bool) bool {
+	for _, loc := range sch.ScheduleLocation {
+		if atLocation[loc.TiplocCode] {
+			return true
+		}
 	}
-	return wttTime[:2] + ":" + wttTime[2:4]
+	return false
 }
+
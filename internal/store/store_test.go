@@ -0,0 +1,344 @@
+package store_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"uk-rail-schedule-api/internal/schedule"
+	"uk-rail-schedule-api/internal/store"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+func setupTestDB(tb testing.TB) *gorm.DB {
+	tb.Helper()
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{
+		Logger: logger.Discard,
+	})
+	if err != nil {
+		tb.Fatal("failed to open test database:", err)
+	}
+	if err := db.AutoMigrate(schedule.Models()...); err != nil {
+		tb.Fatal("failed to migrate test database:", err)
+	}
+	return db
+}
+
+// busyJunctionRoute is a run through Clapham Junction; every seeded train calls or passes at each TIPLOC on it.
+var busyJunctionRoute = []string{"WATRLMN", "VAUXHLM", "QTRDBAT", "CLPHMJN", "EARLFLD", "WDON", "RAYNSPK", "NEWMLDN",
+	"BERRYLN", "SURBITN", "HAMPTNC", "ESHER", "HERSHAM", "WALTON", "WEYBDGE", "BYFLEET", "WOKING"}
+
+// seedBusyJunction inserts trains running on Sundays along busyJunctionRoute, a third of which have an overlay, along
+// with the TIPLOCs of the route.
+func seedBusyJunction(tb testing.TB, db *gorm.DB, trains int) {
+	tb.Helper()
+	for _, code := range busyJunctionRoute {
+		if err := db.Create(&schedule.Tiploc{TiplocCode: code, TpsDescription: code + " DESCRIPTION"}).Error; err != nil {
+			tb.Fatal("failed to seed tiploc:", err)
+		}
+	}
+
+	for i := 0; i < trains; i++ {
+		stps := []string{"P"}
+		if i%3 == 0 {
+			stps = append(stps, "O")
+		}
+		for _, stp := range stps {
+			sch := schedule.Schedule{
+				CIFStpIndicator:   stp,
+				SignallingID:      fmt.Sprintf("2A%02d", i%100),
+				CIFTrainUID:       fmt.Sprintf("W%05d", i),
+				Source:            "Feed",
+				ScheduleDaysRuns:  "0000001",
+				ScheduleStartDate: "2023-01-01",
+				ScheduleEndDate:   "2099-12-31",
+				AtocCode:          "SW",
+			}
+			sch.AugmentSchedule()
+			if err := db.Create(&sch).Error; err != nil {
+				tb.Fatal("failed to seed schedule:", err)
+			}
+
+			var locations []schedule.ScheduleLocation
+			for l, code := range busyJunctionRoute {
+				loc := schedule.ScheduleLocation{ScheduleID: sch.ID, TiplocCode: code, RecordIdentity: "LI"}
+				t := schedule.WTTTime(fmt.Sprintf("%02d%02d", 6+i/60%18, (i+l)%60))
+				switch {
+				case l == 0:
+					loc.RecordIdentity = "LO"
+					loc.Departure = t
+				case l == len(busyJunctionRoute)-1:
+					loc.RecordIdentity = "LT"
+					loc.Arrival = t
+				case l%2 == 0:
+					loc.Pass = t
+				default:
+					loc.Arrival = t
+					loc.Departure = t
+				}
+				locations = append(locations, loc)
+			}
+			if err := db.Create(&locations).Error; err != nil {
+				tb.Fatal("failed to seed schedule locations:", err)
+			}
+		}
+	}
+}
+
+// countQueries returns a counter of the statements run against db.
+func countQueries(tb testing.TB, db *gorm.DB) *int {
+	tb.Helper()
+	count := 0
+	if err := db.Callback().Query().Before("gorm:query").Register("test:count_queries", func(*gorm.DB) { count++ }); err != nil {
+		tb.Fatal("failed to register query callback:", err)
+	}
+	if err := db.Callback().Raw().Before("gorm:raw").Register("test:count_raw", func(*gorm.DB) { count++ }); err != nil {
+		tb.Fatal("failed to register raw callback:", err)
+	}
+	return &count
+}
+
+func TestGetSchedules_QueryCountDoesNotGrowWithResults(t *testing.T) {
+	queriesFor := func(trains int) int {
+		db := setupTestDB(t)
+		seedBusyJunction(t, db, trains)
+		count := countQueries(t, db)
+
+		schedules, err := store.New(db, "test").GetSchedules(store.ScheduleQuery{Tiploc: "CLPHMJN", Date: "2023-05-21"})
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if len(schedules) != trains {
+			t.Fatalf("expected %d schedules, got %d", trains, len(schedules))
+		}
+		for _, sch := range schedules {
+			if sch.Origin != "WATRLMN DESCRIPTION" || sch.Destination != "WOKING DESCRIPTION" {
+				t.Fatalf("expected origin and destination to be filled in, got %q and %q", sch.Origin, sch.Destination)
+			}
+			if sch.ScheduleLocation[3].Tiploc.TiplocCode != "CLPHMJN" {
+				t.Fatalf("expected locations in order with their TIPLOC loaded, got %+v", sch.ScheduleLocation[3])
+			}
+		}
+		return *count
+	}
+
+	few, many := queriesFor(5), queriesFor(200)
+	if few != many {
+		t.Errorf("expected the same number of queries for 5 and 200 trains, got %d and %d", few, many)
+	}
+}
+
+func TestGetSchedules_RangeQueryCountDoesNotGrowWithDays(t *testing.T) {
+	db := setupTestDB(t)
+	seedBusyJunction(t, db, 6)
+	s := store.New(db, "test")
+
+	queriesFor := func(to string) ([]schedule.Schedule, int) {
+		count := countQueries(t, db)
+		defer func() {
+			db.Callback().Query().Remove("test:count_queries")
+			db.Callback().Raw().Remove("test:count_raw")
+		}()
+		schedules, err := s.GetSchedules(store.ScheduleQuery{Tiploc: "CLPHMJN", Date: "2023-05-21", To: to})
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		return schedules, *count
+	}
+
+	week, weekQueries := queriesFor("2023-05-27")
+	month, monthQueries := queriesFor("2023-06-17")
+	if len(week) != 6 || len(month) != 24 {
+		t.Fatalf("expected the trains on each of 1 and 4 Sundays, got %d and %d", len(week), len(month))
+	}
+	if weekQueries != monthQueries {
+		t.Errorf("expected the same number of queries for 7 and 28 days, got %d and %d", weekQueries, monthQueries)
+	}
+
+	// Each date's schedule has its own call times, though the records are shared between the dates
+	departures := map[int64]bool{}
+	for _, sch := range month {
+		departures[sch.ScheduleLocation[0].DepartureTS] = true
+	}
+	if len(departures) != len(month) {
+		t.Errorf("expected a departure time for each train on each date, got %d for %d schedules", len(departures), len(month))
+	}
+}
+
+func TestGetBoardAndJourneys_QueryCountDoesNotGrowWithDays(t *testing.T) {
+	db := setupTestDB(t)
+	seedBusyJunction(t, db, 6)
+	if err := db.Exec("UPDATE schedule_locations SET public_arrival = arrival, public_departure = departure").Error; err != nil {
+		t.Fatal("failed to make the calls public:", err)
+	}
+	s := store.New(db, "test")
+	from := time.Date(2023, 5, 21, 6, 0, 0, 0, store.LondonLocation())
+
+	queriesFor := func(window time.Duration) (int, int, int) {
+		count := countQueries(t, db)
+		defer func() {
+			db.Callback().Query().Remove("test:count_queries")
+			db.Callback().Raw().Remove("test:count_raw")
+		}()
+		board, err := s.GetBoard("CLPHMJN", from, window, store.BoardAll, true)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		boardQueries := *count
+		plan, err := s.GetJourneys(store.JourneySearch{From: "WATRLMN", To: "WOKING", DepartAfter: from, Window: window, Changes: true})
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if len(board.Entries) != len(plan.Journeys) {
+			t.Fatalf("expected a journey for each train on the board, got %d and %d", len(plan.Journeys), len(board.Entries))
+		}
+		// The trains only pass Earlsfield, so the search looks for a change of train
+		if _, err := s.GetJourneys(store.JourneySearch{From: "WATRLMN", To: "EARLFLD", DepartAfter: from, Window: window, Changes: true}); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		return len(board.Entries), boardQueries, *count - boardQueries
+	}
+
+	hour, hourBoard, hourJourneys := queriesFor(time.Hour)
+	days, daysBoard, daysJourneys := queriesFor(48 * time.Hour)
+	if hour != 6 || days != 6 {
+		t.Fatalf("expected the 6 trains on the Sunday, got %d and %d", hour, days)
+	}
+	if hourBoard != daysBoard || hourJourneys != daysJourneys {
+		t.Errorf("expected the same number of queries for 1 and 48 hours, got %d and %d for the board and %d and %d for journeys",
+			hourBoard, daysBoard, hourJourneys, daysJourneys)
+	}
+}
+
+func BenchmarkGetSchedules_BusyTiploc(b *testing.B) {
+	db := setupTestDB(b)
+	seedBusyJunction(b, db, 1000)
+	s := store.New(db, "test")
+	q := store.ScheduleQuery{Tiploc: "CLPHMJN", Date: "2023-05-21"}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := s.GetSchedules(q); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestGetSchedulePage_PagesThroughGetSchedules(t *testing.T) {
+	db := setupTestDB(t)
+	seedBusyJunction(t, db, 20)
+	assoc := schedule.Association{
+		MainTrainUID:    "W00007",
+		AssocTrainUID:   "W00008",
+		AssocStartDate:  "2023-01-01",
+		AssocEndDate:    "2099-12-31",
+		AssocDays:       "0000001",
+		Category:        "NP",
+		Location:        "WOKING",
+		CIFStpIndicator: "P",
+	}
+	if err := assoc.AugmentAssociation(); err != nil {
+		t.Fatal("failed to augment association:", err)
+	}
+	if err := db.Create(&assoc).Error; err != nil {
+		t.Fatal("failed to seed association:", err)
+	}
+	s := store.New(db, "test")
+	q := store.ScheduleQuery{Tiploc: "CLPHMJN", Date: "2023-05-21"}
+
+	all, err := s.GetSchedules(q)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	var paged []schedule.Schedule
+	cursor := ""
+	for {
+		page, err := s.GetSchedulePage(q, cursor, 7)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		paged = append(paged, page.Schedules...)
+		if page.NextCursor == "" {
+			break
+		}
+		cursor = page.NextCursor
+	}
+
+	if len(paged) != len(all) {
+		t.Fatalf("expected %d schedules over the pages, got %d", len(all), len(paged))
+	}
+	for idx := range all {
+		if paged[idx].CIFTrainUID != all[idx].CIFTrainUID {
+			t.Fatalf("expected %s at %d, got %s", all[idx].CIFTrainUID, idx, paged[idx].CIFTrainUID)
+		}
+		if len(paged[idx].Associations) != len(all[idx].Associations) {
+			t.Errorf("expected %d associations for %s, got %d", len(all[idx].Associations), all[idx].CIFTrainUID, len(paged[idx].Associations))
+		}
+	}
+	for _, sch := range paged {
+		if (sch.CIFTrainUID == "W00007" || sch.CIFTrainUID == "W00008") && len(sch.Associations) != 1 {
+			t.Errorf("expected the association on %s, got %d", sch.CIFTrainUID, len(sch.Associations))
+		}
+	}
+}
+
+func TestGetSchedulePage_LaterPagesSkipEarlierDates(t *testing.T) {
+	db := setupTestDB(t)
+	seedBusyJunction(t, db, 6)
+	// Half the trains stop running after the first Sunday of the range
+	if err := db.Model(&schedule.Schedule{}).Where("cif_train_uid < ?", "W00003").
+		Updates(map[string]interface{}{"schedule_end_date": "2023-05-21", "schedule_end_date_ts": 1684713599}).Error; err != nil {
+		t.Fatal("failed to end schedules:", err)
+	}
+	s := store.New(db, "test")
+	q := store.ScheduleQuery{Tiploc: "CLPHMJN", Date: "2023-05-21", To: "2023-06-17"}
+
+	all, err := s.GetSchedules(q)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	// Count the schedule records each page fetches
+	fetched := 0
+	if err := db.Callback().Query().After("gorm:query").Register("test:count_locations", func(tx *gorm.DB) {
+		if tx.Statement.Table == "schedule_locations" {
+			fetched += int(tx.RowsAffected) / len(busyJunctionRoute)
+		}
+	}); err != nil {
+		t.Fatal("failed to register query callback:", err)
+	}
+
+	var paged []schedule.Schedule
+	var perPage []int
+	cursor := ""
+	for {
+		fetched = 0
+		page, err := s.GetSchedulePage(q, cursor, 3)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		paged = append(paged, page.Schedules...)
+		perPage = append(perPage, fetched)
+		if page.NextCursor == "" {
+			break
+		}
+		cursor = page.NextCursor
+	}
+
+	if len(all) != 15 || len(paged) != len(all) {
+		t.Fatalf("expected 15 schedules from GetSchedules and over the pages, got %d and %d", len(all), len(paged))
+	}
+	for idx := range all {
+		if paged[idx].CIFTrainUID != all[idx].CIFTrainUID || paged[idx].RunDate != all[idx].RunDate {
+			t.Fatalf("expected %s on %s at %d, got %s on %s", all[idx].CIFTrainUID, all[idx].RunDate, idx,
+				paged[idx].CIFTrainUID, paged[idx].RunDate)
+		}
+	}
+	if first, last := perPage[0], perPage[len(perPage)-1]; last >= first {
+		t.Errorf("expected the last page to fetch fewer records than the first, got %d and %d", last, first)
+	}
+}
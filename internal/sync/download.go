@@ -0,0 +1,195 @@
+package sync
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"uk-rail-schedule-api/internal/schedule"
+	"uk-rail-schedule-api/internal/telemetry"
+
+	"gorm.io/gorm"
+)
+
+// ErrInvalidDownload is returned for a downloaded feed file that fails the sanity checks. It's discarded, leaving
+// the feed file as it was.
+var ErrInvalidDownload = errors.New("downloaded schedule feed is invalid")
+
+// FeedDownloadOptions describes where the schedule feed is downloaded from and to, and when.
+type FeedDownloadOptions struct {
+	// URL is where the feed is downloaded from. Any "{day}" in it is replaced by the abbreviated day of the week
+	// (mon, tue...) it's downloaded on, in UTC, as the daily update files are named.
+	URL      string
+	Username string
+	Password string
+	// Filename is where the feed is written. It's only replaced once a download has passed the sanity checks.
+	Filename string
+	// At is the time of day, in UTC, the feed is downloaded, as the time since midnight
+	At time.Duration
+	// Attempts is the number of times a download is tried before giving up until the next day
+	Attempts int
+	// RetryDelay is how long to wait before the first retry of a download. It doubles with each retry.
+	RetryDelay time.Duration
+	// MinSize is the smallest, in bytes, a downloaded file can be. Anything smaller is an error page or an empty feed.
+	MinSize int64
+	// Client makes the requests, or http.DefaultClient if it's nil
+	Client *http.Client
+}
+
+// DownloadSchedulesDaily downloads the schedule feed at the time of day in opts, every day, and loads each download
+// into the database as described for RefreshSchedules. It returns once ctx is cancelled.
+func DownloadSchedulesDaily(ctx context.Context, db *gorm.DB, opts FeedDownloadOptions, dataDir string, deleteExpired bool) {
+	for {
+		next := nextDownloadTime(time.Now(), opts.At)
+		slog.Info("Waiting to download the schedule feed", "at", next)
+		select {
+		case <-time.After(time.Until(next)):
+		case <-ctx.Done():
+			slog.Info("Stopping scheduled schedule feed downloads")
+			return
+		}
+
+		if err := DownloadScheduleFeed(ctx, opts); err != nil {
+			slog.Error("Failed to download the schedule feed - trying again tomorrow", "error", err)
+			continue
+		}
+		if err := RefreshSchedules(ctx, opts.Filename, db, dataDir, deleteExpired); err != nil {
+			slog.Error("Failed to load the downloaded schedule feed", "error", err, "filename", opts.Filename)
+		}
+	}
+}
+
+// nextDownloadTime returns the next time after now that it's at, in UTC.
+func nextDownloadTime(now time.Time, at time.Duration) time.Time {
+	now = now.UTC()
+	next := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC).Add(at)
+	if !next.After(now) {
+		next = next.AddDate(0, 0, 1)
+	}
+	return next
+}
+
+// DownloadScheduleFeed downloads the schedule feed to the file in opts, trying up to opts.Attempts times with
+// exponential backoff. See downloadFeedFile for the checks made on each download.
+func DownloadScheduleFeed(ctx context.Context, opts FeedDownloadOptions) error {
+	url := strings.ReplaceAll(opts.URL, "{day}", strings.ToLower(time.Now().UTC().Format("Mon")))
+	delay := opts.RetryDelay
+	var err error
+	for attempt := 1; attempt <= max(opts.Attempts, 1); attempt++ {
+		if attempt > 1 {
+			slog.Warn(fmt.Sprintf("Failed to download the schedule feed. Pausing for %s before retrying", delay), "error", err, "attempt", attempt-1)
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			delay *= 2
+		}
+		if err = downloadFeedFile(ctx, url, opts); err == nil || ctx.Err() != nil {
+			break
+		}
+	}
+	if err != nil {
+		telemetry.RecordError(context.Background(), "sync")
+	}
+	return err
+}
+
+// downloadFeedFile downloads the feed from url into a temporary file beside opts.Filename, then replaces the feed
+// file with it if it's complete: no shorter than the response's Content-Length or opts.MinSize, passing the gzip
+// checksum if it's gzipped, and starting with the timetable metadata record.
+func downloadFeedFile(ctx context.Context, url string, opts FeedDownloadOptions) error {
+	client := opts.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	if opts.Username != "" {
+		req.SetBasicAuth(opts.Username, opts.Password)
+	}
+
+	slog.Info("Downloading schedule feed", "url", url, "filename", opts.Filename)
+	started := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("error downloading schedule feed: %s", resp.Status)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(opts.Filename), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(opts.Filename), "."+filepath.Base(opts.Filename)+".download-*")
+	if err != nil {
+		return err
+	}
+	// Does nothing once the download has been renamed into place
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	size, err := io.Copy(tmp, resp.Body)
+	if err != nil {
+		return fmt.Errorf("error downloading schedule feed: %w", err)
+	}
+	if resp.ContentLength >= 0 && size != resp.ContentLength {
+		return fmt.Errorf("%w: got %d of %d bytes", ErrInvalidDownload, size, resp.ContentLength)
+	}
+	if size < opts.MinSize {
+		return fmt.Errorf("%w: it's %d bytes, less than the minimum of %d", ErrInvalidDownload, size, opts.MinSize)
+	}
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	timetable, err := checkFeedFile(tmp.Name())
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), opts.Filename); err != nil {
+		return err
+	}
+	slog.Info("Downloaded schedule feed", "filename", opts.Filename, "bytes", size, "duration", time.Since(started),
+		"timestamp", timetable.Timestamp, "type", timetable.Metadata.Type, "sequence", timetable.Metadata.Sequence)
+	return nil
+}
+
+// checkFeedFile reads a feed file to the end, which checks it against its checksum if it's gzipped, and returns its
+// timetable metadata.
+func checkFeedFile(filename string) (schedule.Timetable, error) {
+	file, err := openFeedFile(filename, nil)
+	if err != nil {
+		return schedule.Timetable{}, fmt.Errorf("%w: %w", ErrInvalidDownload, err)
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	line, err := reader.ReadBytes('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return schedule.Timetable{}, fmt.Errorf("%w: %w", ErrInvalidDownload, err)
+	}
+	var record schedule.ScheduleFeedRecord
+	if err := json.Unmarshal(line, &record); err != nil || !record.IsMetadata() {
+		return schedule.Timetable{}, fmt.Errorf("%w: %w", ErrInvalidDownload, ErrNoMetadata)
+	}
+	if _, err := io.Copy(io.Discard, reader); err != nil {
+		return schedule.Timetable{}, fmt.Errorf("%w: %w", ErrInvalidDownload, err)
+	}
+	return record.Timetable, nil
+}
@@ -0,0 +1,214 @@
+package sync_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"uk-rail-schedule-api/internal/schedule"
+	internalsync "uk-rail-schedule-api/internal/sync"
+)
+
+// gzipFeed returns a gzipped line-delimited feed, as published by Network Rail.
+func gzipFeed(t testing.TB, lines ...string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write([]byte(strings.Join(lines, "\n") + "\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// feedStandIn is an HTTP server standing in for the Network Rail open data portal. It serves the responses in turn,
+// repeating the last, to requests made with the username "user" and password "secret".
+func feedStandIn(t *testing.T, responses ...func(w http.ResponseWriter)) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := int(requests.Add(1))
+		if username, password, ok := r.BasicAuth(); !ok || username != "user" || password != "secret" {
+			http.Error(w, "unauthorised", http.StatusUnauthorized)
+			return
+		}
+		responses[min(n, len(responses))-1](w)
+	}))
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+func serveFeed(feed []byte) func(w http.ResponseWriter) {
+	return func(w http.ResponseWriter) { w.Write(feed) }
+}
+
+func serveStatus(status int) func(w http.ResponseWriter) {
+	return func(w http.ResponseWriter) { http.Error(w, http.StatusText(status), status) }
+}
+
+func downloadOptions(url, filename string) internalsync.FeedDownloadOptions {
+	return internalsync.FeedDownloadOptions{
+		URL:        url,
+		Username:   "user",
+		Password:   "secret",
+		Filename:   filename,
+		Attempts:   3,
+		RetryDelay: time.Millisecond,
+	}
+}
+
+func TestDownloadScheduleFeed_WritesFeedFile(t *testing.T) {
+	feed := gzipFeed(t, metadataLine, scheduleLine, tiplocLine)
+	server, _ := feedStandIn(t, serveFeed(feed))
+	filename := filepath.Join(t.TempDir(), "schedule.json.gz")
+
+	if err := internalsync.DownloadScheduleFeed(t.Context(), downloadOptions(server.URL, filename)); err != nil {
+		t.Fatalf("DownloadScheduleFeed: %v", err)
+	}
+	if got, err := os.ReadFile(filename); err != nil || !bytes.Equal(got, feed) {
+		t.Errorf("expected the feed to be written to %s, got %d bytes and %v", filename, len(got), err)
+	}
+
+	// The gzipped file is loaded as it is
+	db := setupTestDB(t)
+	if err := internalsync.RefreshSchedules(t.Context(), filename, db, t.TempDir(), false); err != nil {
+		t.Fatalf("RefreshSchedules: %v", err)
+	}
+	if count := countSchedules(db); count != 1 {
+		t.Errorf("expected 1 schedule loaded from the download, got %d", count)
+	}
+}
+
+func TestDownloadScheduleFeed_ReplacesDayInURL(t *testing.T) {
+	var path string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		w.Write(gzipFeed(t, metadataLine))
+	}))
+	t.Cleanup(server.Close)
+
+	if err := internalsync.DownloadScheduleFeed(t.Context(), downloadOptions(server.URL+"/toc-update-{day}", filepath.Join(t.TempDir(), "update.gz"))); err != nil {
+		t.Fatalf("DownloadScheduleFeed: %v", err)
+	}
+	if want := "/toc-update-" + strings.ToLower(time.Now().UTC().Format("Mon")); path != want {
+		t.Errorf("expected %s to be requested, got %s", want, path)
+	}
+}
+
+func TestDownloadScheduleFeed_RetriesFailedDownload(t *testing.T) {
+	server, requests := feedStandIn(t, serveStatus(http.StatusServiceUnavailable), serveStatus(http.StatusBadGateway), serveFeed(gzipFeed(t, metadataLine)))
+	filename := filepath.Join(t.TempDir(), "schedule.json.gz")
+
+	if err := internalsync.DownloadScheduleFeed(t.Context(), downloadOptions(server.URL, filename)); err != nil {
+		t.Fatalf("expected the third attempt to succeed, got %v", err)
+	}
+	if n := requests.Load(); n != 3 {
+		t.Errorf("expected 3 requests, got %d", n)
+	}
+}
+
+func TestDownloadScheduleFeed_GivesUpAfterAttempts(t *testing.T) {
+	server, requests := feedStandIn(t, serveStatus(http.StatusInternalServerError))
+
+	if err := internalsync.DownloadScheduleFeed(t.Context(), downloadOptions(server.URL, filepath.Join(t.TempDir(), "schedule.json.gz"))); err == nil {
+		t.Fatal("expected an error once every attempt had failed")
+	}
+	if n := requests.Load(); n != 3 {
+		t.Errorf("expected 3 requests, got %d", n)
+	}
+}
+
+func TestDownloadScheduleFeed_KeepsFeedFileWhenDownloadIsInvalid(t *testing.T) {
+	feed := gzipFeed(t, metadataLine, scheduleLine)
+	// A gzipped feed whose content doesn't match its checksum
+	corrupt := bytes.Clone(feed)
+	corrupt[len(corrupt)-5] ^= 0xff
+
+	tests := map[string]struct {
+		response func(w http.ResponseWriter)
+		minSize  int64
+	}{
+		"corrupt":      {response: serveFeed(corrupt)},
+		"truncated":    {response: serveFeed(feed[:len(feed)/2])},
+		"too small":    {response: serveFeed(feed), minSize: int64(len(feed)) + 1},
+		"not the feed": {response: serveFeed([]byte("<html><body>Service unavailable</body></html>"))},
+		"short": {response: func(w http.ResponseWriter) {
+			w.Header().Set("Content-Length", "100000")
+			w.Write(feed)
+		}},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			server, _ := feedStandIn(t, tt.response)
+			dir := t.TempDir()
+			filename := filepath.Join(dir, "schedule.json.gz")
+			os.WriteFile(filename, []byte("previous feed"), 0644)
+			opts := downloadOptions(server.URL, filename)
+			opts.MinSize = tt.minSize
+
+			if err := internalsync.DownloadScheduleFeed(t.Context(), opts); err == nil {
+				t.Fatal("expected the download to be rejected")
+			}
+			if got, _ := os.ReadFile(filename); string(got) != "previous feed" {
+				t.Errorf("expected the feed file to be left as it was, got %q", got)
+			}
+			if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+				t.Errorf("expected the rejected download to be removed, got %d files", len(entries))
+			}
+		})
+	}
+}
+
+func TestDownloadScheduleFeed_InvalidDownloadIsErrInvalidDownload(t *testing.T) {
+	server, _ := feedStandIn(t, serveFeed([]byte("not a feed")))
+
+	err := internalsync.DownloadScheduleFeed(t.Context(), downloadOptions(server.URL, filepath.Join(t.TempDir(), "schedule.json.gz")))
+	if !errors.Is(err, internalsync.ErrInvalidDownload) {
+		t.Errorf("expected ErrInvalidDownload, got %v", err)
+	}
+}
+
+func TestDownloadSchedulesDaily_DownloadsAndLoadsFeedAtTimeOfDay(t *testing.T) {
+	server, requests := feedStandIn(t, serveFeed(gzipFeed(t, metadataLine, scheduleLine, tiplocLine)))
+	db := setupTestDB(t)
+	opts := downloadOptions(server.URL, filepath.Join(t.TempDir(), "schedule.json.gz"))
+	// A second from now
+	now := time.Now().UTC()
+	opts.At = now.Add(time.Second).Sub(time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC))
+
+	ctx, cancel := context.WithCancel(t.Context())
+	done := make(chan struct{})
+	go func() {
+		internalsync.DownloadSchedulesDaily(ctx, db, opts, t.TempDir(), false)
+		close(done)
+	}()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for countSchedules(db) == 0 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	cancel()
+	<-done
+
+	if count := countSchedules(db); count != 1 {
+		t.Errorf("expected the downloaded feed to be loaded, got %d schedules", count)
+	}
+	if n := requests.Load(); n != 1 {
+		t.Errorf("expected the feed to be downloaded once, got %d requests", n)
+	}
+	var job schedule.RefreshJob
+	if err := db.First(&job).Error; err != nil || job.Filename != opts.Filename {
+		t.Errorf("expected a refresh job for the downloaded file, got %+v and %v", job, err)
+	}
+}
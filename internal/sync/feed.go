@@ -2,80 +2,65 @@ package sync
 
 import (
 	"bufio"
+	"bytes"
+	"compress/gzip"
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
 	"log/slog"
 	"os"
 	"path"
-	"strconv"
-	"sync"
+	"slices"
+	"sync/atomic"
 	"time"
+	internaldb "uk-rail-schedule-api/internal/db"
 	"uk-rail-schedule-api/internal/schedule"
 	"uk-rail-schedule-api/internal/telemetry"
 
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
-var (
-	mu                 sync.Mutex
-	refreshingDatabase bool
-)
-
-func IsRefreshingDatabase() bool {
-	mu.Lock()
-	defer mu.Unlock()
-	return refreshingDatabase
-}
+var ErrNoMetadata = errors.New("first record in feed file is not timetable metadata")
 
-func startRefreshingDatabase() {
-	mu.Lock()
-	defer mu.Unlock()
-	slog.Info("start refreshing database")
-	refreshingDatabase = true
-}
-
-func endRefreshingDatabase(db *gorm.DB, deleteExpired bool) {
-	if db != nil && deleteExpired {
-		slog.Debug("Deleting expired schedules")
-		currentTimestamp := time.Now().Unix()
-		db.Delete(&schedule.Schedule{}, "schedule_end_date_ts < ?", currentTimestamp)
-	} else {
-		slog.Debug("Not deleting expired schedules from database")
-	}
+// feedBatchSize is the number of lines of a full extract loaded in each transaction. A load that's interrupted
+// resumes after the last batch committed.
+const feedBatchSize = 1000
 
-	mu.Lock()
-	defer mu.Unlock()
-	slog.Info("end refreshing database")
-	refreshingDatabase = false
-}
+// maxFeedLineSize is the longest line a feed file can have. A schedule with many locations is well over the 64KB a
+// bufio.Scanner allows by default.
+const maxFeedLineSize = 16 << 20
 
-// SetRefreshingDatabase forces the refresh state — useful for testing and operational resets.
-func SetRefreshingDatabase(v bool) {
-	mu.Lock()
-	defer mu.Unlock()
-	refreshingDatabase = v
+// feedCounts are the numbers of each kind of record loaded from a feed file.
+type feedCounts struct {
+	schedules, tiplocs, associations int64
 }
 
-// RefreshSchedules loads the schedule feed file into the database.
-// It also replays any VSTP files in the data directory that are newer than the timetable.
-func RefreshSchedules(filename string, db *gorm.DB, dataDir string, deleteExpired bool) {
-	if IsRefreshingDatabase() {
-		slog.Info("Not going to load - schedule feed is already loading in another process")
-		return
-	}
-
-	// We set the refreshing state here because the feed file is large and takes a while to load, we won't also try to load it again in another process.
-	startRefreshingDatabase()
-	defer endRefreshingDatabase(db, deleteExpired)
-
-	file, err := os.Open(filename)
+// loadScheduleFeed loads the schedule feed file into the database. The file may be either a full extract or a daily
+// update, which is applied on top of the data already loaded.
+// A full extract is loaded into a new database, which replaces the live one once it's complete (see reloadDatabase),
+// and the VSTP files in the data directory are replayed into it.
+// If ctx is cancelled the load stops, leaving the database as it was after the last batch committed, and a full
+// extract carries on from there the next time it's loaded. The counts are of the records loaded, even if it fails.
+// The progress of the load and the issues found in the file are recorded in load.
+func loadScheduleFeed(ctx context.Context, filename string, db *gorm.DB, dataDir string, load *feedLoad) (feedCounts, error) {
+	var counts feedCounts
+
+	file, err := openFeedFile(filename, &load.bytesRead)
 	if err != nil {
 		slog.Error("Error opening schedule feed file. Cannot load.", "error", err)
-		return
+		return counts, err
 	}
 	defer file.Close()
+	if info, err := os.Stat(filename); err == nil {
+		load.bytesTotal.Store(info.Size())
+	}
 
 	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 1<<20), maxFeedLineSize)
 
 	// The first line must be the timetable metadata record
 	scanner.Scan()
@@ -84,82 +69,429 @@ func RefreshSchedules(filename string, db *gorm.DB, dataDir string, deleteExpire
 	var scheduleFeedRecord schedule.ScheduleFeedRecord
 	if err := json.Unmarshal([]byte(line), &scheduleFeedRecord); err != nil {
 		slog.Error("Error unmarshaling JSON:", "error", err)
-		return
+		return counts, err
 	}
 
 	if !scheduleFeedRecord.IsMetadata() {
 		slog.Error("First record in feed file is not metadata, cannot continue loading feed file", "record", scheduleFeedRecord)
-		return
+		return counts, ErrNoMetadata
+	}
+
+	if scheduleFeedRecord.Timetable.IsUpdate() {
+		counts, err := applyUpdate(ctx, scanner, db, scheduleFeedRecord.Timetable, load)
+		if err != nil {
+			telemetry.RecordError(context.Background(), "sync")
+		}
+		return counts, err
 	}
 
 	// Check if the timetable in the feed file is older than the latest timetable in the database, if it is then we shouldn't load it as it would be out of date.
 	var laterTimetable schedule.Timetable
 	if err := db.Where("timestamp >= ?", scheduleFeedRecord.Timetable.Timestamp).First(&laterTimetable).Error; err == nil {
 		slog.Info("The schedule feed file is older than the timetable in the database, so it won't be loaded.", "timetable", laterTimetable)
-		return
+		return counts, nil
 	}
 
-	publishedAt := time.Unix(int64(scheduleFeedRecord.Timetable.Timestamp), 0)
+	liveFilename, err := internaldb.Filename(db)
+	if err != nil {
+		return counts, err
+	}
+	if liveFilename == "" {
+		// An in-memory database can't be swapped, so it's loaded in place
+		if counts, err = loadFullExtract(ctx, scanner, db, scheduleFeedRecord.Timetable, load); err != nil {
+			return counts, err
+		}
+		checkTiplocs(db, load)
+		return counts, replayVSTPFiles(ctx, db, dataDir)
+	}
+	return reloadDatabase(ctx, scanner, db, liveFilename, dataDir, scheduleFeedRecord.Timetable, load)
+}
 
-	var schedules []schedule.Schedule
-	var tiplocs []schedule.Tiploc
-	var existingSchedule schedule.Schedule
-	var scheduleCount, tiplocCount int64
+// gzipMagic are the first bytes of a gzipped file.
+var gzipMagic = []byte{0x1f, 0x8b}
 
-	for scanner.Scan() {
-		var record schedule.ScheduleFeedRecord
-		line := scanner.Text()
+// feedFile reads a feed file, which may be gzipped.
+type feedFile struct {
+	io.Reader
+	file *os.File
+}
 
-		if err := json.Unmarshal([]byte(line), &record); err != nil {
-			slog.Error("Error unmarshaling scheduleFeedRecord JSON", "error", err)
-			continue
+func (f *feedFile) Close() error {
+	return f.file.Close()
+}
+
+// openFeedFile opens a feed file, decompressing it as it's read if it's gzipped, as the files published by Network
+// Rail are. Gzipped files are recognised by their content rather than their name. If read isn't nil, the bytes read
+// from the file are added to it.
+func openFeedFile(filename string, read *atomic.Int64) (io.ReadCloser, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	var r io.Reader = file
+	if read != nil {
+		r = countingReader{Reader: file, n: read}
+	}
+	buffered := bufio.NewReader(r)
+	if magic, err := buffered.Peek(len(gzipMagic)); err != nil || !bytes.Equal(magic, gzipMagic) {
+		return &feedFile{Reader: buffered, file: file}, nil
+	}
+	decompressed, err := gzip.NewReader(buffered)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("error decompressing %s: %w", filename, err)
+	}
+	return &feedFile{Reader: decompressed, file: file}, nil
+}
+
+// reloadDatabase loads a full extract into a new database file beside the live one, replays the VSTP files in the
+// data directory into it and, if it's valid, swaps it in for the live database. The API carries on serving the live
+// database until then. A reload that's interrupted carries on in the same file the next time the extract is loaded;
+// one that's invalid is left for inspection.
+func reloadDatabase(ctx context.Context, scanner *bufio.Scanner, live *gorm.DB, liveFilename, dataDir string, timetable schedule.Timetable, load *feedLoad) (feedCounts, error) {
+	next, err := openNextDatabase(liveFilename, timetable.Timestamp)
+	if err != nil {
+		slog.Error("Failed to open database to reload schedule feed into", "error", err, "filename", internaldb.NextFilename(liveFilename))
+		return feedCounts{}, err
+	}
+	defer closeDatabase(next)
+
+	// Indexes are built once the extract has been loaded, which is much quicker than keeping them up to date as it's
+	// loaded. The ones used to replace records that have already been loaded are kept.
+	if err := internaldb.DropIndexes(next, bulkLoadIndexes, bulkLoadModels...); err != nil {
+		return feedCounts{}, err
+	}
+	counts, err := loadFullExtract(ctx, scanner, next, timetable, load)
+	if err != nil {
+		return counts, err
+	}
+	started := time.Now()
+	if err := internaldb.CreateIndexes(next, bulkLoadModels...); err != nil {
+		slog.Error("Failed to index reloaded database", "error", err)
+		return counts, err
+	}
+	slog.Info("Indexed reloaded database", "duration", time.Since(started))
+	checkTiplocs(next, load)
+	if err := replayVSTPFiles(ctx, next, dataDir); err != nil {
+		return counts, err
+	}
+	if err := validateReload(live, next); err != nil {
+		slog.Error("Reloaded database is invalid - carrying on with the live database", "error", err, "filename", internaldb.NextFilename(liveFilename))
+		return counts, err
+	}
+
+	if err := internaldb.Swap(live, next, carryOver(dataDir)); err != nil {
+		slog.Error("Failed to swap in reloaded database", "error", err, "filename", liveFilename)
+		return counts, err
+	}
+	slog.Info("Swapped in reloaded database", "filename", liveFilename, "previous", internaldb.PreviousFilename(liveFilename))
+
+	// Catch up with the VSTP messages applied to the old database while the new one was being loaded
+	return counts, replayVSTPFiles(ctx, live, dataDir)
+}
+
+// bulkLoadModels are the tables a full extract is loaded into, and bulkLoadIndexes the indexes on them that are kept
+// while it's loaded.
+var (
+	bulkLoadModels  = []any{&schedule.Schedule{}, &schedule.ScheduleLocation{}, &schedule.Association{}, &schedule.Tiploc{}}
+	bulkLoadIndexes = []string{"idx_schedules_combined_id", "idx_associations_combined_id", "idx_tiplocs_tiploc_code"}
+)
+
+// openNextDatabase opens the file a full extract is reloaded into. It's kept if it holds an interrupted reload of the
+// same extract, and otherwise replaced by an empty database.
+func openNextDatabase(liveFilename string, timestamp int) (*gorm.DB, error) {
+	filename := internaldb.NextFilename(liveFilename)
+	if _, err := os.Stat(filename); err == nil {
+		next, err := internaldb.Open(filename)
+		if err != nil {
+			return nil, err
+		}
+		var progress int64
+		if err := next.Model(&schedule.FeedLoadProgress{}).Where("timetable_timestamp = ?", timestamp).Count(&progress).Error; err != nil {
+			closeDatabase(next)
+			return nil, err
+		}
+		if progress > 0 {
+			return next, nil
+		}
+		closeDatabase(next)
+	}
+
+	for _, f := range []string{filename, filename + "-journal"} {
+		if err := os.Remove(f); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
 		}
+	}
+	return internaldb.Open(filename)
+}
 
-		// We check if the record is a schedule or a tiploc and insert it into the database in batches of 10 to improve performance.
-		if record.IsSchedule() {
-			sch := record.JSONScheduleV1.ToSchedule(publishedAt)
-			sch.AugmentSchedule()
+// closeDatabase closes a database's connections. Closing one that's already closed does nothing.
+func closeDatabase(database *gorm.DB) {
+	if sqlDB, err := database.DB(); err == nil {
+		sqlDB.Close()
+	}
+}
 
-			if err := db.Where("combined_id = ?", sch.CombinedID).First(&existingSchedule).Error; err != nil {
-				sch.ID = existingSchedule.ID
-			}
+// minReloadFraction is the smallest share of the live database's schedules from the feed that a reload must have to
+// be swapped in, so a truncated extract can't replace a good timetable.
+const minReloadFraction = 0.5
 
-			schedules = append(schedules, sch)
-			scheduleCount++
-			if len(schedules) == 10 {
-				db.Save(&schedules)
-				schedules = nil
+var ErrInvalidReload = errors.New("reloaded database is invalid")
+
+// validateReload checks a reloaded database is intact, and has tiplocs and enough schedules to replace the live one.
+func validateReload(live, next *gorm.DB) error {
+	var check string
+	if err := next.Raw("PRAGMA quick_check").Scan(&check).Error; err != nil {
+		return err
+	}
+	if check != "ok" {
+		return fmt.Errorf("%w: integrity check failed: %s", ErrInvalidReload, check)
+	}
+
+	var schedules, tiplocs, liveSchedules int64
+	if err := next.Model(&schedule.Schedule{}).Where("source = ?", "Feed").Count(&schedules).Error; err != nil {
+		return err
+	}
+	if err := next.Model(&schedule.Tiploc{}).Count(&tiplocs).Error; err != nil {
+		return err
+	}
+	if err := live.Model(&schedule.Schedule{}).Where("source = ?", "Feed").Count(&liveSchedules).Error; err != nil {
+		return err
+	}
+
+	if schedules == 0 || tiplocs == 0 {
+		return fmt.Errorf("%w: it has %d schedules and %d tiplocs", ErrInvalidReload, schedules, tiplocs)
+	}
+	if float64(schedules) < minReloadFraction*float64(liveSchedules) {
+		return fmt.Errorf("%w: it has %d schedules from the feed, against %d in the live database", ErrInvalidReload, schedules, liveSchedules)
+	}
+	return nil
+}
+
+// carryOver returns the function that copies the records that are kept in the live database, rather than loaded
+// from the feed or replayed from the data directory, to the reloaded one as it's swapped in.
+func carryOver(dataDir string) func(live, next *gorm.DB) error {
+	return func(live, next *gorm.DB) error {
+		replayed, err := readReplayedVSTP(dataDir)
+		if err != nil {
+			return err
+		}
+		return next.Transaction(func(tx *gorm.DB) error {
+			if err := carryOverRefreshJobs(live, tx); err != nil {
+				return err
 			}
+			return carryOverVSTPHistory(live, tx, replayed)
+		})
+	}
+}
+
+// carryOverRefreshJobs copies the refresh jobs, including the one running the reload, the issues found by them and
+// the lease held from the live database to the reloaded one.
+func carryOverRefreshJobs(live, next *gorm.DB) error {
+	var jobs []schedule.RefreshJob
+	if err := live.Find(&jobs).Error; err != nil {
+		return err
+	}
+	var issues []schedule.RefreshIssue
+	if err := live.Find(&issues).Error; err != nil {
+		return err
+	}
+	var leases []schedule.RefreshLease
+	if err := live.Find(&leases).Error; err != nil {
+		return err
+	}
+
+	if len(jobs) > 0 {
+		if err := next.CreateInBatches(&jobs, 100).Error; err != nil {
+			return err
+		}
+	}
+	if len(issues) > 0 {
+		if err := next.CreateInBatches(&issues, 500).Error; err != nil {
+			return err
 		}
+	}
+	if len(leases) > 0 {
+		return next.Create(&leases).Error
+	}
+	return nil
+}
 
-		if record.IsTiploc() {
-			tiplocs = append(tiplocs, record.Tiploc)
-			tiplocCount++
-			if len(tiplocs) == 10 {
-				db.Save(&tiplocs)
-				tiplocs = nil
-			}
+// replayedVSTP identifies the VSTP messages in the data directory, which are replayed into a reloaded database and
+// so have their audit entries and processed records made there, by content hash and by audit entry.
+type replayedVSTP struct {
+	hashes  map[string]bool
+	entries map[vstpAuditKey]bool
+}
+
+// vstpAuditKey identifies the audit entry made by a VSTP message.
+type vstpAuditKey struct {
+	originMsgID, combinedID, transactionType string
+	publishedAt                              int64
+}
+
+// readReplayedVSTP reads the VSTP files in the data directory that replayVSTPFiles applies. Files that can't be
+// parsed are left out, as they can't be replayed either.
+func readReplayedVSTP(dataDir string) (replayedVSTP, error) {
+	replayed := replayedVSTP{hashes: map[string]bool{}, entries: map[vstpAuditKey]bool{}}
+	files, err := os.ReadDir(dataDir)
+	if err != nil {
+		return replayed, err
+	}
+	for _, f := range files {
+		if f.IsDir() || path.Ext(f.Name()) != ".json" {
+			continue
+		}
+		data, err := os.ReadFile(path.Join(dataDir, f.Name()))
+		if err != nil {
+			return replayed, err
 		}
+		sch, originMsgID, contentHash, err := parseVSTP(data)
+		if err != nil {
+			continue
+		}
+		replayed.hashes[contentHash] = true
+		replayed.entries[vstpAuditKey{originMsgID, sch.CombinedID, sch.TransactionType, sch.PublishedAt.Unix()}] = true
 	}
+	return replayed, nil
+}
 
-	if len(schedules) > 0 {
-		db.Save(&schedules)
+// carryOverVSTPHistory copies the VSTP audit trail and the record of processed messages from the live database to the
+// reloaded one, for the messages that aren't replayed from the data directory, such as those that were dead lettered
+// or whose files have gone. Their schedules aren't in the reloaded database, so the audit entries no longer point to
+// them.
+func carryOverVSTPHistory(live, next *gorm.DB, replayed replayedVSTP) error {
+	var entries []schedule.VSTPAuditEntry
+	if err := live.Order("id").Find(&entries).Error; err != nil {
+		return err
 	}
-	if len(tiplocs) > 0 {
-		db.Save(&tiplocs)
+	var messages []schedule.ProcessedVSTPMessage
+	if err := live.Order("id").Find(&messages).Error; err != nil {
+		return err
 	}
 
-	db.Create(&scheduleFeedRecord.Timetable)
+	var keptEntries []schedule.VSTPAuditEntry
+	for _, entry := range entries {
+		if replayed.entries[vstpAuditKey{entry.OriginMsgID, entry.CombinedID, entry.TransactionType, entry.PublishedAt.Unix()}] {
+			continue
+		}
+		entry.ID, entry.ScheduleID = 0, 0
+		keptEntries = append(keptEntries, entry)
+	}
+	var keptMessages []schedule.ProcessedVSTPMessage
+	for _, msg := range messages {
+		if replayed.hashes[msg.ContentHash] {
+			continue
+		}
+		msg.ID = 0
+		keptMessages = append(keptMessages, msg)
+	}
 
-	telemetry.RecordFeedRefreshCompleted(context.Background(), scheduleCount, tiplocCount)
+	if len(keptEntries) > 0 {
+		if err := next.CreateInBatches(&keptEntries, 500).Error; err != nil {
+			return err
+		}
+	}
+	if len(keptMessages) > 0 {
+		// A message replayed by an earlier attempt at this reload, whose file has since gone, is already recorded
+		return next.Clauses(clause.OnConflict{DoNothing: true}).CreateInBatches(&keptMessages, 500).Error
+	}
+	return nil
+}
 
-	// Replay any VSTP files in the data directory so we can recover from a database deletion
+// loadFullExtract loads the records of a full extract after its metadata in batches, carrying on from where an
+// interrupted load of the same extract into the database stopped, then records its timetable.
+func loadFullExtract(ctx context.Context, scanner *bufio.Scanner, db *gorm.DB, timetable schedule.Timetable, load *feedLoad) (feedCounts, error) {
+	var counts feedCounts
+	publishedAt := time.Unix(int64(timetable.Timestamp), 0)
+
+	// Carry on from where an interrupted load of the same extract stopped
+	progress := schedule.FeedLoadProgress{TimetableTimestamp: timetable.Timestamp}
+	if err := db.Where("timetable_timestamp <> ?", progress.TimetableTimestamp).Delete(&schedule.FeedLoadProgress{}).Error; err != nil {
+		return counts, err
+	}
+	if err := db.Where("timetable_timestamp = ?", progress.TimetableTimestamp).Limit(1).Find(&progress).Error; err != nil {
+		return counts, err
+	}
+	if progress.Lines > 0 {
+		slog.Info("Resuming interrupted load of schedule feed", "lines", progress.Lines)
+		for skipped := int64(0); skipped < progress.Lines && scanner.Scan(); skipped++ {
+		}
+		load.lines.Store(progress.Lines)
+	}
+
+	started, resumedAt := time.Now(), progress.Lines
+	lastReported := started
+	for more := true; more; {
+		if time.Since(lastReported) >= feedProgressInterval {
+			lastReported = time.Now()
+			slog.Info("Loading schedule feed", "lines", progress.Lines, "lines_per_second", linesPerSecond(progress.Lines-resumedAt, started))
+		}
+		if err := ctx.Err(); err != nil {
+			slog.Info("Schedule feed load stopped - it will carry on from here when the feed is next loaded", "lines", progress.Lines)
+			return counts, err
+		}
+		var err error
+		if more, err = loadFeedBatch(scanner, db, publishedAt, &progress, &counts, load); err != nil {
+			slog.Error("Failed to load schedule feed - it will carry on from the last batch loaded", "error", err, "lines", progress.Lines)
+			telemetry.RecordError(context.Background(), "sync")
+			return counts, err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		slog.Error("Error reading schedule feed file", "error", err, "lines", progress.Lines)
+		return counts, err
+	}
+	slog.Info("Loaded schedule feed", "schedules", counts.schedules, "tiplocs", counts.tiplocs, "associations", counts.associations,
+		"lines", progress.Lines, "duration", time.Since(started), "lines_per_second", linesPerSecond(progress.Lines-resumedAt, started))
+
+	if err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&timetable).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&progress).Error
+	}); err != nil {
+		slog.Error("Failed to record loaded timetable", "error", err)
+		return counts, err
+	}
+
+	telemetry.RecordFeedRefreshCompleted(context.Background(), counts.schedules, counts.tiplocs)
+	return counts, nil
+}
+
+// feedProgressInterval is how often the progress of a full extract is logged while it loads.
+const feedProgressInterval = 30 * time.Second
+
+// linesPerSecond is the rate lines have been loaded at since started, rounded to a whole number.
+func linesPerSecond(lines int64, started time.Time) int64 {
+	elapsed := time.Since(started).Seconds()
+	if elapsed == 0 {
+		return 0
+	}
+	return int64(float64(lines) / elapsed)
+}
+
+// checkTiplocs records the schedules loaded from the feed that call at tiplocs which aren't in it. The report is
+// only advisory, so the load carries on if it can't be checked.
+func checkTiplocs(db *gorm.DB, load *feedLoad) {
+	if err := load.checkTiplocs(db); err != nil {
+		slog.Error("Failed to check the tiplocs of the schedules loaded", "error", err)
+	}
+}
+
+// replayVSTPFiles applies the VSTP files in the data directory to the database, so we can recover from a database
+// deletion. Messages that have already been applied are skipped.
+func replayVSTPFiles(ctx context.Context, db *gorm.DB, dataDir string) error {
 	files, err := os.ReadDir(dataDir)
 	if err != nil {
 		slog.Error("Failed to read data directory to find vstp files", "error", err)
-		return
+		return err
 	}
 	for _, f := range files {
+		if err := ctx.Err(); err != nil {
+			slog.Info("Replay of vstp files stopped", "filename", f.Name())
+			return err
+		}
 		if !f.IsDir() && path.Ext(f.Name()) == ".json" {
 			fp := path.Join(dataDir, f.Name())
 			if err := insertVSTP(fp, db); err != nil {
@@ -167,32 +499,222 @@ func RefreshSchedules(filename string, db *gorm.DB, dataDir string, deleteExpire
 			}
 		}
 	}
+	return nil
 }
 
-// insertVSTP reads a VSTP message from a file, parses it, and inserts the schedule into the database.
-func insertVSTP(filename string, db *gorm.DB) error {
-	var vstpMsg schedule.VSTPStompMsg
+// loadFeedBatch loads up to feedBatchSize lines of a full extract in a single transaction, which also records the
+// progress of the load. Records already loaded with the same CombinedID, or tiplocs with the same code, are replaced.
+// It adds the records loaded to counts once they're committed, and any issues with them to load, and returns false
+// once the end of the file has been reached.
+func loadFeedBatch(scanner *bufio.Scanner, db *gorm.DB, publishedAt time.Time, progress *schedule.FeedLoadProgress, counts *feedCounts, load *feedLoad) (bool, error) {
+	var lines int64
+	var schedules []schedule.Schedule
+	var associations []schedule.Association
+	var tiplocs []schedule.Tiploc
 
-	vstp, err := os.ReadFile(filename)
+	for lines < feedBatchSize && scanner.Scan() {
+		lines++
+		// The metadata is on the first line of the file
+		line := 1 + progress.Lines + lines
+		var record schedule.ScheduleFeedRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			slog.Error("Error unmarshaling scheduleFeedRecord JSON", "error", err, "line", line)
+			load.unparseable(line, scanner.Bytes(), err)
+			continue
+		}
+
+		switch {
+		case record.IsSchedule():
+			sch := record.JSONScheduleV1.ToSchedule(publishedAt)
+			sch.AugmentSchedule()
+			load.checkSchedule(line, sch)
+			load.duplicate(line, "schedule", sch.CombinedID)
+			schedules = append(schedules, sch)
+		case record.IsAssociation():
+			assoc := record.Association.ToAssociation(publishedAt)
+			assoc.AugmentAssociation()
+			load.checkAssociation(line, assoc)
+			load.duplicate(line, "association", assoc.CombinedID)
+			associations = append(associations, assoc)
+		case record.IsTiploc():
+			load.duplicate(line, "tiploc", record.Tiploc.TiplocCode)
+			tiplocs = append(tiplocs, record.Tiploc)
+		}
+	}
+	if lines == 0 {
+		return false, nil
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		tx = tx.Session(&gorm.Session{CreateBatchSize: insertBatchSize})
+		if err := upsertFeedSchedules(tx, schedules); err != nil {
+			return err
+		}
+		if err := upsertFeedAssociations(tx, associations); err != nil {
+			return err
+		}
+		if err := upsertTiplocs(tx, tiplocs); err != nil {
+			return err
+		}
+
+		saved := *progress
+		saved.Lines += lines
+		return tx.Save(&saved).Error
+	})
 	if err != nil {
-		slog.Error("Failed to read vstp message from file", "error", err, "filename", filename)
-		return err
+		return false, err
 	}
 
-	if err = json.Unmarshal(vstp, &vstpMsg); err != nil {
-		slog.Error("Error decoding STOMP message json", "error", err)
-		return err
+	progress.Lines += lines
+	load.lines.Store(progress.Lines)
+	counts.schedules += int64(len(schedules))
+	counts.tiplocs += int64(len(tiplocs))
+	counts.associations += int64(len(associations))
+	return lines == feedBatchSize, nil
+}
+
+// insertBatchSize is the number of rows inserted by each statement, which keeps within SQLite's limit on the number
+// of values in a statement.
+const insertBatchSize = 500
+
+// feedRowIDs returns the IDs of the rows of model from the feed with each of the CombinedIDs.
+func feedRowIDs(tx *gorm.DB, model any, combinedIDs []string) (map[string][]uint64, error) {
+	var rows []struct {
+		ID         uint64
+		CombinedID string
 	}
+	if err := tx.Model(model).Select("id", "combined_id").Where("source = ? AND combined_id IN ?", "Feed", combinedIDs).Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	ids := make(map[string][]uint64, len(rows))
+	for _, row := range rows {
+		ids[row.CombinedID] = append(ids[row.CombinedID], row.ID)
+	}
+	return ids, nil
+}
 
-	parsedTimestamp, err := strconv.ParseInt(vstpMsg.VSTPCIFMsgV1.Timestamp, 10, 64)
+// upsertFeedSchedules inserts schedules from the feed, replacing those already loaded with the same CombinedID, and
+// their locations. A replacement keeps the ID of the schedule it replaces.
+func upsertFeedSchedules(tx *gorm.DB, schedules []schedule.Schedule) error {
+	return upsertByCombinedID(tx, schedules, "schedules",
+		func(sch *schedule.Schedule) string { return sch.CombinedID },
+		func(sch *schedule.Schedule) *uint64 { return &sch.ID },
+		func(tx *gorm.DB, replaced []uint64) error {
+			if err := tx.Where("schedule_id IN ?", replaced).Delete(&schedule.ScheduleLocation{}).Error; err != nil {
+				return fmt.Errorf("error deleting schedule locations: %w", err)
+			}
+			return nil
+		})
+}
+
+// upsertFeedAssociations inserts associations from the feed, replacing those already loaded with the same CombinedID.
+// A replacement keeps the ID of the association it replaces.
+func upsertFeedAssociations(tx *gorm.DB, associations []schedule.Association) error {
+	return upsertByCombinedID(tx, associations, "associations",
+		func(assoc *schedule.Association) string { return assoc.CombinedID },
+		func(assoc *schedule.Association) *uint64 { return &assoc.ID },
+		nil)
+}
+
+// upsertByCombinedID inserts rows from the feed, replacing those already loaded with the same CombinedID. Where a
+// CombinedID appears more than once in rows, the last row wins, and a replacement keeps the lowest ID of the rows it
+// replaces. combinedID and id give the fields of a row, name is the plural of the rows in errors, and
+// deleteChildren, if set, deletes the rows belonging to those being replaced before they are.
+func upsertByCombinedID[T any](tx *gorm.DB, rows []T, name string, combinedID func(*T) string, id func(*T) *uint64,
+	deleteChildren func(tx *gorm.DB, replaced []uint64) error) error {
+	if len(rows) == 0 {
+		return nil
+	}
+	combinedIDs := make([]string, len(rows))
+	for i := range rows {
+		combinedIDs[i] = combinedID(&rows[i])
+	}
+	existing, err := feedRowIDs(tx, new(T), combinedIDs)
 	if err != nil {
-		slog.Error("Error parsing VSTP timestamp", "error", err, "timestamp", vstpMsg.VSTPCIFMsgV1.Timestamp)
-		return err
+		return fmt.Errorf("error looking up %s: %w", name, err)
+	}
+
+	var replaced []uint64
+	for _, ids := range existing {
+		replaced = append(replaced, ids...)
+	}
+	if len(replaced) > 0 {
+		if deleteChildren != nil {
+			if err := deleteChildren(tx, replaced); err != nil {
+				return err
+			}
+		}
+		if err := tx.Where("id IN ?", replaced).Delete(new(T)).Error; err != nil {
+			return fmt.Errorf("error deleting %s: %w", name, err)
+		}
 	}
 
-	sch := vstpMsg.VSTPCIFMsgV1.VSTPSchedule.ToSchedule(time.Unix(parsedTimestamp/1000, 0))
-	sch.AugmentSchedule()
-	slog.Debug("Inserting schedule into db from file", "filename", filename)
-	db.Create(&sch)
+	latest := make(map[string]int, len(rows))
+	for i := range rows {
+		latest[combinedID(&rows[i])] = i
+	}
+	var inserts, replacements []T
+	for i := range rows {
+		row := rows[i]
+		key := combinedID(&row)
+		if latest[key] != i {
+			continue
+		}
+		if ids, ok := existing[key]; ok {
+			*id(&row) = slices.Min(ids)
+			replacements = append(replacements, row)
+		} else {
+			inserts = append(inserts, row)
+		}
+	}
+	for _, batch := range [][]T{replacements, inserts} {
+		if len(batch) == 0 {
+			continue
+		}
+		if err := tx.Create(&batch).Error; err != nil {
+			return fmt.Errorf("error creating %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// upsertTiplocs inserts tiplocs, replacing those already loaded with the same code.
+func upsertTiplocs(tx *gorm.DB, tiplocs []schedule.Tiploc) error {
+	if len(tiplocs) == 0 {
+		return nil
+	}
+	codes := make([]string, len(tiplocs))
+	for i := range tiplocs {
+		codes[i] = tiplocs[i].TiplocCode
+	}
+	if err := tx.Where("tiploc_code IN ?", codes).Delete(&schedule.Tiploc{}).Error; err != nil {
+		return fmt.Errorf("error deleting tiplocs: %w", err)
+	}
+	// Where a code appears more than once, the last tiploc wins
+	latest := make(map[string]int, len(tiplocs))
+	for i := range tiplocs {
+		latest[tiplocs[i].TiplocCode] = i
+	}
+	inserts := make([]schedule.Tiploc, 0, len(latest))
+	for i := range tiplocs {
+		if latest[tiplocs[i].TiplocCode] == i {
+			inserts = append(inserts, tiplocs[i])
+		}
+	}
+	if err := tx.Create(&inserts).Error; err != nil {
+		return fmt.Errorf("error creating tiplocs: %w", err)
+	}
 	return nil
 }
+
+// insertVSTP reads a VSTP message from a file and applies it to the database.
+func insertVSTP(filename string, db *gorm.DB) error {
+	vstp, err := os.ReadFile(filename)
+	if err != nil {
+		slog.Error("Failed to read vstp message from file", "error", err, "filename", filename)
+		return err
+	}
+
+	slog.Debug("Applying VSTP message from file", "filename", filename)
+	return InsertVSTPFromBytes(vstp, db)
+}
@@ -1,11 +1,16 @@
 package sync_test
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
+	"uk-rail-schedule-api/internal/db"
 	"uk-rail-schedule-api/internal/schedule"
 	internalsync "uk-rail-schedule-api/internal/sync"
 
@@ -23,19 +28,14 @@ func setupTestDB(t *testing.T) *gorm.DB {
 	if err != nil {
 		t.Fatal("failed to open test database:", err)
 	}
-	if err := db.AutoMigrate(
-		&schedule.ScheduleLocation{},
-		&schedule.Schedule{},
-		&schedule.Tiploc{},
-		&schedule.Timetable{},
-	); err != nil {
+	if err := db.AutoMigrate(schedule.Models()...); err != nil {
 		t.Fatal("failed to migrate test database:", err)
 	}
 	return db
 }
 
 // writeFeedFile writes a line-delimited feed file to a temp path and returns its path.
-func writeFeedFile(t *testing.T, lines ...string) string {
+func writeFeedFile(t testing.TB, lines ...string) string {
 	t.Helper()
 	f, err := os.CreateTemp(t.TempDir(), "feed-*.json")
 	if err != nil {
@@ -54,23 +54,28 @@ const (
 
 	scheduleLine = `{"JsonScheduleV1":{"CIF_bank_holiday_running":"","CIF_stp_indicator":"P","CIF_train_uid":"C00206","applicable_timetable":"Y","atoc_code":"GW","new_schedule_segment":{"traction_class":"","uic_code":""},"schedule_days_runs":"0000001","schedule_end_date":"2099-12-31","schedule_segment":{"signalling_id":"2A20","CIF_train_category":"OO","CIF_headcode":"","CIF_course_indicator":1,"CIF_train_service_code":"22209000","CIF_business_sector":"??","CIF_power_type":"DMU","CIF_timing_load":"E","CIF_speed":"100","CIF_operating_characteristics":"D","CIF_train_class":"B","CIF_sleepers":"","CIF_reservations":"","CIF_connection_indicator":"","CIF_catering_code":"","CIF_service_branding":"","schedule_location":[{"record_identity":"LO","tiploc_code":"DRBY","departure":"0756","public_departure":"0756"}]},"schedule_start_date":"2023-01-01","train_status":"P","transaction_type":"Create"}}`
 
+	associationLine = `{"JsonAssociationV1":{"transaction_type":"Create","main_train_uid":"C00206","assoc_train_uid":"C00299","assoc_start_date":"2023-01-01T00:00:00Z","assoc_end_date":"2099-12-31T00:00:00Z","assoc_days":"0000001","category":"VV","date_indicator":"S","location":"DRBY","base_location_suffix":null,"assoc_location_suffix":null,"diagram_type":"T","CIF_stp_indicator":"P"}}`
+
 	tiplocLine = `{"TiplocV1":{"transaction_type":"Create","tiploc_code":"DRBY","nalco":"161050","stanox":"52101","crs_code":"DBY","description":"DERBY","tps_description":"DERBY"}}`
 )
 
 func TestIsRefreshingDatabase_InitiallyFalse(t *testing.T) {
-	// Ensure any previous test cleaned up.
-	internalsync.SetRefreshingDatabase(false)
-	if internalsync.IsRefreshingDatabase() {
+	db := setupTestDB(t)
+	if internalsync.IsRefreshingDatabase(db) {
 		t.Error("expected IsRefreshingDatabase() to return false before any refresh")
 	}
 }
 
 func TestRefreshSchedules_SkipsWhenAlreadyRefreshing(t *testing.T) {
-	internalsync.SetRefreshingDatabase(true)
-	t.Cleanup(func() { internalsync.SetRefreshingDatabase(false) })
-
 	db := setupTestDB(t)
-	internalsync.RefreshSchedules("irrelevant.json", db, t.TempDir(), false)
+	if _, err := internalsync.BeginRefresh(db, "running.json"); err != nil {
+		t.Fatalf("BeginRefresh: %v", err)
+	}
+
+	err := internalsync.RefreshSchedules(t.Context(), writeFeedFile(t, metadataLine, scheduleLine), db, t.TempDir(), false)
+	if !errors.Is(err, internalsync.ErrAlreadyRefreshing) {
+		t.Errorf("expected ErrAlreadyRefreshing, got %v", err)
+	}
 
 	var count int64
 	db.Model(&schedule.Schedule{}).Count(&count)
@@ -82,7 +87,7 @@ func TestRefreshSchedules_SkipsWhenAlreadyRefreshing(t *testing.T) {
 func TestRefreshSchedules_FileNotFound(t *testing.T) {
 	db := setupTestDB(t)
 	// Should return gracefully without panicking.
-	internalsync.RefreshSchedules("/nonexistent/path/feed.json", db, t.TempDir(), false)
+	internalsync.RefreshSchedules(t.Context(), "/nonexistent/path/feed.json", db, t.TempDir(), false)
 
 	var count int64
 	db.Model(&schedule.Schedule{}).Count(&count)
@@ -94,7 +99,7 @@ func TestRefreshSchedules_FileNotFound(t *testing.T) {
 func TestRefreshSchedules_InvalidFirstLine(t *testing.T) {
 	db := setupTestDB(t)
 	feedFile := writeFeedFile(t, "this is not valid json")
-	internalsync.RefreshSchedules(feedFile, db, t.TempDir(), false)
+	internalsync.RefreshSchedules(t.Context(), feedFile, db, t.TempDir(), false)
 
 	var count int64
 	db.Model(&schedule.Schedule{}).Count(&count)
@@ -107,7 +112,7 @@ func TestRefreshSchedules_FirstLineNotMetadata(t *testing.T) {
 	db := setupTestDB(t)
 	// First line is a valid schedule record, not a timetable metadata record.
 	feedFile := writeFeedFile(t, scheduleLine)
-	internalsync.RefreshSchedules(feedFile, db, t.TempDir(), false)
+	internalsync.RefreshSchedules(t.Context(), feedFile, db, t.TempDir(), false)
 
 	var count int64
 	db.Model(&schedule.Schedule{}).Count(&count)
@@ -119,7 +124,7 @@ func TestRefreshSchedules_FirstLineNotMetadata(t *testing.T) {
 func TestRefreshSchedules_LoadsSchedulesAndTiplocs(t *testing.T) {
 	db := setupTestDB(t)
 	feedFile := writeFeedFile(t, metadataLine, scheduleLine, tiplocLine)
-	internalsync.RefreshSchedules(feedFile, db, t.TempDir(), false)
+	internalsync.RefreshSchedules(t.Context(), feedFile, db, t.TempDir(), false)
 
 	var schedCount int64
 	db.Model(&schedule.Schedule{}).Count(&schedCount)
@@ -140,10 +145,52 @@ func TestRefreshSchedules_LoadsSchedulesAndTiplocs(t *testing.T) {
 	}
 }
 
+func TestRefreshSchedules_LoadsScheduleLongerThan64KB(t *testing.T) {
+	db := setupTestDB(t)
+	var locations []string
+	for i := range 1000 {
+		locations = append(locations, fmt.Sprintf(`{"record_identity":"LI","tiploc_code":"T%04d","pass":"0800","platform":"","line":"","path":"","engineering_allowance":"","pathing_allowance":"","performance_allowance":""}`, i))
+	}
+	long := strings.Replace(scheduleLine, `"schedule_location":[`, `"schedule_location":[`+strings.Join(locations, ",")+",", 1)
+	if len(long) < 64*1024 {
+		t.Fatalf("expected a schedule line over 64KB, got %d bytes", len(long))
+	}
+
+	if err := internalsync.RefreshSchedules(t.Context(), writeFeedFile(t, metadataLine, long, tiplocLine), db, t.TempDir(), false); err != nil {
+		t.Fatal(err)
+	}
+	var count int64
+	db.Model(&schedule.ScheduleLocation{}).Count(&count)
+	if count != 1001 {
+		t.Errorf("expected every location of the long schedule to be loaded, got %d", count)
+	}
+	db.Model(&schedule.Tiploc{}).Count(&count)
+	if count != 1 {
+		t.Errorf("expected the line after the long schedule to be loaded, got %d tiplocs", count)
+	}
+}
+
+func TestRefreshSchedules_LoadsAssociations(t *testing.T) {
+	db := setupTestDB(t)
+	feedFile := writeFeedFile(t, metadataLine, scheduleLine, associationLine)
+	internalsync.RefreshSchedules(t.Context(), feedFile, db, t.TempDir(), false)
+
+	var assoc schedule.Association
+	if err := db.First(&assoc).Error; err != nil {
+		t.Fatalf("expected association to be loaded from feed, got: %v", err)
+	}
+	if assoc.MainTrainUID != "C00206" || assoc.AssocTrainUID != "C00299" {
+		t.Errorf("expected association between C00206 and C00299, got %q and %q", assoc.MainTrainUID, assoc.AssocTrainUID)
+	}
+	if assoc.AssocStartDateTS == 0 {
+		t.Error("expected AssocStartDateTS to be computed by augmentation")
+	}
+}
+
 func TestRefreshSchedules_ScheduleIsAugmented(t *testing.T) {
 	db := setupTestDB(t)
 	feedFile := writeFeedFile(t, metadataLine, scheduleLine)
-	internalsync.RefreshSchedules(feedFile, db, t.TempDir(), false)
+	internalsync.RefreshSchedules(t.Context(), feedFile, db, t.TempDir(), false)
 
 	var sch schedule.Schedule
 	db.First(&sch)
@@ -170,7 +217,7 @@ func TestRefreshSchedules_SkipsOlderFeedThanDatabase(t *testing.T) {
 	})
 
 	feedFile := writeFeedFile(t, metadataLine, scheduleLine)
-	internalsync.RefreshSchedules(feedFile, db, t.TempDir(), false)
+	internalsync.RefreshSchedules(t.Context(), feedFile, db, t.TempDir(), false)
 
 	var count int64
 	db.Model(&schedule.Schedule{}).Count(&count)
@@ -192,15 +239,22 @@ func TestRefreshSchedules_DeletesExpiredSchedules(t *testing.T) {
 	}
 	expired.AugmentSchedule()
 	db.Create(&expired)
+	db.Create(&schedule.ScheduleLocation{ScheduleID: expired.ID, TiplocCode: "DRBY", RecordIdentity: "LO"})
 
 	feedFile := writeFeedFile(t, metadataLine)
-	internalsync.RefreshSchedules(feedFile, db, t.TempDir(), true)
+	if err := internalsync.RefreshSchedules(t.Context(), feedFile, db, t.TempDir(), true); err != nil {
+		t.Fatalf("RefreshSchedules: %v", err)
+	}
 
-	var count int64
+	var count, locations int64
 	db.Model(&schedule.Schedule{}).Count(&count)
+	db.Model(&schedule.ScheduleLocation{}).Count(&locations)
 	if count != 0 {
 		t.Errorf("expected expired schedule to be deleted, got %d remaining schedules", count)
 	}
+	if locations != 0 {
+		t.Errorf("expected the expired schedule's locations to be deleted, got %d remaining locations", locations)
+	}
 }
 
 func TestRefreshSchedules_ReplaysVSTPFilesFromDataDir(t *testing.T) {
@@ -217,7 +271,7 @@ func TestRefreshSchedules_ReplaysVSTPFilesFromDataDir(t *testing.T) {
 	}
 
 	feedFile := writeFeedFile(t, metadataLine)
-	internalsync.RefreshSchedules(feedFile, db, dataDir, false)
+	internalsync.RefreshSchedules(t.Context(), feedFile, db, dataDir, false)
 
 	var count int64
 	db.Model(&schedule.Schedule{}).Count(&count)
@@ -225,3 +279,315 @@ func TestRefreshSchedules_ReplaysVSTPFilesFromDataDir(t *testing.T) {
 		t.Errorf("expected 1 VSTP schedule replayed from dataDir, got %d", count)
 	}
 }
+
+func TestRefreshSchedules_ReplayingVSTPFilesTwiceIsANoOp(t *testing.T) {
+	db := setupTestDB(t)
+
+	dataDir := t.TempDir()
+	vstpData, err := os.ReadFile(filepath.Join("..", "..", "test-fixtures", "vstp.json"))
+	if err != nil {
+		t.Fatal("failed to read vstp fixture:", err)
+	}
+	if err := os.WriteFile(filepath.Join(dataDir, "vstp-replay.json"), vstpData, 0644); err != nil {
+		t.Fatal("failed to write vstp replay file:", err)
+	}
+
+	internalsync.RefreshSchedules(t.Context(), writeFeedFile(t, metadataLine), db, dataDir, false)
+	db.Where("1 = 1").Delete(&schedule.Timetable{})
+	internalsync.RefreshSchedules(t.Context(), writeFeedFile(t, metadataLine), db, dataDir, false)
+
+	var count, audited int64
+	db.Model(&schedule.Schedule{}).Count(&count)
+	db.Model(&schedule.VSTPAuditEntry{}).Count(&audited)
+	if count != 1 || audited != 1 {
+		t.Errorf("expected the VSTP file to be applied once, got %d schedules and %d audit entries", count, audited)
+	}
+}
+
+func TestRefreshSchedules_StopsWhenCancelled(t *testing.T) {
+	db := setupTestDB(t)
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+
+	err := internalsync.RefreshSchedules(ctx, writeFeedFile(t, metadataLine, scheduleLine, tiplocLine), db, t.TempDir(), true)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+	if internalsync.IsRefreshingDatabase(db) {
+		t.Error("expected the refreshing state to be cleared after the load stopped")
+	}
+
+	var schedules, timetables int64
+	db.Model(&schedule.Schedule{}).Count(&schedules)
+	db.Model(&schedule.Timetable{}).Count(&timetables)
+	if schedules != 0 || timetables != 0 {
+		t.Errorf("expected nothing to be loaded, got %d schedules and %d timetables", schedules, timetables)
+	}
+}
+
+func TestRefreshSchedules_ResumesInterruptedLoad(t *testing.T) {
+	db := setupTestDB(t)
+
+	// A previous load of the same extract committed its first line, the tiploc, before it was stopped
+	db.Create(&schedule.FeedLoadProgress{TimetableTimestamp: 1683043200, Lines: 1})
+
+	if err := internalsync.RefreshSchedules(t.Context(), writeFeedFile(t, metadataLine, tiplocLine, scheduleLine), db, t.TempDir(), false); err != nil {
+		t.Fatal(err)
+	}
+
+	var schedules, tiplocs, timetables, progress int64
+	db.Model(&schedule.Schedule{}).Count(&schedules)
+	db.Model(&schedule.Tiploc{}).Count(&tiplocs)
+	db.Model(&schedule.Timetable{}).Count(&timetables)
+	db.Model(&schedule.FeedLoadProgress{}).Count(&progress)
+	if schedules != 1 || tiplocs != 0 {
+		t.Errorf("expected only the lines after the first to be loaded, got %d schedules and %d tiplocs", schedules, tiplocs)
+	}
+	if timetables != 1 || progress != 0 {
+		t.Errorf("expected the timetable to be recorded and the progress removed, got %d timetables and %d progress rows", timetables, progress)
+	}
+}
+
+func TestRefreshSchedules_ReplacesRepeatedRecords(t *testing.T) {
+	db := setupTestDB(t)
+	// The later schedule departs from platform 2, rather than without a platform
+	replacement := strings.Replace(scheduleLine, `"public_departure":"0756"}`, `"public_departure":"0756","platform":"2"}`, 1)
+	feedFile := writeFeedFile(t, metadataLine, scheduleLine, tiplocLine, associationLine, replacement, tiplocLine, associationLine)
+	if err := internalsync.RefreshSchedules(t.Context(), feedFile, db, t.TempDir(), false); err != nil {
+		t.Fatal(err)
+	}
+
+	var schedules []schedule.Schedule
+	db.Preload("ScheduleLocation").Find(&schedules)
+	if len(schedules) != 1 || len(schedules[0].ScheduleLocation) != 1 || schedules[0].ScheduleLocation[0].Platform != "2" {
+		t.Errorf("expected the later schedule to replace the earlier one, got %+v", schedules)
+	}
+	var tiplocs, associations int64
+	db.Model(&schedule.Tiploc{}).Count(&tiplocs)
+	db.Model(&schedule.Association{}).Count(&associations)
+	if tiplocs != 1 || associations != 1 {
+		t.Errorf("expected 1 tiploc and 1 association, got %d and %d", tiplocs, associations)
+	}
+}
+
+func TestRefreshSchedules_ReplacesScheduleFromEarlierBatch(t *testing.T) {
+	db := setupTestDB(t)
+	lines := []string{metadataLine, scheduleLine}
+	// Enough tiplocs to put the replacement schedule in a later batch
+	for i := range 1000 {
+		lines = append(lines, strings.Replace(tiplocLine, `"tiploc_code":"DRBY"`, fmt.Sprintf(`"tiploc_code":"T%04d"`, i), 1))
+	}
+	lines = append(lines, strings.Replace(scheduleLine, `"public_departure":"0756"}`, `"public_departure":"0756","platform":"2"}`, 1))
+	if err := internalsync.RefreshSchedules(t.Context(), writeFeedFile(t, lines...), db, t.TempDir(), false); err != nil {
+		t.Fatal(err)
+	}
+
+	var schedules []schedule.Schedule
+	db.Preload("ScheduleLocation").Find(&schedules)
+	if len(schedules) != 1 || len(schedules[0].ScheduleLocation) != 1 || schedules[0].ScheduleLocation[0].Platform != "2" {
+		t.Fatalf("expected the later schedule to replace the earlier one, got %+v", schedules)
+	}
+	if schedules[0].ID != 1 {
+		t.Errorf("expected the replacement to keep the ID of the schedule it replaced, got %d", schedules[0].ID)
+	}
+	var locations int64
+	db.Model(&schedule.ScheduleLocation{}).Count(&locations)
+	if locations != 1 {
+		t.Errorf("expected the earlier schedule's location to be deleted, got %d locations", locations)
+	}
+}
+
+func TestRefreshSchedules_SwapsInReloadedDatabase(t *testing.T) {
+	database := openTestDB(t)
+	liveFilename, _ := db.Filename(database)
+	database.Create(&schedule.Schedule{CIFTrainUID: "OLD001", Source: "Feed"})
+
+	dataDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dataDir, "vstp-1.json"), vstpMessage("Create", "reload-001"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := internalsync.RefreshSchedules(t.Context(), writeFeedFile(t, metadataLine, tiplocLine, scheduleLine), database, dataDir, false); err != nil {
+		t.Fatalf("RefreshSchedules: %v", err)
+	}
+
+	// The same handle now reads the reloaded database, which has the VSTP files replayed into it
+	var sources []string
+	database.Model(&schedule.Schedule{}).Order("source").Pluck("source", &sources)
+	if fmt.Sprint(sources) != "[Feed VSTP]" {
+		t.Errorf("expected the feed schedule and the replayed VSTP schedule, got %v", sources)
+	}
+	var old int64
+	database.Model(&schedule.Schedule{}).Where("cif_train_uid = ?", "OLD001").Count(&old)
+	if old != 0 {
+		t.Error("expected the schedule in the old database to be gone")
+	}
+	var job schedule.RefreshJob
+	if err := database.First(&job).Error; err != nil || job.State != schedule.RefreshJobSucceeded {
+		t.Errorf("expected the refresh job to be carried over and succeed, got %+v (%v)", job, err)
+	}
+	if internalsync.IsRefreshingDatabase(database) {
+		t.Error("expected the carried over lease to be released")
+	}
+
+	previous, err := db.Open(db.PreviousFilename(liveFilename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous.Model(&schedule.Schedule{}).Where("cif_train_uid = ?", "OLD001").Count(&old)
+	if old != 1 {
+		t.Error("expected the old database to be kept as the previous file")
+	}
+}
+
+func TestRefreshSchedules_CarriesVSTPHistoryOverToReloadedDatabase(t *testing.T) {
+	database := openTestDB(t)
+	database.Create(&schedule.Schedule{CIFTrainUID: "OLD001", Source: "Feed"})
+
+	// One message is on disk and replayed, the other was applied but has no file to replay
+	dataDir := t.TempDir()
+	replayed := vstpMessage("Create", "reload-001")
+	if err := os.WriteFile(filepath.Join(dataDir, "vstp-1.json"), replayed, 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, msg := range [][]byte{replayed, vstpMessage("Delete", "gone-001")} {
+		if err := internalsync.InsertVSTPFromBytes(msg, database); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := internalsync.RefreshSchedules(t.Context(), writeFeedFile(t, metadataLine, tiplocLine, scheduleLine), database, dataDir, false); err != nil {
+		t.Fatalf("RefreshSchedules: %v", err)
+	}
+
+	var entries []schedule.VSTPAuditEntry
+	database.Order("origin_msg_id").Find(&entries)
+	if len(entries) != 2 || entries[0].OriginMsgID != "gone-001" || entries[1].OriginMsgID != "reload-001" {
+		t.Fatalf("expected an audit entry for each message, got %+v", entries)
+	}
+	if entries[0].ScheduleID != 0 || entries[1].ScheduleID == 0 {
+		t.Errorf("expected only the replayed message's entry to point to a schedule, got %d and %d", entries[0].ScheduleID, entries[1].ScheduleID)
+	}
+	var processed int64
+	database.Model(&schedule.ProcessedVSTPMessage{}).Count(&processed)
+	if processed != 2 {
+		t.Errorf("expected both messages to be recorded as processed, got %d", processed)
+	}
+	var vstp int64
+	database.Model(&schedule.Schedule{}).Where("source = ?", "VSTP").Count(&vstp)
+	if vstp != 1 {
+		t.Errorf("expected the replayed VSTP schedule, got %d", vstp)
+	}
+}
+
+func TestRefreshSchedules_KeepsLiveDatabaseWhenReloadIsInvalid(t *testing.T) {
+	database := openTestDB(t)
+	liveFilename, _ := db.Filename(database)
+	for _, uid := range []string{"OLD001", "OLD002", "OLD003"} {
+		database.Create(&schedule.Schedule{CIFTrainUID: uid, Source: "Feed"})
+	}
+
+	// A truncated extract with a single schedule
+	err := internalsync.RefreshSchedules(t.Context(), writeFeedFile(t, metadataLine, tiplocLine, scheduleLine), database, t.TempDir(), false)
+	if !errors.Is(err, internalsync.ErrInvalidReload) {
+		t.Fatalf("expected ErrInvalidReload, got %v", err)
+	}
+
+	if count := countSchedules(database); count != 3 {
+		t.Errorf("expected the live database to keep its 3 schedules, got %d", count)
+	}
+	if _, err := os.Stat(db.NextFilename(liveFilename)); err != nil {
+		t.Errorf("expected the invalid reload to be kept for inspection, got %v", err)
+	}
+}
+
+func TestRefreshSchedules_ResumesInterruptedReload(t *testing.T) {
+	database := openTestDB(t)
+	liveFilename, _ := db.Filename(database)
+
+	// A previous reload of the same extract committed its first line, the tiploc, before it was stopped
+	next, err := db.Open(db.NextFilename(liveFilename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tiploc schedule.ScheduleFeedRecord
+	json.Unmarshal([]byte(tiplocLine), &tiploc)
+	next.Create(&tiploc.Tiploc)
+	next.Create(&schedule.FeedLoadProgress{TimetableTimestamp: 1683043200, Lines: 1})
+	if sqlDB, err := next.DB(); err == nil {
+		sqlDB.Close()
+	}
+
+	if err := internalsync.RefreshSchedules(t.Context(), writeFeedFile(t, metadataLine, tiplocLine, scheduleLine), database, t.TempDir(), false); err != nil {
+		t.Fatalf("RefreshSchedules: %v", err)
+	}
+
+	var schedules, tiplocs, progress int64
+	database.Model(&schedule.Schedule{}).Count(&schedules)
+	database.Model(&schedule.Tiploc{}).Count(&tiplocs)
+	database.Model(&schedule.FeedLoadProgress{}).Count(&progress)
+	if schedules != 1 || tiplocs != 1 || progress != 0 {
+		t.Errorf("expected the reload to carry on after the tiploc, got %d schedules, %d tiplocs and %d progress rows", schedules, tiplocs, progress)
+	}
+	var job schedule.RefreshJob
+	database.First(&job)
+	if job.Schedules != 1 || job.Tiplocs != 0 {
+		t.Errorf("expected the job to count only the lines loaded after resuming, got %+v", job)
+	}
+}
+
+// writeSyntheticFeed writes a full extract with the given number of schedules, each calling at 20 of 200 tiplocs, and
+// an association for every tenth schedule - roughly the mix of the real feed.
+func writeSyntheticFeed(tb testing.TB, schedules int) string {
+	tb.Helper()
+	lines := []string{metadataLine}
+	for i := range 200 {
+		lines = append(lines, strings.NewReplacer(`"tiploc_code":"DRBY"`, fmt.Sprintf(`"tiploc_code":"TIP%03d"`, i), `"crs_code":"DBY"`, fmt.Sprintf(`"crs_code":"T%02d"`, i%100)).Replace(tiplocLine))
+	}
+
+	for i := range schedules {
+		locations := make([]string, 20)
+		for stop := range locations {
+			tiploc := fmt.Sprintf("TIP%03d", (i+stop*7)%200)
+			switch stop {
+			case 0:
+				locations[stop] = fmt.Sprintf(`{"location_type":"LO","record_identity":"LO","tiploc_code":"%s","departure":"0756","public_departure":"0756","platform":"1","line":"F","engineering_allowance":null,"pathing_allowance":null,"performance_allowance":null}`, tiploc)
+			case len(locations) - 1:
+				locations[stop] = fmt.Sprintf(`{"location_type":"LT","record_identity":"LT","tiploc_code":"%s","arrival":"0959","public_arrival":"1000","platform":"2","path":null}`, tiploc)
+			default:
+				locations[stop] = fmt.Sprintf(`{"location_type":"LI","record_identity":"LI","tiploc_code":"%s","arrival":"08%02dH","departure":"08%02d","pass":null,"public_arrival":"08%02d","public_departure":"08%02d","platform":null,"line":"SL","path":null,"engineering_allowance":null,"pathing_allowance":null,"performance_allowance":"1"}`, tiploc, stop, stop+1, stop, stop+1)
+			}
+		}
+		lines = append(lines, strings.NewReplacer(
+			`"CIF_train_uid":"C00206"`, fmt.Sprintf(`"CIF_train_uid":"S%05d"`, i),
+			`[{"record_identity":"LO","tiploc_code":"DRBY","departure":"0756","public_departure":"0756"}]`, "["+strings.Join(locations, ",")+"]",
+		).Replace(scheduleLine))
+
+		if i%10 == 0 {
+			lines = append(lines, strings.Replace(associationLine, `"main_train_uid":"C00206"`, fmt.Sprintf(`"main_train_uid":"S%05d"`, i), 1))
+		}
+	}
+	return writeFeedFile(tb, lines...)
+}
+
+// BenchmarkRefreshSchedules_SyntheticFeed loads a synthetic full extract into a new database, reporting the lines
+// loaded per second. The real feed has around 450,000 lines.
+func BenchmarkRefreshSchedules_SyntheticFeed(b *testing.B) {
+	const schedules = 20000
+	feedFile := writeSyntheticFeed(b, schedules)
+	lines := 1 + 200 + schedules + schedules/10
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		database := openTestDB(b)
+		b.StartTimer()
+		if err := internalsync.RefreshSchedules(b.Context(), feedFile, database, b.TempDir(), false); err != nil {
+			b.Fatal(err)
+		}
+		if count := countSchedules(database); count != schedules {
+			b.Fatalf("expected %d schedules, got %d", schedules, count)
+		}
+	}
+	b.ReportMetric(float64(lines*b.N)/b.Elapsed().Seconds(), "lines/s")
+}
@@ -0,0 +1,222 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+	"uk-rail-schedule-api/internal/schedule"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	ErrAlreadyRefreshing = errors.New("schedule feed is already being loaded")
+	ErrRefreshLeaseLost  = errors.New("refresh lease was taken over by another job")
+)
+
+// refreshLeaseName names the lease held while the schedule feed is loaded.
+const refreshLeaseName = "schedule_feed"
+
+// A refresh job renews its lease every refreshLeaseRenewal. The lease lasts for refreshLeaseTTL, so a job that's
+// busy for a few renewals, waiting for the database, doesn't lose it.
+const (
+	refreshLeaseTTL     = 2 * time.Minute
+	refreshLeaseRenewal = 30 * time.Second
+)
+
+// IsRefreshingDatabase reports whether a job in any process sharing the database is loading the schedule feed.
+func IsRefreshingDatabase(db *gorm.DB) bool {
+	var count int64
+	db.Model(&schedule.RefreshLease{}).Where("name = ? AND expires_at >= ?", refreshLeaseName, time.Now().Unix()).Count(&count)
+	return count > 0
+}
+
+// RefreshSchedules loads the schedule feed file into the database, as a refresh job. See BeginRefresh and
+// RunRefreshJob.
+func RefreshSchedules(ctx context.Context, filename string, db *gorm.DB, dataDir string, deleteExpired bool) error {
+	job, err := BeginRefresh(db, filename)
+	if err != nil {
+		return err
+	}
+	return RunRefreshJob(ctx, job, db, dataDir, deleteExpired)
+}
+
+// BeginRefresh records a new refresh job for the feed file and takes the refresh lease for it. It returns
+// ErrAlreadyRefreshing, without recording a job, if another job holds the lease. Jobs whose lease has expired were
+// left running by a process that stopped, and are marked as failed.
+func BeginRefresh(db *gorm.DB, filename string) (schedule.RefreshJob, error) {
+	now := time.Now()
+	job := schedule.RefreshJob{Filename: filename, State: schedule.RefreshJobRunning, StartedAt: now}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		held := tx.Model(&schedule.RefreshLease{}).Select("job_id").Where("expires_at >= ?", now.Unix())
+		if err := tx.Model(&schedule.RefreshJob{}).Where("state = ? AND id NOT IN (?)", schedule.RefreshJobRunning, held).Updates(map[string]any{
+			"state":       schedule.RefreshJobFailed,
+			"finished_at": now,
+			"error":       "abandoned - the process running it stopped",
+		}).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Create(&job).Error; err != nil {
+			return err
+		}
+
+		// Take the lease unless it's held by a job that's still running
+		lease := schedule.RefreshLease{Name: refreshLeaseName, JobID: job.ID, ExpiresAt: now.Add(refreshLeaseTTL).Unix()}
+		result := tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "name"}},
+			DoUpdates: clause.AssignmentColumns([]string{"job_id", "expires_at"}),
+			Where: clause.Where{Exprs: []clause.Expression{
+				clause.Lt{Column: clause.Column{Table: "refresh_leases", Name: "expires_at"}, Value: now.Unix()},
+			}},
+		}).Create(&lease)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrAlreadyRefreshing
+		}
+		return nil
+	})
+	if errors.Is(err, ErrAlreadyRefreshing) {
+		slog.Info("Not going to load - schedule feed is already loading in another process")
+	}
+	if err != nil {
+		return schedule.RefreshJob{}, err
+	}
+	return job, nil
+}
+
+// RunRefreshJob loads the feed file of a job begun by BeginRefresh, renewing the job's lease and saving its progress
+// while it runs, then records the outcome of the job, with the issues found in the file, and releases the lease. If
+// ctx is cancelled, or the lease is lost, the load stops as described for loadScheduleFeed.
+func RunRefreshJob(ctx context.Context, job schedule.RefreshJob, db *gorm.DB, dataDir string, deleteExpired bool) error {
+	slog.Info("start refreshing database", "job", job.ID, "filename", job.Filename)
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	stopRenewing := renewRefreshLease(ctx, db, job.ID, cancel)
+	load := newFeedLoad()
+	stopReporting := reportRefreshProgress(ctx, db, job, load)
+
+	counts, err := loadScheduleFeed(ctx, job.Filename, db, dataDir, load)
+	if err != nil && ctx.Err() != nil {
+		err = context.Cause(ctx)
+	}
+
+	// Leave expired schedules for the next refresh rather than hold up a shutdown
+	if err == nil && ctx.Err() == nil && deleteExpired {
+		slog.Debug("Deleting expired schedules")
+		if err = deleteExpiredRecords(db, time.Now().Unix()); err != nil {
+			slog.Error("Failed to delete expired schedules", "error", err)
+		}
+	} else {
+		slog.Debug("Not deleting expired schedules from database")
+	}
+
+	stopReporting()
+	stopRenewing()
+	finishRefreshJob(db, &job, counts, load, err)
+	return err
+}
+
+// deleteExpiredRecords deletes the schedules, with their locations, and the associations that ended before now, in a
+// single transaction.
+func deleteExpiredRecords(db *gorm.DB, now int64) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("schedule_id IN (SELECT id FROM schedules WHERE schedule_end_date_ts < ?)", now).
+			Delete(&schedule.ScheduleLocation{}).Error; err != nil {
+			return fmt.Errorf("error deleting locations of expired schedules: %w", err)
+		}
+		if err := tx.Delete(&schedule.Schedule{}, "schedule_end_date_ts < ?", now).Error; err != nil {
+			return fmt.Errorf("error deleting expired schedules: %w", err)
+		}
+		if err := tx.Delete(&schedule.Association{}, "assoc_end_date_ts < ?", now).Error; err != nil {
+			return fmt.Errorf("error deleting expired associations: %w", err)
+		}
+		return nil
+	})
+}
+
+// renewRefreshLease renews the lease of a running job until the returned function is called. If the lease has been
+// taken over by another job, it calls lost with ErrRefreshLeaseLost.
+func renewRefreshLease(ctx context.Context, db *gorm.DB, jobID uint64, lost context.CancelCauseFunc) func() {
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Go(func() {
+		ticker := time.NewTicker(refreshLeaseRenewal)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			result := db.Model(&schedule.RefreshLease{}).Where("name = ? AND job_id = ?", refreshLeaseName, jobID).
+				Update("expires_at", time.Now().Add(refreshLeaseTTL).Unix())
+			if result.Error != nil {
+				slog.Error("Failed to renew refresh lease", "error", result.Error, "job", jobID)
+				continue
+			}
+			if result.RowsAffected == 0 {
+				slog.Error("Refresh lease has been taken over by another job - stopping", "job", jobID)
+				lost(ErrRefreshLeaseLost)
+				return
+			}
+		}
+	})
+	return func() {
+		close(done)
+		wg.Wait()
+	}
+}
+
+// refreshJobsWithIssues is the number of the most recent refresh jobs whose issues are kept. The counts of the
+// issues found by older jobs are kept with the jobs.
+const refreshJobsWithIssues = 10
+
+// finishRefreshJob records the outcome of a job and the issues found in its file, and releases its lease.
+func finishRefreshJob(db *gorm.DB, job *schedule.RefreshJob, counts feedCounts, load *feedLoad, loadErr error) {
+	finishedAt := time.Now()
+	job.FinishedAt = &finishedAt
+	job.Schedules, job.Tiplocs, job.Associations = counts.schedules, counts.tiplocs, counts.associations
+	job.BytesRead, job.BytesTotal, job.Lines = load.bytesRead.Load(), load.bytesTotal.Load(), load.lines.Load()
+	job.EstimatedFinishAt = nil
+	job.IssueCounts = load.issueCounts
+	for i := range load.issues {
+		load.issues[i].JobID = job.ID
+	}
+	job.State = schedule.RefreshJobSucceeded
+	if loadErr != nil {
+		job.State = schedule.RefreshJobFailed
+		job.Error = loadErr.Error()
+	}
+
+	if err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(job).Error; err != nil {
+			return err
+		}
+		if len(load.issues) > 0 {
+			if err := tx.CreateInBatches(load.issues, 500).Error; err != nil {
+				return err
+			}
+		}
+		latest := tx.Model(&schedule.RefreshJob{}).Select("id").Order("id desc").Limit(refreshJobsWithIssues)
+		if err := tx.Where("job_id NOT IN (?)", latest).Delete(&schedule.RefreshIssue{}).Error; err != nil {
+			return err
+		}
+		return tx.Where("name = ? AND job_id = ?", refreshLeaseName, job.ID).Delete(&schedule.RefreshLease{}).Error
+	}); err != nil {
+		// The lease expires by itself, and the job is then marked as abandoned
+		slog.Error("Failed to record the end of refresh job", "error", err, "job", job.ID)
+	}
+	slog.Info("end refreshing database", "job", job.ID, "state", job.State, "issues", job.IssueCounts)
+}
@@ -0,0 +1,95 @@
+package sync_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+	"uk-rail-schedule-api/internal/schedule"
+	internalsync "uk-rail-schedule-api/internal/sync"
+)
+
+func TestRefreshSchedules_RecordsSucceededJob(t *testing.T) {
+	db := setupTestDB(t)
+
+	if err := internalsync.RefreshSchedules(t.Context(), writeFeedFile(t, metadataLine, scheduleLine, associationLine, tiplocLine), db, t.TempDir(), false); err != nil {
+		t.Fatalf("RefreshSchedules: %v", err)
+	}
+
+	var job schedule.RefreshJob
+	if err := db.First(&job).Error; err != nil {
+		t.Fatalf("expected a refresh job to be recorded: %v", err)
+	}
+	if job.State != schedule.RefreshJobSucceeded || job.FinishedAt == nil || job.Error != "" {
+		t.Errorf("expected a finished, succeeded job, got %+v", job)
+	}
+	if job.Schedules != 1 || job.Associations != 1 || job.Tiplocs != 1 {
+		t.Errorf("expected 1 schedule, association and tiploc, got %d, %d and %d", job.Schedules, job.Associations, job.Tiplocs)
+	}
+	if internalsync.IsRefreshingDatabase(db) {
+		t.Error("expected the lease to be released once the job finished")
+	}
+}
+
+func TestRefreshSchedules_RecordsFailedJob(t *testing.T) {
+	db := setupTestDB(t)
+
+	err := internalsync.RefreshSchedules(t.Context(), writeFeedFile(t, scheduleLine), db, t.TempDir(), false)
+	if !errors.Is(err, internalsync.ErrNoMetadata) {
+		t.Fatalf("expected ErrNoMetadata, got %v", err)
+	}
+
+	var job schedule.RefreshJob
+	if err := db.First(&job).Error; err != nil {
+		t.Fatalf("expected a refresh job to be recorded: %v", err)
+	}
+	if job.State != schedule.RefreshJobFailed || job.Error != internalsync.ErrNoMetadata.Error() {
+		t.Errorf("expected the job to have failed with ErrNoMetadata, got %+v", job)
+	}
+	if internalsync.IsRefreshingDatabase(db) {
+		t.Error("expected the lease to be released once the job failed")
+	}
+}
+
+func TestBeginRefresh_WhenBusy(t *testing.T) {
+	db := setupTestDB(t)
+	running, err := internalsync.BeginRefresh(db, "schedule.json")
+	if err != nil {
+		t.Fatalf("BeginRefresh: %v", err)
+	}
+	if !internalsync.IsRefreshingDatabase(db) {
+		t.Error("expected IsRefreshingDatabase() to return true while a job holds the lease")
+	}
+
+	if _, err := internalsync.BeginRefresh(db, "schedule.json"); !errors.Is(err, internalsync.ErrAlreadyRefreshing) {
+		t.Errorf("expected ErrAlreadyRefreshing, got %v", err)
+	}
+
+	var jobs []schedule.RefreshJob
+	db.Find(&jobs)
+	if len(jobs) != 1 || jobs[0].ID != running.ID || jobs[0].State != schedule.RefreshJobRunning {
+		t.Errorf("expected only the running job to be recorded, got %+v", jobs)
+	}
+}
+
+func TestBeginRefresh_TakesOverExpiredLease(t *testing.T) {
+	db := setupTestDB(t)
+	// A job left running by a process that stopped without releasing its lease
+	abandoned := schedule.RefreshJob{Filename: "schedule.json", State: schedule.RefreshJobRunning, StartedAt: time.Now().Add(-time.Hour)}
+	db.Create(&abandoned)
+	db.Create(&schedule.RefreshLease{Name: "schedule_feed", JobID: abandoned.ID, ExpiresAt: time.Now().Add(-time.Minute).Unix()})
+
+	job, err := internalsync.BeginRefresh(db, "schedule.json")
+	if err != nil {
+		t.Fatalf("expected the expired lease to be taken over, got %v", err)
+	}
+
+	var lease schedule.RefreshLease
+	db.First(&lease)
+	if lease.JobID != job.ID {
+		t.Errorf("expected the lease to be held by job %d, got %d", job.ID, lease.JobID)
+	}
+	db.First(&abandoned, abandoned.ID)
+	if abandoned.State != schedule.RefreshJobFailed || abandoned.FinishedAt == nil {
+		t.Errorf("expected the abandoned job to be marked as failed, got %+v", abandoned)
+	}
+}
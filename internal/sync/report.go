@@ -0,0 +1,174 @@
+package sync
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"time"
+	"uk-rail-schedule-api/internal/schedule"
+
+	"gorm.io/gorm"
+)
+
+// feedLoad follows a load of a feed file. Its progress is updated as the file is loaded, and saved to the refresh job
+// by reportRefreshProgress; the issues found in the file are collected to be saved once the job has finished.
+type feedLoad struct {
+	bytesRead  atomic.Int64
+	bytesTotal atomic.Int64
+	lines      atomic.Int64
+
+	// Only the first maxIssuesPerKind issues of each kind are kept, but they're all counted
+	issueCounts map[string]int64
+	issues      []schedule.RefreshIssue
+	// The keys of the records loaded, to find duplicates
+	seen map[string]struct{}
+}
+
+func newFeedLoad() *feedLoad {
+	return &feedLoad{issueCounts: make(map[string]int64), seen: make(map[string]struct{})}
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	io.Reader
+	n *atomic.Int64
+}
+
+func (r countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.n.Add(int64(n))
+	return n, err
+}
+
+// refreshProgressInterval is how often the progress of a running refresh job is saved.
+const refreshProgressInterval = 5 * time.Second
+
+// reportRefreshProgress saves the progress of a running job every refreshProgressInterval, with an estimate of when
+// it'll finish, until the returned function is called.
+func reportRefreshProgress(ctx context.Context, db *gorm.DB, job schedule.RefreshJob, load *feedLoad) func() {
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Go(func() {
+		ticker := time.NewTicker(refreshProgressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			read, total := load.bytesRead.Load(), load.bytesTotal.Load()
+			updates := map[string]any{"bytes_read": read, "bytes_total": total, "lines": load.lines.Load()}
+			if elapsed := time.Since(job.StartedAt); read > 0 && total > read {
+				updates["estimated_finish_at"] = time.Now().Add(time.Duration(float64(elapsed) * float64(total-read) / float64(read)))
+			}
+			if err := db.Model(&schedule.RefreshJob{}).Where("id = ?", job.ID).Updates(updates).Error; err != nil {
+				slog.Error("Failed to save refresh job progress", "error", err, "job", job.ID)
+			}
+		}
+	})
+	return func() {
+		close(done)
+		wg.Wait()
+	}
+}
+
+// maxIssuesPerKind is the number of issues of each kind kept from a feed file.
+const maxIssuesPerKind = 1000
+
+// add records an issue on a line of the file.
+func (l *feedLoad) add(kind string, line int64, key, detail string) {
+	l.issueCounts[kind]++
+	if l.issueCounts[kind] <= maxIssuesPerKind {
+		l.issues = append(l.issues, schedule.RefreshIssue{Kind: kind, Line: line, Key: key, Detail: detail})
+	}
+}
+
+// unparseable records a line that couldn't be parsed, with the start of it.
+func (l *feedLoad) unparseable(line int64, text []byte, err error) {
+	const maxExcerpt = 80
+	excerpt := string(text[:min(len(text), maxExcerpt)])
+	l.add(schedule.IssueUnparseableLine, line, "", fmt.Sprintf("%v: %q", err, excerpt))
+}
+
+// duplicate records a record whose key has already been loaded from the file. kind distinguishes the keys of
+// schedules, associations and tiplocs.
+func (l *feedLoad) duplicate(line int64, kind, key string) {
+	if _, ok := l.seen[kind+key]; ok {
+		l.add(schedule.IssueDuplicateKey, line, key, "another "+kind+" with the same key is earlier in the file")
+		return
+	}
+	l.seen[kind+key] = struct{}{}
+}
+
+var daysRunPattern = regexp.MustCompile(`^[01]{7}$`)
+
+// checkDates records an issue if a record's start or end date isn't a date, or it ends before it starts.
+func (l *feedLoad) checkDates(line int64, key, start, end string) {
+	startDate, startErr := time.Parse("2006-01-02", start)
+	endDate, endErr := time.Parse("2006-01-02", end)
+	switch {
+	case startErr != nil:
+		l.add(schedule.IssueInvalidDate, line, key, fmt.Sprintf("start date %q isn't a date", start))
+	case endErr != nil:
+		l.add(schedule.IssueInvalidDate, line, key, fmt.Sprintf("end date %q isn't a date", end))
+	case endDate.Before(startDate):
+		l.add(schedule.IssueInvalidDate, line, key, fmt.Sprintf("end date %s is before start date %s", end, start))
+	}
+}
+
+// checkDaysRun records an issue if a days run string isn't seven 0s and 1s, one for each day from Monday.
+func (l *feedLoad) checkDaysRun(line int64, key, daysRun string) {
+	if !daysRunPattern.MatchString(daysRun) {
+		l.add(schedule.IssueInvalidDaysRun, line, key, fmt.Sprintf("days run %q isn't seven 0s and 1s", daysRun))
+	}
+}
+
+// checkSchedule records any issues with the dates and days run of a schedule. Deletions only identify the schedule
+// they delete, so they aren't checked.
+func (l *feedLoad) checkSchedule(line int64, sch schedule.Schedule) {
+	if sch.TransactionType == "Delete" {
+		return
+	}
+	l.checkDaysRun(line, sch.CombinedID, sch.ScheduleDaysRuns)
+	l.checkDates(line, sch.CombinedID, sch.ScheduleStartDate, sch.ScheduleEndDate)
+}
+
+// checkAssociation records any issues with the dates and days of an association.
+func (l *feedLoad) checkAssociation(line int64, assoc schedule.Association) {
+	if assoc.TransactionType == "Delete" {
+		return
+	}
+	l.checkDaysRun(line, assoc.CombinedID, assoc.AssocDays)
+	l.checkDates(line, assoc.CombinedID, assoc.AssocStartDate, assoc.AssocEndDate)
+}
+
+// checkTiplocs records the schedules from the feed in the database that call at tiplocs which aren't in it.
+func (l *feedLoad) checkTiplocs(db *gorm.DB) error {
+	rows, err := db.Table("schedule_locations").
+		Select("DISTINCT schedules.combined_id, schedule_locations.tiploc_code").
+		Joins("JOIN schedules ON schedules.id = schedule_locations.schedule_id").
+		Joins("LEFT JOIN tiplocs ON tiplocs.tiploc_code = schedule_locations.tiploc_code").
+		Where("schedules.source = ? AND tiplocs.tiploc_code IS NULL", "Feed").
+		Order("schedules.combined_id").
+		Rows()
+	if err != nil {
+		return fmt.Errorf("error looking for unknown tiplocs: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var combinedID, tiplocCode string
+		if err := rows.Scan(&combinedID, &tiplocCode); err != nil {
+			return fmt.Errorf("error looking for unknown tiplocs: %w", err)
+		}
+		l.add(schedule.IssueUnknownTiploc, 0, combinedID, fmt.Sprintf("calls at tiploc %s, which isn't in the feed", tiplocCode))
+	}
+	return rows.Err()
+}
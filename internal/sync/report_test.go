@@ -0,0 +1,121 @@
+package sync_test
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"uk-rail-schedule-api/internal/schedule"
+	internalsync "uk-rail-schedule-api/internal/sync"
+)
+
+func TestRefreshSchedules_ReportsIssuesInFeed(t *testing.T) {
+	db := setupTestDB(t)
+	feedFile := writeFeedFile(t,
+		metadataLine,
+		scheduleLine,
+		`{"JsonScheduleV1":`,
+		strings.NewReplacer(`"C00206"`, `"C00207"`, `"schedule_days_runs":"0000001"`, `"schedule_days_runs":"000001"`).Replace(scheduleLine),
+		strings.NewReplacer(`"C00206"`, `"C00208"`, `"schedule_end_date":"2099-12-31"`, `"schedule_end_date":"2022-12-31"`).Replace(scheduleLine),
+		scheduleLine,
+		tiplocLine,
+		strings.Replace(tiplocLine, `"tiploc_code":"DRBY"`, `"tiploc_code":"LEEDS"`, 1),
+		// Calls at a tiploc that isn't in the feed
+		strings.NewReplacer(`"C00206"`, `"C00209"`, `"tiploc_code":"DRBY"`, `"tiploc_code":"NOWHERE"`).Replace(scheduleLine),
+	)
+	if err := internalsync.RefreshSchedules(t.Context(), feedFile, db, t.TempDir(), false); err != nil {
+		t.Fatalf("RefreshSchedules: %v", err)
+	}
+
+	var job schedule.RefreshJob
+	db.First(&job)
+	want := map[string]int64{
+		schedule.IssueUnparseableLine: 1,
+		schedule.IssueInvalidDaysRun:  1,
+		schedule.IssueInvalidDate:     1,
+		schedule.IssueDuplicateKey:    1,
+		schedule.IssueUnknownTiploc:   1,
+	}
+	for kind, count := range want {
+		if job.IssueCounts[kind] != count {
+			t.Errorf("expected %d %s issues, got %d", count, kind, job.IssueCounts[kind])
+		}
+	}
+	if len(job.IssueCounts) != len(want) {
+		t.Errorf("expected only the issues in the feed, got %v", job.IssueCounts)
+	}
+
+	var issues []schedule.RefreshIssue
+	db.Where("job_id = ?", job.ID).Order("id").Find(&issues)
+	lines := map[string]int64{}
+	keys := map[string]string{}
+	for _, issue := range issues {
+		lines[issue.Kind], keys[issue.Kind] = issue.Line, issue.Key
+	}
+	wantLines := map[string]int64{
+		schedule.IssueUnparseableLine: 3,
+		schedule.IssueInvalidDaysRun:  4,
+		schedule.IssueInvalidDate:     5,
+		schedule.IssueDuplicateKey:    6,
+		schedule.IssueUnknownTiploc:   0,
+	}
+	for kind, line := range wantLines {
+		if lines[kind] != line {
+			t.Errorf("expected the %s issue on line %d, got %d", kind, line, lines[kind])
+		}
+	}
+	if !strings.HasPrefix(keys[schedule.IssueUnknownTiploc], "C00209") {
+		t.Errorf("expected the schedule calling at the unknown tiploc to be reported, got %q", keys[schedule.IssueUnknownTiploc])
+	}
+
+	// The records with issues are still loaded, apart from the line that couldn't be parsed
+	if count := countSchedules(db); count != 4 {
+		t.Errorf("expected 4 schedules, got %d", count)
+	}
+}
+
+func TestRefreshSchedules_ReportsIssuesInUpdate(t *testing.T) {
+	db := setupTestDB(t)
+	internalsync.RefreshSchedules(t.Context(), writeFeedFile(t, metadataLine, scheduleLine, tiplocLine), db, t.TempDir(), false)
+
+	if err := internalsync.RefreshSchedules(t.Context(), writeFeedFile(t, updateMetadataLine, createScheduleLine, "not json"), db, t.TempDir(), false); err != nil {
+		t.Fatalf("RefreshSchedules: %v", err)
+	}
+
+	var job schedule.RefreshJob
+	db.Last(&job)
+	var issues []schedule.RefreshIssue
+	db.Where("job_id = ?", job.ID).Find(&issues)
+	if len(issues) != 1 || issues[0].Kind != schedule.IssueUnparseableLine || issues[0].Line != 3 {
+		t.Errorf("expected the unparseable line 3 to be reported, got %+v", issues)
+	}
+}
+
+func TestRefreshSchedules_RecordsProgress(t *testing.T) {
+	db := setupTestDB(t)
+	for name, feed := range map[string]func(lines ...string) string{
+		"plain": func(lines ...string) string { return writeFeedFile(t, lines...) },
+		"gzipped": func(lines ...string) string {
+			filename := writeFeedFile(t)
+			os.WriteFile(filename, gzipFeed(t, lines...), 0644)
+			return filename
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			db.Where("1 = 1").Delete(&schedule.Timetable{})
+			feedFile := feed(metadataLine, tiplocLine, scheduleLine, associationLine)
+			if err := internalsync.RefreshSchedules(t.Context(), feedFile, db, t.TempDir(), false); err != nil {
+				t.Fatalf("RefreshSchedules: %v", err)
+			}
+
+			var job schedule.RefreshJob
+			db.Last(&job)
+			info, _ := os.Stat(feedFile)
+			if job.BytesTotal != info.Size() || job.BytesRead != job.BytesTotal || job.PercentRead() != 100 {
+				t.Errorf("expected all %d bytes of the file to have been read, got %d of %d", info.Size(), job.BytesRead, job.BytesTotal)
+			}
+			if job.Lines != 3 {
+				t.Errorf("expected the 3 lines after the metadata to be counted, got %d", job.Lines)
+			}
+		})
+	}
+}
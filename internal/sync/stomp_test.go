@@ -0,0 +1,467 @@
+package sync_test
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"uk-rail-schedule-api/internal/db"
+	"uk-rail-schedule-api/internal/schedule"
+	internalsync "uk-rail-schedule-api/internal/sync"
+
+	"github.com/go-stomp/stomp/v3/frame"
+	"gorm.io/gorm"
+)
+
+// stompStandIn is an in-process STOMP broker standing in for the Network Rail feed. Like the real broker, it sends
+// each subscription one message at a time, waiting for it to be acked or nacked, and redelivers nacked and
+// unacknowledged messages with the same message-id.
+type stompStandIn struct {
+	addr string
+
+	mu      sync.Mutex
+	queues  map[string][]stompMessage
+	nextID  int
+	acks    int
+	nacks   int
+	changed chan struct{}
+	// The number of clients that have disconnected cleanly
+	disconnects int
+	// The headers of the CONNECT and SUBSCRIBE frames received
+	connects   []*frame.Header
+	subscribes []*frame.Header
+}
+
+type stompMessage struct {
+	id   string
+	body []byte
+}
+
+// startStompStandIn starts a stompStandIn listening on a local port.
+func startStompStandIn(t *testing.T) *stompStandIn {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("failed to listen for STOMP connections:", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	s := &stompStandIn{addr: l.Addr().String(), queues: make(map[string][]stompMessage), changed: make(chan struct{})}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+// publish queues a message to destination for delivery to the next subscriber that's ready for one.
+func (s *stompStandIn) publish(destination string, body []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nextID++
+	s.queues[destination] = append(s.queues[destination], stompMessage{id: strconv.Itoa(s.nextID), body: body})
+	s.notify()
+}
+
+// requeue puts a message back at the front of its destination's queue, for redelivery.
+func (s *stompStandIn) requeue(destination string, msg stompMessage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.queues[destination] = append([]stompMessage{msg}, s.queues[destination]...)
+	s.notify()
+}
+
+// notify wakes everything waiting for a message. It must be called with mu held.
+func (s *stompStandIn) notify() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// take removes the next message from destination's queue, waiting for one if it's empty. It returns false if done
+// is closed first.
+func (s *stompStandIn) take(destination string, done <-chan struct{}) (stompMessage, bool) {
+	for {
+		s.mu.Lock()
+		if queue := s.queues[destination]; len(queue) > 0 {
+			s.queues[destination] = queue[1:]
+			s.mu.Unlock()
+			return queue[0], true
+		}
+		changed := s.changed
+		s.mu.Unlock()
+		select {
+		case <-changed:
+		case <-done:
+			return stompMessage{}, false
+		}
+	}
+}
+
+func (s *stompStandIn) counts() (acks, nacks int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.acks, s.nacks
+}
+
+func (s *stompStandIn) headers() (connects, subscribes []*frame.Header) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.connects, s.subscribes
+}
+
+// stompConn is a client connection to the stand-in.
+type stompConn struct {
+	writeMu sync.Mutex
+	writer  *frame.Writer
+	// The channels waiting for the ACK or NACK of each message delivered, by ack id
+	mu      sync.Mutex
+	replies map[string]chan *frame.Frame
+	done    chan struct{}
+}
+
+func (c *stompConn) write(f *frame.Frame) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.writer.Write(f)
+}
+
+func (s *stompStandIn) serve(netConn net.Conn) {
+	defer netConn.Close()
+	reader := frame.NewReader(netConn)
+	conn := &stompConn{writer: frame.NewWriter(netConn), replies: make(map[string]chan *frame.Frame), done: make(chan struct{})}
+	defer close(conn.done)
+
+	for {
+		f, err := reader.Read()
+		if err != nil {
+			return
+		}
+		if f == nil {
+			// heart-beat
+			continue
+		}
+		switch f.Command {
+		case frame.CONNECT, frame.STOMP:
+			s.mu.Lock()
+			s.connects = append(s.connects, f.Header.Clone())
+			s.mu.Unlock()
+			conn.write(frame.New(frame.CONNECTED, frame.Version, "1.2", frame.HeartBeat, "0,0"))
+		case frame.SUBSCRIBE:
+			s.mu.Lock()
+			s.subscribes = append(s.subscribes, f.Header.Clone())
+			s.mu.Unlock()
+			go s.deliver(conn, f.Header.Get(frame.Id), f.Header.Get(frame.Destination))
+		case frame.ACK, frame.NACK:
+			conn.mu.Lock()
+			reply := conn.replies[f.Header.Get(frame.Id)]
+			conn.mu.Unlock()
+			if reply != nil {
+				reply <- f
+			}
+		case frame.DISCONNECT:
+			s.mu.Lock()
+			s.disconnects++
+			s.mu.Unlock()
+			if receipt := f.Header.Get(frame.Receipt); receipt != "" {
+				conn.write(frame.New(frame.RECEIPT, frame.ReceiptId, receipt))
+			}
+			return
+		}
+	}
+}
+
+// deliver sends destination's messages to a subscription one at a time, until the connection is closed.
+func (s *stompStandIn) deliver(conn *stompConn, subscription, destination string) {
+	for {
+		msg, ok := s.take(destination, conn.done)
+		if !ok {
+			return
+		}
+
+		reply := make(chan *frame.Frame, 1)
+		conn.mu.Lock()
+		conn.replies[msg.id] = reply
+		conn.mu.Unlock()
+
+		f := frame.New(frame.MESSAGE,
+			frame.Destination, destination,
+			frame.Subscription, subscription,
+			frame.MessageId, msg.id,
+			frame.Ack, msg.id,
+			frame.ContentType, "application/json")
+		f.Body = msg.body
+		if err := conn.write(f); err != nil {
+			s.requeue(destination, msg)
+			return
+		}
+
+		select {
+		case r := <-reply:
+			s.mu.Lock()
+			if r.Command == frame.ACK {
+				s.acks++
+			} else {
+				s.nacks++
+			}
+			s.mu.Unlock()
+			if r.Command == frame.NACK {
+				s.requeue(destination, msg)
+			}
+		case <-conn.done:
+			s.requeue(destination, msg)
+			return
+		}
+		conn.mu.Lock()
+		delete(conn.replies, msg.id)
+		conn.mu.Unlock()
+	}
+}
+
+// openTestDB returns a database in a file, which, unlike an in-memory database, is shared by all the connections
+// the listener and test make.
+func openTestDB(t testing.TB) *gorm.DB {
+	t.Helper()
+	database, err := db.Open(filepath.Join(t.TempDir(), "ukra.db"))
+	if err != nil {
+		t.Fatal("failed to open test database:", err)
+	}
+	return database
+}
+
+// waitFor polls cond until it's true, failing the test if it isn't within a few seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatal("timed out waiting for", what)
+}
+
+func countSchedules(database *gorm.DB) int64 {
+	var count int64
+	database.Model(&schedule.Schedule{}).Count(&count)
+	return count
+}
+
+// standInOptions returns the options to connect to the stand-in and subscribe to destinations.
+func standInOptions(broker *stompStandIn, destinations ...string) internalsync.StompOptions {
+	return internalsync.StompOptions{URL: broker.addr, Login: "user", Password: "password", Destinations: destinations}
+}
+
+func TestListenForVSTP_StoresAcksAndDeadLettersMessages(t *testing.T) {
+	broker := startStompStandIn(t)
+	database := openTestDB(t)
+	dataDir := t.TempDir()
+
+	go internalsync.ListenForVSTP(t.Context(), database, standInOptions(broker, "/topic/VSTP_ALL"), dataDir)
+
+	broker.publish("/topic/VSTP_ALL", vstpMessage("Create", "msg-1"))
+	waitFor(t, "the VSTP schedule to be stored", func() bool { return countSchedules(database) == 1 })
+
+	// A message that can never be stored goes to the dead letter directory rather than being redelivered
+	broker.publish("/topic/VSTP_ALL", []byte("not valid json {{{"))
+	waitFor(t, "the invalid message to be dead lettered", func() bool {
+		files, _ := os.ReadDir(filepath.Join(dataDir, "dead-letter"))
+		return len(files) == 1
+	})
+
+	// The next message is only delivered once the ones before it have been acknowledged
+	broker.publish("/topic/VSTP_ALL", vstpMessage("Delete", "msg-2"))
+	waitFor(t, "the VSTP delete to be applied", func() bool { return countSchedules(database) == 0 })
+	waitFor(t, "the VSTP delete to be acknowledged", func() bool {
+		acks, _ := broker.counts()
+		return acks == 3
+	})
+	if _, nacks := broker.counts(); nacks != 0 {
+		t.Errorf("expected no messages to be nacked, got %d", nacks)
+	}
+
+	files, err := os.ReadDir(dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stored []string
+	for _, f := range files {
+		if strings.HasSuffix(f.Name(), ".tmp") {
+			t.Errorf("expected no temporary files to be left in the data directory, found %s", f.Name())
+		}
+		if strings.HasPrefix(f.Name(), "vstp-") {
+			stored = append(stored, f.Name())
+		}
+	}
+	if len(stored) != 2 {
+		t.Errorf("expected the create and delete messages to be written to the data directory, found %v", stored)
+	}
+
+	deadLetters, _ := os.ReadDir(filepath.Join(dataDir, "dead-letter"))
+	data, err := os.ReadFile(filepath.Join(dataDir, "dead-letter", deadLetters[0].Name()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "not valid json {{{" {
+		t.Errorf("expected the dead letter to hold the invalid message, got %q", data)
+	}
+}
+
+func TestListenForVSTP_RedeliversMessagesThatFailToStore(t *testing.T) {
+	broker := startStompStandIn(t)
+	database := openTestDB(t)
+	// The data directory doesn't exist yet, so the message can't be written to disk
+	dataDir := filepath.Join(t.TempDir(), "data")
+
+	go internalsync.ListenForVSTP(t.Context(), database, standInOptions(broker, "/topic/VSTP_ALL"), dataDir)
+
+	broker.publish("/topic/VSTP_ALL", vstpMessage("Create", "msg-1"))
+	time.Sleep(200 * time.Millisecond)
+	if count := countSchedules(database); count != 0 {
+		t.Fatalf("expected the message not to be applied until it could be written to disk, got %d schedules", count)
+	}
+
+	if err := os.Mkdir(dataDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the redelivered message to be stored", func() bool { return countSchedules(database) == 1 })
+	waitFor(t, "the redelivered message to be acknowledged", func() bool {
+		acks, _ := broker.counts()
+		return acks == 1
+	})
+
+	if _, nacks := broker.counts(); nacks == 0 {
+		t.Error("expected the message to be nacked before it could be stored")
+	}
+	if _, err := os.Stat(filepath.Join(dataDir, "dead-letter")); !os.IsNotExist(err) {
+		t.Errorf("expected the message not to be dead lettered, got %v", err)
+	}
+}
+
+func TestListenForVSTP_RollsBackMessageWhoseFileCantBeStored(t *testing.T) {
+	broker := startStompStandIn(t)
+	database := openTestDB(t)
+	dataDir := t.TempDir()
+
+	// The temporary file goes just before it would be moved into place, once the message has been applied
+	err := database.Callback().Create().After("gorm:create").Register("test:remove_vstp_file", func(tx *gorm.DB) {
+		if tx.Statement.Table != "processed_vstp_messages" {
+			return
+		}
+		tmps, _ := filepath.Glob(filepath.Join(dataDir, ".vstp-*.tmp"))
+		for _, tmp := range tmps {
+			os.Remove(tmp)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go internalsync.ListenForVSTP(t.Context(), database, standInOptions(broker, "/topic/VSTP_ALL"), dataDir)
+
+	broker.publish("/topic/VSTP_ALL", vstpMessage("Create", "msg-1"))
+	waitFor(t, "the message to be nacked", func() bool {
+		_, nacks := broker.counts()
+		return nacks > 0
+	})
+
+	if count := countSchedules(database); count != 0 {
+		t.Errorf("expected the schedule to be rolled back without a file to replay, got %d schedules", count)
+	}
+	stored, _ := filepath.Glob(filepath.Join(dataDir, "vstp-*.json"))
+	if len(stored) != 0 {
+		t.Errorf("expected no file for the message, found %v", stored)
+	}
+}
+
+func TestListenForVSTP_SubscribesDurablyToEachDestination(t *testing.T) {
+	broker := startStompStandIn(t)
+	database := openTestDB(t)
+
+	opts := standInOptions(broker, "/topic/VSTP_ALL", "/queue/VSTP_REPLAY")
+	opts.ClientID = "syncd-test"
+	go internalsync.ListenForVSTP(t.Context(), database, opts, t.TempDir())
+
+	broker.publish("/topic/VSTP_ALL", vstpMessage("Create", "msg-1"))
+	replayed := strings.Replace(string(vstpMessage("Create", "msg-2")), `"CIF_train_uid": "T99999"`, `"CIF_train_uid": "T88888"`, 1)
+	broker.publish("/queue/VSTP_REPLAY", []byte(replayed))
+	waitFor(t, "the messages from both destinations to be stored", func() bool { return countSchedules(database) == 2 })
+
+	connects, subscribes := broker.headers()
+	if len(connects) != 1 || connects[0].Get("client-id") != "syncd-test" {
+		t.Errorf("expected one connection with client-id syncd-test, got %v", connects)
+	}
+	names := map[string]string{}
+	for _, header := range subscribes {
+		names[header.Get(frame.Destination)] = header.Get("activemq.subscriptionName")
+		if ack := header.Get(frame.Ack); ack != "client-individual" {
+			t.Errorf("expected subscriptions to acknowledge messages individually, got %q", ack)
+		}
+	}
+	expected := map[string]string{
+		"/topic/VSTP_ALL":    "syncd-test-topic.VSTP_ALL",
+		"/queue/VSTP_REPLAY": "syncd-test-queue.VSTP_REPLAY",
+	}
+	for destination, name := range expected {
+		if names[destination] != name {
+			t.Errorf("expected durable subscription %q to %s, got %q", name, destination, names[destination])
+		}
+	}
+}
+
+func TestListenForVSTP_SubscriptionsAreNotDurableWithoutClientID(t *testing.T) {
+	broker := startStompStandIn(t)
+	database := openTestDB(t)
+
+	go internalsync.ListenForVSTP(t.Context(), database, standInOptions(broker, "/topic/VSTP_ALL"), t.TempDir())
+
+	broker.publish("/topic/VSTP_ALL", vstpMessage("Create", "msg-1"))
+	waitFor(t, "the message to be stored", func() bool { return countSchedules(database) == 1 })
+
+	connects, subscribes := broker.headers()
+	if _, ok := connects[0].Contains("client-id"); ok {
+		t.Error("expected no client-id without a client id configured")
+	}
+	if _, ok := subscribes[0].Contains("activemq.subscriptionName"); ok {
+		t.Error("expected no durable subscription without a client id configured")
+	}
+}
+
+func TestListenForVSTP_DisconnectsWhenCancelled(t *testing.T) {
+	broker := startStompStandIn(t)
+	database := openTestDB(t)
+
+	ctx, cancel := context.WithCancel(t.Context())
+	stopped := make(chan struct{})
+	go func() {
+		internalsync.ListenForVSTP(ctx, database, standInOptions(broker, "/topic/VSTP_ALL"), t.TempDir())
+		close(stopped)
+	}()
+
+	broker.publish("/topic/VSTP_ALL", vstpMessage("Create", "msg-1"))
+	waitFor(t, "the message to be stored", func() bool { return countSchedules(database) == 1 })
+
+	cancel()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the listener to stop")
+	}
+
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+	if broker.disconnects != 1 {
+		t.Errorf("expected the listener to disconnect cleanly, got %d disconnects", broker.disconnects)
+	}
+}
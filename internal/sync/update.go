@@ -0,0 +1,144 @@
+package sync
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+	"uk-rail-schedule-api/internal/schedule"
+
+	"gorm.io/gorm"
+)
+
+var (
+	ErrNoFullTimetable = errors.New("a full extract must be loaded before a daily update can be applied")
+	ErrSequenceGap     = errors.New("daily update is out of sequence - an update has been missed")
+)
+
+// applyUpdate applies the records of a daily update file (CIF_ALL_UPDATE_DAILY) on top of the schedules already in
+// the database. The update's sequence number must directly follow the last timetable loaded; an update that has
+// already been applied is skipped, and one that would leave a gap is rejected so a missed day can't silently corrupt
+// the data. The whole update is applied in a single transaction, which is abandoned if ctx is cancelled, so the
+// counts of the records applied are only returned once it has been committed. Issues with the records are added to
+// load.
+func applyUpdate(ctx context.Context, scanner *bufio.Scanner, db *gorm.DB, timetable schedule.Timetable, load *feedLoad) (feedCounts, error) {
+	var latest schedule.Timetable
+	if err := db.Order("timestamp desc").First(&latest).Error; err != nil {
+		slog.Error("No timetable has been loaded, cannot apply daily update", "sequence", timetable.Metadata.Sequence)
+		return feedCounts{}, ErrNoFullTimetable
+	}
+
+	switch {
+	case latest.Metadata.Sequence == 0:
+		// Timetables loaded before sequence numbers were recorded can't be checked
+		slog.Warn("Latest timetable has no sequence number - applying update without sequence check", "sequence", timetable.Metadata.Sequence)
+	case timetable.Metadata.Sequence <= latest.Metadata.Sequence:
+		slog.Info("Daily update has already been applied, so it won't be loaded.", "sequence", timetable.Metadata.Sequence, "latest_sequence", latest.Metadata.Sequence)
+		return feedCounts{}, nil
+	case timetable.Metadata.Sequence != latest.Metadata.Sequence+1:
+		slog.Error("Daily update is out of sequence", "sequence", timetable.Metadata.Sequence, "expected_sequence", latest.Metadata.Sequence+1)
+		return feedCounts{}, fmt.Errorf("%w: expected sequence %d, got %d", ErrSequenceGap, latest.Metadata.Sequence+1, timetable.Metadata.Sequence)
+	}
+
+	publishedAt := time.Unix(int64(timetable.Timestamp), 0)
+	var created, deleted, tiplocCount, associationCount int64
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		// The metadata is on the first line of the file
+		for line := int64(2); scanner.Scan(); line++ {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			load.lines.Store(line - 1)
+
+			var record schedule.ScheduleFeedRecord
+			if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+				slog.Error("Error unmarshaling scheduleFeedRecord JSON", "error", err, "line", line)
+				load.unparseable(line, scanner.Bytes(), err)
+				continue
+			}
+
+			if record.IsSchedule() {
+				sch := record.JSONScheduleV1.ToSchedule(publishedAt)
+				sch.AugmentSchedule()
+				load.checkSchedule(line, sch)
+
+				removed, err := deleteSchedule(tx, sch.CombinedID, "Feed")
+				if err != nil {
+					return err
+				}
+				if sch.TransactionType == "Delete" {
+					// A delete for a schedule that isn't there removes nothing
+					deleted += int64(len(removed))
+					continue
+				}
+				if err := tx.Create(&sch).Error; err != nil {
+					return fmt.Errorf("error creating schedule %s: %w", sch.CombinedID, err)
+				}
+				created++
+			}
+
+			if record.IsAssociation() {
+				assoc := record.Association.ToAssociation(publishedAt)
+				assoc.AugmentAssociation()
+				load.checkAssociation(line, assoc)
+
+				if err := tx.Where("combined_id = ? AND source = ?", assoc.CombinedID, "Feed").Delete(&schedule.Association{}).Error; err != nil {
+					return fmt.Errorf("error deleting association %s: %w", assoc.CombinedID, err)
+				}
+				if assoc.TransactionType != "Delete" {
+					if err := tx.Create(&assoc).Error; err != nil {
+						return fmt.Errorf("error creating association %s: %w", assoc.CombinedID, err)
+					}
+				}
+				associationCount++
+			}
+
+			if record.IsTiploc() {
+				if err := tx.Where("tiploc_code = ?", record.Tiploc.TiplocCode).Delete(&schedule.Tiploc{}).Error; err != nil {
+					return fmt.Errorf("error deleting tiploc %s: %w", record.Tiploc.TiplocCode, err)
+				}
+				if record.Tiploc.TransactionType != "Delete" {
+					if err := tx.Create(&record.Tiploc).Error; err != nil {
+						return fmt.Errorf("error creating tiploc %s: %w", record.Tiploc.TiplocCode, err)
+					}
+				}
+				tiplocCount++
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return fmt.Errorf("error reading daily update: %w", err)
+		}
+
+		return tx.Create(&timetable).Error
+	})
+	if err != nil {
+		slog.Error("Failed to apply daily update - no changes have been made", "error", err, "sequence", timetable.Metadata.Sequence)
+		return feedCounts{}, err
+	}
+
+	slog.Info("Applied daily update", "sequence", timetable.Metadata.Sequence, "created", created, "deleted", deleted, "tiplocs", tiplocCount, "associations", associationCount)
+	return feedCounts{schedules: created + deleted, tiplocs: tiplocCount, associations: associationCount}, nil
+}
+
+// deleteSchedule removes the schedules from source identified by combinedID (UID, start date and STP indicator),
+// along with their locations, and returns the IDs of the schedules removed.
+func deleteSchedule(tx *gorm.DB, combinedID, source string) ([]uint64, error) {
+	var ids []uint64
+	if err := tx.Model(&schedule.Schedule{}).Where("combined_id = ? AND source = ?", combinedID, source).Pluck("id", &ids).Error; err != nil {
+		return nil, fmt.Errorf("error finding schedule %s: %w", combinedID, err)
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	if err := tx.Where("schedule_id IN ?", ids).Delete(&schedule.ScheduleLocation{}).Error; err != nil {
+		return nil, fmt.Errorf("error deleting locations for schedule %s: %w", combinedID, err)
+	}
+	if err := tx.Delete(&schedule.Schedule{}, ids).Error; err != nil {
+		return nil, fmt.Errorf("error deleting schedule %s: %w", combinedID, err)
+	}
+	return ids, nil
+}
@@ -0,0 +1,185 @@
+package sync_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"uk-rail-schedule-api/internal/schedule"
+	internalsync "uk-rail-schedule-api/internal/sync"
+)
+
+// Daily update lines. The full extract in metadataLine has sequence 1.
+const (
+	updateMetadataLine = `{"JsonTimetableV1":{"classification":"public","timestamp":1683129600,"owner":"Network Rail","Sender":{"organisation":"Rockshore","application":"NTROD","component":"SCHEDULE"},"Metadata":{"type":"update","sequence":2}}}`
+
+	deleteScheduleLine = `{"JsonScheduleV1":{"CIF_train_uid":"C00206","schedule_start_date":"2023-01-01","CIF_stp_indicator":"P","transaction_type":"Delete"}}`
+
+	createScheduleLine = `{"JsonScheduleV1":{"CIF_bank_holiday_running":"","CIF_stp_indicator":"O","CIF_train_uid":"C00206","applicable_timetable":"Y","atoc_code":"GW","new_schedule_segment":{"traction_class":"","uic_code":""},"schedule_days_runs":"0000001","schedule_end_date":"2023-05-21","schedule_segment":{"signalling_id":"2A21","CIF_train_category":"OO","CIF_power_type":"DMU","schedule_location":[{"record_identity":"LO","tiploc_code":"DRBY","departure":"0806","public_departure":"0806"}]},"schedule_start_date":"2023-05-21","train_status":"P","transaction_type":"Create"}}`
+
+	deleteTiplocLine = `{"TiplocV1":{"transaction_type":"Delete","tiploc_code":"DRBY"}}`
+)
+
+func updateMetadata(sequence string) string {
+	return strings.Replace(updateMetadataLine, `"sequence":2`, `"sequence":`+sequence, 1)
+}
+
+func TestRefreshSchedules_UpdateWithoutFullExtract(t *testing.T) {
+	db := setupTestDB(t)
+	updateFile := writeFeedFile(t, updateMetadataLine, createScheduleLine)
+
+	err := internalsync.RefreshSchedules(t.Context(), updateFile, db, t.TempDir(), false)
+	if !errors.Is(err, internalsync.ErrNoFullTimetable) {
+		t.Errorf("expected ErrNoFullTimetable, got %v", err)
+	}
+
+	var count int64
+	db.Model(&schedule.Schedule{}).Count(&count)
+	if count != 0 {
+		t.Errorf("expected 0 schedules when no full extract has been loaded, got %d", count)
+	}
+}
+
+func TestRefreshSchedules_UpdateAppliesCreateAndDelete(t *testing.T) {
+	db := setupTestDB(t)
+	internalsync.RefreshSchedules(t.Context(), writeFeedFile(t, metadataLine, scheduleLine, tiplocLine), db, t.TempDir(), false)
+
+	updateFile := writeFeedFile(t, updateMetadataLine, deleteScheduleLine, createScheduleLine, deleteTiplocLine)
+	if err := internalsync.RefreshSchedules(t.Context(), updateFile, db, t.TempDir(), false); err != nil {
+		t.Fatalf("expected update to apply, got: %v", err)
+	}
+
+	var schedules []schedule.Schedule
+	db.Find(&schedules)
+	if len(schedules) != 1 {
+		t.Fatalf("expected 1 schedule after update, got %d", len(schedules))
+	}
+	if schedules[0].CombinedID != "C002062023-05-21O" {
+		t.Errorf("expected only the created overlay to remain, got %q", schedules[0].CombinedID)
+	}
+
+	var locationCount int64
+	db.Model(&schedule.ScheduleLocation{}).Count(&locationCount)
+	if locationCount != 1 {
+		t.Errorf("expected the deleted schedule's locations to be removed, got %d locations", locationCount)
+	}
+
+	var tiplocCount int64
+	db.Model(&schedule.Tiploc{}).Count(&tiplocCount)
+	if tiplocCount != 0 {
+		t.Errorf("expected deleted tiploc to be removed, got %d", tiplocCount)
+	}
+
+	var latest schedule.Timetable
+	db.Order("timestamp desc").First(&latest)
+	if latest.Metadata.Sequence != 2 {
+		t.Errorf("expected update sequence 2 to be recorded, got %d", latest.Metadata.Sequence)
+	}
+}
+
+func TestRefreshSchedules_UpdateCountsOnlySchedulesDeleted(t *testing.T) {
+	db := setupTestDB(t)
+	internalsync.RefreshSchedules(t.Context(), writeFeedFile(t, metadataLine, scheduleLine, tiplocLine), db, t.TempDir(), false)
+
+	// The second delete is for a schedule that has already gone
+	updateFile := writeFeedFile(t, updateMetadataLine, deleteScheduleLine, deleteScheduleLine)
+	if err := internalsync.RefreshSchedules(t.Context(), updateFile, db, t.TempDir(), false); err != nil {
+		t.Fatalf("expected update to apply, got: %v", err)
+	}
+
+	var job schedule.RefreshJob
+	if err := db.Order("id desc").First(&job).Error; err != nil {
+		t.Fatal(err)
+	}
+	if job.Schedules != 1 {
+		t.Errorf("expected the update to count 1 schedule deleted, got %d", job.Schedules)
+	}
+}
+
+func TestRefreshSchedules_UpdateCreateReplacesExistingSchedule(t *testing.T) {
+	db := setupTestDB(t)
+	internalsync.RefreshSchedules(t.Context(), writeFeedFile(t, metadataLine, scheduleLine), db, t.TempDir(), false)
+
+	recreated := strings.Replace(scheduleLine, `"signalling_id":"2A20"`, `"signalling_id":"2A99"`, 1)
+	if err := internalsync.RefreshSchedules(t.Context(), writeFeedFile(t, updateMetadataLine, recreated), db, t.TempDir(), false); err != nil {
+		t.Fatalf("expected update to apply, got: %v", err)
+	}
+
+	var schedules []schedule.Schedule
+	db.Find(&schedules)
+	if len(schedules) != 1 {
+		t.Fatalf("expected the schedule to be replaced rather than duplicated, got %d", len(schedules))
+	}
+	if schedules[0].SignallingID != "2A99" {
+		t.Errorf("expected SignallingID '2A99', got %q", schedules[0].SignallingID)
+	}
+}
+
+func TestRefreshSchedules_UpdateDeletesAssociation(t *testing.T) {
+	db := setupTestDB(t)
+	internalsync.RefreshSchedules(t.Context(), writeFeedFile(t, metadataLine, scheduleLine, associationLine), db, t.TempDir(), false)
+
+	deleteAssociation := strings.Replace(associationLine, `"transaction_type":"Create"`, `"transaction_type":"Delete"`, 1)
+	if err := internalsync.RefreshSchedules(t.Context(), writeFeedFile(t, updateMetadataLine, deleteAssociation), db, t.TempDir(), false); err != nil {
+		t.Fatalf("expected update to apply, got: %v", err)
+	}
+
+	var count int64
+	db.Model(&schedule.Association{}).Count(&count)
+	if count != 0 {
+		t.Errorf("expected deleted association to be removed, got %d", count)
+	}
+}
+
+func TestRefreshSchedules_UpdateSequenceGap(t *testing.T) {
+	db := setupTestDB(t)
+	internalsync.RefreshSchedules(t.Context(), writeFeedFile(t, metadataLine, scheduleLine), db, t.TempDir(), false)
+
+	updateFile := writeFeedFile(t, updateMetadata("3"), deleteScheduleLine)
+	err := internalsync.RefreshSchedules(t.Context(), updateFile, db, t.TempDir(), false)
+	if !errors.Is(err, internalsync.ErrSequenceGap) {
+		t.Errorf("expected ErrSequenceGap, got %v", err)
+	}
+
+	var count int64
+	db.Model(&schedule.Schedule{}).Count(&count)
+	if count != 1 {
+		t.Errorf("expected no changes when an update is missed, got %d schedules", count)
+	}
+}
+
+func TestRefreshSchedules_UpdateAlreadyApplied(t *testing.T) {
+	db := setupTestDB(t)
+	internalsync.RefreshSchedules(t.Context(), writeFeedFile(t, metadataLine, scheduleLine), db, t.TempDir(), false)
+
+	updateFile := writeFeedFile(t, updateMetadata("1"), deleteScheduleLine)
+	if err := internalsync.RefreshSchedules(t.Context(), updateFile, db, t.TempDir(), false); err != nil {
+		t.Errorf("expected an already-applied update to be skipped without error, got %v", err)
+	}
+
+	var count int64
+	db.Model(&schedule.Schedule{}).Count(&count)
+	if count != 1 {
+		t.Errorf("expected no changes when an update has already been applied, got %d schedules", count)
+	}
+}
+
+func TestRefreshSchedules_CancelledUpdateIsNotApplied(t *testing.T) {
+	db := setupTestDB(t)
+	internalsync.RefreshSchedules(t.Context(), writeFeedFile(t, metadataLine, scheduleLine), db, t.TempDir(), false)
+
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+	err := internalsync.RefreshSchedules(ctx, writeFeedFile(t, updateMetadataLine, deleteScheduleLine), db, t.TempDir(), false)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+
+	var schedules, timetables int64
+	db.Model(&schedule.Schedule{}).Count(&schedules)
+	db.Model(&schedule.Timetable{}).Count(&timetables)
+	if schedules != 1 || timetables != 1 {
+		t.Errorf("expected the update not to be applied, got %d schedules and %d timetables", schedules, timetables)
+	}
+}
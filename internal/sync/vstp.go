@@ -2,43 +2,87 @@ package sync
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log/slog"
+	"net"
 	"os"
 	"path"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
+	internaldb "uk-rail-schedule-api/internal/db"
 	"uk-rail-schedule-api/internal/schedule"
 	"uk-rail-schedule-api/internal/telemetry"
 
 	gostomp "github.com/go-stomp/stomp/v3"
+	"github.com/go-stomp/stomp/v3/frame"
 	"gorm.io/gorm"
 )
 
-// ListenForVSTP connects to the Network Rail STOMP server and processes incoming VSTP messages,
-// writing each to disk and inserting it into the database. It retries on connection failure with
-// exponential backoff.
-func ListenForVSTP(db *gorm.DB, stompURL, login, password, dataDir string) {
+// ErrInvalidVSTP is returned for VSTP messages that can't be parsed, which will never succeed however often they're
+// retried.
+var ErrInvalidVSTP = errors.New("invalid VSTP message")
+
+const (
+	// maxVSTPAttempts is the number of times a message is tried before it's moved to the dead letter directory
+	maxVSTPAttempts = 5
+	// maxDeadLetters is the number of messages kept in the dead letter directory; the oldest are removed first
+	maxDeadLetters = 1000
+	// vstpRetryDelay is how much longer to wait before each retry of a message, so a failing database isn't hammered
+	vstpRetryDelay = time.Second
+)
+
+// StompOptions describes the connection to the Network Rail STOMP server and the destinations VSTP messages are
+// received from.
+type StompOptions struct {
+	URL      string
+	Login    string
+	Password string
+	// Destinations are the topics and queues subscribed to
+	Destinations []string
+	// ClientID, if set, makes the subscriptions durable, so that messages sent while syncd is disconnected are
+	// received when it reconnects. It must not be shared with any other connection.
+	ClientID string
+}
+
+// ListenForVSTP connects to the Network Rail STOMP server and processes incoming VSTP messages from the destinations
+// in opts, writing each to disk and inserting it into the database before acknowledging it. It retries on
+// connection failure with exponential backoff. When ctx is cancelled it finishes storing the message it's working
+// on, disconnects and returns.
+func ListenForVSTP(ctx context.Context, db *gorm.DB, opts StompOptions, dataDir string) {
 	var stompConn *gostomp.Conn
-	var sub *gostomp.Subscription
+	var messages <-chan *gostomp.Message
 	var err error
 	timeout := 1
 	maxTimeout := 60
+	attempts := make(map[string]int)
 
-	for {
+	connOpts := []func(*gostomp.Conn) error{
+		gostomp.ConnOpt.HeartBeat(10*60*time.Second, 10*60*time.Second),
+		gostomp.ConnOpt.Login(opts.Login, opts.Password),
+	}
+	if opts.ClientID != "" {
+		connOpts = append(connOpts, gostomp.ConnOpt.Header("client-id", opts.ClientID))
+	}
+
+	for ctx.Err() == nil {
 		if stompConn == nil {
-			slog.Debug("Dialling a new STOMP connection", "url", stompURL, "username", login)
+			slog.Debug("Dialling a new STOMP connection", "url", opts.URL, "username", opts.Login, "clientID", opts.ClientID)
 
-			stompConn, err = gostomp.Dial("tcp", stompURL,
-				gostomp.ConnOpt.HeartBeat(10*60*time.Second, 10*60*time.Second),
-				gostomp.ConnOpt.Login(login, password))
+			stompConn, err = dialStomp(ctx, opts.URL, connOpts...)
 
 			if err != nil {
 				slog.Warn(fmt.Sprintf("Could not connect to stomp. Pausing for %d seconds before retrying", timeout))
 				telemetry.RecordStompReconnect(context.Background())
-				time.Sleep(time.Duration(timeout) * time.Second)
+				select {
+				case <-time.After(time.Duration(timeout) * time.Second):
+				case <-ctx.Done():
+				}
 				timeout = timeout * 2
 				if timeout > maxTimeout {
 					timeout = maxTimeout
@@ -46,32 +90,121 @@ func ListenForVSTP(db *gorm.DB, stompURL, login, password, dataDir string) {
 				continue
 			}
 
-			defer stompConn.Disconnect()
-			sub, err = stompConn.Subscribe("/topic/VSTP_ALL", gostomp.AckClient)
+			messages, err = subscribeVSTP(stompConn, opts)
 			if err != nil {
-				slog.Error("There was an error subscribing to STOMP topic - disconnecting", "err", err)
-				sub.Unsubscribe()
+				slog.Error("There was an error subscribing to STOMP destinations - disconnecting", "err", err)
 				stompConn.Disconnect()
 				stompConn = nil
 				continue
 			}
 		}
 
-		if sub != nil {
-			if err := processVSTPMessage(sub, db, dataDir); err != nil {
-				slog.Error("There was an error processing message. Disconnecting from STOMP server", "err", err)
-				if sub.Active() {
-					stompConn.Disconnect()
+		if err := processVSTPMessage(ctx, messages, db, dataDir, attempts); err != nil {
+			if ctx.Err() != nil {
+				// Messages that haven't been acknowledged are delivered again after reconnecting
+				slog.Info("Stopping listening for VSTP messages - disconnecting from STOMP server")
+			} else {
+				slog.Error("There was an error receiving or acknowledging a message. Disconnecting from STOMP server", "err", err)
+			}
+			stompConn.Disconnect()
+			stompConn = nil
+			// The other subscriptions may still be delivering their errors
+			go func(messages <-chan *gostomp.Message) {
+				for range messages {
+				}
+			}(messages)
+		}
+	}
+
+	if stompConn != nil {
+		slog.Info("Stopping listening for VSTP messages - disconnecting from STOMP server")
+		stompConn.Disconnect()
+	}
+}
+
+// dialStomp connects to the STOMP server at addr, giving up if ctx is cancelled.
+func dialStomp(ctx context.Context, addr string, opts ...func(*gostomp.Conn) error) (*gostomp.Conn, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	stompConn, err := gostomp.Connect(conn, opts...)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return stompConn, nil
+}
+
+// subscribeVSTP subscribes to each of the destinations in opts, durably if there's a client id, and returns a
+// channel that receives the messages from all of them. The channel is closed once all the subscriptions are. If any
+// subscription fails, those already made are unsubscribed, and nothing is forwarded to the channel until every
+// destination has been subscribed to, so no forwarder is left blocked on a channel nobody reads.
+func subscribeVSTP(conn *gostomp.Conn, opts StompOptions) (<-chan *gostomp.Message, error) {
+	var subs []*gostomp.Subscription
+	for _, destination := range opts.Destinations {
+		var subOpts []func(*frame.Frame) error
+		if opts.ClientID != "" {
+			subOpts = append(subOpts, gostomp.SubscribeOpt.Header("activemq.subscriptionName", durableSubscriptionName(opts.ClientID, destination)))
+		}
+
+		// Each message is acknowledged on its own, once it has been stored, so a failure doesn't acknowledge
+		// the messages received before it
+		sub, err := conn.Subscribe(destination, gostomp.AckClientIndividual, subOpts...)
+		if err != nil {
+			for _, sub := range subs {
+				if err := sub.Unsubscribe(); err != nil {
+					slog.Warn("Failed to unsubscribe from VSTP messages", "destination", sub.Destination(), "error", err)
 				}
-				stompConn = nil
 			}
+			return nil, fmt.Errorf("error subscribing to %s: %w", destination, err)
 		}
+		slog.Info("Subscribed to VSTP messages", "destination", destination, "durable", opts.ClientID != "")
+		subs = append(subs, sub)
+	}
+
+	messages := make(chan *gostomp.Message)
+	var wg sync.WaitGroup
+	for _, sub := range subs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for msg := range sub.C {
+				messages <- msg
+			}
+		}()
 	}
+
+	go func() {
+		wg.Wait()
+		close(messages)
+	}()
+	return messages, nil
+}
+
+// durableSubscriptionName names the durable subscription to destination, which the broker keeps for the client
+// between connections.
+func durableSubscriptionName(clientID, destination string) string {
+	return clientID + "-" + strings.ReplaceAll(strings.TrimPrefix(destination, "/"), "/", ".")
 }
 
-func processVSTPMessage(subscription *gostomp.Subscription, db *gorm.DB, dataDir string) error {
-	slog.Debug("Waiting for a message from STOMP subscription")
-	msg := <-subscription.C
+// processVSTPMessage stores the next message from the subscriptions and acknowledges it. A message that can't be
+// stored is nacked so that it's delivered again, until it has failed maxVSTPAttempts times or can never be stored,
+// when it's moved to the dead letter directory and acknowledged. attempts counts the failures by message id, except
+// those from the database being busy. An error is returned only if a subscription or the connection has failed, or
+// ctx has been cancelled.
+func processVSTPMessage(ctx context.Context, messages <-chan *gostomp.Message, db *gorm.DB, dataDir string, attempts map[string]int) error {
+	slog.Debug("Waiting for a message from STOMP subscriptions")
+	var msg *gostomp.Message
+	select {
+	case msg = <-messages:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if msg != nil && msg.Err != nil {
+		return msg.Err
+	}
 	if msg == nil || msg.Body == nil {
 		slog.Error("STOMP message body is empty - will stop consuming more messages", "msg", msg)
 		return errors.New("STOMP message body is empty")
@@ -79,36 +212,219 @@ func processVSTPMessage(subscription *gostomp.Subscription, db *gorm.DB, dataDir
 
 	slog.Debug("Got a message from VSTP subscription")
 
-	// Persist the raw message to disk so it can be replayed after a database deletion
-	filename := path.Join(dataDir, "vstp-"+strconv.FormatInt(time.Now().Unix(), 10)+".json")
-	os.WriteFile(filename, msg.Body, 0644)
+	id := msg.Header.Get("message-id")
+	err := storeVSTPMessage(msg.Body, db, dataDir)
+	if err == nil {
+		delete(attempts, id)
+		telemetry.RecordVSTPProcessed(context.Background())
+		return msg.Conn.Ack(msg)
+	}
 
-	if err := InsertVSTPFromBytes(msg.Body, db); err != nil {
-		slog.Error("Failed to insert vstp message", "error", err)
-		telemetry.RecordVSTPFailed(context.Background())
+	telemetry.RecordVSTPFailed(context.Background())
+	// A database locked by another process, such as while it applies a daily update, isn't a fault of the message,
+	// so it doesn't count towards the attempts before the message is dead lettered
+	if !internaldb.IsBusy(err) {
+		attempts[id]++
+	}
+	if !errors.Is(err, ErrInvalidVSTP) && attempts[id] < maxVSTPAttempts {
+		slog.Warn("Failed to store vstp message - it will be redelivered", "error", err, "messageID", id, "attempt", attempts[id])
+		select {
+		case <-time.After(time.Duration(max(attempts[id], 1)) * vstpRetryDelay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		return msg.Conn.Nack(msg)
+	}
+
+	slog.Error("Failed to store vstp message - moving it to the dead letter directory", "error", err, "messageID", id, "attempts", attempts[id])
+	delete(attempts, id)
+	if err := writeDeadLetter(msg.Body, path.Join(dataDir, "dead-letter")); err != nil {
+		slog.Error("Failed to write vstp message to the dead letter directory", "error", err, "messageID", id)
+	}
+	return msg.Conn.Ack(msg)
+}
+
+// storeVSTPMessage writes a VSTP message to the data directory, so it can be replayed after a database deletion,
+// and applies it to the database. The file is moved into place in the same database transaction, before it commits,
+// and removed again if the commit fails, so every message applied has a file to replay. A message that has already
+// been applied isn't written again.
+func storeVSTPMessage(data []byte, db *gorm.DB, dataDir string) error {
+	sch, originMsgID, contentHash, err := parseVSTP(data)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(dataDir, ".vstp-*.tmp")
+	if err != nil {
+		return fmt.Errorf("error creating vstp file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error writing vstp file: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error syncing vstp file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("error closing vstp file: %w", err)
+	}
+
+	// Nanoseconds keep messages received in the same second apart, and in order when they're replayed
+	filename := path.Join(dataDir, "vstp-"+strconv.FormatInt(time.Now().UnixNano(), 10)+".json")
+	err = applyVSTP(db, sch, originMsgID, contentHash, func() error {
+		if err := os.Rename(tmp.Name(), filename); err != nil {
+			return fmt.Errorf("error renaming vstp file: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		os.Remove(filename)
 		return err
 	}
-	telemetry.RecordVSTPProcessed(context.Background())
 	return nil
 }
 
-// InsertVSTPFromBytes parses a raw VSTP STOMP message body and inserts it into the database.
+// writeDeadLetter writes a message that couldn't be stored to dir, removing the oldest messages there to keep no
+// more than maxDeadLetters.
+func writeDeadLetter(data []byte, dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	filename := path.Join(dir, "vstp-"+strconv.FormatInt(time.Now().UnixNano(), 10)+".json")
+	if err := os.WriteFile(filename, data, 0644); err != nil {
+		return err
+	}
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	// ReadDir sorts by filename, which is oldest first
+	for len(files) > maxDeadLetters {
+		if err := os.Remove(path.Join(dir, files[0].Name())); err != nil {
+			return err
+		}
+		files = files[1:]
+	}
+	return nil
+}
+
+// InsertVSTPFromBytes parses a raw VSTP STOMP message body and applies it to the database. Create, Update and
+// Revise transactions replace any VSTP schedule with the same UID, start date and STP indicator, and Delete
+// transactions remove it. Each change is recorded in the VSTP audit trail. Messages that have already been applied,
+// identified by their originMsgId or content, are skipped.
 func InsertVSTPFromBytes(data []byte, db *gorm.DB) error {
+	sch, originMsgID, contentHash, err := parseVSTP(data)
+	if err != nil {
+		return err
+	}
+	return applyVSTP(db, sch, originMsgID, contentHash, nil)
+}
+
+// parseVSTP decodes a raw VSTP STOMP message body into the schedule it carries, its originMsgId and the SHA-256 hash
+// of its content.
+func parseVSTP(data []byte) (sch schedule.Schedule, originMsgID, contentHash string, err error) {
 	var vstpMsg schedule.VSTPStompMsg
 
 	if err := json.Unmarshal(data, &vstpMsg); err != nil {
 		slog.Error("Error decoding STOMP message json", "error", err)
-		return err
+		return sch, "", "", fmt.Errorf("%w: %w", ErrInvalidVSTP, err)
 	}
 
 	parsedTimestamp, err := strconv.ParseInt(vstpMsg.VSTPCIFMsgV1.Timestamp, 10, 64)
 	if err != nil {
 		slog.Error("Error parsing VSTP timestamp", "error", err, "timestamp", vstpMsg.VSTPCIFMsgV1.Timestamp)
-		return err
+		return sch, "", "", fmt.Errorf("%w: %w", ErrInvalidVSTP, err)
 	}
 
-	sch := vstpMsg.VSTPCIFMsgV1.VSTPSchedule.ToSchedule(time.Unix(parsedTimestamp/1000, 0))
+	sch = vstpMsg.VSTPCIFMsgV1.VSTPSchedule.ToSchedule(time.Unix(parsedTimestamp/1000, 0))
 	sch.AugmentSchedule()
-	db.Create(&sch)
-	return nil
+	hash := sha256.Sum256(data)
+	return sch, vstpMsg.VSTPCIFMsgV1.OriginMsgID, hex.EncodeToString(hash[:]), nil
+}
+
+// applyVSTP applies the transaction of a VSTP schedule, and records it in the audit trail, in a single database
+// transaction. Only schedules received through VSTP are changed; the feed's schedules are left for STP precedence.
+// Nothing is changed if a message with the same contentHash, or the same originMsgID for the same schedule, has
+// already been applied. beforeCommit, if given, is called last in the transaction, which is rolled back if it fails.
+func applyVSTP(db *gorm.DB, sch schedule.Schedule, originMsgID, contentHash string, beforeCommit func() error) error {
+	entry := schedule.VSTPAuditEntry{
+		OriginMsgID:     originMsgID,
+		PublishedAt:     sch.PublishedAt,
+		TransactionType: sch.TransactionType,
+		CombinedID:      sch.CombinedID,
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		processed, err := isProcessedVSTP(tx, originMsgID, sch.CombinedID, contentHash)
+		if err != nil {
+			return err
+		}
+		if processed {
+			slog.Info("Skipping VSTP message that has already been processed", "originMsgID", originMsgID, "combinedID", sch.CombinedID)
+			telemetry.RecordVSTPDuplicate(context.Background())
+			return nil
+		}
+
+		switch strings.ToLower(sch.TransactionType) {
+		case "create", "update", "revise":
+			removed, err := deleteSchedule(tx, sch.CombinedID, "VSTP")
+			if err != nil {
+				return err
+			}
+			if err := tx.Create(&sch).Error; err != nil {
+				return fmt.Errorf("error creating schedule %s: %w", sch.CombinedID, err)
+			}
+			entry.Action = schedule.VSTPActionCreated
+			if len(removed) > 0 {
+				entry.Action = schedule.VSTPActionReplaced
+			}
+			entry.ScheduleID = sch.ID
+			entry.RemovedCount = len(removed)
+		case "delete":
+			removed, err := deleteSchedule(tx, sch.CombinedID, "VSTP")
+			if err != nil {
+				return err
+			}
+			entry.Action = schedule.VSTPActionDeleted
+			if len(removed) == 0 {
+				slog.Warn("VSTP delete for a schedule that doesn't exist", "combinedID", sch.CombinedID, "originMsgID", originMsgID)
+				entry.Action = schedule.VSTPActionNotFound
+			}
+			entry.RemovedCount = len(removed)
+		default:
+			slog.Warn("Ignoring VSTP message with unknown transaction type", "transactionType", sch.TransactionType, "originMsgID", originMsgID)
+			entry.Action = schedule.VSTPActionIgnored
+		}
+
+		slog.Debug("Applied VSTP transaction", "combinedID", sch.CombinedID, "action", entry.Action, "originMsgID", originMsgID)
+		if err := tx.Create(&entry).Error; err != nil {
+			return err
+		}
+		if err := tx.Create(&schedule.ProcessedVSTPMessage{OriginMsgID: originMsgID, ContentHash: contentHash, CombinedID: sch.CombinedID}).Error; err != nil {
+			return err
+		}
+		if beforeCommit != nil {
+			return beforeCommit()
+		}
+		return nil
+	})
+}
+
+// isProcessedVSTP reports whether a VSTP message has already been applied: one with the same content hash, or a
+// redelivery with the same origin message id for the same schedule. The origin message id on its own isn't enough,
+// as it's only a timestamp to the second and a host, so different messages sent in the same second share it.
+func isProcessedVSTP(tx *gorm.DB, originMsgID, combinedID, contentHash string) (bool, error) {
+	query := tx.Model(&schedule.ProcessedVSTPMessage{}).Where("content_hash = ?", contentHash)
+	if originMsgID != "" {
+		query = query.Or("origin_msg_id = ? AND combined_id = ?", originMsgID, combinedID)
+	}
+	var count int64
+	if err := query.Count(&count).Error; err != nil {
+		return false, fmt.Errorf("error checking for processed VSTP message: %w", err)
+	}
+	return count > 0, nil
 }
@@ -2,6 +2,7 @@ package sync_test
 
 import (
 	"fmt"
+	"strings"
 	"testing"
 
 	"uk-rail-schedule-api/internal/schedule"
@@ -124,18 +125,166 @@ func TestInsertVSTPFromBytes_InvalidTimestamp(t *testing.T) {
 	}
 }
 
-func TestInsertVSTPFromBytes_MultipleCallsInsertMultipleSchedules(t *testing.T) {
+func TestInsertVSTPFromBytes_RepeatedCreateReplacesSchedule(t *testing.T) {
 	db := setupTestDB(t)
 
 	for i := 0; i < 3; i++ {
-		if err := internalsync.InsertVSTPFromBytes([]byte(validVSTPJSON), db); err != nil {
+		if err := internalsync.InsertVSTPFromBytes(vstpMessage("Create", fmt.Sprintf("msg-%d", i)), db); err != nil {
 			t.Fatalf("insert %d failed: %v", i, err)
 		}
 	}
 
 	var count int64
 	db.Model(&schedule.Schedule{}).Count(&count)
-	if count != 3 {
-		t.Errorf("expected 3 schedules after 3 inserts, got %d", count)
+	if count != 1 {
+		t.Errorf("expected 1 schedule after 3 creates of the same schedule, got %d", count)
+	}
+
+	var locations int64
+	db.Model(&schedule.ScheduleLocation{}).Count(&locations)
+	if locations != 2 {
+		t.Errorf("expected the replaced schedule's locations to be removed, got %d locations", locations)
+	}
+}
+
+// vstpMessage returns validVSTPJSON with the given transaction type and origin message id.
+func vstpMessage(transactionType, originMsgID string) []byte {
+	msg := strings.Replace(validVSTPJSON, `"transaction_type": "Create"`, `"transaction_type": "`+transactionType+`"`, 1)
+	return []byte(strings.Replace(msg, `"originMsgId": "test-001"`, `"originMsgId": "`+originMsgID+`"`, 1))
+}
+
+func TestInsertVSTPFromBytes_DeleteRemovesSchedule(t *testing.T) {
+	db := setupTestDB(t)
+
+	if err := internalsync.InsertVSTPFromBytes(vstpMessage("Create", "msg-1"), db); err != nil {
+		t.Fatal(err)
+	}
+	if err := internalsync.InsertVSTPFromBytes(vstpMessage("Delete", "msg-2"), db); err != nil {
+		t.Fatal(err)
+	}
+
+	var count, locations int64
+	db.Model(&schedule.Schedule{}).Count(&count)
+	db.Model(&schedule.ScheduleLocation{}).Count(&locations)
+	if count != 0 || locations != 0 {
+		t.Errorf("expected the schedule and its locations to be deleted, got %d schedules and %d locations", count, locations)
+	}
+
+	var entry schedule.VSTPAuditEntry
+	if err := db.Where("origin_msg_id = ?", "msg-2").First(&entry).Error; err != nil {
+		t.Fatal("expected an audit entry for the delete:", err)
+	}
+	if entry.Action != schedule.VSTPActionDeleted || entry.RemovedCount != 1 || entry.CombinedID != "T999992023-10-13N" {
+		t.Errorf("unexpected audit entry for the delete: %+v", entry)
+	}
+}
+
+func TestInsertVSTPFromBytes_DeleteLeavesFeedSchedule(t *testing.T) {
+	db := setupTestDB(t)
+
+	feedSchedule := schedule.Schedule{Source: "Feed", CIFTrainUID: "T99999", ScheduleStartDate: "2023-10-13", CIFStpIndicator: "N", CombinedID: "T999992023-10-13N"}
+	if err := db.Create(&feedSchedule).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := internalsync.InsertVSTPFromBytes(vstpMessage("Delete", "msg-1"), db); err != nil {
+		t.Fatal(err)
+	}
+
+	var count int64
+	db.Model(&schedule.Schedule{}).Count(&count)
+	if count != 1 {
+		t.Errorf("expected the feed schedule to be left alone, got %d schedules", count)
+	}
+
+	var entry schedule.VSTPAuditEntry
+	db.First(&entry)
+	if entry.Action != schedule.VSTPActionNotFound {
+		t.Errorf("expected action %q, got %q", schedule.VSTPActionNotFound, entry.Action)
+	}
+}
+
+func TestInsertVSTPFromBytes_ReviseReplacesSchedule(t *testing.T) {
+	db := setupTestDB(t)
+
+	if err := internalsync.InsertVSTPFromBytes(vstpMessage("Create", "msg-1"), db); err != nil {
+		t.Fatal(err)
+	}
+	revised := strings.Replace(string(vstpMessage("Update", "msg-2")), `"signalling_id": "5T99"`, `"signalling_id": "5T98"`, 1)
+	if err := internalsync.InsertVSTPFromBytes([]byte(revised), db); err != nil {
+		t.Fatal(err)
+	}
+
+	var schedules []schedule.Schedule
+	db.Find(&schedules)
+	if len(schedules) != 1 || schedules[0].SignallingID != "5T98" {
+		t.Fatalf("expected only the revised schedule, got %+v", schedules)
+	}
+
+	var entries []schedule.VSTPAuditEntry
+	db.Order("id").Find(&entries)
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 audit entries, got %d", len(entries))
+	}
+	if entries[0].Action != schedule.VSTPActionCreated || entries[0].OriginMsgID != "msg-1" {
+		t.Errorf("unexpected audit entry for the create: %+v", entries[0])
+	}
+	if entries[1].Action != schedule.VSTPActionReplaced || entries[1].ScheduleID != schedules[0].ID || entries[1].RemovedCount != 1 {
+		t.Errorf("unexpected audit entry for the update: %+v", entries[1])
+	}
+}
+
+func TestInsertVSTPFromBytes_SkipsRepeatedOriginMsgID(t *testing.T) {
+	db := setupTestDB(t)
+
+	if err := internalsync.InsertVSTPFromBytes(vstpMessage("Create", "msg-1"), db); err != nil {
+		t.Fatal(err)
+	}
+	// A redelivery of the same message, even with different content, mustn't be applied again
+	if err := internalsync.InsertVSTPFromBytes(vstpMessage("Delete", "msg-1"), db); err != nil {
+		t.Fatal(err)
+	}
+
+	var count, audited int64
+	db.Model(&schedule.Schedule{}).Count(&count)
+	db.Model(&schedule.VSTPAuditEntry{}).Count(&audited)
+	if count != 1 || audited != 1 {
+		t.Errorf("expected the repeated message to be skipped, got %d schedules and %d audit entries", count, audited)
+	}
+}
+
+func TestInsertVSTPFromBytes_AppliesDifferentSchedulesWithSameOriginMsgID(t *testing.T) {
+	db := setupTestDB(t)
+
+	// Messages sent in the same second share an originMsgId
+	if err := internalsync.InsertVSTPFromBytes(vstpMessage("Create", "msg-1"), db); err != nil {
+		t.Fatal(err)
+	}
+	other := strings.Replace(string(vstpMessage("Create", "msg-1")), `"CIF_train_uid": "T99999"`, `"CIF_train_uid": "T99998"`, 1)
+	if err := internalsync.InsertVSTPFromBytes([]byte(other), db); err != nil {
+		t.Fatal(err)
+	}
+
+	var uids []string
+	db.Model(&schedule.Schedule{}).Order("cif_train_uid").Pluck("cif_train_uid", &uids)
+	if strings.Join(uids, ",") != "T99998,T99999" {
+		t.Errorf("expected both schedules to be applied, got %v", uids)
+	}
+}
+
+func TestInsertVSTPFromBytes_SkipsRepeatedContentWithoutOriginMsgID(t *testing.T) {
+	db := setupTestDB(t)
+
+	msg := vstpMessage("Delete", "")
+	for i := 0; i < 2; i++ {
+		if err := internalsync.InsertVSTPFromBytes(msg, db); err != nil {
+			t.Fatalf("insert %d failed: %v", i, err)
+		}
+	}
+
+	var processed, audited int64
+	db.Model(&schedule.ProcessedVSTPMessage{}).Count(&processed)
+	db.Model(&schedule.VSTPAuditEntry{}).Count(&audited)
+	if processed != 1 || audited != 1 {
+		t.Errorf("expected the repeated content to be skipped, got %d processed messages and %d audit entries", processed, audited)
 	}
 }
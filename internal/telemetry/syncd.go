@@ -16,6 +16,7 @@ import (
 type syncdMetrics struct {
 	vstpProcessed    metric.Int64Counter
 	vstpFailed       metric.Int64Counter
+	vstpDuplicates   metric.Int64Counter
 	stompReconnects  metric.Int64Counter
 	feedRefreshTotal metric.Int64Counter
 }
@@ -36,6 +37,10 @@ func getSyncdMetrics() syncdMetrics {
 			"vstp_messages_failed_total",
 			metric.WithDescription("Total number of VSTP messages that failed to process"),
 		)
+		sm.vstpDuplicates, _ = meter.Int64Counter(
+			"vstp_messages_duplicate_total",
+			metric.WithDescription("Total number of VSTP messages skipped because they had already been processed"),
+		)
 		sm.stompReconnects, _ = meter.Int64Counter(
 			"vstp_stomp_reconnects_total",
 			metric.WithDescription("Total number of STOMP reconnection attempts"),
@@ -58,6 +63,11 @@ func RecordVSTPFailed(ctx context.Context) {
 	getSyncdMetrics().vstpFailed.Add(ctx, 1)
 }
 
+// RecordVSTPDuplicate increments the counter for VSTP messages skipped as already processed.
+func RecordVSTPDuplicate(ctx context.Context) {
+	getSyncdMetrics().vstpDuplicates.Add(ctx, 1)
+}
+
 // RecordStompReconnect increments the counter for STOMP reconnection attempts.
 func RecordStompReconnect(ctx context.Context) {
 	getSyncdMetrics().stompReconnects.Add(ctx, 1)